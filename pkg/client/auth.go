@@ -0,0 +1,139 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/auth"
+	_ "github.com/distribution/distribution/v3/registry/auth/htpasswd"
+	_ "github.com/distribution/distribution/v3/registry/auth/silly"
+	_ "github.com/distribution/distribution/v3/registry/auth/token"
+)
+
+// Authorizer decides whether a user may access a resource of the in-process registry.
+// It is consulted after the access controller configured in the auth section, if any, has authenticated the request.
+type Authorizer interface {
+	// Authorize returns nil if user may perform access.Action on access.Resource, typically a repository
+	// (access.Type "repository", access.Name the repository name, access.Action "pull", "push", "delete" or "*").
+	// user is the name set by the configured access controller, or "" if no access controller is configured.
+	Authorize(ctx context.Context, user string, access auth.Access) error
+}
+
+// AuthorizerFunc is an adapter to allow the use of ordinary functions as Authorizers.
+type AuthorizerFunc func(ctx context.Context, user string, access auth.Access) error
+
+// Authorize calls f(ctx, user, access).
+func (f AuthorizerFunc) Authorize(ctx context.Context, user string, access auth.Access) error {
+	return f(ctx, user, access)
+}
+
+// ClientOption configures optional behavior of a Client.
+type ClientOption func(*Client)
+
+// WithAuthorizer makes the in-process registry ask authorizer about every resource a request accesses.
+func WithAuthorizer(authorizer Authorizer) ClientOption {
+	return func(c *Client) {
+		c.authorizer = authorizer
+	}
+}
+
+const (
+	// authorizerAccessControllerName is the auth type used to wrap the configured access controller with an Authorizer.
+	authorizerAccessControllerName = "udistribution-authorizer"
+	authorizerParameter            = "udistribution.authorizer"
+	authenticatorParameter         = "udistribution.authenticator"
+)
+
+func init() {
+	if err := auth.Register(authorizerAccessControllerName, auth.InitFunc(newAuthorizerAccessController)); err != nil {
+		panic(err)
+	}
+}
+
+// configureAuthorizer replaces the auth section of config with one wrapping the configured access controller, if any, with authorizer.
+func configureAuthorizer(config *configuration.Configuration, authorizer Authorizer) {
+	params := configuration.Parameters{}
+	for k, v := range config.Auth.Parameters() {
+		params[k] = v
+	}
+	params[authorizerParameter] = authorizer
+	params[authenticatorParameter] = config.Auth.Type()
+	config.Auth = configuration.Auth{authorizerAccessControllerName: params}
+}
+
+// AcceptsBasicAuth returns whether the access controller of the in-process registry accepts basic auth credentials in
+// place of the bearer token its challenges ask for, which is the case of every access controller but "token".
+func (c *Client) AcceptsBasicAuth() bool {
+	authType := c.config.Auth.Type()
+	if authType == authorizerAccessControllerName {
+		authType, _ = c.config.Auth.Parameters()[authenticatorParameter].(string)
+	}
+	return authType != "token"
+}
+
+// authorizerAccessController is an auth.AccessController which authenticates requests with the configured access controller,
+// if any, and authorizes them with an Authorizer.
+type authorizerAccessController struct {
+	authenticator auth.AccessController
+	authorizer    Authorizer
+}
+
+func newAuthorizerAccessController(options map[string]interface{}) (auth.AccessController, error) {
+	authorizer, ok := options[authorizerParameter].(Authorizer)
+	if !ok {
+		return nil, fmt.Errorf("%q must be set for %s access controller", authorizerParameter, authorizerAccessControllerName)
+	}
+	ac := &authorizerAccessController{authorizer: authorizer}
+	if authType, _ := options[authenticatorParameter].(string); authType != "" && authType != "none" {
+		params := map[string]interface{}{}
+		for k, v := range options {
+			if k != authorizerParameter && k != authenticatorParameter {
+				params[k] = v
+			}
+		}
+		authenticator, err := auth.GetAccessController(authType, params)
+		if err != nil {
+			return nil, err
+		}
+		ac.authenticator = authenticator
+	}
+	return ac, nil
+}
+
+func (ac *authorizerAccessController) Authorized(ctx context.Context, accessRecords ...auth.Access) (context.Context, error) {
+	if ac.authenticator != nil {
+		authenticated, err := ac.authenticator.Authorized(ctx, accessRecords...)
+		if err != nil {
+			return nil, err
+		}
+		ctx = authenticated
+	}
+	user, _ := ctx.Value(auth.UserNameKey).(string)
+	for _, access := range accessRecords {
+		if err := ac.authorizer.Authorize(ctx, user, access); err != nil {
+			return nil, deniedChallenge{user: user, access: access, err: err}
+		}
+	}
+	if ac.authenticator == nil {
+		ctx = auth.WithUser(ctx, auth.UserInfo{})
+	}
+	return ctx, nil
+}
+
+// deniedChallenge is returned when an Authorizer denies access, so that the registry responds with 401 UNAUTHORIZED.
+type deniedChallenge struct {
+	user   string
+	access auth.Access
+	err    error
+}
+
+var _ auth.Challenge = deniedChallenge{}
+
+// SetHeaders does not set any header: retrying with the same credentials would not help.
+func (ch deniedChallenge) SetHeaders(r *http.Request, w http.ResponseWriter) {}
+
+func (ch deniedChallenge) Error() string {
+	return fmt.Sprintf("access to %s:%s:%s denied for user %q: %v", ch.access.Type, ch.access.Name, ch.access.Action, ch.user, ch.err)
+}
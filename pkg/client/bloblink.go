@@ -0,0 +1,128 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	"github.com/distribution/distribution/v3/registry/storage"
+	gorillahandlers "github.com/gorilla/handlers"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// BlobLinkPath is the route of the blob linking API extension served by the in-process registry.
+// POST with a "from" query parameter naming another repository links the blob stored there into the repository,
+// without copying any data, and without the upload session a failed cross-repository mount would start.
+// The response is the descriptor of the blob, as JSON.
+var BlobLinkPath = "/extensions/v2/{name:" + reference.NameRegexp.String() + "}/blobs/{digest:" + digest.DigestRegexp.String() + "}/link"
+
+const (
+	blobLinkRouteName = "blob-link"
+	// BlobLinkFromParameter names the repository a blob is linked from.
+	BlobLinkFromParameter = "from"
+)
+
+// registerBlobLink serves the blob linking API extension from c's storage.
+func (c *Client) registerBlobLink() {
+	c.app.RegisterRoute(blobLinkRouteName, c.app.NewRoute().Path(BlobLinkPath), c.blobLinkDispatcher, handlers.NameRequired, blobLinkAccessRecords)
+}
+
+// blobLinkAccessRecords requires pulling from the repository a blob is linked from.
+func blobLinkAccessRecords(r *http.Request) []auth.Access {
+	from := r.URL.Query().Get(BlobLinkFromParameter)
+	if from == "" {
+		return []auth.Access{}
+	}
+	return []auth.Access{{Resource: auth.Resource{Type: "repository", Name: from}, Action: "pull"}}
+}
+
+// blobLinkHandler links a single blob into a repository.
+type blobLinkHandler struct {
+	*handlers.Context
+	client *Client
+	digest digest.Digest
+}
+
+func (c *Client) blobLinkDispatcher(ctx *handlers.Context, r *http.Request) http.Handler {
+	dgst, err := digest.Parse(dcontext.GetStringValue(ctx, "vars.digest"))
+	if err != nil {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx.Errors = append(ctx.Errors, v2.ErrorCodeDigestInvalid.WithDetail(err))
+		})
+	}
+	h := &blobLinkHandler{
+		Context: ctx,
+		client:  c,
+		digest:  dgst,
+	}
+	return gorillahandlers.MethodHandler{
+		http.MethodPost: http.HandlerFunc(h.LinkBlob),
+	}
+}
+
+// LinkBlob links the blob from the repository in the "from" parameter, responding 201 Created if it was linked,
+// 200 OK if the repository already contained it, and BLOB_UNKNOWN if the other repository does not contain it.
+func (h *blobLinkHandler) LinkBlob(w http.ResponseWriter, r *http.Request) {
+	from, err := reference.WithName(r.URL.Query().Get(BlobLinkFromParameter))
+	if err != nil {
+		h.Errors = append(h.Errors, v2.ErrorCodeNameInvalid.WithDetail(err))
+		return
+	}
+	status := http.StatusOK
+	var desc distribution.Descriptor
+	// The blob is looked up in the storage rather than through the repository, whose middlewares would see a pull.
+	blob, err := h.client.OpenBlob(h, h.Repository.Named().Name(), h.digest)
+	switch {
+	case err == nil:
+		desc = distribution.Descriptor{MediaType: "application/octet-stream", Digest: blob.Digest, Size: blob.Size}
+	case errors.Is(err, distribution.ErrBlobUnknown):
+		desc, err = h.mount(h.Repository.Blobs(h), from)
+		if err != nil {
+			h.Errors = append(h.Errors, err)
+			return
+		}
+		status = http.StatusCreated
+	default:
+		h.Errors = append(h.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	body, err := json.Marshal(imgspecv1.Descriptor{MediaType: desc.MediaType, Digest: desc.Digest, Size: desc.Size})
+	if err != nil {
+		h.Errors = append(h.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// mount links the blob from the repository from into blobs.
+func (h *blobLinkHandler) mount(blobs distribution.BlobStore, from reference.Named) (distribution.Descriptor, error) {
+	canonical, err := reference.WithDigest(from, h.digest)
+	if err != nil {
+		return distribution.Descriptor{}, v2.ErrorCodeNameInvalid.WithDetail(err)
+	}
+	writer, err := blobs.Create(h, storage.WithMountFrom(canonical))
+	var mounted distribution.ErrBlobMounted
+	if errors.As(err, &mounted) {
+		return mounted.Descriptor, nil
+	}
+	if err != nil {
+		return distribution.Descriptor{}, errcode.ErrorCodeUnknown.WithDetail(err)
+	}
+	// The blob store starts an upload if the blob can not be mounted.
+	if err := writer.Cancel(h); err != nil {
+		dcontext.GetLogger(h).Errorf("error cancelling upload after failed mount: %v", err)
+	}
+	return distribution.Descriptor{}, v2.ErrorCodeBlobUnknown.WithDetail(canonical.String())
+}
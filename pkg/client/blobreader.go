@@ -0,0 +1,56 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// StoredBlob is the data of a blob in the storage of a client, read directly from the storage driver; see OpenBlob.
+type StoredBlob struct {
+	Digest digest.Digest
+	Size   int64
+	driver storagedriver.StorageDriver
+	path   string
+}
+
+// OpenBlob returns the blob dgst of repository, e.g. "ns/repo", for reading its data directly from the storage,
+// without the registry API. It returns distribution.ErrBlobUnknown if repository does not contain the blob.
+// Access to the repository is not authorized; callers must check it, e.g. with a HEAD request through the registry.
+func (c *Client) OpenBlob(ctx context.Context, repository string, dgst digest.Digest) (*StoredBlob, error) {
+	if _, err := reference.WithName(repository); err != nil {
+		return nil, fmt.Errorf("invalid repository %q: %w", repository, err)
+	}
+	if err := dgst.Validate(); err != nil {
+		return nil, err
+	}
+	driver, err := c.StorageDriver()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBlobLink(ctx, driver, repository, dgst); err != nil {
+		return nil, err
+	}
+	dataPath := blobDataPath(dgst)
+	info, err := driver.Stat(ctx, dataPath)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, fmt.Errorf("blob %s of %s: %w", dgst, repository, distribution.ErrBlobUnknown)
+		}
+		return nil, err
+	}
+	return &StoredBlob{Digest: dgst, Size: info.Size(), driver: driver, path: dataPath}, nil
+}
+
+// Reader returns a reader of the data of b from offset; several readers of a blob may be used concurrently.
+func (b *StoredBlob) Reader(ctx context.Context, offset int64) (io.ReadCloser, error) {
+	if offset < 0 || offset > b.Size {
+		return nil, fmt.Errorf("offset %d is outside of blob %s of %d bytes", offset, b.Digest, b.Size)
+	}
+	return b.driver.Reader(ctx, b.path, offset)
+}
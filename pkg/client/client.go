@@ -4,14 +4,15 @@ import (
 	"context"
 	"crypto/rand"
 	"fmt"
+	"sync"
 
-	// "github.com/distribution/distribution/v3/registry/storage/driver/factory"
 	uconfiguration "github.com/migtools/udistribution/pkg/distribution/configuration"
 	"github.com/migtools/udistribution/pkg/distribution/registry"
 
 	"github.com/distribution/distribution/v3/configuration"
 	dcontext "github.com/distribution/distribution/v3/context"
 	"github.com/distribution/distribution/v3/registry/handlers"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/azure"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/base"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/factory"
@@ -28,12 +29,27 @@ import (
 )
 
 type Client struct {
-	config *configuration.Configuration
-	app    *handlers.App
+	config     *configuration.Configuration
+	app        *handlers.App
+	authorizer Authorizer
+	// tokenIssuerOptions, if not nil, enables the in-process token issuer.
+	tokenIssuerOptions *TokenIssuerOptions
+	// immutableTags are patterns of the repositories whose tags can not be moved, see WithImmutableTags.
+	immutableTags []string
+	// noSignaturesExtension disables the signatures API extension, see WithoutSignaturesExtension.
+	noSignaturesExtension bool
+	// quotas, if not nil, tracks and enforces the quotas set with WithQuotas.
+	quotas *quotaTracker
+	// events, if not nil, dispatches the events of the registry to the subscriptions, see WithEvents.
+	events *eventHub
+	// Storage driver for direct access to stored data, see StorageDriver.
+	driverOnce sync.Once
+	driver     storagedriver.StorageDriver
+	driverErr  error
 }
 
 // NewClient creates a new client from the provided configuration.
-func NewClient(configString string, envs []string) (client *Client, err error) {
+func NewClient(configString string, envs []string, opts ...ClientOption) (client *Client, err error) {
 	if configString == "" {
 		configString = def.Config
 	}
@@ -43,6 +59,36 @@ func NewClient(configString string, envs []string) (client *Client, err error) {
 		return nil, err
 	}
 	configureSecret(config)
+	client = &Client{config: config}
+	for _, opt := range opts {
+		opt(client)
+	}
+	var issuer *tokenIssuer
+	if client.tokenIssuerOptions != nil {
+		var cleanup func()
+		issuer, cleanup, err = configureTokenIssuer(config, *client.tokenIssuerOptions)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+	}
+	if client.authorizer != nil {
+		configureAuthorizer(config, client.authorizer)
+	}
+	if len(client.immutableTags) != 0 {
+		configureImmutableTags(config, client.immutableTags)
+	}
+	if client.quotas != nil {
+		if err := configureQuotas(config, client.quotas); err != nil {
+			return nil, err
+		}
+	}
+	if client.events != nil {
+		configureEvents(config, client.events)
+	}
+	if !client.noSignaturesExtension {
+		configureSignaturesExtension(config)
+	}
 	ctx, err := GetContext(config)
 	if err != nil {
 		return nil, err
@@ -52,22 +98,17 @@ func NewClient(configString string, envs []string) (client *Client, err error) {
 	// inject a logger into the uuid library. warns us if there is a problem
 	// with uuid generation under low entropy.
 	uuid.Loggerf = dcontext.GetLogger(ctx).Warnf
-	client = &Client{
-		config: config,
-		app:    handlers.NewApp(ctx, config),
+	client.app = handlers.NewApp(ctx, config)
+	if !client.noSignaturesExtension {
+		client.registerSignaturesExtension()
+	}
+	client.indexReferrers()
+	client.registerReferrers()
+	client.registerBlobLink()
+	if issuer != nil {
+		client.app.NewRoute().Path(TokenRealmPath).Handler(issuer)
 	}
 	return client, err
-	// // initialize driver factory like https://github.com/distribution/distribution/blob/1d33874951b749df7e070b1c702ea418bbc57ed1/registry/root.go#L55
-	// storageParams := config.Storage.Parameters()
-	// if storageParams == nil {
-	// 	storageParams = make(configuration.Parameters)
-	// }
-	// storageParams["useragent"] = fmt.Sprintf("docker-distribution/%s %s", version.Version, runtime.Version())
-
-	// driver, err := factory.Create(config.Storage.Type(), storageParams)
-	// if err != nil {
-	// 	fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
-	// }
 }
 
 // randomSecretSize is the number of random bytes to generate if no secret
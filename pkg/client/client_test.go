@@ -1,6 +1,8 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
@@ -8,6 +10,7 @@ import (
 	"testing"
 
 	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/auth"
 	"github.com/google/go-cmp/cmp"
 	uconfig "github.com/migtools/udistribution/pkg/distribution/configuration"
 )
@@ -30,7 +33,12 @@ func TestNewClient(t *testing.T) {
 				envs:         []string{},
 			},
 			wantClient: &Client{
-				config: uconfig.GetWantConfig(),
+				config: uconfig.GetWantConfig(
+					uconfig.WithHeaders(http.Header{
+						"X-Content-Type-Options":         []string{"nosniff"},
+						"X-Registry-Supports-Signatures": []string{"1"},
+					}),
+				),
 			},
 			wantErr: false,
 		},
@@ -62,7 +70,10 @@ func TestNewClient(t *testing.T) {
 						},
 					}),
 					uconfig.WithHTTP(uconfig.HTTP{Addr: "localhost:6000"}),
-					uconfig.WithHeaders(http.Header{"X-Content-Type-Options": []string{"nosniff"}}),
+					uconfig.WithHeaders(http.Header{
+						"X-Content-Type-Options":         []string{"nosniff"},
+						"X-Registry-Supports-Signatures": []string{"1"},
+					}),
 				),
 			},
 		},
@@ -109,6 +120,53 @@ func TestNewClient(t *testing.T) {
 	}
 }
 
+func TestWithAuthorizer(t *testing.T) {
+	authorizer := AuthorizerFunc(func(ctx context.Context, user string, access auth.Access) error {
+		if access.Name != "allowed/repo" {
+			return errors.New("denied")
+		}
+		return nil
+	})
+	c, err := NewClient("", []string{
+		"REGISTRY_STORAGE=filesystem",
+		"REGISTRY_STORAGE_FILESYSTEM_ROOTDIRECTORY=" + t.TempDir(),
+		"REGISTRY_STORAGE_CACHE_BLOBDESCRIPTOR=inmemory",
+	}, WithAuthorizer(authorizer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]int{
+		"/v2/":                        http.StatusOK,
+		"/v2/allowed/repo/tags/list":  http.StatusNotFound,
+		"/v2/other/repo/tags/list":    http.StatusUnauthorized,
+		"/v2/allowed/other/tags/list": http.StatusUnauthorized,
+	} {
+		rr := httptest.NewRecorder()
+		rq, err := http.NewRequest("GET", path, strings.NewReader(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.GetApp().ServeHTTP(rr, rq)
+		if got := rr.Result().StatusCode; got != want {
+			t.Errorf("GET %s = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestParseScope(t *testing.T) {
+	repo := auth.Resource{Type: "repository", Name: "localhost:5000/foo/bar"}
+	for scope, want := range map[string][]auth.Access{
+		"repository:localhost:5000/foo/bar:pull,push": {{Resource: repo, Action: "pull"}, {Resource: repo, Action: "push"}},
+		"repository(plugin):foo:pull":                 {{Resource: auth.Resource{Type: "repository", Class: "plugin", Name: "foo"}, Action: "pull"}},
+		"registry:catalog:*":                          {{Resource: auth.Resource{Type: "registry", Name: "catalog"}, Action: "*"}},
+		"invalid":                                     nil,
+	} {
+		if got := parseScope(scope); !reflect.DeepEqual(got, want) {
+			t.Errorf("parseScope(%q) = %v, want %v", scope, got, want)
+		}
+	}
+}
+
 // TODO: fix test
 // func TestHTTPResponses(t *testing.T) {
 // 	type args struct {
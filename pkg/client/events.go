@@ -0,0 +1,342 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/notifications"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/auth"
+	repositorymiddleware "github.com/distribution/distribution/v3/registry/middleware/repository"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// eventsMiddlewareName is the repository middleware notifying the subscribers of a client.
+	eventsMiddlewareName = "udistribution-events"
+	eventsParameter      = "udistribution.events"
+	// defaultEventBufferSize is the number of events buffered for a subscriber if SubscribeOptions.BufferSize is 0.
+	defaultEventBufferSize = 100
+)
+
+// EventAction is the action of an Event.
+type EventAction string
+
+const (
+	// EventPush is notified when a manifest or a blob is pushed.
+	EventPush EventAction = "push"
+	// EventPull is notified when a manifest or a blob is pulled.
+	EventPull EventAction = "pull"
+	// EventDelete is notified when a manifest, a blob or a tag is deleted.
+	EventDelete EventAction = "delete"
+	// EventMount is notified when a blob is mounted from another repository.
+	EventMount EventAction = "mount"
+)
+
+// Event is an action of the in-process registry.
+type Event struct {
+	Action EventAction
+	// Repository is the repository of the action, e.g. "ns/repo".
+	Repository string
+	// Tag is the tag a manifest was pushed or pulled by, or the tag deleted.
+	Tag string
+	// Digest, Size and MediaType describe the manifest or the blob; only Digest is set for deletions, and none for tag
+	// deletions.
+	Digest    digest.Digest
+	Size      int64
+	MediaType string
+	// FromRepository is the repository a blob was mounted from.
+	FromRepository string
+	// Actor is the name of the authenticated user, if any.
+	Actor     string
+	Timestamp time.Time
+}
+
+// EventOverflow is the behaviour of a subscription when its buffer is full.
+type EventOverflow int
+
+const (
+	// EventOverflowDropNewest drops the events notified while the buffer is full.
+	EventOverflowDropNewest EventOverflow = iota
+	// EventOverflowDropOldest drops the oldest buffered event to buffer the new one.
+	EventOverflowDropOldest
+	// EventOverflowBlock blocks the request notifying the event until the buffer has room, or the request is canceled.
+	EventOverflowBlock
+)
+
+// SubscribeOptions configures a subscription.
+type SubscribeOptions struct {
+	// BufferSize is the number of events buffered while the listener is busy; 0 means 100.
+	BufferSize int
+	// Overflow is the behaviour when the buffer is full.
+	Overflow EventOverflow
+}
+
+// Subscription delivers the events of the in-process registry of a client to a listener.
+type Subscription struct {
+	hub       *eventHub
+	listener  func(Event)
+	overflow  EventOverflow
+	events    chan Event
+	done      chan struct{}
+	closeOnce sync.Once
+	dropped   atomic.Uint64
+}
+
+// WithEvents enables Subscribe. Without subscriptions, the in-process registry does not track events.
+func WithEvents() ClientOption {
+	return func(c *Client) {
+		c.events = newEventHub()
+	}
+}
+
+// Subscribe calls listener with the events of the in-process registry of c, one at a time and in order, from a goroutine
+// of the subscription. c must have been created WithEvents.
+// Changes made directly to the storage, e.g. by CopyBlob or ApplyRetention, are not notified.
+func (c *Client) Subscribe(listener func(Event), opts SubscribeOptions) (*Subscription, error) {
+	if c.events == nil {
+		return nil, errors.New("events are not enabled, see WithEvents")
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = defaultEventBufferSize
+	}
+	s := &Subscription{
+		hub:      c.events,
+		listener: listener,
+		overflow: opts.Overflow,
+		events:   make(chan Event, opts.BufferSize),
+		done:     make(chan struct{}),
+	}
+	c.events.mutex.Lock()
+	c.events.subscriptions[s] = struct{}{}
+	c.events.mutex.Unlock()
+	go s.run()
+	return s, nil
+}
+
+// Close stops delivering events to the listener; buffered events are discarded, and the event being delivered, if any,
+// may still be in progress when Close returns.
+func (s *Subscription) Close() {
+	s.closeOnce.Do(func() {
+		s.hub.mutex.Lock()
+		delete(s.hub.subscriptions, s)
+		s.hub.mutex.Unlock()
+		close(s.done)
+	})
+}
+
+// Dropped returns the number of events dropped because the buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+func (s *Subscription) run() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case event := <-s.events:
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			s.listener(event)
+		}
+	}
+}
+
+// notify buffers event, following the overflow behaviour of s if the buffer is full.
+func (s *Subscription) notify(ctx context.Context, event Event) {
+	select {
+	case s.events <- event:
+		return
+	case <-s.done:
+		return
+	default:
+	}
+	switch s.overflow {
+	case EventOverflowDropOldest:
+		for {
+			select {
+			case s.events <- event:
+				return
+			case <-s.done:
+				return
+			case <-s.events:
+				s.dropped.Add(1)
+			}
+		}
+	case EventOverflowBlock:
+		select {
+		case s.events <- event:
+		case <-s.done:
+		case <-ctx.Done():
+			s.dropped.Add(1)
+		}
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// eventHub dispatches the events of a client to its subscriptions.
+type eventHub struct {
+	mutex         sync.Mutex
+	subscriptions map[*Subscription]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscriptions: map[*Subscription]struct{}{}}
+}
+
+// subscribed returns whether h has subscriptions.
+func (h *eventHub) subscribed() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.subscriptions) != 0
+}
+
+func (h *eventHub) publish(ctx context.Context, event Event) {
+	h.mutex.Lock()
+	subscriptions := make([]*Subscription, 0, len(h.subscriptions))
+	for s := range h.subscriptions {
+		subscriptions = append(subscriptions, s)
+	}
+	h.mutex.Unlock()
+	for _, s := range subscriptions {
+		s.notify(ctx, event)
+	}
+}
+
+func init() {
+	if err := repositorymiddleware.Register(eventsMiddlewareName, newEventsRepository); err != nil {
+		panic(err)
+	}
+}
+
+// configureEvents adds the events middleware for hub to config, before the other repository middlewares so that actions
+// they reject are not notified.
+func configureEvents(config *configuration.Configuration, hub *eventHub) {
+	if config.Middleware == nil {
+		config.Middleware = map[string][]configuration.Middleware{}
+	}
+	config.Middleware["repository"] = append([]configuration.Middleware{{
+		Name:    eventsMiddlewareName,
+		Options: configuration.Parameters{eventsParameter: hub},
+	}}, config.Middleware["repository"]...)
+}
+
+func newEventsRepository(ctx context.Context, repository distribution.Repository, options map[string]interface{}) (distribution.Repository, error) {
+	hub, ok := options[eventsParameter].(*eventHub)
+	if !ok {
+		return nil, fmt.Errorf("%q must be set for %s repository middleware", eventsParameter, eventsMiddlewareName)
+	}
+	if !hub.subscribed() {
+		return repository, nil
+	}
+	return &eventsRepository{Repository: repository, hub: hub}, nil
+}
+
+// eventsRepository notifies the actions on the repository to the subscribers of hub.
+type eventsRepository struct {
+	distribution.Repository
+	hub *eventHub
+}
+
+// listen returns the repository notifying the actions of the request of ctx.
+func (r *eventsRepository) listen(ctx context.Context) distribution.Repository {
+	actor := dcontext.GetStringValue(ctx, auth.UserNameKey)
+	if actor == "" {
+		if request, err := dcontext.GetRequest(ctx); err == nil {
+			actor, _, _ = request.BasicAuth()
+		}
+	}
+	repository, _ := notifications.Listen(r.Repository, nil, &eventListener{ctx: ctx, hub: r.hub, actor: actor})
+	return repository
+}
+
+func (r *eventsRepository) Manifests(ctx context.Context, options ...distribution.ManifestServiceOption) (distribution.ManifestService, error) {
+	return r.listen(ctx).Manifests(ctx, options...)
+}
+
+func (r *eventsRepository) Blobs(ctx context.Context) distribution.BlobStore {
+	return r.listen(ctx).Blobs(ctx)
+}
+
+func (r *eventsRepository) Tags(ctx context.Context) distribution.TagService {
+	return r.listen(ctx).Tags(ctx)
+}
+
+// eventListener publishes the actions of a request as events.
+type eventListener struct {
+	ctx   context.Context
+	hub   *eventHub
+	actor string
+}
+
+var _ notifications.Listener = &eventListener{}
+
+func (l *eventListener) publish(event Event) error {
+	event.Actor = l.actor
+	event.Timestamp = time.Now()
+	l.hub.publish(l.ctx, event)
+	return nil
+}
+
+// manifestEvent publishes action on manifest m, referenced by the tag of options if any.
+func (l *eventListener) manifestEvent(action EventAction, repo reference.Named, m distribution.Manifest, options []distribution.ManifestServiceOption) error {
+	mediaType, payload, err := m.Payload()
+	if err != nil {
+		return err
+	}
+	event := Event{Action: action, Repository: repo.Name(), Digest: digest.FromBytes(payload), Size: int64(len(payload)), MediaType: mediaType}
+	for _, option := range options {
+		if tagOption, ok := option.(distribution.WithTagOption); ok {
+			event.Tag = tagOption.Tag
+		}
+	}
+	return l.publish(event)
+}
+
+func (l *eventListener) ManifestPushed(repo reference.Named, m distribution.Manifest, options ...distribution.ManifestServiceOption) error {
+	return l.manifestEvent(EventPush, repo, m, options)
+}
+
+func (l *eventListener) ManifestPulled(repo reference.Named, m distribution.Manifest, options ...distribution.ManifestServiceOption) error {
+	return l.manifestEvent(EventPull, repo, m, options)
+}
+
+func (l *eventListener) ManifestDeleted(repo reference.Named, dgst digest.Digest) error {
+	return l.publish(Event{Action: EventDelete, Repository: repo.Name(), Digest: dgst})
+}
+
+func (l *eventListener) BlobPushed(repo reference.Named, desc distribution.Descriptor) error {
+	return l.publish(Event{Action: EventPush, Repository: repo.Name(), Digest: desc.Digest, Size: desc.Size, MediaType: desc.MediaType})
+}
+
+func (l *eventListener) BlobPulled(repo reference.Named, desc distribution.Descriptor) error {
+	return l.publish(Event{Action: EventPull, Repository: repo.Name(), Digest: desc.Digest, Size: desc.Size, MediaType: desc.MediaType})
+}
+
+func (l *eventListener) BlobMounted(repo reference.Named, desc distribution.Descriptor, fromRepo reference.Named) error {
+	return l.publish(Event{Action: EventMount, Repository: repo.Name(), Digest: desc.Digest, Size: desc.Size, MediaType: desc.MediaType, FromRepository: fromRepo.Name()})
+}
+
+func (l *eventListener) BlobDeleted(repo reference.Named, dgst digest.Digest) error {
+	return l.publish(Event{Action: EventDelete, Repository: repo.Name(), Digest: dgst})
+}
+
+func (l *eventListener) TagDeleted(repo reference.Named, tag string) error {
+	return l.publish(Event{Action: EventDelete, Repository: repo.Name(), Tag: tag})
+}
+
+func (l *eventListener) RepoDeleted(repo reference.Named) error {
+	return nil
+}
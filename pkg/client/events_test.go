@@ -0,0 +1,113 @@
+package client_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/client"
+	"github.com/migtools/udistribution/pkg/internal/testing/clienttest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribe(t *testing.T) {
+	ctx := context.Background()
+	ut, _ := newFilesystemTestTransport(t, []string{"REGISTRY_STORAGE_DELETE_ENABLED=true"}, client.WithEvents())
+	cl := ut.Client
+
+	var mutex sync.Mutex
+	events := []client.Event{}
+	subscription, err := cl.Subscribe(func(e client.Event) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, e)
+	}, client.SubscribeOptions{})
+	require.NoError(t, err)
+	defer subscription.Close()
+	// receive waits until want is received, ignoring timestamps, and returns the events received until then.
+	receive := func(want client.Event) []client.Event {
+		got := []client.Event{}
+		require.Eventually(t, func() bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			for len(events) != 0 {
+				e := events[0]
+				events = events[1:]
+				assert.WithinDuration(t, time.Now(), e.Timestamp, time.Minute)
+				e.Timestamp = time.Time{}
+				got = append(got, e)
+				if e == want {
+					return true
+				}
+			}
+			return false
+		}, 10*time.Second, 10*time.Millisecond, "waiting for %v", want)
+		return got
+	}
+
+	ref, err := ut.ParseReference("//test/app:v1")
+	require.NoError(t, err)
+	imageManifest := clienttest.CopyFixtureImage(t, ref)
+	parsed, err := manifest.FromBlob(imageManifest, manifest.GuessMIMEType(imageManifest))
+	require.NoError(t, err)
+	config, layer := parsed.ConfigInfo(), parsed.LayerInfos()[0]
+	imageDigest, err := manifest.Digest(imageManifest)
+	require.NoError(t, err)
+	manifestEvent := client.Event{Repository: "test/app", Tag: "v1", Digest: imageDigest, Size: int64(len(imageManifest)), MediaType: manifest.GuessMIMEType(imageManifest)}
+
+	push := manifestEvent
+	push.Action = client.EventPush
+	pushed := receive(push)
+	assert.ElementsMatch(t, []client.Event{
+		{Action: client.EventPush, Repository: "test/app", Digest: config.Digest, Size: config.Size, MediaType: "application/octet-stream"},
+		{Action: client.EventPush, Repository: "test/app", Digest: layer.Digest, Size: layer.Size, MediaType: "application/octet-stream"},
+	}, pushed[:len(pushed)-1])
+
+	img, err := ref.NewImage(ctx, &types.SystemContext{})
+	require.NoError(t, err)
+	require.NoError(t, img.Close())
+	pull := manifestEvent
+	pull.Action = client.EventPull
+	receive(pull)
+
+	// Reads of the API extensions are not pulls.
+	for _, request := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/extensions/v2/test/app/signatures/"+imageDigest.String(), nil),
+		httptest.NewRequest(http.MethodPost, "/extensions/v2/test/app/blobs/"+layer.Digest.String()+"/link?from=test/app", nil),
+		httptest.NewRequest(http.MethodGet, "/v2/test/app/referrers/"+imageDigest.String(), nil),
+	} {
+		recorder := httptest.NewRecorder()
+		cl.GetApp().ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code, "%s %s: %s", request.Method, request.URL, recorder.Body.String())
+	}
+
+	recorder := httptest.NewRecorder()
+	cl.GetApp().ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/v2/test/app/blobs/"+config.Digest.String(), nil))
+	require.Equal(t, http.StatusAccepted, recorder.Code, recorder.Body.String())
+	deleted := receive(client.Event{Action: client.EventDelete, Repository: "test/app", Digest: config.Digest})
+	assert.Len(t, deleted, 1, "events of the API extensions: %v", deleted[:len(deleted)-1])
+
+	require.NoError(t, ref.DeleteImage(ctx, &types.SystemContext{}))
+	receive(client.Event{Action: client.EventDelete, Repository: "test/app", Digest: imageDigest})
+
+	// Events are dropped while the listener is busy and the buffer is full.
+	subscription.Close()
+	release := make(chan struct{})
+	busy, err := cl.Subscribe(func(client.Event) { <-release }, client.SubscribeOptions{BufferSize: 1})
+	require.NoError(t, err)
+	defer busy.Close()
+	clienttest.CopyFixtureImage(t, ref)
+	close(release)
+	assert.NotZero(t, busy.Dropped())
+
+	// Events must be enabled.
+	disabled, _ := newFilesystemTestTransport(t, nil)
+	_, err = disabled.Client.Subscribe(func(client.Event) {}, client.SubscribeOptions{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,251 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	repositorymiddleware "github.com/distribution/distribution/v3/registry/middleware/repository"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// immutableTagsMiddlewareName is the repository middleware making tags immutable. It can also be configured in the
+	// middleware section of the configuration, with a "repositories" option listing path.Match patterns of repositories.
+	immutableTagsMiddlewareName = "udistribution-immutable-tags"
+	immutableTagsRepositories   = "repositories"
+)
+
+// ErrorCodeTagImmutable is returned by the in-process registry when a manifest PUT would move an immutable tag to
+// another manifest.
+var ErrorCodeTagImmutable = errcode.Register("udistribution", errcode.ErrorDescriptor{
+	Value:          "TAG_IMMUTABLE",
+	Message:        "tag is immutable",
+	Description:    "The tag already references another manifest, and the tags of the repository can not be moved.",
+	HTTPStatusCode: http.StatusConflict,
+})
+
+// WithImmutableTags makes the tags of the repositories matching any of the path.Match patterns immutable, e.g. "backups/*":
+// once a tag is pushed, it can be pushed again with the same manifest, deleted, but not moved to another manifest.
+// Concurrent pushes of a tag through the registries of the process are serialized, so that only one of them succeeds
+// if they push different manifests; registries of other processes sharing the storage are not excluded.
+func WithImmutableTags(repositories ...string) ClientOption {
+	return func(c *Client) {
+		c.immutableTags = append(c.immutableTags, repositories...)
+	}
+}
+
+func init() {
+	if err := repositorymiddleware.Register(immutableTagsMiddlewareName, newImmutableTagsRepository); err != nil {
+		panic(err)
+	}
+}
+
+// configureImmutableTags adds the immutable tags middleware for repositories to config.
+func configureImmutableTags(config *configuration.Configuration, repositories []string) {
+	if config.Middleware == nil {
+		config.Middleware = map[string][]configuration.Middleware{}
+	}
+	config.Middleware["repository"] = append(config.Middleware["repository"], configuration.Middleware{
+		Name:    immutableTagsMiddlewareName,
+		Options: configuration.Parameters{immutableTagsRepositories: repositories},
+	})
+}
+
+// stringsOption returns the list of strings of option name in options, set from Go or from the YAML configuration.
+func stringsOption(options map[string]interface{}, name string) ([]string, error) {
+	switch value := options[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{value}, nil
+	case []string:
+		return value, nil
+	case []interface{}:
+		values := []string{}
+		for _, v := range value {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%q must be a list of strings", name)
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("%q must be a list of strings", name)
+	}
+}
+
+// matchesAny returns whether name matches any of the path.Match patterns, which must be valid.
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func newImmutableTagsRepository(ctx context.Context, repository distribution.Repository, options map[string]interface{}) (distribution.Repository, error) {
+	patterns, err := stringsOption(options, immutableTagsRepositories)
+	if err != nil {
+		return nil, err
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid repository pattern %q: %w", pattern, err)
+		}
+	}
+	if !matchesAny(patterns, repository.Named().Name()) {
+		return repository, nil
+	}
+	return &immutableTagsRepository{Repository: repository}, nil
+}
+
+// tagLock contains a lock for a specific tag.
+type tagLock struct {
+	refCount int        // Number of goroutines owning or waiting on this lock. Protected by tagLocksMutex.
+	mutex    sync.Mutex // Owned by the goroutine checking and pushing the tag.
+}
+
+var (
+	// tagLocks contains a lock for each tag being checked and pushed, by "repository:tag".
+	// This must be global so that the middleware instances, created for each request, exclude each other.
+	// The map is protected by tagLocksMutex.
+	tagLocks      = map[string]*tagLock{}
+	tagLocksMutex = sync.Mutex{}
+)
+
+// lockTag obtains the tagLock for name, "repository:tag".
+// The caller must call unlockTag eventually.
+func lockTag(name string) {
+	tl := func() *tagLock { // A scope for defer
+		tagLocksMutex.Lock()
+		defer tagLocksMutex.Unlock()
+		tl, ok := tagLocks[name]
+		if ok {
+			tl.refCount++
+		} else {
+			tl = &tagLock{refCount: 1}
+			tagLocks[name] = tl
+		}
+		return tl
+	}()
+	tl.mutex.Lock()
+}
+
+// unlockTag releases the tagLock for name.
+func unlockTag(name string) {
+	tagLocksMutex.Lock()
+	defer tagLocksMutex.Unlock()
+	tl, ok := tagLocks[name]
+	if !ok {
+		panic(fmt.Sprintf("Internal error: unlocking nonexistent lock for tag %s", name))
+	}
+	tl.mutex.Unlock()
+	tl.refCount--
+	if tl.refCount == 0 {
+		delete(tagLocks, name)
+	}
+}
+
+// immutableTagsRepository is a repository whose tags can not be moved.
+type immutableTagsRepository struct {
+	distribution.Repository
+}
+
+// lockTags obtains the tagLocks of tags of r, in order, and returns a function releasing them.
+// Tags are checked and pushed with their locks held, so that concurrent pushes can not both move them.
+func (r *immutableTagsRepository) lockTags(tags []string) func() {
+	names := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		names = append(names, r.Named().Name()+":"+tag)
+	}
+	sort.Strings(names)
+	names = slices.Compact(names)
+	for _, name := range names {
+		lockTag(name)
+	}
+	return func() {
+		for _, name := range names {
+			unlockTag(name)
+		}
+	}
+}
+
+// checkTag returns ErrorCodeTagImmutable if tag exists in r and does not reference dgst.
+func (r *immutableTagsRepository) checkTag(ctx context.Context, tag string, dgst digest.Digest) error {
+	current, err := r.Repository.Tags(ctx).Get(ctx, tag)
+	if err != nil {
+		if _, ok := err.(distribution.ErrTagUnknown); ok {
+			return nil
+		}
+		return err
+	}
+	if current.Digest != dgst {
+		return ErrorCodeTagImmutable.WithDetail(fmt.Sprintf("%s:%s references %s", r.Named().Name(), tag, current.Digest))
+	}
+	return nil
+}
+
+func (r *immutableTagsRepository) Manifests(ctx context.Context, options ...distribution.ManifestServiceOption) (distribution.ManifestService, error) {
+	manifests, err := r.Repository.Manifests(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &immutableTagsManifestService{ManifestService: manifests, repository: r}, nil
+}
+
+func (r *immutableTagsRepository) Tags(ctx context.Context) distribution.TagService {
+	return &immutableTagsTagService{TagService: r.Repository.Tags(ctx), repository: r}
+}
+
+// immutableTagsManifestService rejects manifests pushed with a tag referencing another manifest, before storing them.
+type immutableTagsManifestService struct {
+	distribution.ManifestService
+	repository *immutableTagsRepository
+}
+
+func (ms *immutableTagsManifestService) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
+	tags := []string{}
+	for _, option := range options {
+		if tagOption, ok := option.(distribution.WithTagOption); ok {
+			tags = append(tags, tagOption.Tag)
+		}
+	}
+	if len(tags) == 0 {
+		return ms.ManifestService.Put(ctx, manifest, options...)
+	}
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		return "", err
+	}
+	defer ms.repository.lockTags(tags)()
+	for _, tag := range tags {
+		if err := ms.repository.checkTag(ctx, tag, digest.FromBytes(payload)); err != nil {
+			return "", err
+		}
+	}
+	return ms.ManifestService.Put(ctx, manifest, options...)
+}
+
+// immutableTagsTagService rejects moving tags.
+type immutableTagsTagService struct {
+	distribution.TagService
+	repository *immutableTagsRepository
+}
+
+func (ts *immutableTagsTagService) Tag(ctx context.Context, tag string, desc distribution.Descriptor) error {
+	defer ts.repository.lockTags([]string{tag})()
+	if err := ts.repository.checkTag(ctx, tag, desc.Digest); err != nil {
+		return err
+	}
+	return ts.TagService.Tag(ctx, tag, desc)
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/opencontainers/go-digest"
+)
+
+// slowTagService is an in-memory TagService which takes time to tag, like a remote storage.
+type slowTagService struct {
+	distribution.TagService
+	mutex sync.Mutex
+	tags  map[string]distribution.Descriptor
+}
+
+func (ts *slowTagService) Get(ctx context.Context, tag string) (distribution.Descriptor, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	desc, ok := ts.tags[tag]
+	if !ok {
+		return distribution.Descriptor{}, distribution.ErrTagUnknown{Tag: tag}
+	}
+	return desc, nil
+}
+
+func (ts *slowTagService) Tag(ctx context.Context, tag string, desc distribution.Descriptor) error {
+	time.Sleep(10 * time.Millisecond)
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	ts.tags[tag] = desc
+	return nil
+}
+
+type slowTagsRepository struct {
+	distribution.Repository
+	name reference.Named
+	tags *slowTagService
+}
+
+func (r *slowTagsRepository) Named() reference.Named {
+	return r.name
+}
+
+func (r *slowTagsRepository) Tags(ctx context.Context) distribution.TagService {
+	return r.tags
+}
+
+func TestImmutableTagsConcurrentPushes(t *testing.T) {
+	ctx := context.Background()
+	name, err := reference.WithName("backups/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := &slowTagService{tags: map[string]distribution.Descriptor{}}
+	const pushes = 8
+	errs := make([]error, pushes)
+	var wg sync.WaitGroup
+	for i := 0; i < pushes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Each request has its own middleware instance.
+			repository, err := newImmutableTagsRepository(ctx, &slowTagsRepository{name: name, tags: tags},
+				map[string]interface{}{immutableTagsRepositories: []string{"backups/*"}})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			errs[i] = repository.Tags(ctx).Tag(ctx, "v1", distribution.Descriptor{Digest: digest.FromString(string(rune('a' + i)))})
+		}(i)
+	}
+	wg.Wait()
+
+	tagged := -1
+	for i, err := range errs {
+		var immutable errcode.Error
+		switch {
+		case err == nil && tagged >= 0:
+			t.Fatalf("pushes %d and %d both tagged v1", tagged, i)
+		case err == nil:
+			tagged = i
+		case !errors.As(err, &immutable) || immutable.Code != ErrorCodeTagImmutable:
+			t.Fatalf("push %d: unexpected error %v", i, err)
+		}
+	}
+	if tagged < 0 {
+		t.Fatal("no push tagged v1")
+	}
+	if desc := tags.tags["v1"]; desc.Digest != digest.FromString(string(rune('a'+tagged))) {
+		t.Errorf("v1 references %s, not the manifest of push %d", desc.Digest, tagged)
+	}
+}
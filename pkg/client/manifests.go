@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/distribution/distribution/v3/reference"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// ManifestRevisions returns the digests of all manifests stored in repository, e.g. "ns/repo", tagged or not.
+// The registry API has no way to list manifests which are not tagged, so they are listed from the storage.
+func (c *Client) ManifestRevisions(ctx context.Context, repository string) ([]digest.Digest, error) {
+	if _, err := reference.WithName(repository); err != nil {
+		return nil, fmt.Errorf("invalid repository %q: %w", repository, err)
+	}
+	driver, err := c.StorageDriver()
+	if err != nil {
+		return nil, err
+	}
+	return manifestRevisions(ctx, driver, repository)
+}
+
+// manifestRevisions returns the digests of the manifest revisions of repository in driver.
+// Deleted revisions, of which only the directory remains, are skipped.
+func manifestRevisions(ctx context.Context, driver storagedriver.StorageDriver, repository string) ([]digest.Digest, error) {
+	root := path.Join(repositoriesRoot, repository, "_manifests/revisions")
+	algorithms, err := driver.List(ctx, root)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	revisions := []digest.Digest{}
+	for _, algDir := range algorithms {
+		entries, err := driver.List(ctx, algDir)
+		if err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); ok {
+				continue
+			}
+			return nil, err
+		}
+		for _, entry := range entries {
+			dgst := digest.NewDigestFromEncoded(digest.Algorithm(path.Base(algDir)), path.Base(entry))
+			if dgst.Validate() != nil {
+				continue
+			}
+			if _, err := driver.Stat(ctx, path.Join(entry, "link")); err != nil {
+				if _, ok := err.(storagedriver.PathNotFoundError); ok {
+					continue
+				}
+				return nil, err
+			}
+			revisions = append(revisions, dgst)
+		}
+	}
+	return revisions, nil
+}
+
+// readStoredManifest returns the payload of the manifest dgst of repository in driver, or nil if repository has no such
+// revision or its data is missing.
+func readStoredManifest(ctx context.Context, driver storagedriver.StorageDriver, repository string, dgst digest.Digest) ([]byte, error) {
+	if _, err := driver.Stat(ctx, manifestRevisionLinkPath(repository, dgst)); err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	payload, err := driver.GetContent(ctx, blobDataPath(dgst))
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return payload, nil
+}
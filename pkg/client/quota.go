@@ -0,0 +1,598 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	repositorymiddleware "github.com/distribution/distribution/v3/registry/middleware/repository"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// quotasMiddlewareName is the repository middleware enforcing quotas.
+	quotasMiddlewareName = "udistribution-quotas"
+	quotasParameter      = "udistribution.quotas"
+)
+
+// ErrorCodeQuotaExceeded is returned by the in-process registry when an upload or a manifest PUT is rejected because
+// the repository is over one of its quotas.
+var ErrorCodeQuotaExceeded = errcode.Register("udistribution", errcode.ErrorDescriptor{
+	Value:          "QUOTA_EXCEEDED",
+	Message:        "quota exceeded",
+	Description:    "The repository uses all the storage, or all the tags, allowed by a quota.",
+	HTTPStatusCode: http.StatusForbidden,
+})
+
+// Quota limits the storage used by the repositories under a prefix.
+type Quota struct {
+	// Prefix is the repository, or the namespace of the repositories, the quota applies to, e.g. "ns" for "ns/repo"
+	// and "ns/other/repo".
+	Prefix string
+	// MaxBytes is the size of the blobs, other than manifests, the repositories may reference, each blob counted once
+	// however many repositories reference it; 0 means unlimited.
+	MaxBytes int64
+	// MaxTags is the number of tags the repositories may have; 0 means unlimited.
+	MaxTags int
+}
+
+// applies returns whether q applies to repository.
+func (q Quota) applies(repository string) bool {
+	return repository == q.Prefix || strings.HasPrefix(repository, q.Prefix+"/")
+}
+
+// QuotaUsage is the usage of a Quota tracked by a Client.
+type QuotaUsage struct {
+	Quota
+	Bytes int64
+	Tags  int
+}
+
+// WithQuotas enforces quotas on the repositories of the in-process registry. Uploads to a repository over the MaxBytes
+// of one of its quotas are rejected when they start, and uploads which would exceed it when they complete; manifests
+// are rejected if the repository is over MaxBytes, or if they would add a tag over MaxTags.
+// Server-side copies with CopyBlob are subject to MaxBytes too.
+// Usage is computed from the storage on first use, then tracked as the registry, CopyBlob and ApplyRetention change it.
+// Quotas are not enforced across several registries sharing the storage, and blobs mounted from other repositories are
+// accepted even if they exceed MaxBytes.
+func WithQuotas(quotas ...Quota) ClientOption {
+	return func(c *Client) {
+		if c.quotas == nil {
+			c.quotas = newQuotaTracker(c)
+		}
+		for _, quota := range quotas {
+			c.quotas.usages = append(c.quotas.usages, &quotaUsage{quota: quota, blobs: map[digest.Digest]int64{}})
+		}
+	}
+}
+
+// QuotaUsage returns the usage of the quotas of c, in the order they were configured.
+func (c *Client) QuotaUsage(ctx context.Context) ([]QuotaUsage, error) {
+	if c.quotas == nil {
+		return []QuotaUsage{}, nil
+	}
+	release, err := c.quotas.acquireUsages(ctx, c.quotas.usages)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	c.quotas.mutex.Lock()
+	defer c.quotas.mutex.Unlock()
+	usages := []QuotaUsage{}
+	for _, usage := range c.quotas.usages {
+		usages = append(usages, QuotaUsage{Quota: usage.quota, Bytes: usage.bytes, Tags: usage.tags})
+	}
+	return usages, nil
+}
+
+func init() {
+	if err := repositorymiddleware.Register(quotasMiddlewareName, newQuotaRepository); err != nil {
+		panic(err)
+	}
+}
+
+// configureQuotas adds the quotas middleware for tracker to config.
+func configureQuotas(config *configuration.Configuration, tracker *quotaTracker) error {
+	for _, usage := range tracker.usages {
+		if _, err := reference.WithName(usage.quota.Prefix); err != nil {
+			return fmt.Errorf("invalid quota prefix %q: %w", usage.quota.Prefix, err)
+		}
+		if usage.quota.MaxBytes < 0 || usage.quota.MaxTags < 0 {
+			return fmt.Errorf("negative quota for %q", usage.quota.Prefix)
+		}
+	}
+	if config.Middleware == nil {
+		config.Middleware = map[string][]configuration.Middleware{}
+	}
+	config.Middleware["repository"] = append(config.Middleware["repository"], configuration.Middleware{
+		Name:    quotasMiddlewareName,
+		Options: configuration.Parameters{quotasParameter: tracker},
+	})
+	return nil
+}
+
+// quotaTracker tracks the usage of the quotas of a client.
+type quotaTracker struct {
+	client *Client
+	// mutex protects the fields of usages, and serializes their checks and updates. It is not held while the storage is read.
+	mutex  sync.Mutex
+	usages []*quotaUsage
+}
+
+// quotaUsage is the usage of a quota.
+type quotaUsage struct {
+	quota Quota
+	// lock is held exclusively while the usage is computed from the storage, and shared while the repositories of the
+	// quota are changed and the changes tracked, so that both do not happen at once.
+	lock sync.RWMutex
+	// loaded is set once the usage has been computed from the storage.
+	loaded bool
+	// blobs are the sizes of the blobs linked to the repositories of the quota.
+	blobs map[digest.Digest]int64
+	bytes int64
+	tags  int
+}
+
+func newQuotaTracker(c *Client) *quotaTracker {
+	return &quotaTracker{client: c}
+}
+
+// invalidate makes the usages of the quotas of repository be computed from the storage again on next use, after data
+// was removed bypassing the registry.
+func (t *quotaTracker) invalidate(repository string) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, usage := range t.usages {
+		if usage.quota.applies(repository) {
+			usage.loaded = false
+		}
+	}
+}
+
+// acquire returns the usages of the quotas of repository, loaded from the storage if necessary, with their locks held
+// shared until release is called. Changes to repository must be made and tracked before release.
+func (t *quotaTracker) acquire(ctx context.Context, repository string) (usages []*quotaUsage, release func(), err error) {
+	if t == nil {
+		return nil, func() {}, nil
+	}
+	usages = []*quotaUsage{}
+	for _, usage := range t.usages {
+		if usage.quota.applies(repository) {
+			usages = append(usages, usage)
+		}
+	}
+	release, err = t.acquireUsages(ctx, usages)
+	if err != nil {
+		return nil, nil, err
+	}
+	return usages, release, nil
+}
+
+// acquireUsages loads usages from the storage if necessary, and holds their locks shared until release is called.
+// Locks are always taken in the order of t.usages.
+func (t *quotaTracker) acquireUsages(ctx context.Context, usages []*quotaUsage) (release func(), err error) {
+	held := []*quotaUsage{}
+	release = func() {
+		for _, usage := range held {
+			usage.lock.RUnlock()
+		}
+	}
+	for _, usage := range usages {
+		for {
+			usage.lock.RLock()
+			t.mutex.Lock()
+			loaded := usage.loaded
+			t.mutex.Unlock()
+			if loaded {
+				break
+			}
+			usage.lock.RUnlock()
+			if err := t.load(ctx, usage); err != nil {
+				release()
+				return nil, err
+			}
+		}
+		held = append(held, usage)
+	}
+	return release, nil
+}
+
+// load computes usage from the storage, unless already loaded, holding its lock exclusively but not t.mutex: only the
+// registry operations on the repositories of the quota wait for it.
+func (t *quotaTracker) load(ctx context.Context, usage *quotaUsage) error {
+	usage.lock.Lock()
+	defer usage.lock.Unlock()
+	t.mutex.Lock()
+	loaded := usage.loaded
+	t.mutex.Unlock()
+	if loaded {
+		return nil
+	}
+	driver, err := t.client.StorageDriver()
+	if err != nil {
+		return err
+	}
+	blobs := map[digest.Digest]int64{}
+	tags := 0
+	err = driver.Walk(ctx, path.Join(repositoriesRoot, usage.quota.Prefix), func(fileInfo storagedriver.FileInfo) error {
+		if !fileInfo.IsDir() {
+			return nil
+		}
+		switch name := path.Base(fileInfo.Path()); name {
+		case "_layers":
+			if err := linkedBlobSizes(ctx, driver, fileInfo.Path(), blobs); err != nil {
+				return err
+			}
+		case "_manifests":
+			tagDirs, err := driver.List(ctx, path.Join(fileInfo.Path(), "tags"))
+			if err != nil {
+				if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+					return err
+				}
+			}
+			tags += len(tagDirs)
+		default:
+			if !strings.HasPrefix(name, "_") {
+				return nil
+			}
+		}
+		return storagedriver.ErrSkipDir
+	})
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			return fmt.Errorf("computing the usage of quota %q: %w", usage.quota.Prefix, err)
+		}
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	usage.blobs = blobs
+	usage.bytes = 0
+	for _, size := range blobs {
+		usage.bytes += size
+	}
+	usage.tags = tags
+	usage.loaded = true
+	return nil
+}
+
+// linkedBlobSizes adds the sizes of the blobs linked in layersDir, the _layers directory of a repository, to blobs.
+// Blobs whose data is missing have a size of 0.
+func linkedBlobSizes(ctx context.Context, driver storagedriver.StorageDriver, layersDir string, blobs map[digest.Digest]int64) error {
+	algorithms, err := driver.List(ctx, layersDir)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	sort.Strings(algorithms)
+	for _, algDir := range algorithms {
+		entries, err := driver.List(ctx, algDir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			dgst := digest.NewDigestFromEncoded(digest.Algorithm(path.Base(algDir)), path.Base(entry))
+			if _, ok := blobs[dgst]; ok || dgst.Validate() != nil {
+				continue
+			}
+			// Blobs deleted from the repository keep their directory, without a link.
+			if _, err := driver.Stat(ctx, path.Join(entry, "link")); err != nil {
+				if _, ok := err.(storagedriver.PathNotFoundError); ok {
+					continue
+				}
+				return err
+			}
+			blobs[dgst] = 0
+			if info, err := driver.Stat(ctx, blobDataPath(dgst)); err == nil {
+				blobs[dgst] = info.Size()
+			}
+		}
+	}
+	return nil
+}
+
+// checkBlob returns ErrorCodeQuotaExceeded if linking the blob dgst with size to repository would exceed usages, its
+// acquired usages.
+func (t *quotaTracker) checkBlob(repository string, usages []*quotaUsage, dgst digest.Digest, size int64) error {
+	if t == nil {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, usage := range usages {
+		if _, ok := usage.blobs[dgst]; ok {
+			continue
+		}
+		if usage.quota.MaxBytes > 0 && usage.bytes+size > usage.quota.MaxBytes {
+			return quotaExceeded(repository, usage, fmt.Sprintf("%d bytes used of %d, the blob has %d", usage.bytes, usage.quota.MaxBytes, size))
+		}
+	}
+	return nil
+}
+
+// linkBlob records the blob dgst with size as linked to a repository of usages, its acquired usages, bypassing the
+// registry.
+func (t *quotaTracker) linkBlob(usages []*quotaUsage, dgst digest.Digest, size int64) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	addBlob(usages, dgst, size)
+}
+
+// addBlob records the blob dgst with size as linked to the repositories of usages.
+func addBlob(usages []*quotaUsage, dgst digest.Digest, size int64) {
+	for _, usage := range usages {
+		if _, ok := usage.blobs[dgst]; !ok {
+			usage.blobs[dgst] = size
+			usage.bytes += size
+		}
+	}
+}
+
+// quotaExceeded returns ErrorCodeQuotaExceeded for repository and usage.
+func quotaExceeded(repository string, usage *quotaUsage, detail string) error {
+	return ErrorCodeQuotaExceeded.WithDetail(fmt.Sprintf("%s: quota %q: %s", repository, usage.quota.Prefix, detail))
+}
+
+func newQuotaRepository(ctx context.Context, repository distribution.Repository, options map[string]interface{}) (distribution.Repository, error) {
+	tracker, ok := options[quotasParameter].(*quotaTracker)
+	if !ok {
+		return nil, fmt.Errorf("%q must be set for %s repository middleware", quotasParameter, quotasMiddlewareName)
+	}
+	name := repository.Named().Name()
+	for _, usage := range tracker.usages {
+		if usage.quota.applies(name) {
+			return &quotaRepository{Repository: repository, tracker: tracker}, nil
+		}
+	}
+	return repository, nil
+}
+
+// quotaRepository is a repository subject to quotas.
+type quotaRepository struct {
+	distribution.Repository
+	tracker *quotaTracker
+}
+
+func (r *quotaRepository) Blobs(ctx context.Context) distribution.BlobStore {
+	return &quotaBlobStore{BlobStore: r.Repository.Blobs(ctx), repository: r}
+}
+
+func (r *quotaRepository) Manifests(ctx context.Context, options ...distribution.ManifestServiceOption) (distribution.ManifestService, error) {
+	manifests, err := r.Repository.Manifests(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &quotaManifestService{ManifestService: manifests, repository: r}, nil
+}
+
+func (r *quotaRepository) Tags(ctx context.Context) distribution.TagService {
+	return &quotaTagService{TagService: r.Repository.Tags(ctx), repository: r}
+}
+
+// quotaBlobStore rejects uploads over quota, and tracks the blobs linked to the repository.
+type quotaBlobStore struct {
+	distribution.BlobStore
+	repository *quotaRepository
+}
+
+func (bs *quotaBlobStore) Create(ctx context.Context, options ...distribution.BlobCreateOption) (distribution.BlobWriter, error) {
+	t := bs.repository.tracker
+	name := bs.repository.Named().Name()
+	usages, release, err := t.acquire(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	t.mutex.Lock()
+	for _, usage := range usages {
+		if usage.quota.MaxBytes > 0 && usage.bytes >= usage.quota.MaxBytes {
+			err = quotaExceeded(name, usage, fmt.Sprintf("%d bytes used of %d", usage.bytes, usage.quota.MaxBytes))
+			break
+		}
+	}
+	t.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	writer, err := bs.BlobStore.Create(ctx, options...)
+	if mounted, ok := err.(distribution.ErrBlobMounted); ok {
+		t.mutex.Lock()
+		addBlob(usages, mounted.Descriptor.Digest, mounted.Descriptor.Size)
+		t.mutex.Unlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &quotaBlobWriter{BlobWriter: writer, repository: bs.repository}, nil
+}
+
+func (bs *quotaBlobStore) Resume(ctx context.Context, id string) (distribution.BlobWriter, error) {
+	writer, err := bs.BlobStore.Resume(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &quotaBlobWriter{BlobWriter: writer, repository: bs.repository}, nil
+}
+
+func (bs *quotaBlobStore) Delete(ctx context.Context, dgst digest.Digest) error {
+	t := bs.repository.tracker
+	name := bs.repository.Named().Name()
+	_, release, err := t.acquire(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := bs.BlobStore.Delete(ctx, dgst); err != nil {
+		return err
+	}
+	// Other repositories of the quotas of the repository may still link the blob.
+	t.invalidate(name)
+	return nil
+}
+
+// quotaBlobWriter rejects completing uploads which would exceed quotas.
+type quotaBlobWriter struct {
+	distribution.BlobWriter
+	repository *quotaRepository
+}
+
+func (bw *quotaBlobWriter) Commit(ctx context.Context, provisional distribution.Descriptor) (distribution.Descriptor, error) {
+	t := bw.repository.tracker
+	name := bw.repository.Named().Name()
+	size := bw.Size()
+	usages, release, err := t.acquire(ctx, name)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	defer release()
+	t.mutex.Lock()
+	// Reserve the size of the blob until it is committed, so that concurrent uploads can not exceed quotas together.
+	reserved := []*quotaUsage{}
+	for _, usage := range usages {
+		if _, ok := usage.blobs[provisional.Digest]; ok {
+			continue
+		}
+		if usage.quota.MaxBytes > 0 && usage.bytes+size > usage.quota.MaxBytes {
+			for _, r := range reserved {
+				r.bytes -= size
+			}
+			t.mutex.Unlock()
+			return distribution.Descriptor{}, quotaExceeded(name, usage, fmt.Sprintf("%d bytes used of %d, the blob has %d", usage.bytes, usage.quota.MaxBytes, size))
+		}
+		usage.bytes += size
+		reserved = append(reserved, usage)
+	}
+	t.mutex.Unlock()
+
+	desc, err := bw.BlobWriter.Commit(ctx, provisional)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, usage := range reserved {
+		usage.bytes -= size
+	}
+	if err == nil {
+		addBlob(reserved, desc.Digest, desc.Size)
+	}
+	return desc, err
+}
+
+// quotaManifestService rejects manifests of repositories over quota, or which would add a tag over quota. The tag
+// check only rejects early: quotaTagService.Tag enforces MaxTags when the tag is added.
+type quotaManifestService struct {
+	distribution.ManifestService
+	repository *quotaRepository
+}
+
+func (ms *quotaManifestService) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
+	newTag := false
+	for _, option := range options {
+		if tagOption, ok := option.(distribution.WithTagOption); ok {
+			_, err := ms.repository.Repository.Tags(ctx).Get(ctx, tagOption.Tag)
+			if _, ok := err.(distribution.ErrTagUnknown); ok {
+				newTag = true
+			} else if err != nil {
+				return "", err
+			}
+		}
+	}
+	t := ms.repository.tracker
+	name := ms.repository.Named().Name()
+	usages, release, err := t.acquire(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	t.mutex.Lock()
+	for _, usage := range usages {
+		if usage.quota.MaxBytes > 0 && usage.bytes > usage.quota.MaxBytes {
+			err = quotaExceeded(name, usage, fmt.Sprintf("%d bytes used of %d", usage.bytes, usage.quota.MaxBytes))
+			break
+		}
+		if newTag && usage.quota.MaxTags > 0 && usage.tags >= usage.quota.MaxTags {
+			err = quotaExceeded(name, usage, fmt.Sprintf("%d tags of %d", usage.tags, usage.quota.MaxTags))
+			break
+		}
+	}
+	t.mutex.Unlock()
+	release()
+	if err != nil {
+		return "", err
+	}
+	return ms.ManifestService.Put(ctx, manifest, options...)
+}
+
+// quotaTagService rejects new tags over quota, and tracks the tags of the repository.
+type quotaTagService struct {
+	distribution.TagService
+	repository *quotaRepository
+}
+
+func (ts *quotaTagService) Tag(ctx context.Context, tag string, desc distribution.Descriptor) error {
+	usages, release, err := ts.repository.tracker.acquire(ctx, ts.repository.Named().Name())
+	if err != nil {
+		return err
+	}
+	defer release()
+	_, err = ts.TagService.Get(ctx, tag)
+	if _, isNew := err.(distribution.ErrTagUnknown); !isNew {
+		return ts.TagService.Tag(ctx, tag, desc)
+	}
+	t := ts.repository.tracker
+	name := ts.repository.Named().Name()
+	t.mutex.Lock()
+	// Reserve the new tag until it is written, so that concurrent pushes can not exceed quotas together.
+	for _, usage := range usages {
+		if usage.quota.MaxTags > 0 && usage.tags >= usage.quota.MaxTags {
+			t.mutex.Unlock()
+			return quotaExceeded(name, usage, fmt.Sprintf("%d tags of %d", usage.tags, usage.quota.MaxTags))
+		}
+	}
+	for _, usage := range usages {
+		usage.tags++
+	}
+	t.mutex.Unlock()
+	if err := ts.TagService.Tag(ctx, tag, desc); err != nil {
+		ts.addTags(usages, -1)
+		return err
+	}
+	return nil
+}
+
+func (ts *quotaTagService) Untag(ctx context.Context, tag string) error {
+	usages, release, err := ts.repository.tracker.acquire(ctx, ts.repository.Named().Name())
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := ts.TagService.Untag(ctx, tag); err != nil {
+		return err
+	}
+	ts.addTags(usages, -1)
+	return nil
+}
+
+// addTags adds n to the tags of usages, the acquired usages of the quotas of the repository.
+func (ts *quotaTagService) addTags(usages []*quotaUsage, n int) {
+	t := ts.repository.tracker
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, usage := range usages {
+		usage.tags += n
+	}
+}
@@ -0,0 +1,128 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/migtools/udistribution/pkg/client"
+	"github.com/migtools/udistribution/pkg/image/udistribution"
+	"github.com/migtools/udistribution/pkg/internal/testing/clienttest"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotas(t *testing.T) {
+	ctx := context.Background()
+	ut, dir := newFilesystemTestTransport(t, []string{"REGISTRY_STORAGE_DELETE_ENABLED=true"},
+		client.WithQuotas(client.Quota{Prefix: "tenant", MaxTags: 1}, client.Quota{Prefix: "small", MaxBytes: 1}))
+	cl := ut.Client
+
+	// push copies the test image to name.
+	push := func(name string) ([]byte, error) {
+		ref, err := ut.ParseReference(name)
+		require.NoError(t, err)
+		return clienttest.CopyFixtureImageWithContext(ref, &types.SystemContext{})
+	}
+	imageManifest, err := push("//tenant/app:v1")
+	require.NoError(t, err)
+	parsed, err := manifest.FromBlob(imageManifest, manifest.GuessMIMEType(imageManifest))
+	require.NoError(t, err)
+	imageSize := parsed.ConfigInfo().Size + parsed.LayerInfos()[0].Size
+
+	// Pushing the tag again does not add a tag.
+	_, err = push("//tenant/app:v1")
+	require.NoError(t, err)
+	var quotaErr udistribution.ErrQuotaExceeded
+	_, err = push("//tenant/other:v1")
+	require.ErrorAs(t, err, &quotaErr)
+	assert.Equal(t, "tenant/other", quotaErr.Repository)
+
+	_, err = push("//small/app:v1")
+	require.ErrorAs(t, err, &quotaErr)
+	assert.Equal(t, "small/app", quotaErr.Repository)
+
+	for _, name := range []string{"//other/app:v1", "//other/app:v2"} {
+		_, err = push(name)
+		require.NoError(t, err)
+	}
+
+	usages, err := cl.QuotaUsage(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []client.QuotaUsage{
+		{Quota: client.Quota{Prefix: "tenant", MaxTags: 1}, Bytes: imageSize, Tags: 1},
+		{Quota: client.Quota{Prefix: "small", MaxBytes: 1}, Bytes: 0, Tags: 0},
+	}, usages)
+
+	// Server-side copies are subject to quotas too.
+	_, err = cl.CopyBlob(ctx, cl, "tenant/app", "small/app", parsed.LayerInfos()[0].Digest)
+	var codeErr errcode.Error
+	require.ErrorAs(t, err, &codeErr)
+	assert.Equal(t, client.ErrorCodeQuotaExceeded, codeErr.Code)
+
+	// Deleting a blob only recomputes the usage of the quotas of its repository: a link added bypassing the registry
+	// to a repository of another quota is not counted.
+	bypassed := digest.FromString("bypassed")
+	dataDir := filepath.Join(dir, "docker/registry/v2/blobs/sha256", bypassed.Encoded()[:2], bypassed.Encoded())
+	require.NoError(t, os.MkdirAll(dataDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "data"), []byte("bypassed"), 0o644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "docker/registry/v2/repositories/small/app/_layers/sha256", bypassed.Encoded()), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "docker/registry/v2/repositories/small/app/_layers/sha256", bypassed.Encoded(), "link"), []byte(bypassed), 0o644))
+	for _, repo := range []string{"tenant/app", "tenant/other"} {
+		recorder := httptest.NewRecorder()
+		cl.GetApp().ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/v2/"+repo+"/blobs/"+parsed.ConfigInfo().Digest.String(), nil))
+		require.Equal(t, http.StatusAccepted, recorder.Code, recorder.Body.String())
+	}
+	usages, err = cl.QuotaUsage(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []client.QuotaUsage{
+		{Quota: client.Quota{Prefix: "tenant", MaxTags: 1}, Bytes: parsed.LayerInfos()[0].Size, Tags: 1},
+		{Quota: client.Quota{Prefix: "small", MaxBytes: 1}, Bytes: 0, Tags: 0},
+	}, usages)
+}
+
+func TestQuotasConcurrentTags(t *testing.T) {
+	ctx := context.Background()
+	quota := client.Quota{Prefix: "tenant", MaxTags: 1}
+	ut, dir := newFilesystemTestTransport(t, nil, client.WithQuotas(quota))
+
+	// Concurrent pushes of new tags can not exceed MaxTags together.
+	errs := make([]error, 8)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ref, err := ut.ParseReference(fmt.Sprintf("//tenant/app:v%d", i))
+			require.NoError(t, err)
+			_, errs[i] = clienttest.CopyFixtureImageWithContext(ref, &types.SystemContext{})
+		}(i)
+	}
+	wg.Wait()
+	pushed := 0
+	for _, err := range errs {
+		if err == nil {
+			pushed++
+			continue
+		}
+		var quotaErr udistribution.ErrQuotaExceeded
+		require.ErrorAs(t, err, &quotaErr)
+	}
+	assert.Equal(t, 1, pushed)
+
+	// The tags in the storage match the usage.
+	cl, _ := clienttest.NewFilesystemClient(t, []string{"REGISTRY_STORAGE_FILESYSTEM_ROOTDIRECTORY=" + dir}, client.WithQuotas(quota))
+	usages, err := cl.QuotaUsage(ctx)
+	require.NoError(t, err)
+	require.Len(t, usages, 1)
+	assert.Equal(t, 1, usages[0].Tags)
+}
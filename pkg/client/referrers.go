@@ -0,0 +1,323 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	repositorymiddleware "github.com/distribution/distribution/v3/registry/middleware/repository"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	gorillahandlers "github.com/gorilla/handlers"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ReferrersPath is the route of the OCI referrers API served by the in-process registry,
+// see https://github.com/opencontainers/distribution-spec/blob/main/spec.md#listing-referrers
+var ReferrersPath = "/v2/{name:" + reference.NameRegexp.String() + "}/referrers/{digest:" + digest.DigestRegexp.String() + "}"
+
+const (
+	referrersRouteName = "referrers"
+	// filtersAppliedHeader lists the filters applied to a referrers response.
+	filtersAppliedHeader = "OCI-Filters-Applied"
+	artifactTypeFilter   = "artifactType"
+	// referrersMiddlewareName is the repository middleware indexing the subjects of the manifests pushed to the
+	// in-process registry.
+	referrersMiddlewareName = "udistribution-referrers"
+	referrersParameter      = "udistribution.referrers"
+)
+
+// referringManifest contains the fields of image manifests and indexes which are relevant to the referrers API.
+type referringManifest struct {
+	MediaType    string                `json:"mediaType"`
+	ArtifactType string                `json:"artifactType,omitempty"`
+	Config       *imgspecv1.Descriptor `json:"config,omitempty"`
+	Subject      *imgspecv1.Descriptor `json:"subject,omitempty"`
+	Annotations  map[string]string     `json:"annotations,omitempty"`
+	// Manifests is only used to tell indexes without a mediaType from image manifests.
+	Manifests json.RawMessage `json:"manifests,omitempty"`
+}
+
+// parseReferringManifest parses payload, returning nil if it is not an OCI image manifest or index.
+func parseReferringManifest(payload []byte) *referringManifest {
+	var parsed referringManifest
+	if err := json.Unmarshal(payload, &parsed); err != nil {
+		return nil
+	}
+	if parsed.MediaType == "" {
+		parsed.MediaType = imgspecv1.MediaTypeImageManifest
+		if parsed.Manifests != nil {
+			parsed.MediaType = imgspecv1.MediaTypeImageIndex
+		}
+	}
+	if parsed.MediaType != imgspecv1.MediaTypeImageManifest && parsed.MediaType != imgspecv1.MediaTypeImageIndex {
+		return nil
+	}
+	return &parsed
+}
+
+// referrersIndexPath returns the storage directory indexing the referrers of subject in repository. Each referrer has a
+// link in it, which is not a manifest revision: the revision link of the referrer is checked when the index is read.
+// The index is kept out of _manifests, whose links distribution enumerates as revisions, e.g. in garbage collection.
+func referrersIndexPath(repository string, subject digest.Digest) string {
+	return path.Join(repositoriesRoot, repository, "_referrers", subject.Algorithm().String(), subject.Encoded())
+}
+
+// referrerLinkPath returns the storage path of the link indexing referrer as a referrer of subject in repository.
+func referrerLinkPath(repository string, subject, referrer digest.Digest) string {
+	return path.Join(referrersIndexPath(repository, subject), referrer.Algorithm().String(), referrer.Encoded(), "link")
+}
+
+// ReferrersTagSchema returns the tag of the index listing referrers of subject, in registries without the referrers API.
+func ReferrersTagSchema(subject digest.Digest) string {
+	return subject.Algorithm().String() + "-" + subject.Encoded()
+}
+
+// registerReferrers serves the OCI referrers API from c's storage.
+func (c *Client) registerReferrers() {
+	c.app.RegisterRoute(referrersRouteName, c.app.NewRoute().Path(ReferrersPath), c.referrersDispatcher, handlers.NameRequired, handlers.NoCustomAccessRecords)
+}
+
+// referrersHandler handles the referrers of a single manifest.
+type referrersHandler struct {
+	*handlers.Context
+	client *Client
+	digest digest.Digest
+}
+
+func (c *Client) referrersDispatcher(ctx *handlers.Context, r *http.Request) http.Handler {
+	dgst, err := digest.Parse(dcontext.GetStringValue(ctx, "vars.digest"))
+	if err != nil {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx.Errors = append(ctx.Errors, v2.ErrorCodeDigestInvalid.WithDetail(err))
+		})
+	}
+	h := &referrersHandler{
+		Context: ctx,
+		client:  c,
+		digest:  dgst,
+	}
+	return gorillahandlers.MethodHandler{
+		http.MethodGet: http.HandlerFunc(h.GetReferrers),
+	}
+}
+
+// GetReferrers returns an image index of the manifests with a subject of the requested digest,
+// merged with the index stored at the ReferrersTagSchema tag, if any.
+// The subject itself does not have to exist.
+// Manifests are read from the storage, as the subjects are indexed there when they are pushed, and so that reading them
+// does not notify pulls.
+func (h *referrersHandler) GetReferrers(w http.ResponseWriter, r *http.Request) {
+	driver, err := h.client.StorageDriver()
+	if err != nil {
+		h.Errors = append(h.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	repository := h.Repository.Named().Name()
+	indexed, err := indexedReferrers(h, driver, repository, h.digest)
+	if err != nil {
+		h.Errors = append(h.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	referrers := []imgspecv1.Descriptor{}
+	seen := map[digest.Digest]bool{}
+	for _, referrer := range indexed {
+		payload, err := readStoredManifest(h, driver, repository, referrer)
+		if err != nil {
+			h.Errors = append(h.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		}
+		if payload == nil {
+			continue // deleted referrer
+		}
+		parsed := parseReferringManifest(payload)
+		if parsed == nil || parsed.Subject == nil || parsed.Subject.Digest != h.digest {
+			continue
+		}
+		artifactType := parsed.ArtifactType
+		if artifactType == "" && parsed.Config != nil && parsed.MediaType == imgspecv1.MediaTypeImageManifest {
+			artifactType = parsed.Config.MediaType
+		}
+		referrers = append(referrers, imgspecv1.Descriptor{
+			MediaType:    parsed.MediaType,
+			ArtifactType: artifactType,
+			Digest:       referrer,
+			Size:         int64(len(payload)),
+			Annotations:  parsed.Annotations,
+		})
+		seen[referrer] = true
+	}
+
+	tagged, err := h.taggedReferrers(driver, repository)
+	if err != nil {
+		h.Errors = append(h.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	for _, desc := range tagged {
+		if !seen[desc.Digest] {
+			referrers = append(referrers, desc)
+			seen[desc.Digest] = true
+		}
+	}
+
+	if artifactType := r.URL.Query().Get(artifactTypeFilter); artifactType != "" {
+		filtered := []imgspecv1.Descriptor{}
+		for _, desc := range referrers {
+			if desc.ArtifactType == artifactType {
+				filtered = append(filtered, desc)
+			}
+		}
+		referrers = filtered
+		w.Header().Set(filtersAppliedHeader, artifactTypeFilter)
+	}
+
+	body, err := json.Marshal(imgspecv1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageIndex,
+		Manifests: referrers,
+	})
+	if err != nil {
+		h.Errors = append(h.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	w.Header().Set("Content-Type", imgspecv1.MediaTypeImageIndex)
+	_, _ = w.Write(body)
+}
+
+// indexedReferrers returns the digests of the manifests indexed as referrers of subject in repository, which may have
+// been deleted since.
+func indexedReferrers(ctx context.Context, driver storagedriver.StorageDriver, repository string, subject digest.Digest) ([]digest.Digest, error) {
+	algorithms, err := driver.List(ctx, referrersIndexPath(repository, subject))
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	referrers := []digest.Digest{}
+	for _, algDir := range algorithms {
+		entries, err := driver.List(ctx, algDir)
+		if err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); ok {
+				continue
+			}
+			return nil, err
+		}
+		for _, entry := range entries {
+			dgst := digest.NewDigestFromEncoded(digest.Algorithm(path.Base(algDir)), path.Base(entry))
+			if dgst.Validate() == nil {
+				referrers = append(referrers, dgst)
+			}
+		}
+	}
+	return referrers, nil
+}
+
+// taggedReferrers returns the referrers listed in the index tagged with the ReferrersTagSchema of the subject, if any.
+func (h *referrersHandler) taggedReferrers(driver storagedriver.StorageDriver, repository string) ([]imgspecv1.Descriptor, error) {
+	link, err := driver.GetContent(h, path.Join(repositoriesRoot, repository, "_manifests/tags", ReferrersTagSchema(h.digest), "current/link"))
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	dgst, err := digest.Parse(string(link))
+	if err != nil {
+		return nil, nil
+	}
+	payload, err := readStoredManifest(h, driver, repository, dgst)
+	if err != nil || payload == nil {
+		return nil, err
+	}
+	var index imgspecv1.Index
+	if err := json.Unmarshal(payload, &index); err != nil || !strings.HasPrefix(index.MediaType, imgspecv1.MediaTypeImageIndex) {
+		return nil, nil
+	}
+	return index.Manifests, nil
+}
+
+func init() {
+	if err := repositorymiddleware.Register(referrersMiddlewareName, newReferrersRepository); err != nil {
+		panic(err)
+	}
+}
+
+// indexReferrers makes the in-process registry of c index the subjects of the manifests pushed to it, for GetReferrers.
+// The middleware is internal to the client, so it is only added to the configuration of the app, before the other
+// repository middlewares so that manifests they reject are not indexed.
+func (c *Client) indexReferrers() {
+	config := *c.app.Config
+	config.Middleware = map[string][]configuration.Middleware{}
+	for name, middlewares := range c.app.Config.Middleware {
+		config.Middleware[name] = middlewares
+	}
+	config.Middleware["repository"] = append([]configuration.Middleware{{
+		Name:    referrersMiddlewareName,
+		Options: configuration.Parameters{referrersParameter: c},
+	}}, config.Middleware["repository"]...)
+	c.app.Config = &config
+}
+
+func newReferrersRepository(ctx context.Context, repository distribution.Repository, options map[string]interface{}) (distribution.Repository, error) {
+	c, ok := options[referrersParameter].(*Client)
+	if !ok {
+		return nil, fmt.Errorf("%q must be set for %s repository middleware", referrersParameter, referrersMiddlewareName)
+	}
+	return &referrersRepository{Repository: repository, client: c}, nil
+}
+
+// referrersRepository indexes the subjects of the manifests pushed to the repository.
+type referrersRepository struct {
+	distribution.Repository
+	client *Client
+}
+
+func (r *referrersRepository) Manifests(ctx context.Context, options ...distribution.ManifestServiceOption) (distribution.ManifestService, error) {
+	manifests, err := r.Repository.Manifests(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &referrersManifestService{ManifestService: manifests, repository: r}, nil
+}
+
+type referrersManifestService struct {
+	distribution.ManifestService
+	repository *referrersRepository
+}
+
+// Put stores m, then links it in the referrers index of its subject, if any.
+func (s *referrersManifestService) Put(ctx context.Context, m distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
+	dgst, err := s.ManifestService.Put(ctx, m, options...)
+	if err != nil {
+		return dgst, err
+	}
+	_, payload, err := m.Payload()
+	if err != nil {
+		return dgst, err
+	}
+	parsed := parseReferringManifest(payload)
+	if parsed == nil || parsed.Subject == nil || parsed.Subject.Digest.Validate() != nil {
+		return dgst, nil
+	}
+	driver, err := s.repository.client.StorageDriver()
+	if err != nil {
+		return dgst, err
+	}
+	repository := s.repository.Named().Name()
+	if err := driver.PutContent(ctx, referrerLinkPath(repository, parsed.Subject.Digest, dgst), []byte(dgst)); err != nil {
+		return dgst, fmt.Errorf("indexing referrer %s of %s: %w", dgst, parsed.Subject.Digest, err)
+	}
+	return dgst, nil
+}
@@ -0,0 +1,337 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/storage"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// RetentionPolicy selects the tags deleted by Client.ApplyRetention.
+type RetentionPolicy struct {
+	// Rules are the rules of the policy. Each repository is subject to the first rule matching its name; repositories
+	// matching no rule are left untouched.
+	Rules []RetentionRule
+	// GarbageCollect removes the blobs no manifest references anymore from the storage once tags are deleted.
+	// Garbage collection must not run while images are pushed to the storage, and the blob descriptor cache of
+	// registries sharing the storage, including the one of the client, may keep describing removed blobs.
+	GarbageCollect bool
+}
+
+// RetentionRule is a rule of a RetentionPolicy. The tags of the repositories it applies to are deleted unless
+// at least one of its Keep criteria, or Protected, keeps them; at least one must be set.
+// Tags are ordered by the modification time of their link in the storage, i.e. the time they were last pushed.
+type RetentionRule struct {
+	// Repositories is a path.Match pattern of the repositories the rule applies to, e.g. "backups/*".
+	Repositories string
+	// KeepLast keeps the KeepLast most recently pushed tags.
+	KeepLast int
+	// KeepWithin keeps the tags pushed less than KeepWithin ago.
+	KeepWithin time.Duration
+	// KeepMatching keeps the tags it matches.
+	KeepMatching *regexp.Regexp
+	// KeepNotMatching keeps the tags it does not match.
+	KeepNotMatching *regexp.Regexp
+	// Protected are path.Match patterns of tags which are never deleted.
+	Protected []string
+}
+
+// ExpiredTag is a tag deleted by Client.ApplyRetention.
+type ExpiredTag struct {
+	// Repository is the repository of the tag, e.g. "ns/repo".
+	Repository string
+	Tag        string
+	Digest     digest.Digest
+	// PushedAt is the modification time of the tag link.
+	PushedAt time.Time
+	// ManifestDeleted is set if no remaining tag of the repository references Digest, directly, as a child of a manifest
+	// list or as the subject of a referrer, and the manifest was deleted from the repository with the tag, along with
+	// its children and referrers which no remaining tag references either.
+	ManifestDeleted bool
+}
+
+// validate returns an error if r is not a valid rule.
+func (r RetentionRule) validate() error {
+	if _, err := path.Match(r.Repositories, ""); err != nil || r.Repositories == "" {
+		return fmt.Errorf("invalid repositories pattern %q", r.Repositories)
+	}
+	for _, pattern := range r.Protected {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid protected tag pattern %q: %w", pattern, err)
+		}
+	}
+	if r.KeepLast < 0 || r.KeepWithin < 0 {
+		return fmt.Errorf("negative retention for %q", r.Repositories)
+	}
+	if r.KeepLast == 0 && r.KeepWithin == 0 && r.KeepMatching == nil && r.KeepNotMatching == nil && len(r.Protected) == 0 {
+		return fmt.Errorf("retention rule for %q keeps no tags", r.Repositories)
+	}
+	return nil
+}
+
+// keeps returns whether r keeps tag, which is the index-th most recently pushed tag, pushed at pushedAt.
+func (r RetentionRule) keeps(tag string, index int, pushedAt, now time.Time) bool {
+	for _, pattern := range r.Protected {
+		if matched, _ := path.Match(pattern, tag); matched {
+			return true
+		}
+	}
+	return index < r.KeepLast ||
+		(r.KeepWithin > 0 && now.Sub(pushedAt) < r.KeepWithin) ||
+		(r.KeepMatching != nil && r.KeepMatching.MatchString(tag)) ||
+		(r.KeepNotMatching != nil && !r.KeepNotMatching.MatchString(tag))
+}
+
+// storedTag is a tag in the storage, with the digest and modification time of its link.
+type storedTag struct {
+	name     string
+	digest   digest.Digest
+	pushedAt time.Time
+}
+
+// ApplyRetention deletes the tags of the repositories of the storage of c which policy does not keep, and the manifests
+// they referenced, with the children of manifest lists and the referrers of the manifests deleted, unless a remaining tag
+// still references them, directly, through manifest lists or as the subject of referrers, unless dryRun is set. Garbage collection then runs if policy.GarbageCollect is set and dryRun is not.
+// It returns the tags deleted, and all errors encountered; tags which could not be deleted are not returned.
+func (c *Client) ApplyRetention(ctx context.Context, policy RetentionPolicy, dryRun bool) ([]ExpiredTag, error) {
+	for _, rule := range policy.Rules {
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+	}
+	driver, err := c.StorageDriver()
+	if err != nil {
+		return nil, err
+	}
+	repositories, err := storedRepositories(ctx, driver)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expired := []ExpiredTag{}
+	errs := []error{}
+	for _, repository := range repositories {
+		var rule *RetentionRule
+		for i := range policy.Rules {
+			if matched, _ := path.Match(policy.Rules[i].Repositories, repository); matched {
+				rule = &policy.Rules[i]
+				break
+			}
+		}
+		if rule == nil {
+			continue
+		}
+		tags, err := storedTags(ctx, driver, repository)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("listing tags of %s: %w", repository, err))
+			continue
+		}
+		found, repoErrs := expireTags(ctx, driver, repository, *rule, tags, now, dryRun)
+		expired = append(expired, found...)
+		errs = append(errs, repoErrs...)
+	}
+
+	if !dryRun {
+		for _, tag := range expired {
+			c.quotas.invalidate(tag.Repository)
+		}
+	}
+	if policy.GarbageCollect && !dryRun && len(errs) == 0 {
+		registry, err := storage.NewRegistry(ctx, driver, storage.EnableDelete)
+		if err != nil {
+			errs = append(errs, err)
+		} else if err := storage.MarkAndSweep(ctx, driver, registry, storage.GCOpts{}); err != nil {
+			errs = append(errs, fmt.Errorf("garbage collection: %w", err))
+		}
+	}
+	dcontext.GetLogger(ctx).Infof("expired %d tags (dry run: %t), %d errors", len(expired), dryRun, len(errs))
+	return expired, errors.Join(errs...)
+}
+
+// expireTags deletes the tags of repository which rule does not keep, and the manifests they reference which are not
+// reachable from the tags kept, with their children and referrers, unless dryRun is set.
+func expireTags(ctx context.Context, driver storagedriver.StorageDriver, repository string, rule RetentionRule, tags []storedTag, now time.Time, dryRun bool) ([]ExpiredTag, []error) {
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].pushedAt.After(tags[j].pushedAt) })
+	kept := map[digest.Digest]bool{}
+	expiring := []storedTag{}
+	for i, tag := range tags {
+		if rule.keeps(tag.name, i, tag.pushedAt, now) {
+			kept[tag.digest] = true
+		} else {
+			expiring = append(expiring, tag)
+		}
+	}
+	if len(expiring) == 0 {
+		return nil, nil
+	}
+	reachable, err := reachableManifests(ctx, driver, repository, kept)
+	if err != nil {
+		return nil, []error{fmt.Errorf("reading manifests of %s: %w", repository, err)}
+	}
+
+	expired := []ExpiredTag{}
+	errs := []error{}
+	// stillTagged are the manifests of the tags which could not be deleted.
+	stillTagged := map[digest.Digest]bool{}
+	for _, tag := range expiring {
+		if !dryRun {
+			if err := driver.Delete(ctx, path.Join(repositoriesRoot, repository, "_manifests/tags", tag.name)); err != nil {
+				if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+					errs = append(errs, fmt.Errorf("deleting tag %s of %s: %w", tag.name, repository, err))
+					stillTagged[tag.digest] = true
+					continue
+				}
+			}
+		}
+		expired = append(expired, ExpiredTag{Repository: repository, Tag: tag.name, Digest: tag.digest, PushedAt: tag.pushedAt})
+	}
+	if len(stillTagged) != 0 {
+		for dgst := range kept {
+			stillTagged[dgst] = true
+		}
+		if reachable, err = reachableManifests(ctx, driver, repository, stillTagged); err != nil {
+			return expired, append(errs, fmt.Errorf("reading manifests of %s: %w", repository, err))
+		}
+	}
+	untagged := map[digest.Digest]bool{}
+	for i := range expired {
+		expired[i].ManifestDeleted = !reachable[expired[i].Digest]
+		if expired[i].ManifestDeleted {
+			untagged[expired[i].Digest] = true
+		}
+	}
+	if dryRun || len(untagged) == 0 {
+		return expired, errs
+	}
+
+	dependents, err := dependentManifests(ctx, driver, repository, untagged)
+	if err != nil {
+		return expired, append(errs, fmt.Errorf("reading manifests of %s: %w", repository, err))
+	}
+	for dgst := range dependents {
+		if reachable[dgst] {
+			continue
+		}
+		if err := driver.Delete(ctx, manifestRevisionLinkPath(repository, dgst)); err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+				errs = append(errs, fmt.Errorf("deleting manifest %s of %s: %w", dgst, repository, err))
+			}
+		}
+	}
+	return expired, errs
+}
+
+// dependentManifests returns the manifests of repository reachable from roots, following the children of manifest
+// lists and the referrers of manifests.
+func dependentManifests(ctx context.Context, driver storagedriver.StorageDriver, repository string, roots map[digest.Digest]bool) (map[digest.Digest]bool, error) {
+	dependents := map[digest.Digest]bool{}
+	pending := make([]digest.Digest, 0, len(roots))
+	for dgst := range roots {
+		pending = append(pending, dgst)
+	}
+	for len(pending) != 0 {
+		dgst := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if dependents[dgst] {
+			continue
+		}
+		dependents[dgst] = true
+		referrers, err := indexedReferrers(ctx, driver, repository, dgst)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, referrers...)
+		payload, err := readStoredManifest(ctx, driver, repository, dgst)
+		if err != nil {
+			return nil, err
+		}
+		var m storedManifest
+		if payload == nil || json.Unmarshal(payload, &m) != nil {
+			continue
+		}
+		for _, child := range m.Manifests {
+			if child.Digest.Validate() == nil {
+				pending = append(pending, child.Digest)
+			}
+		}
+	}
+	return dependents, nil
+}
+
+// reachableManifests returns the manifests of repository reachable from roots, following the children of manifest lists
+// and the subjects of referrers.
+func reachableManifests(ctx context.Context, driver storagedriver.StorageDriver, repository string, roots map[digest.Digest]bool) (map[digest.Digest]bool, error) {
+	reachable := map[digest.Digest]bool{}
+	pending := make([]digest.Digest, 0, len(roots))
+	for dgst := range roots {
+		pending = append(pending, dgst)
+	}
+	for len(pending) != 0 {
+		dgst := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if reachable[dgst] {
+			continue
+		}
+		reachable[dgst] = true
+		payload, err := readStoredManifest(ctx, driver, repository, dgst)
+		if err != nil {
+			return nil, err
+		}
+		var m storedManifest
+		if payload == nil || json.Unmarshal(payload, &m) != nil {
+			continue
+		}
+		for _, child := range m.Manifests {
+			if child.Digest.Validate() == nil {
+				pending = append(pending, child.Digest)
+			}
+		}
+		if m.Subject != nil && m.Subject.Digest.Validate() == nil {
+			pending = append(pending, m.Subject.Digest)
+		}
+	}
+	return reachable, nil
+}
+
+// storedTags returns the tags of repository with a valid link, sorted by name.
+func storedTags(ctx context.Context, driver storagedriver.StorageDriver, repository string) ([]storedTag, error) {
+	tagDirs, err := driver.List(ctx, path.Join(repositoriesRoot, repository, "_manifests/tags"))
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	sort.Strings(tagDirs)
+	tags := []storedTag{}
+	for _, tagDir := range tagDirs {
+		linkPath := path.Join(tagDir, "current/link")
+		info, err := driver.Stat(ctx, linkPath)
+		if err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); ok {
+				continue
+			}
+			return nil, err
+		}
+		content, err := driver.GetContent(ctx, linkPath)
+		if err != nil {
+			return nil, err
+		}
+		dgst, err := digest.Parse(string(content))
+		if err != nil {
+			continue // Reported by Verify.
+		}
+		tags = append(tags, storedTag{name: path.Base(tagDir), digest: dgst, pushedAt: info.ModTime()})
+	}
+	return tags, nil
+}
@@ -0,0 +1,247 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/client"
+	"github.com/migtools/udistribution/pkg/image/udistribution"
+	"github.com/migtools/udistribution/pkg/internal/testing/clienttest"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyRetention(t *testing.T) {
+	ctx := context.Background()
+	sys := &types.SystemContext{}
+	ut, dir := newFilesystemTestTransport(t, nil)
+	now := time.Now()
+
+	// pushManifest pushes m, whose blobs are in repo, as tag of repo, pushed age ago.
+	pushManifest := func(repo, tag string, m []byte, age time.Duration) digest.Digest {
+		ref, err := ut.ParseReference("//" + repo + ":" + tag)
+		require.NoError(t, err)
+		dest, err := ref.NewImageDestination(ctx, sys)
+		require.NoError(t, err)
+		require.NoError(t, dest.PutManifest(ctx, m, nil))
+		require.NoError(t, dest.Close())
+		return setPushedAt(t, dir, repo, tag, now.Add(-age))
+	}
+	// variantOf returns a variant of the test image, with the same blobs.
+	var imageManifest []byte
+	variantOf := func(variant int) []byte {
+		var m map[string]any
+		require.NoError(t, json.Unmarshal(imageManifest, &m))
+		m["variant"] = variant
+		variantManifest, err := json.Marshal(m)
+		require.NoError(t, err)
+		return variantManifest
+	}
+	// pushTag pushes a variant of the test image, or the image itself if variant is 0, as tag of repo, pushed age ago.
+	pushTag := func(repo, tag string, variant int, age time.Duration) digest.Digest {
+		if variant == 0 {
+			ref, err := ut.ParseReference("//" + repo + ":" + tag)
+			require.NoError(t, err)
+			imageManifest = clienttest.CopyFixtureImage(t, ref)
+			return setPushedAt(t, dir, repo, tag, now.Add(-age))
+		}
+		return pushManifest(repo, tag, variantOf(variant), age)
+	}
+	day := 24 * time.Hour
+	pushTag("test/app", "base", 0, 10*day)
+	v1 := pushTag("test/app", "v1", 1, 5*day)
+	pushTag("test/app", "v2", 2, 3*day)
+	v3 := pushTag("test/app", "v3", 3, time.Hour)
+	pushTag("test/app", "old", 3, 20*day)
+	pushTag("test/app", "release-1", 4, 30*day)
+	pushTag("other/app", "v1", 0, 30*day)
+	manifestDigest, err := manifest.Digest(imageManifest)
+	require.NoError(t, err)
+	parsed, err := manifest.FromBlob(imageManifest, manifest.GuessMIMEType(imageManifest))
+	require.NoError(t, err)
+
+	// child is only kept as a child of a kept index, and signed as the subject of a kept referrer.
+	childManifest, signedManifest := variantOf(5), variantOf(6)
+	child := pushManifest("test/app", "child", childManifest, 40*day)
+	index, err := json.Marshal(imgspecv1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageIndex,
+		Manifests: []imgspecv1.Descriptor{{MediaType: manifest.GuessMIMEType(imageManifest), Digest: child, Size: int64(len(childManifest))}},
+	})
+	require.NoError(t, err)
+	pushManifest("test/app", "release-index", index, 40*day)
+	signed := pushManifest("test/app", "signed", signedManifest, 50*day)
+	layer := parsed.LayerInfos()[0]
+	referrer, err := json.Marshal(imgspecv1.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    imgspecv1.MediaTypeImageManifest,
+		ArtifactType: "application/vnd.example.signature",
+		Config:       imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageConfig, Digest: parsed.ConfigInfo().Digest, Size: parsed.ConfigInfo().Size},
+		Layers:       []imgspecv1.Descriptor{{MediaType: imgspecv1.MediaTypeImageLayerGzip, Digest: layer.Digest, Size: layer.Size}},
+		Subject:      &imgspecv1.Descriptor{MediaType: manifest.GuessMIMEType(imageManifest), Digest: signed, Size: int64(len(signedManifest))},
+	})
+	require.NoError(t, err)
+	pushManifest("test/app", "release-signature", referrer, 40*day)
+
+	policy := client.RetentionPolicy{
+		Rules: []client.RetentionRule{{
+			Repositories: "test/*",
+			KeepLast:     1,
+			KeepWithin:   4 * day,
+			KeepMatching: regexp.MustCompile(`^release-`),
+			Protected:    []string{"base"},
+		}},
+		GarbageCollect: true,
+	}
+	// old references the manifest of v3, which is kept, and child and signed manifests reachable from kept tags.
+	expected := []client.ExpiredTag{
+		{Repository: "test/app", Tag: "v1", Digest: v1, ManifestDeleted: true},
+		{Repository: "test/app", Tag: "old", Digest: v3},
+		{Repository: "test/app", Tag: "child", Digest: child},
+		{Repository: "test/app", Tag: "signed", Digest: signed},
+	}
+	for _, dryRun := range []bool{true, false} {
+		expired, err := ut.Client.ApplyRetention(ctx, policy, dryRun)
+		require.NoError(t, err)
+		for i := range expired {
+			assert.WithinDuration(t, now, expired[i].PushedAt, 51*day)
+			expired[i].PushedAt = time.Time{}
+		}
+		assert.Equal(t, expected, expired, "dry run: %t", dryRun)
+	}
+
+	repo, err := ut.ParseReference("//test/app:latest")
+	require.NoError(t, err)
+	tags, err := udistribution.GetRepositoryTags(ctx, sys, repo)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"base", "v2", "v3", "release-1", "release-index", "release-signature"}, tags)
+	revisions, err := ut.Client.ManifestRevisions(ctx, "test/app")
+	require.NoError(t, err)
+	assert.NotContains(t, revisions, v1)
+	assert.Contains(t, revisions, v3)
+	assert.Contains(t, revisions, child)
+	assert.Contains(t, revisions, signed)
+	assertImageIn(t, ut, "//other/app:v1")
+	assertImageIn(t, ut, "//test/app@"+manifestDigest.String())
+
+	// Garbage collection removed the deleted manifest, and nothing else.
+	_, err = os.Stat(filepath.Join(dir, "docker/registry/v2/blobs", v1.Algorithm().String(), v1.Encoded()[:2], v1.Encoded()))
+	assert.True(t, os.IsNotExist(err))
+	report, err := ut.Client.Verify(ctx, client.VerifyOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+
+	_, err = ut.Client.ApplyRetention(ctx, client.RetentionPolicy{Rules: []client.RetentionRule{{Repositories: "test/*"}}}, true)
+	assert.Error(t, err)
+}
+
+func TestApplyRetentionIndex(t *testing.T) {
+	ctx := context.Background()
+	sys := &types.SystemContext{}
+	ut, dir := newFilesystemTestTransport(t, nil)
+	old := time.Now().Add(-48 * time.Hour)
+
+	// pushUntagged pushes m, and blobs, to backups/app by digest.
+	pushUntagged := func(m []byte, blobs ...string) digest.Digest {
+		dgst, err := manifest.Digest(m)
+		require.NoError(t, err)
+		ref, err := ut.ParseReference("//backups/app@" + dgst.String())
+		require.NoError(t, err)
+		dest, err := ref.NewImageDestination(ctx, sys)
+		require.NoError(t, err)
+		defer dest.Close()
+		for _, blob := range blobs {
+			_, err = dest.PutBlob(ctx, strings.NewReader(blob), types.BlobInfo{Digest: digest.FromString(blob), Size: int64(len(blob))}, none.NoCache, false)
+			require.NoError(t, err)
+		}
+		require.NoError(t, dest.PutManifest(ctx, m, nil))
+		require.NoError(t, dest.Commit(ctx, nil))
+		return dgst
+	}
+	// The index, tagged multi, has the image, tagged image, and an untagged variant for children, and an untagged
+	// referrer with a blob of its own. All tags expire.
+	ref, err := ut.ParseReference("//backups/app:image")
+	require.NoError(t, err)
+	imageManifest := clienttest.CopyFixtureImage(t, ref)
+	image := setPushedAt(t, dir, "backups/app", "image", old)
+	var m map[string]any
+	require.NoError(t, json.Unmarshal(imageManifest, &m))
+	m["variant"] = 1
+	variantManifest, err := json.Marshal(m)
+	require.NoError(t, err)
+	variant := pushUntagged(variantManifest)
+	mediaType := manifest.GuessMIMEType(imageManifest)
+	index, err := json.Marshal(imgspecv1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageIndex,
+		Manifests: []imgspecv1.Descriptor{
+			{MediaType: mediaType, Digest: image, Size: int64(len(imageManifest))},
+			{MediaType: mediaType, Digest: variant, Size: int64(len(variantManifest))},
+		},
+	})
+	require.NoError(t, err)
+	indexRef, err := ut.ParseReference("//backups/app:multi")
+	require.NoError(t, err)
+	dest, err := indexRef.NewImageDestination(ctx, sys)
+	require.NoError(t, err)
+	require.NoError(t, dest.PutManifest(ctx, index, nil))
+	require.NoError(t, dest.Close())
+	indexDigest := setPushedAt(t, dir, "backups/app", "multi", old)
+	emptyConfig := "{}"
+	sbom := "sbom"
+	referrer, err := json.Marshal(imgspecv1.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    imgspecv1.MediaTypeImageManifest,
+		ArtifactType: "application/spdx+json",
+		Config:       imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeEmptyJSON, Digest: digest.FromString(emptyConfig), Size: int64(len(emptyConfig))},
+		Layers:       []imgspecv1.Descriptor{{MediaType: "text/plain", Digest: digest.FromString(sbom), Size: int64(len(sbom))}},
+		Subject:      &imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageIndex, Digest: indexDigest, Size: int64(len(index))},
+	})
+	require.NoError(t, err)
+	sbomDigest := pushUntagged(referrer, emptyConfig, sbom)
+
+	expired, err := ut.Client.ApplyRetention(ctx, client.RetentionPolicy{
+		Rules:          []client.RetentionRule{{Repositories: "backups/*", KeepWithin: time.Hour}},
+		GarbageCollect: true,
+	}, false)
+	require.NoError(t, err)
+	for i := range expired {
+		expired[i].PushedAt = time.Time{}
+	}
+	assert.Equal(t, []client.ExpiredTag{
+		{Repository: "backups/app", Tag: "image", Digest: image, ManifestDeleted: true},
+		{Repository: "backups/app", Tag: "multi", Digest: indexDigest, ManifestDeleted: true},
+	}, expired)
+
+	// The children and referrers of the index are deleted with it, and garbage collection removed all their blobs.
+	revisions, err := ut.Client.ManifestRevisions(ctx, "backups/app")
+	require.NoError(t, err)
+	assert.Empty(t, revisions)
+	parsed, err := manifest.FromBlob(imageManifest, mediaType)
+	require.NoError(t, err)
+	for _, dgst := range []digest.Digest{parsed.LayerInfos()[0].Digest, parsed.ConfigInfo().Digest, variant, sbomDigest, digest.FromString(emptyConfig), digest.FromString(sbom)} {
+		_, err = os.Stat(filepath.Join(dir, "docker/registry/v2/blobs", dgst.Algorithm().String(), dgst.Encoded()[:2], dgst.Encoded()))
+		assert.True(t, os.IsNotExist(err), dgst.String())
+	}
+}
+
+// setPushedAt sets the modification time of the link of tag of repo, stored in dir, to pushedAt, and returns its digest.
+func setPushedAt(t *testing.T, dir, repo, tag string, pushedAt time.Time) digest.Digest {
+	link := filepath.Join(dir, "docker/registry/v2/repositories", repo, "_manifests/tags", tag, "current/link")
+	require.NoError(t, os.Chtimes(link, pushedAt, pushedAt))
+	content, err := os.ReadFile(link)
+	require.NoError(t, err)
+	return digest.Digest(content)
+}
@@ -0,0 +1,216 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/uuid"
+	"github.com/opencontainers/go-digest"
+)
+
+// blobsRoot is the storage path of the blob data of the registry.
+const blobsRoot = "/docker/registry/v2/blobs"
+
+// ErrServerSideCopyUnsupported is returned by CopyBlob when the storage backends of two clients can not copy data between each other.
+var ErrServerSideCopyUnsupported = errors.New("server-side copy is not supported between these storage backends")
+
+// serverSideCopier copies blob data from the storage of one client to the storage of another, without it passing through this process.
+type serverSideCopier interface {
+	// copyBlob copies the object at srcPath, of size bytes, to dstPath.
+	copyBlob(ctx context.Context, srcPath, dstPath string, size int64) error
+	close() error
+}
+
+// CopyBlob copies the blob dgst of srcRepository, e.g. "ns/repo", in the storage of src into repository of c, and returns its size.
+// The blob data is copied by the storage backend itself: with CopyObject on S3, a rewrite on GCS, and a copy from a signed URL on Azure;
+// filesystem storage copies the file directly. Only the link of the blob is written by c, and the data is not copied if c already stores it.
+// The credentials of c must allow reading the data of src. CopyBlob returns ErrServerSideCopyUnsupported if the storage types of
+// src and c differ or can not copy between each other, and distribution.ErrBlobUnknown if srcRepository does not contain the blob.
+// The link is written to the storage directly: only quotas are enforced, the Authorizer and the repository middlewares of c
+// are not called, and no events are notified. Callers acting for a user must check that it may push to repository first,
+// as the udistribution transport does through the registry.
+func (c *Client) CopyBlob(ctx context.Context, src *Client, srcRepository, repository string, dgst digest.Digest) (int64, error) {
+	for _, name := range []string{srcRepository, repository} {
+		if _, err := reference.WithName(name); err != nil {
+			return 0, fmt.Errorf("invalid repository %q: %w", name, err)
+		}
+	}
+	if err := dgst.Validate(); err != nil {
+		return 0, err
+	}
+	srcDriver, err := src.StorageDriver()
+	if err != nil {
+		return 0, err
+	}
+	dstDriver, err := c.StorageDriver()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := checkBlobLink(ctx, srcDriver, srcRepository, dgst); err != nil {
+		return 0, err
+	}
+	dataPath := blobDataPath(dgst)
+	srcData, err := srcDriver.Stat(ctx, dataPath)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return 0, fmt.Errorf("blob %s of %s: %w", dgst, srcRepository, distribution.ErrBlobUnknown)
+		}
+		return 0, err
+	}
+	usages, release, err := c.quotas.acquire(ctx, repository)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	if err := c.quotas.checkBlob(repository, usages, dgst, srcData.Size()); err != nil {
+		return 0, err
+	}
+	dstData, err := dstDriver.Stat(ctx, dataPath)
+	switch {
+	case err == nil && dstData.Size() == srcData.Size():
+		dcontext.GetLogger(ctx).Debugf("blob %s is already stored, linking it into %s", dgst, repository)
+	case err == nil, errors.As(err, new(storagedriver.PathNotFoundError)): // missing, or of another size
+		copier, err := c.serverSideCopier(ctx, src, repository)
+		if err != nil {
+			return 0, err
+		}
+		defer copier.close()
+		if err := copier.copyBlob(ctx, dataPath, dataPath, srcData.Size()); err != nil {
+			return 0, fmt.Errorf("copying blob %s from %s storage: %w", dgst, src.config.Storage.Type(), err)
+		}
+	default:
+		return 0, err
+	}
+
+	if err := dstDriver.PutContent(ctx, blobLinkPath(repository, dgst), []byte(dgst.String())); err != nil {
+		return 0, err
+	}
+	c.quotas.linkBlob(usages, dgst, srcData.Size())
+	return srcData.Size(), nil
+}
+
+// serverSideCopier returns a copier from the storage of src to the storage of c, copying blobs for repository.
+func (c *Client) serverSideCopier(ctx context.Context, src *Client, repository string) (serverSideCopier, error) {
+	srcType, dstType := storageTypeName(src), storageTypeName(c)
+	if srcType != dstType {
+		return nil, fmt.Errorf("copying from %s to %s storage: %w", srcType, dstType, ErrServerSideCopyUnsupported)
+	}
+	srcParams, dstParams := src.config.Storage.Parameters(), c.config.Storage.Parameters()
+	switch dstType {
+	case "s3":
+		return newS3Copier(srcParams, dstParams)
+	case "gcs":
+		return newGCSCopier(ctx, srcParams, dstParams)
+	case "azure":
+		srcDriver, err := src.StorageDriver()
+		if err != nil {
+			return nil, err
+		}
+		return newAzureCopier(srcDriver, dstParams)
+	case "filesystem":
+		srcDriver, err := src.StorageDriver()
+		if err != nil {
+			return nil, err
+		}
+		dstDriver, err := c.StorageDriver()
+		if err != nil {
+			return nil, err
+		}
+		return &driverCopier{src: srcDriver, dst: dstDriver, uploadsDir: path.Join(repositoriesRoot, repository, "_uploads")}, nil
+	}
+	return nil, fmt.Errorf("copying within %s storage: %w", dstType, ErrServerSideCopyUnsupported)
+}
+
+// storageTypeName returns the name of the storage type of c, with aliases of the same driver resolved.
+func storageTypeName(c *Client) string {
+	if name := c.config.Storage.Type(); name != "s3aws" {
+		return name
+	}
+	return "s3"
+}
+
+// checkBlobLink returns distribution.ErrBlobUnknown if repository does not link to the blob dgst.
+func checkBlobLink(ctx context.Context, driver storagedriver.StorageDriver, repository string, dgst digest.Digest) error {
+	link, err := driver.GetContent(ctx, blobLinkPath(repository, dgst))
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return fmt.Errorf("blob %s of %s: %w", dgst, repository, distribution.ErrBlobUnknown)
+		}
+		return err
+	}
+	if linked, err := digest.Parse(string(link)); err != nil || linked != dgst {
+		return fmt.Errorf("blob %s of %s: invalid link %q: %w", dgst, repository, link, distribution.ErrBlobUnknown)
+	}
+	return nil
+}
+
+// blobDataPath returns the storage path of the data of the blob dgst.
+func blobDataPath(dgst digest.Digest) string {
+	return path.Join(blobsRoot, dgst.Algorithm().String(), dgst.Encoded()[:2], dgst.Encoded(), "data")
+}
+
+// blobLinkPath returns the storage path of the link of repository to the blob dgst.
+func blobLinkPath(repository string, dgst digest.Digest) string {
+	return path.Join(repositoriesRoot, repository, "_layers", dgst.Algorithm().String(), dgst.Encoded(), "link")
+}
+
+// driverCopier copies data between the storage drivers of two local storages. The data is written to an upload
+// of the repository it is copied for, and moved into place once complete; PurgeUploads removes interrupted copies.
+type driverCopier struct {
+	src, dst   storagedriver.StorageDriver
+	uploadsDir string
+}
+
+func (d *driverCopier) copyBlob(ctx context.Context, srcPath, dstPath string, size int64) error {
+	tmpDir := path.Join(d.uploadsDir, uuid.Generate().String())
+	tmpPath := path.Join(tmpDir, "data")
+	defer func() {
+		if err := d.dst.Delete(ctx, tmpDir); err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+				dcontext.GetLogger(ctx).Errorf("error removing %s: %v", tmpDir, err)
+			}
+		}
+	}()
+
+	if err := d.dst.PutContent(ctx, path.Join(tmpDir, "startedat"), []byte(time.Now().UTC().Format(time.RFC3339))); err != nil {
+		return err
+	}
+	r, err := d.src.Reader(ctx, srcPath, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := d.dst.Writer(ctx, tmpPath, false)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(w, r)
+	if err == nil && n != size {
+		err = fmt.Errorf("copied %d bytes of %s, expected %d", n, srcPath, size)
+	}
+	if err != nil {
+		_ = w.Cancel(ctx)
+		return err
+	}
+	if err := w.Commit(); err != nil {
+		_ = w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return d.dst.Move(ctx, tmpPath, dstPath)
+}
+
+func (d *driverCopier) close() error {
+	return nil
+}
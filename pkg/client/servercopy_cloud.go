@@ -0,0 +1,400 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/distribution/distribution/v3/configuration"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	azuredriver "github.com/distribution/distribution/v3/registry/storage/driver/azure"
+	"google.golang.org/api/option"
+)
+
+const (
+	// s3MaxCopyObjectSize is the largest object S3 copies with a single CopyObject request.
+	s3MaxCopyObjectSize = 5 << 30
+	// s3CopyPartSize is the size of the parts of larger objects, copied with a multipart upload.
+	s3CopyPartSize = 512 << 20
+	// azureCopyURLExpiry is how long the signed URL Azure copies a blob from is valid.
+	azureCopyURLExpiry = time.Hour
+	// azureCopyPollInterval is how often the status of an Azure blob copy is checked.
+	azureCopyPollInterval = time.Second
+)
+
+// stringParameter returns the storage parameter name, or "" if it is not set.
+func stringParameter(params configuration.Parameters, name string) string {
+	if v, ok := params[name]; ok && v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// boolParameter returns the boolean storage parameter name, or def if it is not set.
+func boolParameter(params configuration.Parameters, name string, def bool) (bool, error) {
+	switch v := params[name].(type) {
+	case nil:
+		return def, nil
+	case bool:
+		return v, nil
+	case string:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, fmt.Errorf("the %s parameter should be a boolean", name)
+		}
+		return b, nil
+	default:
+		return false, fmt.Errorf("the %s parameter should be a boolean", name)
+	}
+}
+
+// s3Copier copies objects between S3 buckets with CopyObject, using the credentials of the destination.
+type s3Copier struct {
+	s3                 *s3.S3
+	srcBucket, srcRoot string
+	dstBucket, dstRoot string
+	// Object settings of the destination, as its storage driver writes objects.
+	encrypt      bool
+	keyID        string
+	storageClass string
+	objectACL    string
+}
+
+// newS3Copier returns a copier between the S3 storages configured by srcParams and dstParams,
+// which must be served by the same endpoint.
+func newS3Copier(srcParams, dstParams configuration.Parameters) (*s3Copier, error) {
+	if stringParameter(srcParams, "regionendpoint") != stringParameter(dstParams, "regionendpoint") {
+		return nil, fmt.Errorf("copying between S3 endpoints: %w", ErrServerSideCopyUnsupported)
+	}
+	if v4auth, err := boolParameter(dstParams, "v4auth", true); err != nil || !v4auth {
+		return nil, fmt.Errorf("copying with S3 signature v2: %w", ErrServerSideCopyUnsupported)
+	}
+	client, err := newS3Client(dstParams)
+	if err != nil {
+		return nil, err
+	}
+	encrypt, err := boolParameter(dstParams, "encrypt", false)
+	if err != nil {
+		return nil, err
+	}
+	c := &s3Copier{
+		s3:           client,
+		srcBucket:    stringParameter(srcParams, "bucket"),
+		srcRoot:      stringParameter(srcParams, "rootdirectory"),
+		dstBucket:    stringParameter(dstParams, "bucket"),
+		dstRoot:      stringParameter(dstParams, "rootdirectory"),
+		encrypt:      encrypt,
+		keyID:        stringParameter(dstParams, "keyid"),
+		storageClass: stringParameter(dstParams, "storageclass"),
+		objectACL:    stringParameter(dstParams, "objectacl"),
+	}
+	if c.storageClass == "" {
+		c.storageClass = s3.StorageClassStandard
+	}
+	if c.objectACL == "" {
+		c.objectACL = s3.ObjectCannedACLPrivate
+	}
+	return c, nil
+}
+
+// newS3Client returns an S3 client configured like the S3 storage driver for params.
+func newS3Client(params configuration.Parameters) (*s3.S3, error) {
+	region := stringParameter(params, "region")
+	if region == "" {
+		return nil, fmt.Errorf("no region parameter provided")
+	}
+	awsConfig := aws.NewConfig().WithRegion(region)
+	if accessKey, secretKey := stringParameter(params, "accesskey"), stringParameter(params, "secretkey"); accessKey != "" && secretKey != "" {
+		awsConfig.WithCredentials(credentials.NewStaticCredentials(accessKey, secretKey, stringParameter(params, "sessiontoken")))
+	}
+	if endpoint := stringParameter(params, "regionendpoint"); endpoint != "" {
+		forcePathStyle, err := boolParameter(params, "forcepathstyle", true)
+		if err != nil {
+			return nil, err
+		}
+		awsConfig.WithEndpoint(endpoint).WithS3ForcePathStyle(forcePathStyle)
+	}
+	secure, err := boolParameter(params, "secure", true)
+	if err != nil {
+		return nil, err
+	}
+	awsConfig.WithDisableSSL(!secure)
+	skipVerify, err := boolParameter(params, "skipverify", false)
+	if err != nil {
+		return nil, err
+	}
+	if skipVerify {
+		httpTransport := http.DefaultTransport.(*http.Transport).Clone()
+		httpTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		awsConfig.WithHTTPClient(&http.Client{Transport: httpTransport})
+	}
+
+	sessionOptions := session.Options{Config: *awsConfig}
+	if configPath := stringParameter(params, "credentialsconfigpath"); configPath != "" {
+		sessionOptions.SharedConfigState = session.SharedConfigEnable
+		sessionOptions.SharedConfigFiles = []string{configPath}
+	}
+	sess, err := session.NewSessionWithOptions(sessionOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new session with aws config: %w", err)
+	}
+	return s3.New(sess), nil
+}
+
+// s3Key returns the key of the storage path p under rootDirectory, as the S3 storage driver does.
+func s3Key(rootDirectory, p string) string {
+	return strings.TrimLeft(strings.TrimRight(rootDirectory, "/")+p, "/")
+}
+
+func (c *s3Copier) copyBlob(ctx context.Context, srcPath, dstPath string, size int64) error {
+	copySource := aws.String(c.srcBucket + "/" + s3Key(c.srcRoot, srcPath))
+	key := aws.String(s3Key(c.dstRoot, dstPath))
+	var encryption *string
+	if c.encrypt {
+		encryption = aws.String("AES256")
+		if c.keyID != "" {
+			encryption = aws.String("aws:kms")
+		}
+	}
+	var keyID, storageClass *string
+	if c.keyID != "" {
+		keyID = aws.String(c.keyID)
+	}
+	if c.storageClass != "NONE" {
+		storageClass = aws.String(c.storageClass)
+	}
+
+	if size <= s3MaxCopyObjectSize {
+		_, err := c.s3.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+			Bucket:               aws.String(c.dstBucket),
+			Key:                  key,
+			CopySource:           copySource,
+			ContentType:          aws.String("application/octet-stream"),
+			ACL:                  aws.String(c.objectACL),
+			ServerSideEncryption: encryption,
+			SSEKMSKeyId:          keyID,
+			StorageClass:         storageClass,
+		})
+		return err
+	}
+
+	upload, err := c.s3.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(c.dstBucket),
+		Key:                  key,
+		ContentType:          aws.String("application/octet-stream"),
+		ACL:                  aws.String(c.objectACL),
+		ServerSideEncryption: encryption,
+		SSEKMSKeyId:          keyID,
+		StorageClass:         storageClass,
+	})
+	if err != nil {
+		return err
+	}
+	parts := []*s3.CompletedPart{}
+	for offset := int64(0); offset < size; offset += s3CopyPartSize {
+		end := min(offset+s3CopyPartSize, size) - 1
+		part, err := c.s3.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(c.dstBucket),
+			Key:             key,
+			CopySource:      copySource,
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+			PartNumber:      aws.Int64(int64(len(parts) + 1)),
+			UploadId:        upload.UploadId,
+		})
+		if err != nil {
+			_, _ = c.s3.AbortMultipartUploadWithContext(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(c.dstBucket),
+				Key:      key,
+				UploadId: upload.UploadId,
+			})
+			return err
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: part.CopyPartResult.ETag, PartNumber: aws.Int64(int64(len(parts) + 1))})
+	}
+	_, err = c.s3.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(c.dstBucket),
+		Key:             key,
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+func (c *s3Copier) close() error {
+	return nil
+}
+
+// gcsCopier copies objects between GCS buckets with rewrites, using the credentials of the destination.
+type gcsCopier struct {
+	client             *storage.Client
+	srcBucket, srcRoot string
+	dstBucket, dstRoot string
+}
+
+// newGCSCopier returns a copier between the GCS storages configured by srcParams and dstParams.
+func newGCSCopier(ctx context.Context, srcParams, dstParams configuration.Parameters) (*gcsCopier, error) {
+	opts := []option.ClientOption{}
+	if keyfile := stringParameter(dstParams, "keyfile"); keyfile != "" {
+		opts = append(opts, option.WithCredentialsFile(keyfile))
+	} else if creds, ok := dstParams["credentials"]; ok {
+		credentialMap := map[string]interface{}{}
+		switch creds := creds.(type) {
+		case map[interface{}]interface{}:
+			for k, v := range creds {
+				credentialMap[fmt.Sprint(k)] = v
+			}
+		case map[string]interface{}:
+			credentialMap = creds
+		default:
+			return nil, fmt.Errorf("the credentials were not specified in the correct format")
+		}
+		data, err := json.Marshal(credentialMap)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal gcs credentials to json: %w", err)
+		}
+		opts = append(opts, option.WithCredentialsJSON(data))
+	}
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &gcsCopier{
+		client:    client,
+		srcBucket: stringParameter(srcParams, "bucket"),
+		srcRoot:   stringParameter(srcParams, "rootdirectory"),
+		dstBucket: stringParameter(dstParams, "bucket"),
+		dstRoot:   stringParameter(dstParams, "rootdirectory"),
+	}, nil
+}
+
+// gcsKey returns the key of the storage path p under rootDirectory, as the GCS storage driver does.
+func gcsKey(rootDirectory, p string) string {
+	if rootDirectory = strings.Trim(rootDirectory, "/"); rootDirectory != "" {
+		rootDirectory += "/"
+	}
+	return strings.TrimSpace(strings.TrimRight(rootDirectory+strings.TrimLeft(p, "/"), "/"))
+}
+
+func (c *gcsCopier) copyBlob(ctx context.Context, srcPath, dstPath string, size int64) error {
+	src := c.client.Bucket(c.srcBucket).Object(gcsKey(c.srcRoot, srcPath))
+	copier := c.client.Bucket(c.dstBucket).Object(gcsKey(c.dstRoot, dstPath)).CopierFrom(src)
+	copier.ContentType = "application/octet-stream"
+	_, err := copier.Run(ctx)
+	return err
+}
+
+func (c *gcsCopier) close() error {
+	return c.client.Close()
+}
+
+// azureCopier copies blobs between Azure containers from URLs signed by the source storage driver.
+type azureCopier struct {
+	src       storagedriver.StorageDriver
+	container *container.Client
+	dstRoot   string
+}
+
+// newAzureCopier returns a copier from the Azure storage of src to the Azure storage configured by dstParams.
+func newAzureCopier(src storagedriver.StorageDriver, dstParams configuration.Parameters) (*azureCopier, error) {
+	params, err := azuredriver.NewParameters(dstParams)
+	if err != nil {
+		return nil, err
+	}
+	var client *azblob.Client
+	switch {
+	case params.AccountKey != "":
+		cred, err := azblob.NewSharedKeyCredential(params.AccountName, params.AccountKey)
+		if err != nil {
+			return nil, err
+		}
+		client, err = azblob.NewClientWithSharedKeyCredential(params.ServiceURL, cred, nil)
+		if err != nil {
+			return nil, err
+		}
+	case params.Credentials.Type == "client_secret":
+		creds := params.Credentials
+		cred, err := azidentity.NewClientSecretCredential(creds.TenantID, creds.ClientID, creds.Secret, nil)
+		if err != nil {
+			return nil, err
+		}
+		client, err = azblob.NewClient(params.ServiceURL, cred, nil)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		cred, err := azidentity.NewDefaultAzureCredential(nil)
+		if err != nil {
+			return nil, err
+		}
+		client, err = azblob.NewClient(params.ServiceURL, cred, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &azureCopier{
+		src:       src,
+		container: client.ServiceClient().NewContainerClient(params.Container),
+		dstRoot:   params.RootDirectory,
+	}, nil
+}
+
+// azureBlobName returns the name of the blob of the storage path p under rootDirectory, as the Azure storage driver does.
+func azureBlobName(rootDirectory, p string) string {
+	return strings.TrimRight(rootDirectory, "/") + "/" + strings.TrimLeft(p, "/")
+}
+
+func (c *azureCopier) copyBlob(ctx context.Context, srcPath, dstPath string, size int64) error {
+	srcURL, err := c.src.URLFor(ctx, srcPath, map[string]interface{}{"expiry": time.Now().UTC().Add(azureCopyURLExpiry)})
+	if err != nil {
+		return err
+	}
+	dst := c.container.NewBlobClient(azureBlobName(c.dstRoot, dstPath))
+	started, err := dst.StartCopyFromURL(ctx, srcURL, nil)
+	if err != nil {
+		return err
+	}
+	status, description := started.CopyStatus, (*string)(nil)
+	ticker := time.NewTicker(azureCopyPollInterval)
+	defer ticker.Stop()
+	for status != nil && *status == blob.CopyStatusTypePending {
+		select {
+		case <-ctx.Done():
+			if started.CopyID != nil {
+				_, _ = dst.AbortCopyFromURL(context.WithoutCancel(ctx), *started.CopyID, nil)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		props, err := dst.GetProperties(ctx, nil)
+		if err != nil {
+			return err
+		}
+		status, description = props.CopyStatus, props.CopyStatusDescription
+	}
+	if status != nil && *status != blob.CopyStatusTypeSuccess {
+		reason := ""
+		if description != nil {
+			reason = ": " + *description
+		}
+		return fmt.Errorf("azure blob copy %s%s", *status, reason)
+	}
+	return nil
+}
+
+func (c *azureCopier) close() error {
+	return nil
+}
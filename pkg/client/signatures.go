@@ -0,0 +1,204 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	gorillahandlers "github.com/gorilla/handlers"
+	"github.com/opencontainers/go-digest"
+)
+
+// SignaturesExtensionPath is the route of the X-Registry-Supports-Signatures API extension served by the in-process registry.
+var SignaturesExtensionPath = "/extensions/v2/{name:" + reference.NameRegexp.String() + "}/signatures/{digest:" + digest.DigestRegexp.String() + "}"
+
+const (
+	signaturesExtensionRouteName = "extension-signatures"
+	signaturesExtensionHeader    = "X-Registry-Supports-Signatures"
+
+	// maxSignatureBodySize is the largest signature upload accepted.
+	maxSignatureBodySize = 4 * 1024 * 1024
+	// signatureSchemaVersion and signatureTypeAtomic are the only supported signature.Version and signature.Type.
+	signatureSchemaVersion = 2
+	signatureTypeAtomic    = "atomic"
+)
+
+// signatureNameSuffixRegexp matches the part of a signature name following "<manifest digest>@".
+var signatureNameSuffixRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// signature and signatureList are the representation of signatures used by the API extension,
+// see github.com/openshift/origin/pkg/dockerregistry/server/signaturedispatcher.go
+type signature struct {
+	Version int    `json:"schemaVersion"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Content []byte `json:"content"`
+}
+
+type signatureList struct {
+	Signatures []signature `json:"signatures"`
+}
+
+// WithoutSignaturesExtension stops the in-process registry from serving and advertising the X-Registry-Supports-Signatures
+// API extension, which otherwise stores signatures next to the manifest revisions. While the extension is advertised, the
+// udistribution transport reads and writes signatures through it instead of a lookaside location configured in registries.d;
+// disabling it keeps using the lookaside.
+func WithoutSignaturesExtension() ClientOption {
+	return func(c *Client) {
+		c.noSignaturesExtension = true
+	}
+}
+
+// configureSignaturesExtension makes the registry advertise the signatures API extension.
+func configureSignaturesExtension(config *configuration.Configuration) {
+	if config.HTTP.Headers == nil {
+		config.HTTP.Headers = http.Header{}
+	}
+	config.HTTP.Headers.Set(signaturesExtensionHeader, "1")
+}
+
+// registerSignaturesExtension serves the signatures API extension from c's storage.
+func (c *Client) registerSignaturesExtension() {
+	c.app.RegisterRoute(signaturesExtensionRouteName, c.app.NewRoute().Path(SignaturesExtensionPath), c.signaturesDispatcher, handlers.NameRequired, handlers.NoCustomAccessRecords)
+}
+
+// signaturesDirectory returns the storage path of signatures of manifest dgst in repository name,
+// next to the manifest revision, see https://github.com/distribution/distribution/blob/main/registry/storage/paths.go
+func signaturesDirectory(name string, dgst digest.Digest) string {
+	return path.Join(repositoriesRoot, name, "_manifests/revisions", dgst.Algorithm().String(), dgst.Encoded(), "signatures")
+}
+
+// signaturesHandler handles the signatures of a single manifest.
+type signaturesHandler struct {
+	*handlers.Context
+	client *Client
+	digest digest.Digest
+	dir    string
+}
+
+func (c *Client) signaturesDispatcher(ctx *handlers.Context, r *http.Request) http.Handler {
+	dgst, err := digest.Parse(dcontext.GetStringValue(ctx, "vars.digest"))
+	if err != nil {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx.Errors = append(ctx.Errors, v2.ErrorCodeDigestInvalid.WithDetail(err))
+		})
+	}
+	h := &signaturesHandler{
+		Context: ctx,
+		client:  c,
+		digest:  dgst,
+		dir:     signaturesDirectory(ctx.Repository.Named().Name(), dgst),
+	}
+	return gorillahandlers.MethodHandler{
+		http.MethodGet: http.HandlerFunc(h.GetSignatures),
+		http.MethodPut: http.HandlerFunc(h.PutSignature),
+	}
+}
+
+// manifestExists checks that the manifest exists in driver, recording an error if it doesn't. It reads the storage
+// rather than the repository, whose middlewares would see reads of the manifest as pulls.
+func (h *signaturesHandler) manifestExists(driver storagedriver.StorageDriver) bool {
+	if _, err := driver.Stat(h, manifestRevisionLinkPath(h.Repository.Named().Name(), h.digest)); err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			h.Errors = append(h.Errors, v2.ErrorCodeManifestUnknown.WithDetail(h.digest))
+		} else {
+			h.Errors = append(h.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		}
+		return false
+	}
+	return true
+}
+
+// GetSignatures returns all signatures of the manifest.
+func (h *signaturesHandler) GetSignatures(w http.ResponseWriter, r *http.Request) {
+	driver, err := h.client.StorageDriver()
+	if err != nil {
+		h.Errors = append(h.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	if !h.manifestExists(driver) {
+		return
+	}
+	list := signatureList{Signatures: []signature{}}
+	files, err := driver.List(h, h.dir)
+	if _, ok := err.(storagedriver.PathNotFoundError); !ok && err != nil {
+		h.Errors = append(h.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	for _, file := range files {
+		content, err := driver.GetContent(h, file)
+		if err != nil {
+			h.Errors = append(h.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		}
+		var sig signature
+		if err := json.Unmarshal(content, &sig); err != nil {
+			h.Errors = append(h.Errors, errcode.ErrorCodeUnknown.WithDetail(fmt.Errorf("invalid signature %s: %w", file, err)))
+			return
+		}
+		list.Signatures = append(list.Signatures, sig)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		h.Errors = append(h.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+	}
+}
+
+// PutSignature stores a new signature of the manifest.
+func (h *signaturesHandler) PutSignature(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignatureBodySize+1))
+	if err != nil {
+		h.Errors = append(h.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	if len(body) > maxSignatureBodySize {
+		h.Errors = append(h.Errors, v2.ErrorCodeSizeInvalid.WithDetail(fmt.Sprintf("signature exceeds %d bytes", maxSignatureBodySize)))
+		return
+	}
+	var sig signature
+	if err := json.Unmarshal(body, &sig); err != nil {
+		h.Errors = append(h.Errors, errcode.ErrorCodeUnsupported.WithDetail(fmt.Sprintf("invalid signature: %v", err)))
+		return
+	}
+	if sig.Type == "" {
+		sig.Type = signatureTypeAtomic
+	}
+	if sig.Version != signatureSchemaVersion || sig.Type != signatureTypeAtomic {
+		h.Errors = append(h.Errors, errcode.ErrorCodeUnsupported.WithDetail(fmt.Sprintf("unsupported signature schema version %d, type %q", sig.Version, sig.Type)))
+		return
+	}
+	suffix, ok := strings.CutPrefix(sig.Name, h.digest.String()+"@")
+	if !ok || !signatureNameSuffixRegexp.MatchString(suffix) {
+		h.Errors = append(h.Errors, errcode.ErrorCodeUnsupported.WithDetail(fmt.Sprintf("invalid signature name %q", sig.Name)))
+		return
+	}
+	driver, err := h.client.StorageDriver()
+	if err != nil {
+		h.Errors = append(h.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	if !h.manifestExists(driver) {
+		return
+	}
+	content, err := json.Marshal(sig)
+	if err != nil {
+		h.Errors = append(h.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	if err := driver.PutContent(h, path.Join(h.dir, suffix), content); err != nil {
+		h.Errors = append(h.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"runtime"
+
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/distribution/distribution/v3/configuration"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	"github.com/distribution/distribution/v3/version"
+)
+
+// ErrStorageUnreachable is returned when the storage backend of a client can not be accessed.
+type ErrStorageUnreachable struct {
+	Driver string
+	Err    error
+}
+
+func (e ErrStorageUnreachable) Error() string {
+	return fmt.Sprintf("%s storage is unreachable: %v", e.Driver, e.Err)
+}
+
+func (e ErrStorageUnreachable) Unwrap() error {
+	return e.Err
+}
+
+// ErrBucketMissing is returned when the bucket configured for the storage backend of a client does not exist.
+type ErrBucketMissing struct {
+	Driver string
+	Bucket string
+	Err    error
+}
+
+func (e ErrBucketMissing) Error() string {
+	return fmt.Sprintf("%s bucket %q does not exist: %v", e.Driver, e.Bucket, e.Err)
+}
+
+func (e ErrBucketMissing) Unwrap() error {
+	return e.Err
+}
+
+// StorageDriver returns a storage driver for the client's storage configuration, for direct access to the stored data.
+// The driver is created on first use, and is separate from the one used by the registry App.
+func (c *Client) StorageDriver() (storagedriver.StorageDriver, error) {
+	c.driverOnce.Do(func() {
+		// initialize driver factory like https://github.com/distribution/distribution/blob/1d33874951b749df7e070b1c702ea418bbc57ed1/registry/root.go#L55
+		storageParams := configuration.Parameters{}
+		for k, v := range c.config.Storage.Parameters() {
+			storageParams[k] = v
+		}
+		storageParams["useragent"] = fmt.Sprintf("docker-distribution/%s %s", version.Version, runtime.Version())
+		c.driver, c.driverErr = factory.Create(c.config.Storage.Type(), storageParams)
+		if c.driverErr != nil {
+			c.driverErr = fmt.Errorf("failed to construct %s driver: %w", c.config.Storage.Type(), c.driverErr)
+		}
+	})
+	return c.driver, c.driverErr
+}
+
+// storageCredentialParameters are the storage parameters which only authenticate the client, and are left out of StorageIdentity.
+var storageCredentialParameters = map[string]bool{
+	"accesskey":             true,
+	"secretkey":             true,
+	"sessiontoken":          true,
+	"credentialsconfigpath": true,
+	"accountkey":            true,
+	"connectionstring":      true,
+	"credentials":           true,
+	"keyfile":               true,
+	"password":              true,
+	"useragent":             true,
+}
+
+// StorageIdentity returns an identifier of the storage the client stores data in, derived from the storage type and
+// parameters but not from credentials: clients configured for the same storage location share it, even across processes.
+func (c *Client) StorageIdentity() string {
+	params := map[string]interface{}{}
+	for k, v := range c.config.Storage.Parameters() {
+		if !storageCredentialParameters[k] {
+			params[k] = v
+		}
+	}
+	// fmt prints maps sorted by key.
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s %v", c.config.Storage.Type(), params)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// CheckStorage checks that the client's storage backend can be accessed, the same way the registry storage health check does.
+// It returns ErrBucketMissing if the configured bucket does not exist, and ErrStorageUnreachable on any other failure.
+func (c *Client) CheckStorage(ctx context.Context) error {
+	driverName := c.config.Storage.Type()
+	d, err := c.StorageDriver()
+	if err != nil {
+		return ErrStorageUnreachable{Driver: driverName, Err: err}
+	}
+	_, err = d.Stat(ctx, "/") // "/" should always exist
+	if _, ok := err.(storagedriver.PathNotFoundError); ok || err == nil {
+		return nil // the backend is responding, even if this path doesn't exist.
+	}
+	if isBucketMissing(err) {
+		bucket, _ := c.config.Storage.Parameters()["bucket"].(string)
+		if driverName == "azure" {
+			bucket, _ = c.config.Storage.Parameters()["container"].(string)
+		}
+		return ErrBucketMissing{Driver: driverName, Bucket: bucket, Err: err}
+	}
+	return ErrStorageUnreachable{Driver: driverName, Err: err}
+}
+
+// isBucketMissing returns true if err, returned by a storage driver, reports that its bucket does not exist.
+func isBucketMissing(err error) bool {
+	if driverErr, ok := err.(storagedriver.Error); ok {
+		err = driverErr.Enclosed
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == "NoSuchBucket" {
+		return true
+	}
+	if bloberror.HasCode(err, bloberror.ContainerNotFound) {
+		return true
+	}
+	return errors.Is(err, storage.ErrBucketNotExist)
+}
@@ -0,0 +1,270 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/auth/token"
+	"github.com/docker/libtrust"
+)
+
+const (
+	// TokenRealmPath is the path of the token realm served by the in-process token issuer.
+	TokenRealmPath = "/udistribution/token"
+	// TokenRealm is the realm announced by the in-process registry when a token issuer is configured.
+	// Its host is recognized by the udistribution transport as served in-process.
+	TokenRealm = "http://127.0.0.1" + TokenRealmPath
+
+	defaultTokenService    = "udistribution"
+	defaultTokenIssuer     = "udistribution-token-issuer"
+	defaultTokenExpiration = 5 * time.Minute
+)
+
+// TokenRequest is a request for a bearer token received by the in-process token issuer.
+type TokenRequest struct {
+	// Username and Password are the basic auth credentials of the request, if any.
+	Username string
+	Password string
+	// Account is the account requested by the client, usually the same as Username.
+	Account string
+	// Service is the service the token is requested for.
+	Service string
+	// Requested is the access requested by the client.
+	Requested []auth.Access
+}
+
+// TokenGrantFunc authenticates a token request, and returns the access to grant, which is usually a subset of req.Requested.
+// An error rejects the request, and is reported to the client as unauthorized.
+type TokenGrantFunc func(ctx context.Context, req TokenRequest) ([]auth.Access, error)
+
+// TokenIssuerOptions configures the in-process token issuer.
+type TokenIssuerOptions struct {
+	// Grant decides which access is granted to a token request. It must be set.
+	Grant TokenGrantFunc
+	// Key signs the issued tokens; it must be an *ecdsa.PrivateKey or *rsa.PrivateKey.
+	// If nil, a new ECDSA P-256 key is generated.
+	// If the auth.token section of the configuration sets rootcertbundle, it must contain a certificate for this key;
+	// otherwise, a self-signed certificate for the key is trusted.
+	Key crypto.PrivateKey
+	// Expiration is how long issued tokens are valid, 5 minutes if 0.
+	Expiration time.Duration
+}
+
+// WithTokenIssuer makes the client issue bearer tokens for its in-process registry, configuring the registry
+// to use token authentication if the configuration does not.
+// The realm of the token access controller is replaced by TokenRealm, which is served by the in-process registry.
+func WithTokenIssuer(opts TokenIssuerOptions) ClientOption {
+	return func(c *Client) {
+		c.tokenIssuerOptions = &opts
+	}
+}
+
+// tokenIssuer mints tokens accepted by the token access controller of the in-process registry.
+type tokenIssuer struct {
+	key        libtrust.PrivateKey
+	alg        string // JWS algorithm of signatures made by key
+	service    string
+	issuer     string
+	expiration time.Duration
+	grant      TokenGrantFunc
+}
+
+// configureTokenIssuer sets up the auth.token section of config for a token issuer using opts, and returns the issuer.
+// The returned cleanup function must be called once the access controller has been created.
+func configureTokenIssuer(config *configuration.Configuration, opts TokenIssuerOptions) (*tokenIssuer, func(), error) {
+	noop := func() {}
+	if opts.Grant == nil {
+		return nil, noop, fmt.Errorf("token issuer requires a Grant function")
+	}
+	if authType := config.Auth.Type(); authType != "" && authType != "token" && authType != "none" {
+		return nil, noop, fmt.Errorf("token issuer can not be used with %s auth", authType)
+	}
+	params := configuration.Parameters{}
+	for k, v := range config.Auth["token"] {
+		params[k] = v
+	}
+
+	issuer := &tokenIssuer{
+		service:    defaultTokenService,
+		issuer:     defaultTokenIssuer,
+		expiration: opts.Expiration,
+		grant:      opts.Grant,
+	}
+	if service, ok := params["service"].(string); ok && service != "" {
+		issuer.service = service
+	}
+	if iss, ok := params["issuer"].(string); ok && iss != "" {
+		issuer.issuer = iss
+	}
+	if issuer.expiration == 0 {
+		issuer.expiration = defaultTokenExpiration
+	}
+	var err error
+	if opts.Key != nil {
+		issuer.key, err = libtrust.FromCryptoPrivateKey(opts.Key)
+	} else {
+		issuer.key, err = libtrust.GenerateECP256PrivateKey()
+	}
+	if err != nil {
+		return nil, noop, fmt.Errorf("token issuer key: %w", err)
+	}
+	// The signing algorithm is determined by the key, but must be in the token header before signing.
+	if _, issuer.alg, err = issuer.key.Sign(bytes.NewReader(nil), crypto.SHA256); err != nil {
+		return nil, noop, fmt.Errorf("token issuer key: %w", err)
+	}
+
+	cleanup := noop
+	if bundle, ok := params["rootcertbundle"].(string); !ok || bundle == "" {
+		// The token access controller only reads certificates from a file, when it is created.
+		cert, err := libtrust.GenerateSelfSignedClientCert(issuer.key)
+		if err != nil {
+			return nil, noop, fmt.Errorf("generating token issuer certificate: %w", err)
+		}
+		f, err := os.CreateTemp("", "udistribution-token-*.pem")
+		if err != nil {
+			return nil, noop, err
+		}
+		cleanup = func() { os.Remove(f.Name()) }
+		err = pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			cleanup()
+			return nil, noop, err
+		}
+		params["rootcertbundle"] = f.Name()
+	}
+	params["realm"] = TokenRealm
+	params["service"] = issuer.service
+	params["issuer"] = issuer.issuer
+	config.Auth = configuration.Auth{"token": params}
+	return issuer, cleanup, nil
+}
+
+// ServeHTTP implements the token endpoint of the docker token authentication specification,
+// see https://distribution.github.io/distribution/spec/auth/token/
+func (ti *tokenIssuer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req := TokenRequest{
+		Account: query.Get("account"),
+		Service: query.Get("service"),
+	}
+	req.Username, req.Password, _ = r.BasicAuth()
+	for _, scopes := range query["scope"] {
+		for _, scope := range strings.Fields(scopes) {
+			req.Requested = append(req.Requested, parseScope(scope)...)
+		}
+	}
+	if req.Service != "" && req.Service != ti.service {
+		_ = errcode.ServeJSON(w, errcode.ErrorCodeUnauthorized.WithMessage(fmt.Sprintf("unknown service %q", req.Service)))
+		return
+	}
+
+	granted, err := ti.grant(r.Context(), req)
+	if err != nil {
+		_ = errcode.ServeJSON(w, errcode.ErrorCodeUnauthorized.WithDetail(err.Error()))
+		return
+	}
+	subject := req.Username
+	if subject == "" {
+		subject = req.Account
+	}
+	now := time.Now()
+	rawToken, err := ti.mint(subject, granted, now)
+	if err != nil {
+		_ = errcode.ServeJSON(w, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":        rawToken,
+		"access_token": rawToken,
+		"expires_in":   int(ti.expiration.Seconds()),
+		"issued_at":    now.UTC().Format(time.RFC3339),
+	})
+}
+
+// mint returns a signed token for subject, granting access.
+func (ti *tokenIssuer) mint(subject string, access []auth.Access, now time.Time) (string, error) {
+	actions := map[auth.Resource]*token.ResourceActions{}
+	resources := []*token.ResourceActions{}
+	for _, a := range access {
+		ra, ok := actions[a.Resource]
+		if !ok {
+			ra = &token.ResourceActions{Type: a.Type, Class: a.Class, Name: a.Name, Actions: []string{}}
+			actions[a.Resource] = ra
+			resources = append(resources, ra)
+		}
+		ra.Actions = append(ra.Actions, a.Action)
+	}
+	var jti [16]byte
+	if _, err := rand.Read(jti[:]); err != nil {
+		return "", err
+	}
+	claims := token.ClaimSet{
+		Issuer:     ti.issuer,
+		Subject:    subject,
+		Audience:   token.AudienceList{ti.service},
+		Expiration: now.Add(ti.expiration).Unix(),
+		NotBefore:  now.Unix(),
+		IssuedAt:   now.Unix(),
+		JWTID:      base64.RawURLEncoding.EncodeToString(jti[:]),
+		Access:     resources,
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	headerJSON, err := json.Marshal(token.Header{Type: "JWT", SigningAlg: ti.alg, KeyID: ti.key.KeyID()})
+	if err != nil {
+		return "", err
+	}
+	payload := joseBase64URLEncode(headerJSON) + token.TokenSeparator + joseBase64URLEncode(claimsJSON)
+	signature, _, err := ti.key.Sign(strings.NewReader(payload), crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return payload + token.TokenSeparator + joseBase64URLEncode(signature), nil
+}
+
+// parseScope parses a scope of a token request, e.g. "repository:foo/bar:pull,push".
+func parseScope(scope string) []auth.Access {
+	typ, rest, ok := strings.Cut(scope, ":")
+	if !ok {
+		return nil
+	}
+	i := strings.LastIndex(rest, ":")
+	if i == -1 {
+		return nil
+	}
+	resource := auth.Resource{Type: typ, Name: rest[:i]}
+	if t, class, ok := strings.Cut(typ, "("); ok && strings.HasSuffix(class, ")") {
+		resource.Type, resource.Class = t, strings.TrimSuffix(class, ")")
+	}
+	access := []auth.Access{}
+	for _, action := range strings.Split(rest[i+1:], ",") {
+		if action != "" {
+			access = append(access, auth.Access{Resource: resource, Action: action})
+		}
+	}
+	return access
+}
+
+// joseBase64URLEncode encodes b using the unpadded base64url encoding used by JWTs.
+func joseBase64URLEncode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,42 @@
+package client_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/client"
+	"github.com/migtools/udistribution/pkg/image/udistribution"
+	"github.com/migtools/udistribution/pkg/internal/testing/clienttest"
+	"github.com/stretchr/testify/require"
+)
+
+// newFilesystemTestTransport returns a registered transport to a client with extraEnv and opts, storing data in a new
+// temporary directory, which is also returned.
+func newFilesystemTestTransport(t *testing.T, extraEnv []string, opts ...client.ClientOption) (*udistribution.UdistributionTransport, string) {
+	c, dir := clienttest.NewFilesystemClient(t, extraEnv, opts...)
+	ut := udistribution.NewTransport(c, "filesystem")
+	t.Cleanup(ut.Deregister)
+	return ut, dir
+}
+
+// assertImageIn asserts that the config and layers of the image refString of ut can be read.
+func assertImageIn(t *testing.T, ut *udistribution.UdistributionTransport, refString string) {
+	ctx := context.Background()
+	ref, err := ut.ParseReference(refString)
+	require.NoError(t, err)
+	img, err := ref.NewImage(ctx, &types.SystemContext{})
+	require.NoError(t, err)
+	defer img.Close()
+	src, err := ref.NewImageSource(ctx, &types.SystemContext{})
+	require.NoError(t, err)
+	defer src.Close()
+	for _, layer := range img.LayerInfos() {
+		rc, _, err := src.GetBlob(ctx, layer, none.NoCache)
+		require.NoError(t, err)
+		rc.Close()
+	}
+	_, err = img.ConfigBlob(ctx)
+	require.NoError(t, err)
+}
@@ -0,0 +1,137 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// repositoriesRoot is the storage path of the repositories of the registry.
+const repositoriesRoot = "/docker/registry/v2/repositories"
+
+// StaleUpload is an unfinished blob upload found by PurgeUploads.
+type StaleUpload struct {
+	// Repository is the repository the blob was uploaded to, e.g. "ns/repo".
+	Repository string
+	UUID       string
+	StartedAt  time.Time
+	// Size is the number of bytes of uploaded data.
+	Size int64
+	// Path is the storage path of the upload directory.
+	Path string
+}
+
+// PurgeUploads finds blob uploads started more than olderThan ago and never completed or cancelled, and removes
+// their data from the storage unless dryRun is set. The default configuration disables the registry's own upload purging.
+// It returns the stale uploads found, and all errors encountered; uploads which could not be removed are not returned.
+func (c *Client) PurgeUploads(ctx context.Context, olderThan time.Duration, dryRun bool) ([]StaleUpload, error) {
+	driver, err := c.StorageDriver()
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-olderThan)
+	stale := []StaleUpload{}
+	errs := []error{}
+	err = driver.Walk(ctx, repositoriesRoot, func(fileInfo storagedriver.FileInfo) error {
+		if !fileInfo.IsDir() {
+			return nil
+		}
+		name := path.Base(fileInfo.Path())
+		if name == "_uploads" {
+			repo := strings.TrimPrefix(path.Dir(fileInfo.Path()), repositoriesRoot+"/")
+			found, err := staleUploads(ctx, driver, repo, fileInfo.Path(), cutoff)
+			stale = append(stale, found...)
+			errs = append(errs, err...)
+			return storagedriver.ErrSkipDir
+		}
+		if strings.HasPrefix(name, "_") {
+			return storagedriver.ErrSkipDir // _layers, _manifests
+		}
+		return nil
+	})
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			errs = append(errs, err)
+		}
+	}
+
+	purged := []StaleUpload{}
+	for _, upload := range stale {
+		if !dryRun {
+			if err := driver.Delete(ctx, upload.Path); err != nil {
+				if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+					errs = append(errs, fmt.Errorf("removing upload %s of %s: %w", upload.UUID, upload.Repository, err))
+					continue
+				}
+			}
+		}
+		purged = append(purged, upload)
+	}
+	dcontext.GetLogger(ctx).Infof("purged %d uploads started before %s (dry run: %t), %d errors", len(purged), cutoff, dryRun, len(errs))
+	return purged, errors.Join(errs...)
+}
+
+// RemoveUpload removes the data of the blob upload with uuid to repository, e.g. "ns/repo", from the storage.
+// The registry recreates part of the data of an upload cancelled with DELETE when closing it; this removes what is left.
+func (c *Client) RemoveUpload(ctx context.Context, repository, uuid string) error {
+	if _, err := reference.WithName(repository); err != nil {
+		return fmt.Errorf("invalid repository %q: %w", repository, err)
+	}
+	uploadPath := path.Join(repositoriesRoot, repository, "_uploads", uuid)
+	if uuid == "" || path.Base(uploadPath) != uuid || !storagedriver.PathRegexp.MatchString(uploadPath) {
+		return fmt.Errorf("invalid upload UUID %q", uuid)
+	}
+	driver, err := c.StorageDriver()
+	if err != nil {
+		return err
+	}
+	if err := driver.Delete(ctx, uploadPath); err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// staleUploads returns the uploads in uploadsDir, of repo, started before cutoff.
+// Uploads without a readable start time are skipped, as the registry's own upload purging does.
+func staleUploads(ctx context.Context, driver storagedriver.StorageDriver, repo, uploadsDir string, cutoff time.Time) ([]StaleUpload, []error) {
+	entries, err := driver.List(ctx, uploadsDir)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, []error{err}
+	}
+	stale := []StaleUpload{}
+	errs := []error{}
+	for _, entry := range entries {
+		startedAt, err := driver.GetContent(ctx, path.Join(entry, "startedat"))
+		if err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		upload := StaleUpload{Repository: repo, UUID: path.Base(entry), Path: entry}
+		if upload.StartedAt, err = time.Parse(time.RFC3339, string(startedAt)); err != nil {
+			errs = append(errs, fmt.Errorf("invalid start time of upload %s of %s: %w", upload.UUID, repo, err))
+			continue
+		}
+		if !upload.StartedAt.Before(cutoff) {
+			continue
+		}
+		if data, err := driver.Stat(ctx, path.Join(entry, "data")); err == nil {
+			upload.Size = data.Size()
+		}
+		stale = append(stale, upload)
+	}
+	return stale, errs
+}
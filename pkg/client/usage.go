@@ -0,0 +1,332 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/docker/go-metrics"
+	"github.com/opencontainers/go-digest"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/errgroup"
+)
+
+// UsageOptions configures Client.Usage.
+type UsageOptions struct {
+	// MaxParallel is the number of blobs whose size is read at once; 0 means 4.
+	MaxParallel int
+}
+
+// UsageReport is the storage used by the images of a storage, computed by Client.Usage.
+// All sizes are in bytes, and include the manifests.
+type UsageReport struct {
+	// Repositories are the repositories of the storage, sorted by name.
+	Repositories []RepositoryUsage
+	// Size is the size of all blobs referenced by the manifests of all repositories, each blob counted once.
+	Size int64
+	// Blobs is the number of blobs referenced by the manifests of all repositories, manifests included.
+	Blobs int
+	// MissingBlobs is the number of blobs referenced by manifests but not stored, which are not counted in sizes.
+	MissingBlobs int
+}
+
+// RepositoryUsage is the storage used by a repository.
+type RepositoryUsage struct {
+	// Repository is the name of the repository, e.g. "ns/repo".
+	Repository string
+	// Size is the size of the blobs referenced by the manifests of the repository, tagged or not, each blob counted once.
+	Size int64
+	// UniqueSize is the size of the blobs of the repository which no other repository references: the storage freed
+	// if the repository was deleted and garbage collected.
+	UniqueSize int64
+	// Manifests is the number of manifests of the repository, tagged or not.
+	Manifests int
+	// Tags are the tags of the repository, sorted by name.
+	Tags []TagUsage
+}
+
+// TagUsage is the storage used by a tag.
+type TagUsage struct {
+	Tag    string
+	Digest digest.Digest
+	// Size is the logical size of the tagged image: the size of its manifest, and of the blobs and child manifests
+	// it references, each counted once, whether or not they are shared with other images.
+	Size int64
+}
+
+// Usage computes the storage used by the images of the storage of c, per tag, per repository, and in total,
+// from the manifests and the blob metadata in the storage. It reads every manifest of the storage, but not the data of
+// other blobs.
+// The report is also exported as the registry_usage_* metrics, labeled with the StorageIdentity of c, so that the
+// reports of clients of different storages with the same driver are all exported. The metrics are registered with the
+// default prometheus registry and served by the debug server of the registry if enabled.
+func (c *Client) Usage(ctx context.Context, opts UsageOptions) (*UsageReport, error) {
+	driver, err := c.StorageDriver()
+	if err != nil {
+		return nil, err
+	}
+	repositories, err := storedRepositories(ctx, driver)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &usageCounter{driver: driver, manifests: map[digest.Digest]*usageManifest{}, sizes: map[digest.Digest]int64{}}
+	report := &UsageReport{Repositories: []RepositoryUsage{}}
+	repositoryBlobs := make([]map[digest.Digest]struct{}, 0, len(repositories))
+	tagBlobs := make([][]map[digest.Digest]struct{}, 0, len(repositories))
+	for _, repository := range repositories {
+		usage, blobs, tags, err := u.countRepository(ctx, repository)
+		if err != nil {
+			return nil, err
+		}
+		report.Repositories = append(report.Repositories, usage)
+		repositoryBlobs = append(repositoryBlobs, blobs)
+		tagBlobs = append(tagBlobs, tags)
+	}
+	if err := u.statBlobs(ctx, opts); err != nil {
+		return nil, err
+	}
+
+	references := map[digest.Digest]int{}
+	for _, blobs := range repositoryBlobs {
+		for dgst := range blobs {
+			references[dgst]++
+		}
+	}
+	for dgst := range references {
+		size, ok := u.sizes[dgst]
+		if !ok {
+			report.MissingBlobs++
+			continue
+		}
+		report.Blobs++
+		report.Size += size
+	}
+	for i := range report.Repositories {
+		usage := &report.Repositories[i]
+		for dgst := range repositoryBlobs[i] {
+			usage.Size += u.sizes[dgst]
+			if references[dgst] == 1 {
+				usage.UniqueSize += u.sizes[dgst]
+			}
+		}
+		for j := range usage.Tags {
+			for dgst := range tagBlobs[i][j] {
+				usage.Tags[j].Size += u.sizes[dgst]
+			}
+		}
+	}
+
+	usageMetrics.set(c.StorageIdentity(), report)
+	dcontext.GetLogger(ctx).Infof("%d repositories use %d bytes in %d blobs, %d blobs are missing",
+		len(report.Repositories), report.Size, report.Blobs, report.MissingBlobs)
+	return report, nil
+}
+
+// usageCounter is the state of a Client.Usage.
+type usageCounter struct {
+	driver storagedriver.StorageDriver
+	// manifests are the manifests read, nil if not stored or not valid.
+	manifests map[digest.Digest]*usageManifest
+	// sizes are the sizes of the blobs stored, manifests once read and other blobs once stat'ed.
+	sizes map[digest.Digest]int64
+}
+
+// usageManifest are the blobs and child manifests referenced by a manifest.
+type usageManifest struct {
+	blobs    []digest.Digest
+	children []digest.Digest
+}
+
+// countRepository returns the usage of repository without sizes, and the blobs of the repository and of each of its tags.
+func (u *usageCounter) countRepository(ctx context.Context, repository string) (RepositoryUsage, map[digest.Digest]struct{}, []map[digest.Digest]struct{}, error) {
+	usage := RepositoryUsage{Repository: repository, Tags: []TagUsage{}}
+	revisions, err := manifestRevisions(ctx, u.driver, repository)
+	if err != nil {
+		return usage, nil, nil, err
+	}
+	usage.Manifests = len(revisions)
+	blobs := map[digest.Digest]struct{}{}
+	for _, revision := range revisions {
+		if err := u.addImage(ctx, revision, blobs); err != nil {
+			return usage, nil, nil, err
+		}
+	}
+
+	stored, err := storedTags(ctx, u.driver, repository)
+	if err != nil {
+		return usage, nil, nil, err
+	}
+	tags := []map[digest.Digest]struct{}{}
+	for _, tag := range stored {
+		tagBlobs := map[digest.Digest]struct{}{}
+		if err := u.addImage(ctx, tag.digest, tagBlobs); err != nil {
+			return usage, nil, nil, err
+		}
+		usage.Tags = append(usage.Tags, TagUsage{Tag: tag.name, Digest: tag.digest})
+		tags = append(tags, tagBlobs)
+	}
+	return usage, blobs, tags, nil
+}
+
+// addImage adds the manifest dgst, and the blobs and child manifests it references, to blobs.
+func (u *usageCounter) addImage(ctx context.Context, dgst digest.Digest, blobs map[digest.Digest]struct{}) error {
+	if _, ok := blobs[dgst]; ok {
+		return nil
+	}
+	blobs[dgst] = struct{}{}
+	m, err := u.manifest(ctx, dgst)
+	if err != nil || m == nil {
+		return err
+	}
+	for _, blob := range m.blobs {
+		blobs[blob] = struct{}{}
+	}
+	for _, child := range m.children {
+		if err := u.addImage(ctx, child, blobs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// manifest returns the references of the manifest dgst, or nil if it is not stored or can not be parsed.
+func (u *usageCounter) manifest(ctx context.Context, dgst digest.Digest) (*usageManifest, error) {
+	if m, ok := u.manifests[dgst]; ok {
+		return m, nil
+	}
+	u.manifests[dgst] = nil
+	content, err := u.driver.GetContent(ctx, blobDataPath(dgst))
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	u.sizes[dgst] = int64(len(content))
+	var parsed storedManifest
+	if err := json.Unmarshal(content, &parsed); err != nil {
+		return nil, nil
+	}
+	m := &usageManifest{}
+	if parsed.Config != nil && parsed.Config.Digest.Validate() == nil {
+		m.blobs = append(m.blobs, parsed.Config.Digest)
+	}
+	for _, layer := range parsed.Layers {
+		if len(layer.URLs) == 0 && layer.Digest.Validate() == nil {
+			m.blobs = append(m.blobs, layer.Digest)
+		}
+	}
+	for _, layer := range parsed.FSLayers {
+		if layer.BlobSum.Validate() == nil {
+			m.blobs = append(m.blobs, layer.BlobSum)
+		}
+	}
+	for _, child := range parsed.Manifests {
+		if child.Digest.Validate() == nil {
+			m.children = append(m.children, child.Digest)
+		}
+	}
+	u.manifests[dgst] = m
+	return m, nil
+}
+
+// statBlobs reads the sizes of the blobs referenced by the manifests read, several at once.
+func (u *usageCounter) statBlobs(ctx context.Context, opts UsageOptions) error {
+	blobs := map[digest.Digest]struct{}{}
+	for _, m := range u.manifests {
+		if m == nil {
+			continue
+		}
+		for _, dgst := range m.blobs {
+			if _, ok := u.sizes[dgst]; !ok {
+				blobs[dgst] = struct{}{}
+			}
+		}
+	}
+	maxParallel := opts.MaxParallel
+	if maxParallel <= 0 {
+		maxParallel = defaultStorageParallelism
+	}
+	var mutex sync.Mutex
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(maxParallel)
+	for dgst := range blobs {
+		dgst := dgst
+		group.Go(func() error {
+			info, err := u.driver.Stat(groupCtx, blobDataPath(dgst))
+			if err != nil {
+				if _, ok := err.(storagedriver.PathNotFoundError); ok {
+					return nil
+				}
+				return err
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			u.sizes[dgst] = info.Size()
+			return nil
+		})
+	}
+	return group.Wait()
+}
+
+var (
+	// usageNamespace is the prometheus namespace of the metrics of Client.Usage.
+	usageNamespace = metrics.NewNamespace(prometheus.NamespacePrefix, "usage", nil)
+	usageMetrics   = newUsageCollector(usageNamespace)
+)
+
+func init() {
+	usageNamespace.Add(usageMetrics)
+	metrics.Register(usageNamespace)
+}
+
+// usageCollector exports the last UsageReport of each storage as metrics, labeled with its StorageIdentity.
+type usageCollector struct {
+	total, repository, repositoryUnique, tag *prom.Desc
+
+	mutex   sync.Mutex
+	reports map[string]*UsageReport
+}
+
+func newUsageCollector(ns *metrics.Namespace) *usageCollector {
+	return &usageCollector{
+		total:            ns.NewDesc("total", "The size of all blobs referenced by manifests, each counted once", metrics.Bytes, "storage"),
+		repository:       ns.NewDesc("repository", "The size of the blobs referenced by the manifests of a repository", metrics.Bytes, "storage", "repository"),
+		repositoryUnique: ns.NewDesc("repository_unique", "The size of the blobs referenced by no other repository", metrics.Bytes, "storage", "repository"),
+		tag:              ns.NewDesc("tag", "The logical size of a tagged image", metrics.Bytes, "storage", "repository", "tag"),
+		reports:          map[string]*UsageReport{},
+	}
+}
+
+// set replaces the report of storage exported.
+func (c *usageCollector) set(storage string, report *UsageReport) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.reports[storage] = report
+}
+
+func (c *usageCollector) Describe(ch chan<- *prom.Desc) {
+	ch <- c.total
+	ch <- c.repository
+	ch <- c.repositoryUnique
+	ch <- c.tag
+}
+
+func (c *usageCollector) Collect(ch chan<- prom.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for storage, report := range c.reports {
+		ch <- prom.MustNewConstMetric(c.total, prom.GaugeValue, float64(report.Size), storage)
+		for _, repository := range report.Repositories {
+			ch <- prom.MustNewConstMetric(c.repository, prom.GaugeValue, float64(repository.Size), storage, repository.Repository)
+			ch <- prom.MustNewConstMetric(c.repositoryUnique, prom.GaugeValue, float64(repository.UniqueSize), storage, repository.Repository)
+			for _, tag := range repository.Tags {
+				ch <- prom.MustNewConstMetric(c.tag, prom.GaugeValue, float64(tag.Size), storage, repository.Repository, tag.Tag)
+			}
+		}
+	}
+}
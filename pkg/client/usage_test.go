@@ -0,0 +1,95 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/client"
+	"github.com/migtools/udistribution/pkg/internal/testing/clienttest"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsage(t *testing.T) {
+	ctx := context.Background()
+	ut, _ := newFilesystemTestTransport(t, nil)
+	var imageManifest []byte
+	for _, name := range []string{"//test/app:v1", "//test/app:v2", "//test/other:v1"} {
+		ref, err := ut.ParseReference(name)
+		require.NoError(t, err)
+		imageManifest = clienttest.CopyFixtureImage(t, ref)
+	}
+	imageDigest, err := manifest.Digest(imageManifest)
+	require.NoError(t, err)
+	parsed, err := manifest.FromBlob(imageManifest, manifest.GuessMIMEType(imageManifest))
+	require.NoError(t, err)
+	imageSize := int64(len(imageManifest)) + parsed.ConfigInfo().Size + parsed.LayerInfos()[0].Size
+
+	// An index of the image, only in test/app.
+	index, err := json.Marshal(imgspecv1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageIndex,
+		Manifests: []imgspecv1.Descriptor{{MediaType: manifest.GuessMIMEType(imageManifest), Digest: imageDigest, Size: int64(len(imageManifest))}},
+	})
+	require.NoError(t, err)
+	indexRef, err := ut.ParseReference("//test/app:index")
+	require.NoError(t, err)
+	dest, err := indexRef.NewImageDestination(ctx, &types.SystemContext{})
+	require.NoError(t, err)
+	require.NoError(t, dest.PutManifest(ctx, index, nil))
+	require.NoError(t, dest.Close())
+	indexSize := int64(len(index))
+
+	report, err := ut.Client.Usage(ctx, client.UsageOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, &client.UsageReport{
+		Repositories: []client.RepositoryUsage{
+			{Repository: "test/app", Size: indexSize + imageSize, UniqueSize: indexSize, Manifests: 2, Tags: []client.TagUsage{
+				{Tag: "index", Digest: digest.FromBytes(index), Size: indexSize + imageSize},
+				{Tag: "v1", Digest: imageDigest, Size: imageSize},
+				{Tag: "v2", Digest: imageDigest, Size: imageSize},
+			}},
+			{Repository: "test/other", Size: imageSize, UniqueSize: 0, Manifests: 1, Tags: []client.TagUsage{
+				{Tag: "v1", Digest: imageDigest, Size: imageSize},
+			}},
+		},
+		Size:  indexSize + imageSize,
+		Blobs: 4,
+	}, report)
+
+	// The reports of storages with the same driver are exported as metrics, labeled with their identity.
+	other, _ := newFilesystemTestTransport(t, nil)
+	ref, err := other.ParseReference("//test/app:v1")
+	require.NoError(t, err)
+	clienttest.CopyFixtureImage(t, ref)
+	_, err = other.Client.Usage(ctx, client.UsageOptions{})
+	require.NoError(t, err)
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	values := map[string]map[string]float64{ut.Client.StorageIdentity(): {}, other.Client.StorageIdentity(): {}}
+	for _, family := range families {
+		if family.GetName() != "registry_usage_repository_unique_bytes" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if storage, ok := values[labels["storage"]]; ok {
+				storage[labels["repository"]] = m.GetGauge().GetValue()
+			}
+		}
+	}
+	assert.Equal(t, map[string]map[string]float64{
+		ut.Client.StorageIdentity():    {"test/app": float64(indexSize), "test/other": 0},
+		other.Client.StorageIdentity(): {"test/app": float64(imageSize)},
+	}, values)
+}
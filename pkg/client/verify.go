@@ -0,0 +1,489 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sync/errgroup"
+)
+
+// defaultStorageParallelism is the number of blobs read at once from the storage by default, by Verify and Usage.
+const defaultStorageParallelism = 4
+
+// VerifyOptions configures Client.Verify.
+type VerifyOptions struct {
+	// Repositories are the repositories verified, e.g. "ns/repo"; all repositories of the storage if empty.
+	// Those which are not in the storage are reported as missing.
+	Repositories []string
+	// Rehash reads the data of every blob and checks that it hashes to its digest. Otherwise blobs are only checked to
+	// exist with the size their manifests expect, which only needs their metadata. Manifests are always rehashed.
+	Rehash bool
+	// MaxParallel is the number of blobs checked at once; 0 means 4.
+	MaxParallel int
+}
+
+// VerifyProblemKind is a kind of problem found by Client.Verify.
+type VerifyProblemKind string
+
+const (
+	// VerifyMissingBlob is a blob referenced by a manifest, or a manifest, whose data is not in the storage.
+	VerifyMissingBlob VerifyProblemKind = "missing blob"
+	// VerifyCorruptBlob is a blob whose data does not have the expected size, or does not hash to its digest, or a manifest
+	// which can not be parsed or references invalid digests.
+	VerifyCorruptBlob VerifyProblemKind = "corrupt blob"
+	// VerifyDanglingTag is a tag of a manifest which is not in its repository.
+	VerifyDanglingTag VerifyProblemKind = "dangling tag"
+	// VerifyBrokenLink is a link file which is missing, or does not contain the digest it links to: the link of a repository
+	// to a blob or child manifest referenced by one of its manifests, or the current link of a tag.
+	VerifyBrokenLink VerifyProblemKind = "broken link"
+	// VerifyMissingRepository is a repository of VerifyOptions.Repositories which is not in the storage.
+	VerifyMissingRepository VerifyProblemKind = "missing repository"
+)
+
+// VerifyProblem is a problem found by Client.Verify.
+type VerifyProblem struct {
+	Kind VerifyProblemKind
+	// Repository is the repository the problem was found in, e.g. "ns/repo".
+	Repository string
+	// Tag is the tag the problem is about, for dangling tags and tag links.
+	Tag string
+	// Manifest is the manifest referencing the blob or child manifest the problem is about, if any.
+	Manifest digest.Digest
+	// Digest is the blob or manifest the problem is about; not set for tag links which do not contain a valid digest.
+	Digest digest.Digest
+	// Path is the storage path of the missing, corrupt or broken file.
+	Path string
+	// Detail describes the problem.
+	Detail string
+}
+
+func (p VerifyProblem) String() string {
+	s := fmt.Sprintf("%s in %s", p.Kind, p.Repository)
+	if p.Tag != "" {
+		s += ":" + p.Tag
+	}
+	if p.Digest != "" {
+		s += " " + p.Digest.String()
+	}
+	if p.Manifest != "" {
+		s += " (referenced by " + p.Manifest.String() + ")"
+	}
+	return s + ": " + p.Detail
+}
+
+// VerifyReport is the result of Client.Verify.
+type VerifyReport struct {
+	// Repositories, Tags and Manifests are the numbers of repositories, tags and manifests verified, not counting missing ones.
+	Repositories int
+	Tags         int
+	Manifests    int
+	// Blobs is the number of distinct blobs checked, other than manifests.
+	Blobs    int
+	Problems []VerifyProblem
+}
+
+// Verify checks that the images stored in the storage of c are complete, reading the storage directly rather than through
+// the registry API: for each repository, it checks that every tag links to a manifest of the repository, and that every
+// manifest, tagged or not, and every config, layer and child manifest they reference, are linked to the repository and
+// stored with the expected size, or digest if opts.Rehash.
+// Problems found are returned in the report; an error is only returned if the storage could not be read.
+func (c *Client) Verify(ctx context.Context, opts VerifyOptions) (*VerifyReport, error) {
+	for _, repository := range opts.Repositories {
+		if _, err := reference.WithName(repository); err != nil {
+			return nil, fmt.Errorf("invalid repository %q: %w", repository, err)
+		}
+	}
+	driver, err := c.StorageDriver()
+	if err != nil {
+		return nil, err
+	}
+	repositories := opts.Repositories
+	if len(repositories) == 0 {
+		if repositories, err = storedRepositories(ctx, driver); err != nil {
+			return nil, err
+		}
+	}
+
+	v := &verifier{driver: driver, blobs: map[digest.Digest]*verifiedBlob{}, report: &VerifyReport{Problems: []VerifyProblem{}}}
+	for _, repository := range repositories {
+		if len(opts.Repositories) != 0 {
+			manifestsPath := path.Join(repositoriesRoot, repository, "_manifests")
+			if _, err := driver.Stat(ctx, manifestsPath); err != nil {
+				if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+					return nil, fmt.Errorf("verifying %s: %w", repository, err)
+				}
+				v.problem(VerifyProblem{Kind: VerifyMissingRepository, Repository: repository, Path: manifestsPath,
+					Detail: "the repository is not stored"})
+				continue
+			}
+		}
+		if err := v.verifyRepository(ctx, repository); err != nil {
+			return nil, fmt.Errorf("verifying %s: %w", repository, err)
+		}
+	}
+	if err := v.verifyBlobs(ctx, opts); err != nil {
+		return nil, err
+	}
+
+	report := v.report
+	sort.SliceStable(report.Problems, func(i, j int) bool {
+		if report.Problems[i].Repository != report.Problems[j].Repository {
+			return report.Problems[i].Repository < report.Problems[j].Repository
+		}
+		return report.Problems[i].Path < report.Problems[j].Path
+	})
+	dcontext.GetLogger(ctx).Infof("verified %d repositories, %d manifests and %d blobs (rehash: %t), %d problems",
+		report.Repositories, report.Manifests, report.Blobs, opts.Rehash, len(report.Problems))
+	return report, nil
+}
+
+// storedRepositories returns the repositories in the storage of driver.
+func storedRepositories(ctx context.Context, driver storagedriver.StorageDriver) ([]string, error) {
+	repositories := []string{}
+	err := driver.Walk(ctx, repositoriesRoot, func(fileInfo storagedriver.FileInfo) error {
+		if !fileInfo.IsDir() {
+			return nil
+		}
+		name := path.Base(fileInfo.Path())
+		if name == "_manifests" {
+			repositories = append(repositories, strings.TrimPrefix(path.Dir(fileInfo.Path()), repositoriesRoot+"/"))
+		}
+		if strings.HasPrefix(name, "_") {
+			return storagedriver.ErrSkipDir // _layers, _manifests, _uploads
+		}
+		return nil
+	})
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	sort.Strings(repositories)
+	return repositories, nil
+}
+
+// verifier is the state of a Client.Verify.
+type verifier struct {
+	driver storagedriver.StorageDriver
+	// blobs are the blobs referenced by the manifests verified, checked once all manifests are.
+	blobs  map[digest.Digest]*verifiedBlob
+	report *VerifyReport
+}
+
+// verifiedBlob is a blob referenced by manifests, with the first reference of each repository.
+type verifiedBlob struct {
+	size       int64
+	references []blobReference
+}
+
+type blobReference struct {
+	repository string
+	manifest   digest.Digest
+}
+
+// storedManifest contains the fields of manifests of all supported schemas which reference blobs or other manifests.
+type storedManifest struct {
+	Config *struct {
+		Digest digest.Digest `json:"digest"`
+		Size   int64         `json:"size"`
+	} `json:"config,omitempty"`
+	Layers []struct {
+		Digest digest.Digest `json:"digest"`
+		Size   int64         `json:"size"`
+		URLs   []string      `json:"urls,omitempty"`
+	} `json:"layers,omitempty"`
+	Manifests []struct {
+		Digest digest.Digest `json:"digest"`
+	} `json:"manifests,omitempty"`
+	// Subject is the manifest referred to by OCI referrers; it is not required to be in the repository.
+	Subject *struct {
+		Digest digest.Digest `json:"digest"`
+	} `json:"subject,omitempty"`
+	// FSLayers are the layers of schema1 manifests.
+	FSLayers []struct {
+		BlobSum digest.Digest `json:"blobSum"`
+	} `json:"fsLayers,omitempty"`
+}
+
+// invalidDigests returns the digests referenced by m which are not valid.
+func (m *storedManifest) invalidDigests() []string {
+	invalid := []string{}
+	check := func(dgst digest.Digest) {
+		if dgst.Validate() != nil {
+			invalid = append(invalid, string(dgst))
+		}
+	}
+	if m.Config != nil {
+		check(m.Config.Digest)
+	}
+	for _, layer := range m.Layers {
+		check(layer.Digest)
+	}
+	for _, child := range m.Manifests {
+		check(child.Digest)
+	}
+	for _, layer := range m.FSLayers {
+		check(layer.BlobSum)
+	}
+	return invalid
+}
+
+func (v *verifier) problem(p VerifyProblem) {
+	v.report.Problems = append(v.report.Problems, p)
+}
+
+// verifyRepository verifies the tags and manifests of repository, and records the blobs they reference.
+func (v *verifier) verifyRepository(ctx context.Context, repository string) error {
+	v.report.Repositories++
+	revisions, err := manifestRevisions(ctx, v.driver, repository)
+	if err != nil {
+		return err
+	}
+	verified := map[digest.Digest]bool{}
+	for _, revision := range revisions {
+		if err := v.verifyManifest(ctx, repository, revision, "", verified); err != nil {
+			return err
+		}
+	}
+
+	tagsDir := path.Join(repositoriesRoot, repository, "_manifests/tags")
+	tags, err := v.driver.List(ctx, tagsDir)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	sort.Strings(tags)
+	for _, tagDir := range tags {
+		tag := path.Base(tagDir)
+		v.report.Tags++
+		linkPath := path.Join(tagDir, "current/link")
+		dgst, detail, err := v.readLink(ctx, linkPath)
+		if err != nil {
+			return err
+		}
+		if detail != "" {
+			v.problem(VerifyProblem{Kind: VerifyBrokenLink, Repository: repository, Tag: tag, Path: linkPath, Detail: detail})
+			continue
+		}
+		revisionLink := manifestRevisionLinkPath(repository, dgst)
+		if _, err := v.driver.Stat(ctx, revisionLink); err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+				return err
+			}
+			v.problem(VerifyProblem{Kind: VerifyDanglingTag, Repository: repository, Tag: tag, Digest: dgst, Path: revisionLink,
+				Detail: "the tagged manifest is not in the repository"})
+		}
+	}
+	return nil
+}
+
+// verifyManifest verifies the manifest dgst of repository, referenced by the manifest list parent if not "",
+// and the child manifests it references, and records the blobs it references.
+func (v *verifier) verifyManifest(ctx context.Context, repository string, dgst, parent digest.Digest, verified map[digest.Digest]bool) error {
+	if verified[dgst] {
+		return nil
+	}
+	verified[dgst] = true
+	v.report.Manifests++
+
+	linkPath := manifestRevisionLinkPath(repository, dgst)
+	linked, detail, err := v.readLink(ctx, linkPath)
+	if err != nil {
+		return err
+	}
+	if detail == "" && linked != dgst {
+		detail = fmt.Sprintf("links to %s", linked)
+	}
+	if detail != "" {
+		v.problem(VerifyProblem{Kind: VerifyBrokenLink, Repository: repository, Manifest: parent, Digest: dgst, Path: linkPath, Detail: detail})
+	}
+
+	dataPath := blobDataPath(dgst)
+	content, err := v.driver.GetContent(ctx, dataPath)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			return err
+		}
+		v.problem(VerifyProblem{Kind: VerifyMissingBlob, Repository: repository, Manifest: parent, Digest: dgst, Path: dataPath,
+			Detail: "the manifest is not stored"})
+		return nil
+	}
+	if actual := dgst.Algorithm().FromBytes(content); actual != dgst {
+		v.problem(VerifyProblem{Kind: VerifyCorruptBlob, Repository: repository, Manifest: parent, Digest: dgst, Path: dataPath,
+			Detail: fmt.Sprintf("the manifest hashes to %s", actual)})
+		return nil
+	}
+
+	var m storedManifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		v.problem(VerifyProblem{Kind: VerifyCorruptBlob, Repository: repository, Manifest: parent, Digest: dgst, Path: dataPath,
+			Detail: fmt.Sprintf("the manifest can not be parsed: %v", err)})
+		return nil
+	}
+	if invalid := m.invalidDigests(); len(invalid) != 0 {
+		v.problem(VerifyProblem{Kind: VerifyCorruptBlob, Repository: repository, Manifest: parent, Digest: dgst, Path: dataPath,
+			Detail: fmt.Sprintf("the manifest references invalid digests %q", invalid)})
+		return nil
+	}
+	if m.Config != nil {
+		if err := v.addBlob(ctx, repository, dgst, m.Config.Digest, m.Config.Size); err != nil {
+			return err
+		}
+	}
+	for _, layer := range m.Layers {
+		if len(layer.URLs) != 0 {
+			continue // Foreign layers are not stored in the registry.
+		}
+		if err := v.addBlob(ctx, repository, dgst, layer.Digest, layer.Size); err != nil {
+			return err
+		}
+	}
+	for _, layer := range m.FSLayers {
+		if err := v.addBlob(ctx, repository, dgst, layer.BlobSum, -1); err != nil {
+			return err
+		}
+	}
+	for _, child := range m.Manifests {
+		if err := v.verifyManifest(ctx, repository, child.Digest, dgst, verified); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addBlob checks the link of repository to blob dgst, referenced by manifest with size, or -1 if unknown,
+// and records it to be checked once all manifests are verified.
+func (v *verifier) addBlob(ctx context.Context, repository string, manifest, dgst digest.Digest, size int64) error {
+	blob, ok := v.blobs[dgst]
+	if !ok {
+		blob = &verifiedBlob{size: size}
+		v.blobs[dgst] = blob
+	}
+	if blob.size < 0 {
+		blob.size = size
+	}
+	for _, ref := range blob.references {
+		if ref.repository == repository {
+			return nil
+		}
+	}
+	blob.references = append(blob.references, blobReference{repository: repository, manifest: manifest})
+
+	linkPath := blobLinkPath(repository, dgst)
+	linked, detail, err := v.readLink(ctx, linkPath)
+	if err != nil {
+		return err
+	}
+	if detail == "" && linked != dgst {
+		detail = fmt.Sprintf("links to %s", linked)
+	}
+	if detail != "" {
+		v.problem(VerifyProblem{Kind: VerifyBrokenLink, Repository: repository, Manifest: manifest, Digest: dgst, Path: linkPath, Detail: detail})
+	}
+	return nil
+}
+
+// readLink returns the digest in the link file at linkPath, or a description of why the link is broken.
+func (v *verifier) readLink(ctx context.Context, linkPath string) (digest.Digest, string, error) {
+	content, err := v.driver.GetContent(ctx, linkPath)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return "", "the link is missing", nil
+		}
+		return "", "", err
+	}
+	dgst, err := digest.Parse(string(content))
+	if err != nil {
+		return "", fmt.Sprintf("the link contains %q: %v", content, err), nil
+	}
+	return dgst, "", nil
+}
+
+// verifyBlobs checks the data of the blobs recorded, several at once, and reports problems for each repository referencing them.
+func (v *verifier) verifyBlobs(ctx context.Context, opts VerifyOptions) error {
+	digests := make([]digest.Digest, 0, len(v.blobs))
+	for dgst := range v.blobs {
+		digests = append(digests, dgst)
+	}
+	sort.Slice(digests, func(i, j int) bool { return digests[i] < digests[j] })
+	v.report.Blobs = len(digests)
+
+	maxParallel := opts.MaxParallel
+	if maxParallel <= 0 {
+		maxParallel = defaultStorageParallelism
+	}
+	var mutex sync.Mutex
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(maxParallel)
+	for _, dgst := range digests {
+		dgst := dgst
+		blob := v.blobs[dgst]
+		group.Go(func() error {
+			kind, detail, err := checkBlobData(groupCtx, v.driver, dgst, blob.size, opts.Rehash)
+			if err != nil || kind == "" {
+				return err
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, ref := range blob.references {
+				v.problem(VerifyProblem{Kind: kind, Repository: ref.repository, Manifest: ref.manifest, Digest: dgst, Path: blobDataPath(dgst), Detail: detail})
+			}
+			return nil
+		})
+	}
+	return group.Wait()
+}
+
+// checkBlobData checks that the data of blob dgst is stored with size, if not -1, and hashes to dgst if rehash.
+// It returns the kind of problem found and its description, if any.
+func checkBlobData(ctx context.Context, driver storagedriver.StorageDriver, dgst digest.Digest, size int64, rehash bool) (VerifyProblemKind, string, error) {
+	dataPath := blobDataPath(dgst)
+	info, err := driver.Stat(ctx, dataPath)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return VerifyMissingBlob, "the blob is not stored", nil
+		}
+		return "", "", err
+	}
+	if size >= 0 && info.Size() != size {
+		return VerifyCorruptBlob, fmt.Sprintf("the blob has %d bytes, expected %d", info.Size(), size), nil
+	}
+	if !rehash {
+		return "", "", nil
+	}
+	reader, err := driver.Reader(ctx, dataPath, 0)
+	if err != nil {
+		return "", "", err
+	}
+	defer reader.Close()
+	digester := dgst.Algorithm().Digester()
+	if _, err := io.Copy(digester.Hash(), reader); err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return "", "", err
+		}
+		return "", "", fmt.Errorf("reading blob %s: %w", dgst, err)
+	}
+	if actual := digester.Digest(); actual != dgst {
+		return VerifyCorruptBlob, fmt.Sprintf("the blob hashes to %s", actual), nil
+	}
+	return "", "", nil
+}
+
+// manifestRevisionLinkPath returns the storage path of the link of repository to the manifest dgst.
+func manifestRevisionLinkPath(repository string, dgst digest.Digest) string {
+	return path.Join(repositoriesRoot, repository, "_manifests/revisions", dgst.Algorithm().String(), dgst.Encoded(), "link")
+}
@@ -0,0 +1,132 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"testing"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/client"
+	"github.com/migtools/udistribution/pkg/internal/testing/clienttest"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	ut, _ := newFilesystemTestTransport(t, nil)
+	var imageManifest []byte
+	for _, name := range []string{"//test/app:v1", "//test/other:v1"} {
+		ref, err := ut.ParseReference(name)
+		require.NoError(t, err)
+		imageManifest = clienttest.CopyFixtureImage(t, ref)
+	}
+	imageDigest, err := manifest.Digest(imageManifest)
+	require.NoError(t, err)
+	index, err := json.Marshal(imgspecv1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageIndex,
+		Manifests: []imgspecv1.Descriptor{{MediaType: manifest.GuessMIMEType(imageManifest), Digest: imageDigest, Size: int64(len(imageManifest))}},
+	})
+	require.NoError(t, err)
+	indexDigest := digest.FromBytes(index)
+	indexRef, err := ut.ParseReference("//test/app:index")
+	require.NoError(t, err)
+	dest, err := indexRef.NewImageDestination(ctx, &types.SystemContext{})
+	require.NoError(t, err)
+	require.NoError(t, dest.PutManifest(ctx, index, nil))
+	require.NoError(t, dest.Close())
+
+	for _, rehash := range []bool{false, true} {
+		report, err := ut.Client.Verify(ctx, client.VerifyOptions{Rehash: rehash})
+		require.NoError(t, err)
+		assert.Equal(t, &client.VerifyReport{Repositories: 2, Tags: 3, Manifests: 3, Blobs: 2, Problems: []client.VerifyProblem{}}, report)
+	}
+
+	// Damage the storage.
+	parsed, err := manifest.FromBlob(imageManifest, manifest.GuessMIMEType(imageManifest))
+	require.NoError(t, err)
+	configDigest := parsed.ConfigInfo().Digest
+	layerDigest := parsed.LayerInfos()[0].Digest
+	driver, err := ut.Client.StorageDriver()
+	require.NoError(t, err)
+	blobPath := func(dgst digest.Digest) string {
+		return path.Join("/docker/registry/v2/blobs", dgst.Algorithm().String(), dgst.Encoded()[:2], dgst.Encoded(), "data")
+	}
+	repoPath := func(repo string, elem ...string) string {
+		return path.Join(append([]string{"/docker/registry/v2/repositories", repo}, elem...)...)
+	}
+	require.NoError(t, driver.Delete(ctx, blobPath(configDigest)))
+	layer, err := driver.GetContent(ctx, blobPath(layerDigest))
+	require.NoError(t, err)
+	layer[len(layer)-1] ^= 0xff
+	require.NoError(t, driver.PutContent(ctx, blobPath(layerDigest), layer))
+	require.NoError(t, driver.Delete(ctx, repoPath("test/other", "_layers", layerDigest.Algorithm().String(), layerDigest.Encoded(), "link")))
+	require.NoError(t, driver.Delete(ctx, repoPath("test/app", "_manifests/revisions", imageDigest.Algorithm().String(), imageDigest.Encoded(), "link")))
+	missing := digest.FromString("missing")
+	require.NoError(t, driver.PutContent(ctx, repoPath("test/app", "_manifests/tags/dangling/current/link"), []byte(missing)))
+	require.NoError(t, driver.PutContent(ctx, repoPath("test/other", "_manifests/tags/broken/current/link"), []byte("garbage")))
+
+	type problem struct {
+		kind           client.VerifyProblemKind
+		repo, tag      string
+		manifest, dgst digest.Digest
+	}
+	expected := []problem{
+		{client.VerifyBrokenLink, "test/app", "", indexDigest, imageDigest},
+		{client.VerifyDanglingTag, "test/app", "v1", "", imageDigest},
+		{client.VerifyDanglingTag, "test/app", "dangling", "", missing},
+		{client.VerifyMissingBlob, "test/app", "", imageDigest, configDigest},
+		{client.VerifyBrokenLink, "test/other", "broken", "", ""},
+		{client.VerifyBrokenLink, "test/other", "", imageDigest, layerDigest},
+		{client.VerifyMissingBlob, "test/other", "", imageDigest, configDigest},
+	}
+	for _, rehash := range []bool{false, true} {
+		report, err := ut.Client.Verify(ctx, client.VerifyOptions{Rehash: rehash, MaxParallel: 1})
+		require.NoError(t, err)
+		assert.Equal(t, 5, report.Tags)
+		problems := []problem{}
+		for _, p := range report.Problems {
+			assert.NotEmpty(t, p.Path)
+			assert.NotEmpty(t, p.Detail)
+			problems = append(problems, problem{p.Kind, p.Repository, p.Tag, p.Manifest, p.Digest})
+		}
+		if rehash {
+			// The layer was corrupted without changing its size, which is only found by rehashing it.
+			expected = append(expected,
+				problem{client.VerifyCorruptBlob, "test/app", "", imageDigest, layerDigest},
+				problem{client.VerifyCorruptBlob, "test/other", "", imageDigest, layerDigest})
+		}
+		assert.ElementsMatch(t, expected, problems, "rehash: %t", rehash)
+	}
+
+	report, err := ut.Client.Verify(ctx, client.VerifyOptions{Repositories: []string{"test/other"}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Repositories)
+	assert.Len(t, report.Problems, 3)
+	_, err = ut.Client.Verify(ctx, client.VerifyOptions{Repositories: []string{"Invalid"}})
+	assert.Error(t, err)
+
+	// Invalid digests referenced by manifests, and repositories which are not stored, are reported.
+	corrupt := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[{"digest":"invalid"}]}`)
+	corruptDigest := digest.FromBytes(corrupt)
+	require.NoError(t, driver.PutContent(ctx, blobPath(corruptDigest), corrupt))
+	require.NoError(t, driver.PutContent(ctx, repoPath("test/corrupt", "_manifests/revisions", corruptDigest.Algorithm().String(), corruptDigest.Encoded(), "link"), []byte(corruptDigest)))
+	report, err = ut.Client.Verify(ctx, client.VerifyOptions{Repositories: []string{"test/corrupt", "test/missing"}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Repositories)
+	assert.Equal(t, 1, report.Manifests)
+	problems := []problem{}
+	for _, p := range report.Problems {
+		problems = append(problems, problem{p.Kind, p.Repository, p.Tag, p.Manifest, p.Digest})
+	}
+	assert.Equal(t, []problem{
+		{client.VerifyCorruptBlob, "test/corrupt", "", "", corruptDigest},
+		{client.VerifyMissingRepository, "test/missing", "", "", ""},
+	}, problems)
+}
@@ -8,17 +8,13 @@ import (
 
 	"github.com/containers/image/v5/docker/reference"
 	ctrImage "github.com/containers/image/v5/image"
-	"github.com/containers/image/v5/transports"
 	"github.com/containers/image/v5/types"
 	"github.com/migtools/udistribution/pkg/image/udistribution/internal/tarfile"
 	"github.com/pkg/errors"
 )
 
-func init() {
-	transports.Register(Transport)
-}
-
 // Transport is an ImageTransport for local Docker archives.
+// It is not registered in transports, which would conflict with the containers/image transport of the same name.
 var Transport = archiveTransport{}
 
 type archiveTransport struct{}
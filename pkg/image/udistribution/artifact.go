@@ -0,0 +1,248 @@
+package udistribution
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// emptyJSON is the content of imgspecv1.DescriptorEmptyJSON, used as the config of artifacts without one.
+var emptyJSON = []byte("{}")
+
+// ArtifactBlob is the config or a layer of an OCI artifact pushed by PushArtifact.
+type ArtifactBlob struct {
+	// MediaType is the media type of the blob, e.g. "application/vnd.cncf.helm.chart.content.v1.tar+gzip".
+	MediaType string
+	// Content is streamed to the registry.
+	Content io.Reader
+	// Digest and Size of Content, if known; Digest "" and Size -1 if not.
+	// If set, they are verified by the registry, and an existing blob with Digest is not uploaded again.
+	Digest digest.Digest
+	Size   int64
+	// Annotations are stored in the descriptor of the blob.
+	Annotations map[string]string
+}
+
+// Artifact is an OCI artifact returned by PullArtifact. It must be closed after use.
+type Artifact struct {
+	// Descriptor describes the manifest of the artifact.
+	Descriptor imgspecv1.Descriptor
+	Manifest   imgspecv1.Manifest
+	src        types.ImageSource
+}
+
+// artifactReference returns ref as a reference of t.
+func (t *UdistributionTransport) artifactReference(ref types.ImageReference) (udistributionReference, error) {
+	dr, ok := ref.(udistributionReference)
+	if !ok {
+		return udistributionReference{}, errors.Errorf("ref must be a udistributionReference")
+	}
+	if dr.UdistributionTransport.Name() != t.Name() {
+		return udistributionReference{}, errors.Errorf("reference %s does not belong to transport %s", transports.ImageName(ref), t.Name())
+	}
+	return dr, nil
+}
+
+// PushArtifact stores an OCI artifact of artifactType at ref, with config (an empty JSON config if nil),
+// layers and manifest annotations, and returns the descriptor of its manifest.
+// The blobs are uploaded in order, streaming their content; an artifact without layers gets a single empty JSON layer.
+func (t *UdistributionTransport) PushArtifact(ctx context.Context, sys *types.SystemContext, ref types.ImageReference, artifactType string, config *ArtifactBlob, layers []ArtifactBlob, annotations map[string]string) (imgspecv1.Descriptor, error) {
+	dr, err := t.artifactReference(ref)
+	if err != nil {
+		return imgspecv1.Descriptor{}, err
+	}
+	if artifactType == "" && config == nil {
+		return imgspecv1.Descriptor{}, errors.Errorf("an artifact without a config must have an artifact type")
+	}
+	if sys == nil {
+		sys = &types.SystemContext{}
+	}
+	dest, err := dr.NewImageDestination(ctx, sys)
+	if err != nil {
+		return imgspecv1.Descriptor{}, err
+	}
+	defer dest.Close()
+
+	m := imgspecv1.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    imgspecv1.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Annotations:  annotations,
+	}
+	emptyBlob := ArtifactBlob{
+		MediaType: imgspecv1.MediaTypeEmptyJSON,
+		Digest:    digest.FromBytes(emptyJSON),
+		Size:      int64(len(emptyJSON)),
+	}
+	if config == nil {
+		emptyBlob.Content = bytes.NewReader(emptyJSON)
+		config = &emptyBlob
+	}
+	if m.Config, err = putArtifactBlob(ctx, dest, *config, true); err != nil {
+		return imgspecv1.Descriptor{}, errors.Wrap(err, "uploading artifact config")
+	}
+	if len(layers) == 0 {
+		emptyBlob.Content = bytes.NewReader(emptyJSON)
+		layers = []ArtifactBlob{emptyBlob}
+	}
+	for i, layer := range layers {
+		desc, err := putArtifactBlob(ctx, dest, layer, false)
+		if err != nil {
+			return imgspecv1.Descriptor{}, errors.Wrapf(err, "uploading artifact layer %d", i)
+		}
+		m.Layers = append(m.Layers, desc)
+	}
+
+	manifestBlob, err := json.Marshal(m)
+	if err != nil {
+		return imgspecv1.Descriptor{}, err
+	}
+	manifestDigest, err := manifest.Digest(manifestBlob)
+	if err != nil {
+		return imgspecv1.Descriptor{}, err
+	}
+	if err := dest.PutManifest(ctx, manifestBlob, nil); err != nil {
+		return imgspecv1.Descriptor{}, err
+	}
+	if err := dest.Commit(ctx, nil); err != nil {
+		return imgspecv1.Descriptor{}, err
+	}
+	return imgspecv1.Descriptor{
+		MediaType:    imgspecv1.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Digest:       manifestDigest,
+		Size:         int64(len(manifestBlob)),
+		Annotations:  annotations,
+	}, nil
+}
+
+// putArtifactBlob uploads blob to dest, and returns its descriptor.
+func putArtifactBlob(ctx context.Context, dest types.ImageDestination, blob ArtifactBlob, isConfig bool) (imgspecv1.Descriptor, error) {
+	if blob.MediaType == "" {
+		return imgspecv1.Descriptor{}, errors.Errorf("missing media type")
+	}
+	if blob.Content == nil {
+		return imgspecv1.Descriptor{}, errors.Errorf("missing content")
+	}
+	if blob.Digest == "" {
+		blob.Size = -1 // Never trust a size without a digest to verify it against.
+	}
+	info, err := dest.PutBlob(ctx, blob.Content, types.BlobInfo{Digest: blob.Digest, Size: blob.Size, MediaType: blob.MediaType}, none.NoCache, isConfig)
+	if err != nil {
+		return imgspecv1.Descriptor{}, err
+	}
+	return imgspecv1.Descriptor{
+		MediaType:   blob.MediaType,
+		Digest:      info.Digest,
+		Size:        info.Size,
+		Annotations: blob.Annotations,
+	}, nil
+}
+
+// PullArtifact returns the OCI artifact, or any other OCI image manifest, stored at ref.
+// Its blobs are read using Artifact.Config and Artifact.Layer.
+func (t *UdistributionTransport) PullArtifact(ctx context.Context, sys *types.SystemContext, ref types.ImageReference) (*Artifact, error) {
+	dr, err := t.artifactReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	if sys == nil {
+		sys = &types.SystemContext{}
+	}
+	src, err := dr.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	success := false
+	defer func() {
+		if !success {
+			src.Close()
+		}
+	}()
+	manifestBlob, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if mimeType != imgspecv1.MediaTypeImageManifest {
+		return nil, errors.Errorf("%s is a %s, not an OCI artifact", transports.ImageName(ref), mimeType)
+	}
+	a := &Artifact{src: src}
+	if err := json.Unmarshal(manifestBlob, &a.Manifest); err != nil {
+		return nil, errors.Wrapf(err, "decoding manifest of %s", transports.ImageName(ref))
+	}
+	manifestDigest, err := manifest.Digest(manifestBlob)
+	if err != nil {
+		return nil, err
+	}
+	a.Descriptor = imgspecv1.Descriptor{
+		MediaType:    mimeType,
+		ArtifactType: a.Manifest.ArtifactType,
+		Digest:       manifestDigest,
+		Size:         int64(len(manifestBlob)),
+		Annotations:  a.Manifest.Annotations,
+	}
+	if a.Descriptor.ArtifactType == "" {
+		a.Descriptor.ArtifactType = a.Manifest.Config.MediaType
+	}
+	success = true
+	return a, nil
+}
+
+// Config returns the content of the artifact config, which is verified against its digest as it is read.
+func (a *Artifact) Config(ctx context.Context) (io.ReadCloser, error) {
+	return a.getBlob(ctx, a.Manifest.Config)
+}
+
+// Layer returns the content of the index-th layer of the artifact, which is verified against its digest as it is read.
+func (a *Artifact) Layer(ctx context.Context, index int) (io.ReadCloser, error) {
+	if index < 0 || index >= len(a.Manifest.Layers) {
+		return nil, errors.Errorf("artifact %s has no layer %d", a.Descriptor.Digest, index)
+	}
+	return a.getBlob(ctx, a.Manifest.Layers[index])
+}
+
+// Close releases the resources associated with the artifact.
+func (a *Artifact) Close() error {
+	return a.src.Close()
+}
+
+func (a *Artifact) getBlob(ctx context.Context, desc imgspecv1.Descriptor) (io.ReadCloser, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid digest in artifact %s", a.Descriptor.Digest)
+	}
+	rc, _, err := a.src.GetBlob(ctx, types.BlobInfo{Digest: desc.Digest, Size: desc.Size, MediaType: desc.MediaType}, none.NoCache)
+	if err != nil {
+		return nil, err
+	}
+	return &verifiedBlobReader{rc: rc, digest: desc.Digest, verifier: desc.Digest.Verifier()}, nil
+}
+
+// verifiedBlobReader reads a blob, failing at EOF if its content does not match digest.
+type verifiedBlobReader struct {
+	rc       io.ReadCloser
+	digest   digest.Digest
+	verifier digest.Verifier
+}
+
+func (r *verifiedBlobReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	r.verifier.Write(p[:n])
+	if err == io.EOF && !r.verifier.Verified() {
+		return n, errors.Errorf("blob content does not match digest %s", r.digest)
+	}
+	return n, err
+}
+
+func (r *verifiedBlobReader) Close() error {
+	return r.rc.Close()
+}
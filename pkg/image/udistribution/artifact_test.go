@@ -0,0 +1,118 @@
+package udistribution
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/internal/testing/clienttest"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAllAndClose(t *testing.T, rc io.ReadCloser, err error) string {
+	require.NoError(t, err)
+	defer rc.Close()
+	content, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestPushPullArtifact(t *testing.T) {
+	ctx := context.Background()
+	sys := &types.SystemContext{}
+	ut, _ := newFilesystemTestTransport(t)
+	ref, err := ut.ParseReference("//charts/mychart:1.0.0")
+	require.NoError(t, err)
+
+	const (
+		chartConfigType  = "application/vnd.cncf.helm.config.v1+json"
+		chartContentType = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+		configContent    = `{"name":"mychart","version":"1.0.0"}`
+	)
+	layerContent := strings.Repeat("chart content", 1000)
+	desc, err := ut.PushArtifact(ctx, sys, ref, "", &ArtifactBlob{
+		MediaType: chartConfigType,
+		Content:   bytesReader(configContent),
+		Digest:    digest.FromString(configContent),
+		Size:      int64(len(configContent)),
+	}, []ArtifactBlob{
+		// Streamed, with an unknown digest and size.
+		{MediaType: chartContentType, Content: io.NopCloser(strings.NewReader(layerContent)), Annotations: map[string]string{imgspecv1.AnnotationTitle: "mychart-1.0.0.tgz"}},
+	}, map[string]string{"com.example.owner": "test"})
+	require.NoError(t, err)
+	assert.Equal(t, imgspecv1.MediaTypeImageManifest, desc.MediaType)
+
+	a, err := ut.PullArtifact(ctx, sys, ref)
+	require.NoError(t, err)
+	defer a.Close()
+	assert.Equal(t, desc.Digest, a.Descriptor.Digest)
+	assert.Equal(t, chartConfigType, a.Descriptor.ArtifactType)
+	assert.Equal(t, "test", a.Manifest.Annotations["com.example.owner"])
+	require.Len(t, a.Manifest.Layers, 1)
+	assert.Equal(t, chartContentType, a.Manifest.Layers[0].MediaType)
+	assert.Equal(t, digest.FromString(layerContent), a.Manifest.Layers[0].Digest)
+	assert.Equal(t, int64(len(layerContent)), a.Manifest.Layers[0].Size)
+	assert.Equal(t, "mychart-1.0.0.tgz", a.Manifest.Layers[0].Annotations[imgspecv1.AnnotationTitle])
+	rc, err := a.Config(ctx)
+	assert.Equal(t, configContent, readAllAndClose(t, rc, err))
+	rc, err = a.Layer(ctx, 0)
+	assert.Equal(t, layerContent, readAllAndClose(t, rc, err))
+	_, err = a.Layer(ctx, 1)
+	assert.Error(t, err)
+}
+
+func TestPushArtifactWithoutConfig(t *testing.T) {
+	ctx := context.Background()
+	sys := &types.SystemContext{}
+	ut, _ := newFilesystemTestTransport(t)
+	ref, err := ut.ParseReference("//backups/velero:backup-1")
+	require.NoError(t, err)
+
+	// An artifact type is required without a config.
+	_, err = ut.PushArtifact(ctx, sys, ref, "", nil, nil, nil)
+	assert.Error(t, err)
+
+	_, err = ut.PushArtifact(ctx, sys, ref, "application/vnd.example.backup.v1", nil, nil, nil)
+	require.NoError(t, err)
+	a, err := ut.PullArtifact(ctx, sys, ref)
+	require.NoError(t, err)
+	defer a.Close()
+	assert.Equal(t, "application/vnd.example.backup.v1", a.Descriptor.ArtifactType)
+	assert.Equal(t, imgspecv1.MediaTypeEmptyJSON, a.Manifest.Config.MediaType)
+	require.Len(t, a.Manifest.Layers, 1)
+	assert.Equal(t, imgspecv1.MediaTypeEmptyJSON, a.Manifest.Layers[0].MediaType)
+	rc, err := a.Layer(ctx, 0)
+	assert.Equal(t, "{}", readAllAndClose(t, rc, err))
+
+	// Blobs with a digest not matching their content are rejected.
+	_, err = ut.PushArtifact(ctx, sys, ref, "application/vnd.example.backup.v1", nil, []ArtifactBlob{
+		{MediaType: "application/octet-stream", Content: bytesReader("content"), Digest: digest.FromString("other"), Size: 7},
+	}, nil)
+	assert.Error(t, err)
+}
+
+func TestPullArtifactOfImage(t *testing.T) {
+	ctx := context.Background()
+	ut, _ := newFilesystemTestTransport(t)
+	ref, err := ut.ParseReference("//test/image:latest")
+	require.NoError(t, err)
+	clienttest.CopyFixtureImage(t, ref)
+
+	// The test image is a docker schema2 image, not an OCI artifact.
+	_, err = ut.PullArtifact(ctx, nil, ref)
+	assert.Error(t, err)
+
+	// References of other transports are rejected.
+	c, _ := clienttest.NewFilesystemClient(t, nil)
+	other := NewTransport(c, "other")
+	defer other.Deregister()
+	artifactRef, err := ut.ParseReference("//test/artifact:latest")
+	require.NoError(t, err)
+	_, err = other.PushArtifact(ctx, nil, artifactRef, "application/vnd.example.test", nil, nil, nil)
+	assert.ErrorContains(t, err, "does not belong to transport")
+}
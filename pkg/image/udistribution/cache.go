@@ -3,6 +3,11 @@ package udistribution
 import (
 	"github.com/containers/image/v5/docker/reference"
 	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/constants"
+	"github.com/migtools/udistribution/pkg/internal/image/blobinfocache"
+	"github.com/migtools/udistribution/pkg/internal/image/blobinfocache/boltdb"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
 )
 
 // bicTransportScope returns a BICTransportScope appropriate for ref.
@@ -21,3 +26,100 @@ func newBICLocationReference(ref udistributionReference) types.BICLocationRefere
 func parseBICLocationReference(lr types.BICLocationReference) (reference.Named, error) {
 	return reference.ParseNormalizedNamed(lr.Opaque)
 }
+
+// WithPersistentBlobInfoCache keeps a BlobInfoCache for the transport in a BoltDB database at path, in addition to the BlobInfoCache
+// callers pass to its image sources and destinations, so that blobs can be reused across repositories after the process restarts.
+// It records where blobs are stored, their compression, and pairs of compressed and uncompressed digests, keyed by the storage
+// identity of each backend (see client.Client.StorageIdentity) instead of the transport name, which is unique to a transport.
+func WithPersistentBlobInfoCache(path string) TransportOption {
+	return func(t *UdistributionTransport) {
+		t.persistentCache = blobinfocache.FromBlobInfoCache(boltdb.New(path))
+	}
+}
+
+// blobInfoCache returns the BlobInfoCache image sources and destinations of t use, given the cache of the caller.
+func (t *UdistributionTransport) blobInfoCache(cache types.BlobInfoCache) blobinfocache.BlobInfoCache2 {
+	if t.persistentCache == nil {
+		return blobinfocache.FromBlobInfoCache(cache)
+	}
+	return &transportBlobInfoCache{
+		BlobInfoCache2: blobinfocache.FromBlobInfoCache(cache),
+		persistent:     t.persistentCache,
+		storage:        storageTransport{name: constants.TransportPrefix + "storage-" + t.Client.StorageIdentity()},
+	}
+}
+
+// transportBlobInfoCache combines the BlobInfoCache of a caller with the persistent cache of a transport:
+// records go to both, and the persistent cache is consulted first.
+type transportBlobInfoCache struct {
+	blobinfocache.BlobInfoCache2 // of the caller
+	persistent                   blobinfocache.BlobInfoCache2
+	// storage stands for the transport in persistent.
+	storage types.ImageTransport
+}
+
+// learn records what the cache of the caller knows about blobDigest in the persistent cache, e.g. uncompressed digests
+// recorded by copy.Image, which only uses its own cache.
+func (c *transportBlobInfoCache) learn(blobDigest digest.Digest) {
+	if c.persistent.UncompressedDigest(blobDigest) != "" {
+		return
+	}
+	if uncompressed := c.BlobInfoCache2.UncompressedDigest(blobDigest); uncompressed != "" {
+		c.persistent.RecordDigestUncompressedPair(blobDigest, uncompressed)
+		if uncompressed == blobDigest {
+			c.persistent.RecordDigestCompressorName(blobDigest, blobinfocache.Uncompressed)
+		}
+	}
+}
+
+func (c *transportBlobInfoCache) UncompressedDigest(anyDigest digest.Digest) digest.Digest {
+	if uncompressed := c.persistent.UncompressedDigest(anyDigest); uncompressed != "" {
+		return uncompressed
+	}
+	return c.BlobInfoCache2.UncompressedDigest(anyDigest)
+}
+
+func (c *transportBlobInfoCache) RecordDigestUncompressedPair(anyDigest digest.Digest, uncompressed digest.Digest) {
+	c.persistent.RecordDigestUncompressedPair(anyDigest, uncompressed)
+	c.BlobInfoCache2.RecordDigestUncompressedPair(anyDigest, uncompressed)
+}
+
+func (c *transportBlobInfoCache) RecordDigestCompressorName(anyDigest digest.Digest, compressorName string) {
+	c.persistent.RecordDigestCompressorName(anyDigest, compressorName)
+	c.BlobInfoCache2.RecordDigestCompressorName(anyDigest, compressorName)
+}
+
+func (c *transportBlobInfoCache) RecordKnownLocation(transport types.ImageTransport, scope types.BICTransportScope, blobDigest digest.Digest, location types.BICLocationReference) {
+	c.learn(blobDigest)
+	c.persistent.RecordKnownLocation(c.storage, scope, blobDigest, location)
+	c.BlobInfoCache2.RecordKnownLocation(transport, scope, blobDigest, location)
+}
+
+func (c *transportBlobInfoCache) CandidateLocations(transport types.ImageTransport, scope types.BICTransportScope, blobDigest digest.Digest, canSubstitute bool) []types.BICReplacementCandidate {
+	c.learn(blobDigest)
+	return append(c.persistent.CandidateLocations(c.storage, scope, blobDigest, canSubstitute),
+		c.BlobInfoCache2.CandidateLocations(transport, scope, blobDigest, canSubstitute)...)
+}
+
+func (c *transportBlobInfoCache) CandidateLocations2(transport types.ImageTransport, scope types.BICTransportScope, blobDigest digest.Digest, canSubstitute bool) []blobinfocache.BICReplacementCandidate2 {
+	c.learn(blobDigest)
+	return append(c.persistent.CandidateLocations2(c.storage, scope, blobDigest, canSubstitute),
+		c.BlobInfoCache2.CandidateLocations2(transport, scope, blobDigest, canSubstitute)...)
+}
+
+// storageTransport identifies the storage of a transport backend in a persistent BlobInfoCache, which only uses its Name.
+type storageTransport struct {
+	name string
+}
+
+func (t storageTransport) Name() string {
+	return t.name
+}
+
+func (t storageTransport) ParseReference(reference string) (types.ImageReference, error) {
+	return nil, errors.Errorf("%s only identifies a storage in a BlobInfoCache", t.name)
+}
+
+func (t storageTransport) ValidatePolicyConfigurationScope(scope string) error {
+	return errors.Errorf("%s only identifies a storage in a BlobInfoCache", t.name)
+}
@@ -0,0 +1,65 @@
+package udistribution
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/client"
+	"github.com/migtools/udistribution/pkg/internal/testing/clienttest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPersistentBlobInfoCache(t *testing.T) {
+	ctx := context.Background()
+	cachePath := filepath.Join(t.TempDir(), "blob-info-cache.boltdb")
+	c, dir := clienttest.NewFilesystemClient(t, nil)
+	ut := NewTransport(c, "filesystem", WithPersistentBlobInfoCache(cachePath))
+	t.Cleanup(ut.Deregister)
+	ref, err := ut.ParseReference("//test/a:latest")
+	require.NoError(t, err)
+	dest, err := ref.NewImageDestination(ctx, &types.SystemContext{})
+	require.NoError(t, err)
+	info, err := dest.PutBlob(ctx, bytesReader("cached blob"), types.BlobInfo{Size: -1}, none.NoCache, false)
+	require.NoError(t, err)
+	require.NoError(t, dest.Close())
+
+	// A new transport for the same storage, as after a restart, finds the blob in the cache.
+	restarted, err := client.NewClient("", []string{
+		"REGISTRY_STORAGE=filesystem",
+		"REGISTRY_STORAGE_FILESYSTEM_ROOTDIRECTORY=" + dir,
+		"REGISTRY_STORAGE_CACHE_BLOBDESCRIPTOR=inmemory",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, c.StorageIdentity(), restarted.StorageIdentity())
+	other, _ := clienttest.NewFilesystemClient(t, nil)
+	assert.NotEqual(t, c.StorageIdentity(), other.StorageIdentity())
+
+	for _, tc := range []struct {
+		name     string
+		opts     []TransportOption
+		expected bool
+	}{
+		{"without persistent cache", nil, false},
+		{"with persistent cache", []TransportOption{WithPersistentBlobInfoCache(cachePath)}, true},
+	} {
+		ut := NewTransport(restarted, "filesystem", tc.opts...)
+		t.Cleanup(ut.Deregister)
+		ref, err := ut.ParseReference("//test/b:latest")
+		require.NoError(t, err)
+		dest, err := ref.NewImageDestination(ctx, &types.SystemContext{})
+		require.NoError(t, err)
+		reused, reusedInfo, err := dest.TryReusingBlob(ctx, types.BlobInfo{Digest: info.Digest, Size: -1}, none.NoCache, true)
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, tc.expected, reused, tc.name)
+		if tc.expected {
+			assert.Equal(t, info.Size, reusedInfo.Size, tc.name)
+		}
+		require.NoError(t, dest.Close())
+	}
+	_, err = restarted.OpenBlob(ctx, "test/b", info.Digest)
+	assert.NoError(t, err)
+}
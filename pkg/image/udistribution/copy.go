@@ -0,0 +1,160 @@
+package udistribution
+
+import (
+	"context"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/client"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// blobLinkingDestination is an ImageDestination of a udistribution transport, which can link blobs from other repositories,
+// and copy blobs from other registries with the server-side copy of their storage.
+type blobLinkingDestination interface {
+	types.ImageDestination
+	reuseBlobFrom(ctx context.Context, srcRepo reference.Named, srcDigest digest.Digest) (bool, int64, error)
+	copyBlobFrom(ctx context.Context, src *client.Client, srcRepo reference.Named, srcDigest digest.Digest) (int64, error)
+}
+
+var (
+	_ blobLinkingDestination = (*dockerImageDestination)(nil)
+	_ blobLinkingDestination = (*replicatedImageDestination)(nil)
+)
+
+// Copy copies the image srcRef to dstRef, which must both be udistributionReferences, and returns the digest of its manifest.
+// Within a transport, blobs are linked into the destination repository through the registry storage, without moving any data.
+// Between transports, blob data is copied by the storage backend where both storages support it, see client.Client.CopyBlob,
+// and streamed from the source to the destination otherwise.
+// The manifest, and the manifests of all instances of a manifest list, are written to dstRef, tagging it if dstRef has a tag.
+// Signatures are not copied.
+func Copy(ctx context.Context, sys *types.SystemContext, srcRef, dstRef types.ImageReference) (digest.Digest, error) {
+	src, ok := srcRef.(udistributionReference)
+	if !ok {
+		return "", errors.Errorf("srcRef must be a udistributionReference")
+	}
+	dst, ok := dstRef.(udistributionReference)
+	if !ok {
+		return "", errors.Errorf("dstRef must be a udistributionReference")
+	}
+	if sys == nil {
+		sys = &types.SystemContext{}
+	}
+	imgSrc, err := newImageSource(ctx, sys, src)
+	if err != nil {
+		return "", err
+	}
+	defer imgSrc.Close()
+	d, err := newImageDestination(sys, dst)
+	if err != nil {
+		return "", err
+	}
+	defer d.Close()
+	dest := d.(blobLinkingDestination)
+
+	srcRepo := imgSrc.physicalRef.ref
+	copyBlob := func(ctx context.Context, blob types.BlobInfo) error {
+		exists, _, err := dest.reuseBlobFrom(ctx, srcRepo, blob.Digest)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errors.Errorf("blob %s is not stored in %s", blob.Digest, srcRepo.Name())
+		}
+		return nil
+	}
+	if src.UdistributionTransport.Name() != dst.UdistributionTransport.Name() {
+		copyBlob = func(ctx context.Context, blob types.BlobInfo) error {
+			return copyBlobBetweenTransports(ctx, imgSrc, dest, blob)
+		}
+	}
+
+	manifestBlob, mimeType, err := imgSrc.GetManifest(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	if err := copyManifest(ctx, imgSrc, dest, manifestBlob, mimeType, nil, copyBlob); err != nil {
+		return "", errors.Wrapf(err, "copying %s to %s", transports.ImageName(srcRef), transports.ImageName(dstRef))
+	}
+	if err := dest.Commit(ctx, nil); err != nil {
+		return "", err
+	}
+	return manifest.Digest(manifestBlob)
+}
+
+// copyBlobBetweenTransports copies blob from the repository of imgSrc to dest, of another transport.
+// Blobs already in the destination repository are not copied; others are copied by the storage of the destination
+// if it can, and streamed from imgSrc if it can not.
+func copyBlobBetweenTransports(ctx context.Context, imgSrc *udistributionImageSource, dest blobLinkingDestination, blob types.BlobInfo) error {
+	dstRef := dest.Reference().(udistributionReference)
+	exists, _, err := dest.reuseBlobFrom(ctx, dstRef.ref, blob.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	srcRepo := imgSrc.physicalRef.ref
+	_, err = dest.copyBlobFrom(ctx, imgSrc.physicalRef.UdistributionTransport.Client, srcRepo, blob.Digest)
+	if err == nil {
+		return nil
+	}
+	logrus.Debugf("Server-side copy of blob %s from %s failed, streaming it: %v", blob.Digest, srcRepo.Name(), err)
+	stream, size, err := imgSrc.GetBlob(ctx, blob, none.NoCache)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	_, err = dest.PutBlob(ctx, stream, types.BlobInfo{Digest: blob.Digest, Size: size, MediaType: blob.MediaType}, none.NoCache, false)
+	return err
+}
+
+// copyManifest copies the blobs referenced by manifestBlob, of mimeType, from the repository of imgSrc to dest with copyBlob,
+// and writes the manifest, as the instance instanceDigest of a manifest list if not nil.
+// The instances of manifest lists are copied and written first.
+func copyManifest(ctx context.Context, imgSrc *udistributionImageSource, dest types.ImageDestination, manifestBlob []byte, mimeType string, instanceDigest *digest.Digest,
+	copyBlob func(ctx context.Context, blob types.BlobInfo) error) error {
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		list, err := manifest.ListFromBlob(manifestBlob, mimeType)
+		if err != nil {
+			return err
+		}
+		for _, instance := range list.Instances() {
+			instance := instance
+			instanceBlob, instanceMIMEType, err := imgSrc.GetManifest(ctx, &instance)
+			if err != nil {
+				return err
+			}
+			if err := copyManifest(ctx, imgSrc, dest, instanceBlob, instanceMIMEType, &instance, copyBlob); err != nil {
+				return err
+			}
+		}
+		return dest.PutManifest(ctx, manifestBlob, instanceDigest)
+	}
+
+	m, err := manifest.FromBlob(manifestBlob, mimeType)
+	if err != nil {
+		return err
+	}
+	blobs := []types.BlobInfo{}
+	if config := m.ConfigInfo(); config.Digest != "" {
+		blobs = append(blobs, config)
+	}
+	for _, layer := range m.LayerInfos() {
+		blobs = append(blobs, layer.BlobInfo)
+	}
+	for _, blob := range blobs {
+		if len(blob.URLs) != 0 {
+			continue // A foreign layer, not stored in the registry.
+		}
+		if err := copyBlob(ctx, blob); err != nil {
+			return err
+		}
+	}
+	return dest.PutManifest(ctx, manifestBlob, instanceDigest)
+}
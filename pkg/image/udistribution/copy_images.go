@@ -0,0 +1,354 @@
+package udistribution
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/pkg/compression"
+	compressiontypes "github.com/containers/image/v5/pkg/compression/types"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	// defaultMaxParallelImages is the number of images CopyImages copies at once by default.
+	defaultMaxParallelImages = 4
+	// defaultMaxParallelDownloads is the number of blobs CopyImages copies at once by default, as copy.Image does for a single image.
+	defaultMaxParallelDownloads = 6
+)
+
+// CopyPair is an image copied by CopyImages, from Src to Dest.
+type CopyPair struct {
+	Src  types.ImageReference
+	Dest types.ImageReference
+}
+
+// ImageCopier copies the image of pair in place of copy.Image, setting copy.Options.ConcurrentBlobCopiesSemaphore to blobCopies,
+// and returns the manifest written to pair.Dest. It is called concurrently: as a signature.PolicyContext can not be used
+// by concurrent copies, it should create one for each copy.
+type ImageCopier func(ctx context.Context, pair CopyPair, blobCopies *semaphore.Weighted) ([]byte, error)
+
+// CopyImagesOptions configures CopyImages.
+type CopyImagesOptions struct {
+	// Policy is the signature policy every image is checked against when copied; it must be set unless Copy is.
+	Policy *signature.Policy
+	// Options, if not nil, are the options of every copy.Image call. ConcurrentBlobCopiesSemaphore is replaced by the
+	// semaphore of the batch, see MaxParallelDownloads; ReportWriter and Progress, if set, are shared by concurrent copies.
+	Options *copy.Options
+	// Copy, if set, copies each image instead of copy.Image; Policy and Options are then not used.
+	Copy ImageCopier
+	// MaxParallelImages is the number of images copied at once; 0 means 4.
+	MaxParallelImages int
+	// MaxParallelDownloads is the number of blobs copied at once by the whole batch; 0 means 6.
+	MaxParallelDownloads uint
+	// Done, if set, is called with the index in pairs and the result of each copy once it is done; calls are not concurrent.
+	Done func(index int, result CopyResult)
+}
+
+// CopyResult is the result of the copy of an image by CopyImages.
+type CopyResult struct {
+	CopyPair
+	// Manifest is the manifest written to Dest, if the copy succeeded.
+	Manifest []byte
+	Err      error
+}
+
+// CopyImages copies the images of pairs with copy.Image, several at once, and returns the result of each copy in the order of pairs.
+// Copies are started in the order of pairs; once ctx is done, the copies not started yet fail with its error.
+// Blobs uploaded by a copy to a udistribution transport are uploaded once for the whole batch: copies of other images needing
+// a blob while it is uploaded to the same storage wait for the upload, and link the blob instead of uploading it again.
+// Uploads a copy did not finish are released before opts.Done is called for it.
+// It returns an error if any copy failed.
+func CopyImages(ctx context.Context, pairs []CopyPair, opts CopyImagesOptions) ([]CopyResult, error) {
+	copyImage := opts.Copy
+	if copyImage == nil {
+		if opts.Policy == nil {
+			return nil, errors.New("neither CopyImagesOptions.Policy nor CopyImagesOptions.Copy is set")
+		}
+		copyImage = policyCopier(opts.Policy, opts.Options)
+	}
+	maxImages := opts.MaxParallelImages
+	if maxImages <= 0 {
+		maxImages = defaultMaxParallelImages
+	}
+	maxDownloads := opts.MaxParallelDownloads
+	if maxDownloads == 0 {
+		maxDownloads = defaultMaxParallelDownloads
+	}
+	blobCopies := semaphore.NewWeighted(int64(maxDownloads))
+
+	uploads := &blobUploads{uploads: map[blobUploadKey]*blobUpload{}, waits: map[[2]int]int{}}
+	results := make([]CopyResult, len(pairs))
+	var doneMutex sync.Mutex
+	done := func(i int) {
+		if opts.Done != nil {
+			doneMutex.Lock()
+			defer doneMutex.Unlock()
+			opts.Done(i, results[i])
+		}
+	}
+	// A slot is taken before starting the goroutine of a copy, so that copies start in the order of pairs.
+	slots := make(chan struct{}, maxImages)
+	var wg sync.WaitGroup
+	for i, pair := range pairs {
+		results[i].CopyPair = pair
+		acquired := false
+		select {
+		case slots <- struct{}{}:
+			acquired = true
+		case <-ctx.Done():
+		}
+		if err := ctx.Err(); err != nil {
+			// Both cases may have been ready: do not start copies once ctx is done.
+			if acquired {
+				<-slots
+			}
+			results[i].Err = err
+			done(i)
+			continue
+		}
+		wg.Add(1)
+		go func(i int, pair CopyPair) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			batch := &batchCopy{uploads: uploads, id: i}
+			results[i].Manifest, results[i].Err = copyImage(context.WithValue(ctx, batchCopyKey{}, batch), pair, blobCopies)
+			uploads.releaseAll(batch.id)
+			done(i)
+		}(i, pair)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	if failed != 0 {
+		return results, errors.Errorf("copying %d of %d images failed", failed, len(pairs))
+	}
+	return results, nil
+}
+
+// policyCopier returns an ImageCopier copying images with copy.Image, with options if not nil, checking them against policy.
+func policyCopier(policy *signature.Policy, options *copy.Options) ImageCopier {
+	return func(ctx context.Context, pair CopyPair, blobCopies *semaphore.Weighted) ([]byte, error) {
+		policyContext, err := signature.NewPolicyContext(policy)
+		if err != nil {
+			return nil, err
+		}
+		defer policyContext.Destroy()
+		imageOptions := copy.Options{}
+		if options != nil {
+			imageOptions = *options
+		}
+		imageOptions.ConcurrentBlobCopiesSemaphore = blobCopies
+		return copy.Image(ctx, policyContext, pair.Dest, pair.Src, &imageOptions)
+	}
+}
+
+// batchCopy is the copy of one image by CopyImages, in the context of its operations.
+type batchCopy struct {
+	uploads *blobUploads
+	id      int
+}
+
+type batchCopyKey struct{}
+
+// batchCopyFromContext returns the copy of CopyImages ctx is for, or nil.
+func batchCopyFromContext(ctx context.Context) *batchCopy {
+	batch, _ := ctx.Value(batchCopyKey{}).(*batchCopy)
+	return batch
+}
+
+// withoutBatchCopy returns ctx without the copy of CopyImages it is for; replicated writes are not deduplicated,
+// as waiting for an upload to one replica while holding the upload of another could deadlock concurrent copies.
+func withoutBatchCopy(ctx context.Context) context.Context {
+	if batchCopyFromContext(ctx) == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, batchCopyKey{}, (*batchCopy)(nil))
+}
+
+// blobUploads tracks the blob uploads of the copies of a CopyImages batch.
+type blobUploads struct {
+	mutex sync.Mutex
+	// uploads are the uploads in progress, and the successful ones.
+	uploads map[blobUploadKey]*blobUpload
+	// waits counts the waits of copies, by waiting copy and owner of the awaited upload.
+	waits map[[2]int]int
+}
+
+// blobUploadKey identifies a blob in a storage, see client.Client.StorageIdentity.
+type blobUploadKey struct {
+	storage string
+	digest  digest.Digest
+}
+
+// blobUpload is a blob upload claimed by a copy.
+type blobUpload struct {
+	owner int
+	done  chan struct{}
+	// repo is the repository the blob was uploaded to; nil if the upload failed. Only valid after done is closed.
+	repo reference.Named
+	// blob is the uploaded blob; its CompressionAlgorithm is set if the copy compressed it. Only valid after done is closed.
+	blob types.BlobInfo
+}
+
+// claim returns the upload of key, if claimed by another copy than owner, and then owner must call doneWaiting once it is done waiting for it.
+// Otherwise it claims the upload for owner, unless already claimed, and returns nil.
+// An upload claimed by a copy is only done once the copy uploaded the blob, or is finished if it did not; it is not waited for
+// if its copy waits, directly or not, for an upload of owner, so that copies never wait for each other.
+func (u *blobUploads) claim(owner int, key blobUploadKey) *blobUpload {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	upload, ok := u.uploads[key]
+	if !ok {
+		u.uploads[key] = &blobUpload{owner: owner, done: make(chan struct{})}
+		return nil
+	}
+	if upload.owner == owner {
+		return nil
+	}
+	select {
+	case <-upload.done:
+	default:
+		if u.waitsFor(upload.owner, owner) {
+			return nil
+		}
+	}
+	u.waits[[2]int{owner, upload.owner}]++
+	return upload
+}
+
+// doneWaiting records that waiter stopped waiting for upload.
+func (u *blobUploads) doneWaiting(waiter int, upload *blobUpload) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	edge := [2]int{waiter, upload.owner}
+	if u.waits[edge]--; u.waits[edge] == 0 {
+		delete(u.waits, edge)
+	}
+}
+
+// waitsFor returns true if copy waiter waits for an upload of owner, directly or through the uploads of other copies.
+// The caller must hold u.mutex.
+func (u *blobUploads) waitsFor(waiter, owner int) bool {
+	visited := map[int]bool{waiter: true}
+	pending := []int{waiter}
+	for len(pending) != 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		for edge := range u.waits {
+			if edge[0] != current || visited[edge[1]] {
+				continue
+			}
+			if edge[1] == owner {
+				return true
+			}
+			visited[edge[1]] = true
+			pending = append(pending, edge[1])
+		}
+	}
+	return false
+}
+
+// finish ends the upload of key claimed by owner, which uploaded blob to repo, or failed if repo is nil.
+func (u *blobUploads) finish(owner int, key blobUploadKey, repo reference.Named, blob types.BlobInfo) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	upload, ok := u.uploads[key]
+	if !ok || upload.owner != owner || upload.repo != nil {
+		return
+	}
+	upload.repo = repo
+	upload.blob = blob
+	close(upload.done)
+	if repo == nil {
+		delete(u.uploads, key)
+	}
+}
+
+// releaseAll ends the uploads claimed by owner and never finished, e.g. because the copy failed before uploading the blob.
+func (u *blobUploads) releaseAll(owner int) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	for key, upload := range u.uploads {
+		if upload.owner == owner && upload.repo == nil {
+			close(upload.done)
+			delete(u.uploads, key)
+		}
+	}
+}
+
+// digestUncompressed returns a reader of stream which computes the digest of the uncompressed data of stream while it is read.
+// The returned function must be called once the reader is not used anymore, with the error of the upload of the data, if any;
+// it returns the digest of the uncompressed data and the compression of stream, nil if uncompressed,
+// or "" if stream was not read to the end without error.
+// It fails if the start of stream, used to detect its compression, can not be read.
+func digestUncompressed(stream io.Reader) (io.Reader, func(err error) (digest.Digest, *compressiontypes.Algorithm), error) {
+	algorithm, decompressor, detected, err := compression.DetectCompressionFormat(stream)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := &eofReader{r: detected}
+	if decompressor == nil {
+		digester := digest.Canonical.Digester()
+		reader.r = io.TeeReader(detected, digester.Hash())
+		return reader, func(err error) (digest.Digest, *compressiontypes.Algorithm) {
+			if err != nil || !reader.eof {
+				return "", nil
+			}
+			return digester.Digest(), nil
+		}, nil
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	reader.r = io.TeeReader(detected, pipeWriter)
+	uncompressed := make(chan digest.Digest, 1)
+	go func() {
+		var dgst digest.Digest
+		if data, err := decompressor(pipeReader); err == nil {
+			digester := digest.Canonical.Digester()
+			if _, err := io.Copy(digester.Hash(), data); err == nil {
+				dgst = digester.Digest()
+			}
+			data.Close()
+		}
+		// Keep consuming the data, if decompressing it failed.
+		_, _ = io.Copy(io.Discard, pipeReader)
+		uncompressed <- dgst
+	}()
+	return reader, func(err error) (digest.Digest, *compressiontypes.Algorithm) {
+		if err == nil && !reader.eof {
+			err = io.ErrUnexpectedEOF
+		}
+		pipeWriter.CloseWithError(err)
+		dgst := <-uncompressed
+		if err != nil || dgst == "" {
+			return "", nil
+		}
+		return dgst, &algorithm
+	}, nil
+}
+
+// eofReader records whether its reader was read to the end.
+type eofReader struct {
+	r   io.Reader
+	eof bool
+}
+
+func (r *eofReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
@@ -0,0 +1,167 @@
+package udistribution
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/image/udistribution/archive"
+	"github.com/migtools/udistribution/pkg/internal/testing/clienttest"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/semaphore"
+)
+
+func TestCopyImages(t *testing.T) {
+	ctx := context.Background()
+	var mutex sync.Mutex
+	uploads := map[digest.Digest]int{}
+	ut, _ := newFilesystemTestTransport(t, WithTransferProgress(TransferProgressOptions{
+		OnProgress: func(p TransferProgress) {
+			if p.Direction == TransferUpload && p.Event == TransferCompleted {
+				mutex.Lock()
+				uploads[p.Digest]++
+				mutex.Unlock()
+			}
+		},
+	}))
+	src, err := archive.ParseReference(clienttest.ArchiveFixture)
+	require.NoError(t, err)
+	missing, err := ut.ParseReference("//test/missing:latest")
+	require.NoError(t, err)
+	names := []string{"//test/a:latest", "//test/b:latest", "//other/c:latest", "//other/d:latest", "//test/missing-copy:latest"}
+	pairs := []CopyPair{}
+	for _, name := range names {
+		dest, err := ut.ParseReference(name)
+		require.NoError(t, err)
+		pairs = append(pairs, CopyPair{Src: src, Dest: dest})
+	}
+	pairs[len(pairs)-1].Src = missing
+
+	results, err := CopyImages(ctx, pairs, CopyImagesOptions{
+		Policy:            &signature.Policy{Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()}},
+		Options:           &copy.Options{SourceCtx: &types.SystemContext{}, DestinationCtx: &types.SystemContext{}},
+		MaxParallelImages: 4,
+	})
+	assert.Error(t, err)
+	require.Len(t, results, len(pairs))
+	for i, result := range results[:len(results)-1] {
+		require.NoError(t, result.Err, i)
+		assert.NotEmpty(t, result.Manifest)
+		assert.Equal(t, pairs[i], result.CopyPair)
+		assertImageIn(t, ut.Client, names[i])
+	}
+	assert.Error(t, results[len(results)-1].Err)
+
+	// The layer and the config shared by all images are uploaded once.
+	assert.Len(t, uploads, 2)
+	for dgst, n := range uploads {
+		assert.Equal(t, 1, n, dgst.String())
+	}
+
+	_, err = CopyImages(ctx, pairs, CopyImagesOptions{})
+	assert.Error(t, err)
+
+	// The policy applies to every copy.
+	rejected, err := CopyImages(ctx, pairs[:2], CopyImagesOptions{
+		Policy: &signature.Policy{Default: []signature.PolicyRequirement{signature.NewPRReject()}},
+	})
+	assert.Error(t, err)
+	for _, result := range rejected {
+		assert.Error(t, result.Err)
+	}
+}
+
+func TestCopyImagesCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pairs := make([]CopyPair, 5)
+	started := []int{}
+	done := []int{}
+	results, err := CopyImages(ctx, pairs, CopyImagesOptions{
+		Copy: func(ctx context.Context, pair CopyPair, blobCopies *semaphore.Weighted) ([]byte, error) {
+			started = append(started, len(started))
+			cancel()
+			return nil, ctx.Err()
+		},
+		MaxParallelImages: 1,
+		Done: func(index int, result CopyResult) {
+			done = append(done, index)
+			assert.ErrorIs(t, result.Err, context.Canceled)
+		},
+	})
+	assert.Error(t, err)
+	// Copies not started once the context is cancelled fail without being attempted.
+	assert.Equal(t, []int{0}, started)
+	assert.ElementsMatch(t, []int{0, 1, 2, 3, 4}, done)
+	for _, result := range results {
+		assert.ErrorIs(t, result.Err, context.Canceled)
+	}
+}
+
+func TestDigestUncompressed(t *testing.T) {
+	data := strings.Repeat("uncompressed ", 1000)
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err := gz.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	for _, c := range []struct {
+		name       string
+		stream     []byte
+		compressed bool
+	}{
+		{"gzip", compressed.Bytes(), true},
+		{"uncompressed", []byte(data), false},
+	} {
+		reader, uncompressedDigest, err := digestUncompressed(bytes.NewReader(c.stream))
+		require.NoError(t, err, c.name)
+		read, err := io.ReadAll(reader)
+		require.NoError(t, err, c.name)
+		assert.Equal(t, c.stream, read, c.name)
+		dgst, algorithm := uncompressedDigest(nil)
+		assert.Equal(t, digest.FromString(data), dgst, c.name)
+		assert.Equal(t, c.compressed, algorithm != nil, c.name)
+
+		// Streams not read to the end have no digest.
+		reader, uncompressedDigest, err = digestUncompressed(bytes.NewReader(c.stream))
+		require.NoError(t, err, c.name)
+		_, err = reader.Read(make([]byte, 10))
+		require.NoError(t, err, c.name)
+		dgst, _ = uncompressedDigest(nil)
+		assert.Empty(t, dgst, c.name)
+	}
+
+	// Streams which can not be read fail.
+	readErr := errors.New("read failed")
+	_, _, err = digestUncompressed(iotest.ErrReader(readErr))
+	assert.ErrorIs(t, err, readErr)
+}
+
+func TestBatchPutBlobReadError(t *testing.T) {
+	ctx := context.Background()
+	ut, _ := newFilesystemTestTransport(t)
+	ref, err := ut.ParseReference("//test/batch:latest")
+	require.NoError(t, err)
+	dest, err := ref.NewImageDestination(ctx, &types.SystemContext{})
+	require.NoError(t, err)
+	defer dest.Close()
+	uploads := &blobUploads{uploads: map[blobUploadKey]*blobUpload{}, waits: map[[2]int]int{}}
+	ctx = context.WithValue(ctx, batchCopyKey{}, &batchCopy{uploads: uploads})
+
+	// Blobs compressed by the copy, of unknown digest, report the errors reading them.
+	readErr := errors.New("read failed")
+	_, err = dest.PutBlob(ctx, iotest.ErrReader(readErr), types.BlobInfo{Size: -1}, none.NoCache, false)
+	assert.ErrorIs(t, err, readErr)
+}
@@ -0,0 +1,157 @@
+package udistribution
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/auth"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/migtools/udistribution/pkg/client"
+	"github.com/migtools/udistribution/pkg/internal/testing/clienttest"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	sys := &types.SystemContext{}
+	transfers := 0
+	ut, _ := newFilesystemTestTransport(t, WithTransferProgress(TransferProgressOptions{
+		OnProgress: func(p TransferProgress) { transfers++ },
+	}))
+	srcRef, err := ut.ParseReference("//test/app:latest")
+	require.NoError(t, err)
+	imageManifest := clienttest.CopyFixtureImage(t, srcRef)
+	imageDigest, err := manifest.Digest(imageManifest)
+	require.NoError(t, err)
+
+	// An index of the image, to copy it with all its instances.
+	index, err := json.Marshal(imgspecv1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageIndex,
+		Manifests: []imgspecv1.Descriptor{{MediaType: manifest.GuessMIMEType(imageManifest), Digest: imageDigest, Size: int64(len(imageManifest))}},
+	})
+	require.NoError(t, err)
+	indexRef, err := ut.ParseReference("//test/app:index")
+	require.NoError(t, err)
+	dest, err := indexRef.NewImageDestination(ctx, sys)
+	require.NoError(t, err)
+	require.NoError(t, dest.PutManifest(ctx, index, nil))
+	require.NoError(t, dest.Close())
+
+	transfers = 0
+	for _, c := range []struct{ src, dst string }{
+		{"//test/app:latest", "//test/copy:v1"},
+		{"//test/app:index", "//other/index:v1"},
+		{"//test/app@" + imageDigest.String(), "//test/copy@" + imageDigest.String()}, // already present
+	} {
+		src, err := ut.ParseReference(c.src)
+		require.NoError(t, err)
+		dst, err := ut.ParseReference(c.dst)
+		require.NoError(t, err)
+		copied, err := Copy(ctx, sys, src, dst)
+		require.NoError(t, err, c.dst)
+		assertImageIn(t, ut.Client, c.dst)
+
+		img, err := dst.NewImageSource(ctx, sys)
+		require.NoError(t, err)
+		m, _, err := img.GetManifest(ctx, nil)
+		require.NoError(t, err)
+		img.Close()
+		manifestDigest, err := manifest.Digest(m)
+		require.NoError(t, err)
+		assert.Equal(t, manifestDigest, copied, c.dst)
+	}
+	assertImageIn(t, ut.Client, "//other/index@"+imageDigest.String())
+	assert.Zero(t, transfers, "no blob data is transferred")
+}
+
+func TestCopyAcrossTransports(t *testing.T) {
+	ctx := context.Background()
+	transfers := 0
+	countTransfers := WithTransferProgress(TransferProgressOptions{
+		OnProgress: func(p TransferProgress) { transfers++ },
+	})
+	ut, _ := newFilesystemTestTransport(t, countTransfers)
+	other, _ := newFilesystemTestTransport(t, countTransfers)
+	src, err := ut.ParseReference("//test/app:latest")
+	require.NoError(t, err)
+	imageManifest := clienttest.CopyFixtureImage(t, src)
+	imageDigest, err := manifest.Digest(imageManifest)
+	require.NoError(t, err)
+
+	transfers = 0
+	for _, dst := range []string{"//test/app:latest", "//test/copy:v1"} { // the second copy finds the blob data stored
+		dstRef, err := other.ParseReference(dst)
+		require.NoError(t, err)
+		copied, err := Copy(ctx, nil, src, dstRef)
+		require.NoError(t, err, dst)
+		assert.Equal(t, imageDigest, copied, dst)
+		assertImageIn(t, other.Client, dst)
+	}
+	assert.Zero(t, transfers, "blob data is copied by the storage")
+
+	// Blobs the source repository does not contain are not copied.
+	_, err = other.Client.CopyBlob(ctx, ut.Client, "test/app", "test/other", digest.FromString("unknown"))
+	assert.ErrorIs(t, err, distribution.ErrBlobUnknown)
+
+	// Nothing is copied to a repository the authorizer of the destination denies pushing to.
+	denying, deniedDir := clienttest.NewFilesystemClient(t, nil, client.WithAuthorizer(client.AuthorizerFunc(func(ctx context.Context, user string, access auth.Access) error {
+		if access.Action == "push" && access.Name == "test/denied" {
+			return errors.New("push denied")
+		}
+		return nil
+	})))
+	denyingTransport := NewTransport(denying, "denying")
+	t.Cleanup(denyingTransport.Deregister)
+	deniedRef, err := denyingTransport.ParseReference("//test/denied:v1")
+	require.NoError(t, err)
+	_, err = Copy(ctx, nil, src, deniedRef)
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(deniedDir, "docker/registry/v2/blobs"))
+	assert.True(t, os.IsNotExist(err), "no blob data is copied")
+	_, err = os.Stat(filepath.Join(deniedDir, "docker/registry/v2/repositories/test/denied/_layers"))
+	assert.True(t, os.IsNotExist(err), "no blob is linked")
+}
+
+func TestCopyAcrossTransportsStreaming(t *testing.T) {
+	ctx := context.Background()
+	ut, _ := newFilesystemTestTransport(t)
+	src, err := ut.ParseReference("//test/app:latest")
+	require.NoError(t, err)
+	imageManifest := clienttest.CopyFixtureImage(t, src)
+	m, err := manifest.FromBlob(imageManifest, manifest.GuessMIMEType(imageManifest))
+	require.NoError(t, err)
+
+	// The storage of the destination can not copy from the storage of the source, so blobs are streamed.
+	c, err := client.NewClient("", []string{"REGISTRY_STORAGE=inmemory", "REGISTRY_STORAGE_CACHE_BLOBDESCRIPTOR=inmemory"})
+	require.NoError(t, err)
+	uploads := 0
+	other := NewTransport(c, "inmemory", WithTransferProgress(TransferProgressOptions{
+		OnProgress: func(p TransferProgress) {
+			if p.Event == TransferCompleted {
+				uploads++
+			}
+		},
+	}))
+	t.Cleanup(other.Deregister)
+	_, err = c.CopyBlob(ctx, ut.Client, "test/app", "test/app", m.ConfigInfo().Digest)
+	require.ErrorIs(t, err, client.ErrServerSideCopyUnsupported)
+
+	dst, err := other.ParseReference("//test/app:latest")
+	require.NoError(t, err)
+	_, err = Copy(ctx, nil, src, dst)
+	require.NoError(t, err)
+	assertImageIn(t, c, "//test/app:latest")
+	assert.NotZero(t, uploads)
+}
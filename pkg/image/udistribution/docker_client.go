@@ -45,6 +45,7 @@ const (
 	blobsPath               = "/v2/%s/blobs/%s"
 	blobUploadPath          = "/v2/%s/blobs/uploads/"
 	extensionsSignaturePath = "/extensions/v2/%s/signatures/%s"
+	blobLinkPath            = "/extensions/v2/%s/blobs/%s/link"
 
 	minimumTokenLifetimeSeconds = 60
 
@@ -299,21 +300,23 @@ func newDockerClient(sys *types.SystemContext, registry, reference string, ut *U
 
 // CheckAuth validates the credentials by attempting to log into the registry
 // returns an error if an error occurred while making the http request or the status code received was 401
+// A registry served in-process is checked against a temporary transport using the default configuration; use
+// UdistributionTransport.CheckAuth to check against the configuration of an existing transport.
 func CheckAuth(ctx context.Context, sys *types.SystemContext, username, password, registry string) error {
-	var (
-		ut  *UdistributionTransport
-		err error
-	)
-	if username == "" && password == "" {
-		// try to test empty credentials
-		ut, err = NewTransportFromNewConfig("", nil)
-		if err != nil {
-			return err
-		}
-	} else {
-		// Our transport do not support auth with user/password
-		return nil
+	if !servedInProcess(&url.URL{Host: registry}) {
+		return checkAuth(ctx, sys, nil, username, password, registry)
 	}
+	ut, err := NewTransportFromNewConfig("", nil)
+	if err != nil {
+		return err
+	}
+	defer ut.Deregister()
+	return checkAuth(ctx, sys, ut, username, password, registry)
+}
+
+// checkAuth validates the credentials against the access controller of ut's in-process registry, or against registry
+// over the network if ut is nil.
+func checkAuth(ctx context.Context, sys *types.SystemContext, ut *UdistributionTransport, username, password, registry string) error {
 	client, err := newDockerClient(sys, registry, registry, ut)
 	if err != nil {
 		return errors.Wrapf(err, "creating new docker client")
@@ -552,6 +555,22 @@ func (c *udistributionClient) makeRequestToResolvedURL(ctx context.Context, meth
 	}
 }
 
+// servedInProcess returns true if requests to url are served by the transport's in-process registry instead of the network.
+func servedInProcess(url *url.URL) bool {
+	return strings.Contains(url.String(), dockerRegistry) || url.Host == "" || strings.Contains(url.Host, "127.0.0.1")
+}
+
+// serveInProcess serves req, which must not include a scheme or host, by the transport's in-process registry.
+func (c *udistributionClient) serveInProcess(req *http.Request) *http.Response {
+	// ServeHTTP requires a non-nil body to call close on it.
+	if req.Body == nil {
+		req.Body = io.NopCloser(bytes.NewReader(nil))
+	}
+	rr := httptest.NewRecorder()
+	c.ut.GetApp().ServeHTTP(rr, req)
+	return rr.Result()
+}
+
 // makeRequestToResolvedURLOnce creates and executes a http.Request with the specified parameters, adding authentication and TLS options for the Docker client.
 // streamLen, if not -1, specifies the length of the data expected on stream.
 // makeRequest should generally be preferred.
@@ -560,7 +579,7 @@ func (c *udistributionClient) makeRequestToResolvedURLOnce(ctx context.Context,
 	log.Println("makeRequestToResolvedURLOnce-HOST: " + url.Host)
 	useUdistributionHTTPServe := false
 	var req *http.Request
-	if strings.Contains(url.String(), dockerRegistry) || url.Host == "" || strings.Contains(url.Host, "127.0.0.1") {
+	if servedInProcess(url) {
 		log.Println("overriding to use udistribution ServeHTTP")
 		useUdistributionHTTPServe = true
 		// log.Println("current path: " + url.Path)
@@ -600,15 +619,9 @@ func (c *udistributionClient) makeRequestToResolvedURLOnce(ctx context.Context,
 			return nil, err
 		}
 	}
-	// ServeHTTP requires a non-nil body to call close on it.
-	if req.Body == nil {
-		req.Body = io.NopCloser(bytes.NewReader(nil))
-	}
 	logrus.Debugf("%s %s", method, url.Redacted())
 	if c.ut != nil && useUdistributionHTTPServe {
-		rr := httptest.NewRecorder()
-		c.ut.GetApp().ServeHTTP(rr, req)
-		res := rr.Result()
+		res := c.serveInProcess(req)
 		log.Println("useUdistributionHTTPServe-Status: " + res.Status)
 		loc, _ := res.Location()
 		if loc != nil {
@@ -661,6 +674,14 @@ func (c *udistributionClient) setupRequestAuth(req *http.Request, extraScope *au
 			return nil
 		case "bearer":
 			registryToken := c.registryToken
+			if registryToken == "" && c.ut != nil && req.URL.Host == "" && !c.realmServedInProcess(challenge) && c.ut.Client.AcceptsBasicAuth() {
+				// The request is served by the in-process registry, but its token realm is not; unless the embedded access
+				// controller checks real tokens, hand it the credentials (e.g. "silly") instead of obtaining a token remotely.
+				if c.auth.Username != "" || c.auth.Password != "" {
+					req.SetBasicAuth(c.auth.Username, c.auth.Password)
+				}
+				return nil
+			}
 			if registryToken == "" {
 				cacheKey := ""
 				scopes := []authScope{c.scope}
@@ -703,6 +724,12 @@ func (c *udistributionClient) setupRequestAuth(req *http.Request, extraScope *au
 	return nil
 }
 
+// realmServedInProcess returns true if the token realm of the bearer challenge is served by the transport's in-process registry.
+func (c *udistributionClient) realmServedInProcess(challenge challenge) bool {
+	realm, err := url.Parse(challenge.Parameters["realm"])
+	return err == nil && realm.Host != "" && servedInProcess(realm)
+}
+
 func (c *udistributionClient) getBearerTokenOAuth2(ctx context.Context, challenge challenge,
 	scopes []authScope) (*bearerToken, error) {
 	realm, ok := challenge.Parameters["realm"]
@@ -734,9 +761,17 @@ func (c *udistributionClient) getBearerTokenOAuth2(ctx context.Context, challeng
 	authReq.Header.Add("User-Agent", c.userAgent)
 	authReq.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	logrus.Debugf("%s %s", authReq.Method, authReq.URL.Redacted())
-	res, err := c.client.Do(authReq)
-	if err != nil {
-		return nil, err
+	var res *http.Response
+	if c.ut != nil && servedInProcess(authReq.URL) {
+		inProcessReq := authReq.Clone(ctx)
+		inProcessReq.URL = &url.URL{Path: authReq.URL.Path, RawQuery: authReq.URL.RawQuery}
+		inProcessReq.RequestURI = inProcessReq.URL.RequestURI()
+		res = c.serveInProcess(inProcessReq)
+	} else {
+		res, err = c.client.Do(authReq)
+		if err != nil {
+			return nil, err
+		}
 	}
 	defer res.Body.Close()
 	if err := httpResponseToError(res, "Trying to obtain access token"); err != nil {
@@ -786,9 +821,17 @@ func (c *udistributionClient) getBearerToken(ctx context.Context, challenge chal
 	authReq.Header.Add("User-Agent", c.userAgent)
 
 	logrus.Debugf("%s %s", authReq.Method, authReq.URL.Redacted())
-	res, err := c.client.Do(authReq)
-	if err != nil {
-		return nil, err
+	var res *http.Response
+	if c.ut != nil && servedInProcess(authReq.URL) {
+		inProcessReq := authReq.Clone(ctx)
+		inProcessReq.URL = &url.URL{Path: authReq.URL.Path, RawQuery: authReq.URL.RawQuery}
+		inProcessReq.RequestURI = inProcessReq.URL.RequestURI()
+		res = c.serveInProcess(inProcessReq)
+	} else {
+		res, err = c.client.Do(authReq)
+		if err != nil {
+			return nil, err
+		}
 	}
 	defer res.Body.Close()
 	if err := httpResponseToError(res, "Requesting bearer token"); err != nil {
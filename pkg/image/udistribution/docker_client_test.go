@@ -2,15 +2,25 @@ package udistribution
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/containers/image/v5/types"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/docker/libtrust"
+	"github.com/migtools/udistribution/pkg/client"
+	"github.com/migtools/udistribution/pkg/internal/testing/clienttest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -187,3 +197,210 @@ func TestUserAgent(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckAuthRemote(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "testuser" || password != "testpassword" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+	// The registry is not served in-process, and is checked over the network.
+	registry := strings.Replace(strings.TrimPrefix(s.URL, "http://"), "127.0.0.1", "localhost", 1)
+	sys := &types.SystemContext{DockerInsecureSkipTLSVerify: types.OptionalBoolTrue}
+
+	assert.NoError(t, CheckAuth(context.Background(), sys, "testuser", "testpassword", registry))
+	assert.ErrorAs(t, CheckAuth(context.Background(), sys, "testuser", "wrong", registry), &ErrUnauthorizedForCredentials{})
+}
+
+// testHtpasswd contains user "testuser" with password "testpassword".
+const testHtpasswd = "testuser:$2a$04$LoWdx3HbUMstQ69n370GiuzMcgm87m7numXDCnqt/CEqlyLFvJMQm\n"
+
+func TestInProcessAuth(t *testing.T) {
+	ctx := context.Background()
+	htpasswdPath := filepath.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, os.WriteFile(htpasswdPath, []byte(testHtpasswd), 0600))
+
+	for _, c := range []struct {
+		name string
+		env  []string
+		good types.SystemContext
+	}{
+		{
+			name: "htpasswd",
+			env: []string{
+				"REGISTRY_AUTH=htpasswd",
+				"REGISTRY_AUTH_HTPASSWD_REALM=test",
+				"REGISTRY_AUTH_HTPASSWD_PATH=" + htpasswdPath,
+			},
+			good: types.SystemContext{DockerAuthConfig: &types.DockerAuthConfig{Username: "testuser", Password: "testpassword"}},
+		},
+		{
+			name: "silly",
+			env: []string{
+				"REGISTRY_AUTH=silly",
+				"REGISTRY_AUTH_SILLY_REALM=https://auth.example.com/token",
+				"REGISTRY_AUTH_SILLY_SERVICE=test",
+			},
+			good: types.SystemContext{DockerAuthConfig: &types.DockerAuthConfig{Username: "anyone", Password: "anything"}},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cl, _ := clienttest.NewFilesystemClient(t, c.env)
+			ut := NewTransport(cl, "filesystem")
+			defer ut.Deregister()
+			ref, err := ut.ParseReference("//test/auth:latest")
+			require.NoError(t, err)
+
+			_, err = clienttest.CopyFixtureImageWithContext(ref, &types.SystemContext{})
+			assert.Error(t, err, "anonymous push")
+			_, err = clienttest.CopyFixtureImageWithContext(ref, &c.good)
+			require.NoError(t, err)
+			src, err := ref.NewImageSource(ctx, &c.good)
+			require.NoError(t, err)
+			src.Close()
+
+			assert.NoError(t, checkAuth(ctx, &types.SystemContext{}, ut, c.good.DockerAuthConfig.Username, c.good.DockerAuthConfig.Password, ""))
+			assert.Error(t, checkAuth(ctx, &types.SystemContext{}, ut, "", "", ""))
+		})
+	}
+
+	cl, _ := clienttest.NewFilesystemClient(t, []string{
+		"REGISTRY_AUTH=htpasswd",
+		"REGISTRY_AUTH_HTPASSWD_REALM=test",
+		"REGISTRY_AUTH_HTPASSWD_PATH=" + htpasswdPath,
+	})
+	ut := NewTransport(cl, "filesystem")
+	defer ut.Deregister()
+	err := checkAuth(ctx, &types.SystemContext{}, ut, "testuser", "wrong", "")
+	assert.ErrorAs(t, err, &ErrUnauthorizedForCredentials{})
+}
+
+func TestInProcessAuthorizer(t *testing.T) {
+	ctx := context.Background()
+	htpasswdPath := filepath.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, os.WriteFile(htpasswdPath, []byte(testHtpasswd), 0600))
+	authorizer := client.AuthorizerFunc(func(ctx context.Context, user string, access auth.Access) error {
+		if access.Type == "repository" && !strings.HasPrefix(access.Name, user+"/") {
+			return fmt.Errorf("%s may only access its own repositories", user)
+		}
+		return nil
+	})
+	cl, _ := clienttest.NewFilesystemClient(t, []string{
+		"REGISTRY_AUTH=htpasswd",
+		"REGISTRY_AUTH_HTPASSWD_REALM=test",
+		"REGISTRY_AUTH_HTPASSWD_PATH=" + htpasswdPath,
+	}, client.WithAuthorizer(authorizer))
+	ut := NewTransport(cl, "filesystem")
+	defer ut.Deregister()
+	sys := &types.SystemContext{DockerAuthConfig: &types.DockerAuthConfig{Username: "testuser", Password: "testpassword"}}
+
+	allowed, err := ut.ParseReference("//testuser/image:latest")
+	require.NoError(t, err)
+	_, err = clienttest.CopyFixtureImageWithContext(allowed, sys)
+	require.NoError(t, err)
+
+	denied, err := ut.ParseReference("//otheruser/image:latest")
+	require.NoError(t, err)
+	_, err = clienttest.CopyFixtureImageWithContext(denied, sys)
+	assert.Error(t, err)
+	_, err = denied.NewImageSource(ctx, sys)
+	assert.Error(t, err)
+
+	// Authentication is still enforced by the configured access controller.
+	_, err = clienttest.CopyFixtureImageWithContext(allowed, &types.SystemContext{DockerAuthConfig: &types.DockerAuthConfig{Username: "testuser", Password: "wrong"}})
+	assert.Error(t, err)
+}
+
+func TestInProcessTokenAuth(t *testing.T) {
+	ctx := context.Background()
+	grant := func(ctx context.Context, req client.TokenRequest) ([]auth.Access, error) {
+		if req.Username != "testuser" || req.Password != "testpassword" {
+			return nil, fmt.Errorf("invalid credentials for %q", req.Username)
+		}
+		granted := []auth.Access{}
+		for _, access := range req.Requested {
+			if access.Type == "repository" && strings.HasPrefix(access.Name, "testuser/") {
+				granted = append(granted, access)
+			}
+		}
+		return granted, nil
+	}
+	cl, _ := clienttest.NewFilesystemClient(t, nil, client.WithTokenIssuer(client.TokenIssuerOptions{Grant: grant}))
+	ut := NewTransport(cl, "filesystem")
+	defer ut.Deregister()
+	sys := &types.SystemContext{DockerAuthConfig: &types.DockerAuthConfig{Username: "testuser", Password: "testpassword"}}
+
+	allowed, err := ut.ParseReference("//testuser/image:latest")
+	require.NoError(t, err)
+	_, err = clienttest.CopyFixtureImageWithContext(allowed, sys)
+	require.NoError(t, err)
+	src, err := allowed.NewImageSource(ctx, sys)
+	require.NoError(t, err)
+	src.Close()
+
+	// Access not granted by the callback.
+	denied, err := ut.ParseReference("//otheruser/image:latest")
+	require.NoError(t, err)
+	_, err = clienttest.CopyFixtureImageWithContext(denied, sys)
+	assert.Error(t, err)
+
+	// Credentials rejected by the callback.
+	_, err = allowed.NewImageSource(ctx, &types.SystemContext{DockerAuthConfig: &types.DockerAuthConfig{Username: "testuser", Password: "wrong"}})
+	assert.Error(t, err)
+	_, err = allowed.NewImageSource(ctx, &types.SystemContext{})
+	assert.Error(t, err)
+	assert.ErrorAs(t, ut.CheckAuth(ctx, &types.SystemContext{}, "testuser", "wrong"), &ErrUnauthorizedForCredentials{})
+	assert.NoError(t, ut.CheckAuth(ctx, &types.SystemContext{}, "testuser", "testpassword"))
+}
+
+func TestInProcessExternalTokenRealm(t *testing.T) {
+	ctx := context.Background()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	grant := func(ctx context.Context, req client.TokenRequest) ([]auth.Access, error) {
+		if req.Username != "testuser" || req.Password != "testpassword" {
+			return nil, fmt.Errorf("invalid credentials for %q", req.Username)
+		}
+		return req.Requested, nil
+	}
+	// The token service runs in another registry, reached over the network.
+	issuer, err := client.NewClient("", []string{
+		"REGISTRY_STORAGE=inmemory",
+	}, client.WithTokenIssuer(client.TokenIssuerOptions{Grant: grant, Key: key}))
+	require.NoError(t, err)
+	var tokenRequests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests.Add(1)
+		issuer.GetApp().ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	libtrustKey, err := libtrust.FromCryptoPrivateKey(key)
+	require.NoError(t, err)
+	cert, err := libtrust.GenerateSelfSignedClientCert(libtrustKey)
+	require.NoError(t, err)
+	bundle := filepath.Join(t.TempDir(), "bundle.pem")
+	require.NoError(t, os.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600))
+	cl, _ := clienttest.NewFilesystemClient(t, []string{
+		"REGISTRY_AUTH=token",
+		"REGISTRY_AUTH_TOKEN_REALM=" + strings.Replace(server.URL, "127.0.0.1", "localhost", 1) + client.TokenRealmPath,
+		"REGISTRY_AUTH_TOKEN_SERVICE=udistribution",
+		"REGISTRY_AUTH_TOKEN_ISSUER=udistribution-token-issuer",
+		"REGISTRY_AUTH_TOKEN_ROOTCERTBUNDLE=" + bundle,
+	})
+	ut := NewTransport(cl, "filesystem")
+	defer ut.Deregister()
+	ref, err := ut.ParseReference("//testuser/image:latest")
+	require.NoError(t, err)
+
+	// Tokens are obtained from the realm, rather than sending the credentials to the token access controller.
+	_, err = clienttest.CopyFixtureImageWithContext(ref, &types.SystemContext{DockerAuthConfig: &types.DockerAuthConfig{Username: "testuser", Password: "testpassword"}})
+	require.NoError(t, err)
+	assert.NotZero(t, tokenRequests.Load())
+	_, err = ref.NewImageSource(ctx, &types.SystemContext{DockerAuthConfig: &types.DockerAuthConfig{Username: "testuser", Password: "wrong"}})
+	assert.Error(t, err)
+}
@@ -22,10 +22,13 @@ import (
 	"github.com/migtools/udistribution/pkg/internal/image/streamdigest"
 	// "github.com/migtools/udistribution/pkg/internal/image/uploadreader"
 	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/compression"
+	compressiontypes "github.com/containers/image/v5/pkg/compression/types"
 	"github.com/containers/image/v5/types"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	v2 "github.com/distribution/distribution/v3/registry/api/v2"
-	"github.com/migtools/udistribution/pkg/internal/image/uploadreader"
+	"github.com/migtools/udistribution/pkg/client"
+	"github.com/migtools/udistribution/pkg/internal/image/iolimits"
 	"github.com/opencontainers/go-digest"
 	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
@@ -41,6 +44,9 @@ type dockerImageDestination struct {
 
 // newImageDestination creates a new ImageDestination for the specified image reference.
 func newImageDestination(sys *types.SystemContext, ref udistributionReference) (types.ImageDestination, error) {
+	if len(ref.UdistributionTransport.writeReplicas) != 0 {
+		return newReplicatedImageDestination(sys, ref)
+	}
 	c, err := newDockerClientFromRef(sys, ref, true, "pull,push")
 	if err != nil {
 		return nil, err
@@ -134,6 +140,48 @@ func (d *dockerImageDestination) HasThreadSafePutBlob() bool {
 // to any other readers for download using the supplied digest.
 // If stream.Read() at any time, ESPECIALLY at end of input, returns an error, PutBlob MUST 1) fail, and 2) delete any data stored so far.
 func (d *dockerImageDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	batch := batchCopyFromContext(ctx)
+	if batch == nil {
+		return d.putBlob(ctx, stream, inputInfo, cache, isConfig)
+	}
+	// Let copies of other images waiting for this upload in TryReusingBlob link the blob, or upload it themselves.
+	// A blob compressed by the copy has an unknown digest; its upload was claimed with the digest of the uncompressed data.
+	claimed := inputInfo.Digest
+	var uncompressedDigest func(error) (digest.Digest, *compressiontypes.Algorithm)
+	if claimed == "" {
+		var err error
+		stream, uncompressedDigest, err = digestUncompressed(stream)
+		if err != nil {
+			return types.BlobInfo{}, err
+		}
+	} else {
+		// Configs are written without TryReusingBlob.
+		reused, reusedInfo, err := d.reuseConcurrentUpload(ctx, inputInfo, d.ref.UdistributionTransport.blobInfoCache(cache), false)
+		if err != nil {
+			return types.BlobInfo{}, err
+		}
+		if reused {
+			return reusedInfo, nil
+		}
+	}
+	info, err := d.putBlob(ctx, stream, inputInfo, cache, isConfig)
+	uploaded := info
+	if uncompressedDigest != nil {
+		claimed, uploaded.CompressionAlgorithm = uncompressedDigest(err)
+	}
+	if claimed != "" {
+		var repo reference.Named
+		if err == nil {
+			repo = d.ref.ref
+		}
+		batch.uploads.finish(batch.id, d.blobUploadKey(claimed), repo, uploaded)
+	}
+	return info, err
+}
+
+// putBlob implements PutBlob.
+func (d *dockerImageDestination) putBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	cache = d.ref.UdistributionTransport.blobInfoCache(cache)
 	// If requested, precompute the blob digest to prevent uploading layers that already exist on the registry.
 	// This functionality is particularly useful when BlobInfoCache has not been populated with compressed digests,
 	// the source blob is uncompressed, and the destination blob is being compressed "on the fly".
@@ -159,7 +207,20 @@ func (d *dockerImageDestination) PutBlob(ctx context.Context, stream io.Reader,
 		}
 	}
 
-	// FIXME? Chunked upload, progress reporting, etc.
+	// Record the compression of the blob, so that the cache can offer it as a substitute.
+	compressorName := blobinfocache.UnknownCompression
+	if d.ref.UdistributionTransport.persistentCache != nil {
+		algorithm, decompressor, detectedStream, err := compression.DetectCompressionFormat(stream)
+		if err != nil {
+			return types.BlobInfo{}, err
+		}
+		stream = detectedStream
+		compressorName = blobinfocache.Uncompressed
+		if decompressor != nil {
+			compressorName = algorithm.Name()
+		}
+	}
+
 	uploadPath := fmt.Sprintf(blobUploadPath, reference.Path(d.ref.ref))
 	logrus.Debugf("Uploading %s", uploadPath)
 	res, err := d.c.makeRequest(ctx, http.MethodPost, uploadPath, nil, nil, v2Auth, nil)
@@ -169,60 +230,73 @@ func (d *dockerImageDestination) PutBlob(ctx context.Context, stream io.Reader,
 	defer res.Body.Close()
 	if res.StatusCode != http.StatusAccepted {
 		logrus.Debugf("Error initiating layer upload, response %#v", *res)
-		return types.BlobInfo{}, errors.Wrapf(registryHTTPResponseToError(res), "initiating layer upload to %s in %s", uploadPath, d.c.registry)
+		rawErr := registryHTTPResponseToError(res)
+		return types.BlobInfo{}, d.quotaError(rawErr, errors.Wrapf(rawErr, "initiating layer upload to %s in %s", uploadPath, d.c.registry))
 	}
 	uploadLocation, err := res.Location()
 	if err != nil {
 		return types.BlobInfo{}, errors.Wrap(err, "determining upload URL")
 	}
+	session := newUploadSession(d.ref.ref, uploadLocation, res)
 
-	digester, stream := putblobdigest.DigestIfCanonicalUnknown(stream, inputInfo)
+	reporter := newTransferReporter(ctx, d.ref.UdistributionTransport, TransferUpload, d.ref.ref, inputInfo.Digest, inputInfo.Size)
+	digester, stream := putblobdigest.DigestIfCanonicalUnknown(&progressReader{r: stream, reporter: reporter}, inputInfo)
 	sizeCounter := &sizeCounter{}
 	stream = io.TeeReader(stream, sizeCounter)
 
-	uploadLocation, err = func() (*url.URL, error) { // A scope for defer
-		uploadReader := uploadreader.NewUploadReader(stream)
-		// This error text should never be user-visible, we terminate only after makeRequestToResolvedURL
-		// returns, so there isn’t a way for the error text to be provided to any of our callers.
-		defer uploadReader.Terminate(errors.New("Reading data from an already terminated upload"))
-		res, err = d.c.makeRequestToResolvedURL(ctx, http.MethodPatch, uploadLocation, map[string][]string{"Content-Type": {"application/octet-stream"}}, uploadReader, inputInfo.Size, v2Auth, nil)
-		if err != nil {
-			logrus.Debugf("Error uploading layer chunked %v", err)
-			return nil, err
-		}
-		defer res.Body.Close()
-		if !successStatus(res.StatusCode) {
-			return nil, errors.Wrapf(registryHTTPResponseToError(res), "uploading layer chunked")
-		}
-		uploadLocation, err := res.Location()
-		if err != nil {
-			return nil, errors.Wrap(err, "determining upload URL")
-		}
-		return uploadLocation, nil
-	}()
+	uploadLocation, err = d.uploadBlobData(ctx, &session, stream, inputInfo.Size)
 	if err != nil {
+		err = d.uploadFailed(ctx, session, err)
+		reporter.failed(err)
 		return types.BlobInfo{}, err
 	}
-	blobDigest := digester.Digest()
+	info, err := d.completeReportedBlobUpload(ctx, reporter, session, uploadLocation, digester.Digest(), sizeCounter.size, cache)
+	if err == nil && compressorName != blobinfocache.UnknownCompression {
+		bic := cache.(blobinfocache.BlobInfoCache2)
+		bic.RecordDigestCompressorName(info.Digest, compressorName)
+		if compressorName == blobinfocache.Uncompressed {
+			bic.RecordDigestUncompressedPair(info.Digest, info.Digest)
+		}
+	}
+	return info, err
+}
 
-	// FIXME: DELETE uploadLocation on failure (does not really work in docker/distribution servers, which incorrectly require the "delete" action in the token's scope)
+// completeReportedBlobUpload is completeBlobUpload for the upload of session, reporting the result of the transfer to
+// reporter.
+func (d *dockerImageDestination) completeReportedBlobUpload(ctx context.Context, reporter *transferReporter, session UploadSession, uploadLocation *url.URL, blobDigest digest.Digest, size int64, cache types.BlobInfoCache) (types.BlobInfo, error) {
+	info, err := d.completeBlobUpload(ctx, uploadLocation, blobDigest, size, cache)
+	if err != nil {
+		// The registry cancels uploads it rejects, e.g. for a digest mismatch, but leaves part of their data behind.
+		if removeErr := d.ref.UdistributionTransport.Client.RemoveUpload(context.WithoutCancel(ctx), session.Repository, session.UUID); removeErr != nil {
+			logrus.Debugf("Error removing failed upload %s: %v", session.UUID, removeErr)
+		}
+		reporter.failed(err)
+		return types.BlobInfo{}, err
+	}
+	reporter.completed(info.Digest, info.Size)
+	return info, nil
+}
 
+// completeBlobUpload completes the upload at uploadLocation of a blob with blobDigest and size.
+func (d *dockerImageDestination) completeBlobUpload(ctx context.Context, uploadLocation *url.URL, blobDigest digest.Digest, size int64, cache types.BlobInfoCache) (types.BlobInfo, error) {
+	// The registry cancels the upload itself if committing it fails.
 	locationQuery := uploadLocation.Query()
 	locationQuery.Set("digest", blobDigest.String())
 	uploadLocation.RawQuery = locationQuery.Encode()
-	res, err = d.c.makeRequestToResolvedURL(ctx, http.MethodPut, uploadLocation, map[string][]string{"Content-Type": {"application/octet-stream"}}, nil, -1, v2Auth, nil)
+	res, err := d.c.makeRequestToResolvedURL(ctx, http.MethodPut, uploadLocation, map[string][]string{"Content-Type": {"application/octet-stream"}}, nil, -1, v2Auth, nil)
 	if err != nil {
 		return types.BlobInfo{}, err
 	}
 	defer res.Body.Close()
 	if res.StatusCode != http.StatusCreated {
 		logrus.Debugf("Error uploading layer, response %#v", *res)
-		return types.BlobInfo{}, errors.Wrapf(registryHTTPResponseToError(res), "uploading layer to %s", uploadLocation)
+		rawErr := registryHTTPResponseToError(res)
+		return types.BlobInfo{}, d.quotaError(rawErr, errors.Wrapf(rawErr, "uploading layer to %s", uploadLocation))
 	}
 
 	logrus.Debugf("Upload of layer %s complete", blobDigest)
 	cache.RecordKnownLocation(d.ref.Transport(), bicTransportScope(d.ref), blobDigest, newBICLocationReference(d.ref))
-	return types.BlobInfo{Digest: blobDigest, Size: sizeCounter.size}, nil
+	return types.BlobInfo{Digest: blobDigest, Size: size}, nil
 }
 
 // blobExists returns true iff repo contains a blob with digest, and if so, also its size.
@@ -254,51 +328,99 @@ func (d *dockerImageDestination) blobExists(ctx context.Context, repo reference.
 	}
 }
 
-// mountBlob tries to mount blob srcDigest from srcRepo to the current destination.
-func (d *dockerImageDestination) mountBlob(ctx context.Context, srcRepo reference.Named, srcDigest digest.Digest, extraScope *authScope) error {
+// linkBlob links blob srcDigest from srcRepo to the current destination through the storage of the in-process registry,
+// without copying data. It returns false if srcRepo does not contain the blob, and the blob size otherwise.
+func (d *dockerImageDestination) linkBlob(ctx context.Context, srcRepo reference.Named, srcDigest digest.Digest, extraScope *authScope) (bool, int64, error) {
 	u := url.URL{
-		Path: fmt.Sprintf(blobUploadPath, reference.Path(d.ref.ref)),
-		RawQuery: url.Values{
-			"mount": {srcDigest.String()},
-			"from":  {reference.Path(srcRepo)},
-		}.Encode(),
+		Path:     fmt.Sprintf(blobLinkPath, reference.Path(d.ref.ref), srcDigest.String()),
+		RawQuery: url.Values{client.BlobLinkFromParameter: {reference.Path(srcRepo)}}.Encode(),
 	}
-	logrus.Debugf("Trying to mount %s", u.Redacted())
+	logrus.Debugf("Trying to link %s", u.Redacted())
 	res, err := d.c.makeRequest(ctx, http.MethodPost, u.String(), nil, nil, v2Auth, extraScope)
 	if err != nil {
-		return err
+		return false, -1, err
 	}
 	defer res.Body.Close()
 	switch res.StatusCode {
-	case http.StatusCreated:
-		logrus.Debugf("... mount OK")
-		return nil
-	case http.StatusAccepted:
-		// Oops, the mount was ignored - either the registry does not support that yet, or the blob does not exist; the registry has started an ordinary upload process.
-		// Abort, and let the ultimate caller do an upload when its ready, instead.
-		// NOTE: This does not really work in docker/distribution servers, which incorrectly require the "delete" action in the token's scope, and is thus entirely untested.
-		uploadLocation, err := res.Location()
+	case http.StatusOK, http.StatusCreated:
+		body, err := iolimits.ReadAtMost(res.Body, iolimits.MaxErrorBodySize)
 		if err != nil {
-			return errors.Wrap(err, "determining upload URL after a mount attempt")
+			return false, -1, err
 		}
-		logrus.Debugf("... started an upload instead of mounting, trying to cancel at %s", uploadLocation.Redacted())
-		res2, err := d.c.makeRequestToResolvedURL(ctx, http.MethodDelete, uploadLocation, nil, nil, -1, v2Auth, extraScope)
-		if err != nil {
-			logrus.Debugf("Error trying to cancel an inadvertent upload: %s", err)
-		} else {
-			defer res2.Body.Close()
-			if res2.StatusCode != http.StatusNoContent {
-				logrus.Debugf("Error trying to cancel an inadvertent upload, status %s", http.StatusText(res.StatusCode))
-			}
+		var desc imgspecv1.Descriptor
+		if err := json.Unmarshal(body, &desc); err != nil {
+			return false, -1, errors.Wrapf(err, "decoding link of %s", srcDigest)
 		}
-		// Anyway, if canceling the upload fails, ignore it and return the more important error:
-		return fmt.Errorf("Mounting %s from %s to %s started an upload instead", srcDigest, srcRepo.Name(), d.ref.ref.Name())
+		logrus.Debugf("... link OK")
+		return true, desc.Size, nil
+	case http.StatusNotFound:
+		logrus.Debugf("... not present in %s", srcRepo.Name())
+		return false, -1, nil
 	default:
-		logrus.Debugf("Error mounting, response %#v", *res)
-		return errors.Wrapf(registryHTTPResponseToError(res), "mounting %s from %s to %s", srcDigest, srcRepo.Name(), d.ref.ref.Name())
+		return false, -1, errors.Wrapf(registryHTTPResponseToError(res), "linking %s from %s to %s", srcDigest, srcRepo.Name(), d.ref.ref.Name())
 	}
 }
 
+// reuseBlobFrom makes blob srcDigest in srcRepo available in the current destination, linking it if srcRepo is another repository.
+// It returns false if srcRepo does not contain the blob, and the blob size otherwise.
+func (d *dockerImageDestination) reuseBlobFrom(ctx context.Context, srcRepo reference.Named, srcDigest digest.Digest) (bool, int64, error) {
+	// Checking srcRepo, and linking from it, requires an
+	// expanded token scope.
+	extraScope := &authScope{
+		remoteName: reference.Path(srcRepo),
+		actions:    "pull",
+	}
+	if srcRepo.Name() == d.ref.ref.Name() {
+		return d.blobExists(ctx, srcRepo, srcDigest, extraScope)
+	}
+	// Blobs of all repositories are in the same storage, so they are linked without an upload session, or moving any data.
+	return d.linkBlob(ctx, srcRepo, srcDigest, extraScope)
+}
+
+// copyBlobFrom copies blob srcDigest in srcRepo, of the registry of src, into the current destination with
+// the server-side copy of the storage, see client.Client.CopyBlob, and returns the blob size.
+// CopyBlob writes to the storage directly, so pushing to the destination is checked through the registry first.
+func (d *dockerImageDestination) copyBlobFrom(ctx context.Context, src *client.Client, srcRepo reference.Named, srcDigest digest.Digest) (int64, error) {
+	if err := d.checkPushAccess(ctx); err != nil {
+		return 0, err
+	}
+	size, err := d.ref.UdistributionTransport.Client.CopyBlob(ctx, src, reference.Path(srcRepo), reference.Path(d.ref.ref), srcDigest)
+	if err != nil {
+		return 0, d.quotaError(err, err)
+	}
+	return size, nil
+}
+
+// checkPushAccess returns an error if the registry does not let the current destination be pushed to, e.g. if its
+// authorizer denies it or the repository is over quota, by starting an upload, which is then removed.
+func (d *dockerImageDestination) checkPushAccess(ctx context.Context) error {
+	uploadPath := fmt.Sprintf(blobUploadPath, reference.Path(d.ref.ref))
+	res, err := d.c.makeRequest(ctx, http.MethodPost, uploadPath, nil, nil, v2Auth, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		rawErr := registryHTTPResponseToError(res)
+		return d.quotaError(rawErr, errors.Wrapf(rawErr, "checking push access to %s in %s", uploadPath, d.c.registry))
+	}
+	uploadLocation, err := res.Location()
+	if err != nil {
+		return errors.Wrap(err, "determining upload URL")
+	}
+	// Removing the upload from the storage does not require the "delete" action cancelling it would.
+	session := newUploadSession(d.ref.ref, uploadLocation, res)
+	return d.ref.UdistributionTransport.Client.RemoveUpload(ctx, session.Repository, session.UUID)
+}
+
+// quotaError returns err, caused by rawErr, as an ErrQuotaExceeded if rawErr reports that the repository is over quota.
+func (d *dockerImageDestination) quotaError(rawErr, err error) error {
+	if hasErrorCode(rawErr, client.ErrorCodeQuotaExceeded) {
+		return ErrQuotaExceeded{Repository: reference.Path(d.ref.ref), Err: err}
+	}
+	return err
+}
+
 // tryReusingExactBlob is a subset of TryReusingBlob which _only_ looks for exactly the specified
 // blob in the current repository, with no cross-repo reuse or mounting; cache may be updated, it is not read.
 // The caller must ensure info.Digest is set.
@@ -324,12 +446,13 @@ func (d *dockerImageDestination) tryReusingExactBlob(ctx context.Context, info t
 // If the transport can not reuse the requested blob, TryReusingBlob returns (false, {}, nil); it returns a non-nil error only on an unexpected failure.
 // May use and/or update cache.
 func (d *dockerImageDestination) TryReusingBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache, canSubstitute bool) (bool, types.BlobInfo, error) {
+	bic := d.ref.UdistributionTransport.blobInfoCache(cache)
 	if info.Digest == "" {
 		return false, types.BlobInfo{}, errors.Errorf(`"Can not check for a blob with unknown digest`)
 	}
 
 	// First, check whether the blob happens to already exist at the destination.
-	haveBlob, reusedInfo, err := d.tryReusingExactBlob(ctx, info, cache)
+	haveBlob, reusedInfo, err := d.tryReusingExactBlob(ctx, info, bic)
 	if err != nil {
 		return false, types.BlobInfo{}, err
 	}
@@ -338,7 +461,6 @@ func (d *dockerImageDestination) TryReusingBlob(ctx context.Context, info types.
 	}
 
 	// Then try reusing blobs from other locations.
-	bic := blobinfocache.FromBlobInfoCache(cache)
 	candidates := bic.CandidateLocations2(d.ref.Transport(), bicTransportScope(d.ref), info.Digest, canSubstitute)
 	for _, candidate := range candidates {
 		candidateRepo, err := parseBICLocationReference(candidate.Location)
@@ -364,33 +486,14 @@ func (d *dockerImageDestination) TryReusingBlob(ctx context.Context, info types.
 
 		// Whatever happens here, don't abort the entire operation.  It's likely we just don't have permissions, and if it is a critical network error, we will find out soon enough anyway.
 
-		// Checking candidateRepo, and mounting from it, requires an
-		// expanded token scope.
-		extraScope := &authScope{
-			remoteName: reference.Path(candidateRepo),
-			actions:    "pull",
-		}
-		// This existence check is not, strictly speaking, necessary: We only _really_ need it to get the blob size, and we could record that in the cache instead.
-		// But a "failed" d.mountBlob currently leaves around an unterminated server-side upload, which we would try to cancel.
-		// So, without this existence check, it would be 1 request on success, 2 requests on failure; with it, it is 2 requests on success, 1 request on failure.
-		// On success we avoid the actual costly upload; so, in a sense, the success case is "free", but failures are always costly.
-		// Even worse, docker/distribution does not actually reasonably implement canceling uploads
-		// (it would require a "delete" action in the token, and Quay does not give that to anyone, so we can't ask);
-		// so, be a nice client and don't create unnecessary upload sessions on the server.
-		exists, size, err := d.blobExists(ctx, candidateRepo, candidate.Digest, extraScope)
+		exists, size, err := d.reuseBlobFrom(ctx, candidateRepo, candidate.Digest)
 		if err != nil {
 			logrus.Debugf("... Failed: %v", err)
 			continue
 		}
 		if !exists {
 			// FIXME? Should we drop the blob from cache here (and elsewhere?)?
-			continue // logrus.Debug() already happened in blobExists
-		}
-		if candidateRepo.Name() != d.ref.ref.Name() {
-			if err := d.mountBlob(ctx, candidateRepo, candidate.Digest, extraScope); err != nil {
-				logrus.Debugf("... Mount failed: %v", err)
-				continue
-			}
+			continue // logrus.Debug() already happened in blobExists or linkBlob
 		}
 
 		bic.RecordKnownLocation(d.ref.Transport(), bicTransportScope(d.ref), candidate.Digest, newBICLocationReference(d.ref))
@@ -404,7 +507,59 @@ func (d *dockerImageDestination) TryReusingBlob(ctx context.Context, info types.
 		return true, types.BlobInfo{Digest: candidate.Digest, MediaType: info.MediaType, Size: size, CompressionOperation: compressionOperation, CompressionAlgorithm: compressionAlgorithm}, nil
 	}
 
-	return false, types.BlobInfo{}, nil
+	// Finally, when copying a batch of images, reuse the blob once another copy has uploaded it.
+	return d.reuseConcurrentUpload(ctx, info, bic, canSubstitute)
+}
+
+// blobUploadKey returns the key of blob dgst in the storage of the destination, see blobUploads.
+func (d *dockerImageDestination) blobUploadKey(dgst digest.Digest) blobUploadKey {
+	return blobUploadKey{storage: d.ref.UdistributionTransport.Client.StorageIdentity(), digest: dgst}
+}
+
+// reuseConcurrentUpload waits for another copy of the CopyImages batch of ctx uploading info.Digest to the same storage, if any, and links the uploaded blob.
+// Otherwise the current copy claims the upload, which ends when PutBlob returns, and it returns false.
+// A blob the other copy compressed is only reused if canSubstitute.
+func (d *dockerImageDestination) reuseConcurrentUpload(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache, canSubstitute bool) (bool, types.BlobInfo, error) {
+	batch := batchCopyFromContext(ctx)
+	if batch == nil {
+		return false, types.BlobInfo{}, nil
+	}
+	key := d.blobUploadKey(info.Digest)
+	for {
+		upload := batch.uploads.claim(batch.id, key)
+		if upload == nil {
+			return false, types.BlobInfo{}, nil
+		}
+		logrus.Debugf("Waiting for a concurrent upload of %s", info.Digest)
+		select {
+		case <-upload.done:
+			batch.uploads.doneWaiting(batch.id, upload)
+		case <-ctx.Done():
+			batch.uploads.doneWaiting(batch.id, upload)
+			return false, types.BlobInfo{}, ctx.Err()
+		}
+		if upload.repo == nil {
+			continue // The upload failed; try claiming it.
+		}
+		if upload.blob.Digest != info.Digest && !canSubstitute {
+			return false, types.BlobInfo{}, nil
+		}
+		exists, size, err := d.reuseBlobFrom(ctx, upload.repo, upload.blob.Digest)
+		if err != nil {
+			logrus.Debugf("... Failed: %v", err)
+			return false, types.BlobInfo{}, nil
+		}
+		if !exists {
+			return false, types.BlobInfo{}, nil
+		}
+		cache.RecordKnownLocation(d.ref.Transport(), bicTransportScope(d.ref), upload.blob.Digest, newBICLocationReference(d.ref))
+		reused := types.BlobInfo{Digest: upload.blob.Digest, MediaType: info.MediaType, Size: size}
+		if upload.blob.CompressionAlgorithm != nil {
+			reused.CompressionOperation = types.Compress
+			reused.CompressionAlgorithm = upload.blob.CompressionAlgorithm
+		}
+		return true, reused, nil
+	}
 }
 
 // PutManifest writes manifest to the destination.
@@ -467,7 +622,10 @@ func (d *dockerImageDestination) PutManifest(ctx context.Context, m []byte, inst
 		if isManifestInvalidError(rawErr) {
 			err = types.ManifestTypeRejectedError{Err: err}
 		}
-		return err
+		if hasErrorCode(rawErr, client.ErrorCodeTagImmutable) {
+			err = ErrTagImmutable{Tag: reference.Path(d.ref.ref) + ":" + refTail, Err: err}
+		}
+		return d.quotaError(rawErr, err)
 	}
 	// A HTTP server may not be a registry at all, and just return 200 OK to everything
 	// (in particular that can fairly easily happen after tearing down a website and
@@ -481,6 +639,13 @@ func (d *dockerImageDestination) PutManifest(ctx context.Context, m []byte, inst
 	if v := res.Header.Values("Docker-Content-Digest"); len(v) == 0 {
 		logrus.Debugf("Manifest upload response didn’t contain a Docker-Content-Digest header, it might not be a container registry")
 	}
+	manifestDigest, err := manifest.Digest(m)
+	if err != nil {
+		return err
+	}
+	if err := d.c.addReferrer(ctx, d.ref.ref, m, manifestDigest, res); err != nil {
+		return errors.Wrapf(err, "recording %s as a referrer", manifestDigest)
+	}
 	return nil
 }
 
@@ -541,10 +706,12 @@ func (d *dockerImageDestination) PutSignatures(ctx context.Context, signatures [
 		return err
 	}
 	switch {
+	case d.c.usesStorageLookaside():
+		return d.putSignaturesToLookaside(ctx, signatures, *instanceDigest)
 	case d.c.supportsSignatures:
 		return d.putSignaturesToAPIExtension(ctx, signatures, *instanceDigest)
 	case d.c.signatureBase != nil:
-		return d.putSignaturesToLookaside(signatures, *instanceDigest)
+		return d.putSignaturesToLookaside(ctx, signatures, *instanceDigest)
 	default:
 		return errors.Errorf("Internal error: X-Registry-Supports-Signatures extension not supported, and lookaside should not be empty configuration")
 	}
@@ -552,7 +719,7 @@ func (d *dockerImageDestination) PutSignatures(ctx context.Context, signatures [
 
 // putSignaturesToLookaside implements PutSignatures() from the lookaside location configured in s.c.signatureBase,
 // which is not nil, for a manifest with manifestDigest.
-func (d *dockerImageDestination) putSignaturesToLookaside(signatures [][]byte, manifestDigest digest.Digest) error {
+func (d *dockerImageDestination) putSignaturesToLookaside(ctx context.Context, signatures [][]byte, manifestDigest digest.Digest) error {
 	// FIXME? This overwrites files one at a time, definitely not atomic.
 	// A failure when updating signatures with a reordered copy could lose some of them.
 
@@ -564,7 +731,7 @@ func (d *dockerImageDestination) putSignaturesToLookaside(signatures [][]byte, m
 	// NOTE: Keep this in sync with docs/signature-protocols.md!
 	for i, signature := range signatures {
 		url := signatureStorageURL(d.c.signatureBase, manifestDigest, i)
-		err := d.putOneSignature(url, signature)
+		err := d.putOneSignature(ctx, url, signature)
 		if err != nil {
 			return err
 		}
@@ -576,7 +743,7 @@ func (d *dockerImageDestination) putSignaturesToLookaside(signatures [][]byte, m
 	// is sufficient.
 	for i := len(signatures); ; i++ {
 		url := signatureStorageURL(d.c.signatureBase, manifestDigest, i)
-		missing, err := d.c.deleteOneSignature(url)
+		missing, err := d.c.deleteOneSignature(ctx, url)
 		if err != nil {
 			return err
 		}
@@ -590,7 +757,7 @@ func (d *dockerImageDestination) putSignaturesToLookaside(signatures [][]byte, m
 
 // putOneSignature stores one signature to url.
 // NOTE: Keep this in sync with docs/signature-protocols.md!
-func (d *dockerImageDestination) putOneSignature(url *url.URL, signature []byte) error {
+func (d *dockerImageDestination) putOneSignature(ctx context.Context, url *url.URL, signature []byte) error {
 	switch url.Scheme {
 	case "file":
 		logrus.Debugf("Writing to %s", url.Path)
@@ -606,6 +773,8 @@ func (d *dockerImageDestination) putOneSignature(url *url.URL, signature []byte)
 
 	case "http", "https":
 		return errors.Errorf("Writing directly to a %s sigstore %s is not supported. Configure a sigstore-staging: location", url.Scheme, url.Redacted())
+	case StorageLookasideScheme:
+		return d.c.putStorageSignature(ctx, url, signature)
 	default:
 		return errors.Errorf("Unsupported scheme when writing signature to %s", url.Redacted())
 	}
@@ -614,7 +783,7 @@ func (d *dockerImageDestination) putOneSignature(url *url.URL, signature []byte)
 // deleteOneSignature deletes a signature from url, if it exists.
 // If it successfully determines that the signature does not exist, returns (true, nil)
 // NOTE: Keep this in sync with docs/signature-protocols.md!
-func (c *udistributionClient) deleteOneSignature(url *url.URL) (missing bool, err error) {
+func (c *udistributionClient) deleteOneSignature(ctx context.Context, url *url.URL) (missing bool, err error) {
 	switch url.Scheme {
 	case "file":
 		logrus.Debugf("Deleting %s", url.Path)
@@ -626,6 +795,8 @@ func (c *udistributionClient) deleteOneSignature(url *url.URL) (missing bool, er
 
 	case "http", "https":
 		return false, errors.Errorf("Writing directly to a %s sigstore %s is not supported. Configure a sigstore-staging: location", url.Scheme, url.Redacted())
+	case StorageLookasideScheme:
+		return c.deleteStorageSignature(ctx, url)
 	default:
 		return false, errors.Errorf("Unsupported scheme when deleting signature from %s", url.Redacted())
 	}
@@ -3,9 +3,19 @@ package udistribution
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/client"
+	"github.com/migtools/udistribution/pkg/internal/testing/clienttest"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -30,3 +40,137 @@ func TestIsManifestInvalidError(t *testing.T) {
 	res := isManifestInvalidError(err)
 	assert.True(t, res, "%#v", err)
 }
+
+func TestSignaturesAPIExtension(t *testing.T) {
+	ctx := context.Background()
+	sys := &types.SystemContext{RegistriesDirPath: "/this/does/not/exist"}
+	ut, dir := newFilesystemTestTransport(t)
+	ref, err := ut.ParseReference("//test/signed:latest")
+	require.NoError(t, err)
+	manifestDigest, err := manifest.Digest(clienttest.CopyFixtureImage(t, ref))
+	require.NoError(t, err)
+
+	dest, err := ref.NewImageDestination(ctx, sys)
+	require.NoError(t, err)
+	defer dest.Close()
+	require.NoError(t, dest.SupportsSignatures(ctx))
+	signatures := [][]byte{[]byte("signature one"), []byte("signature two")}
+	require.NoError(t, dest.PutSignatures(ctx, signatures, &manifestDigest))
+	// Signatures which already exist are not duplicated.
+	require.NoError(t, dest.PutSignatures(ctx, signatures[:1], &manifestDigest))
+
+	src, err := ref.NewImageSource(ctx, sys)
+	require.NoError(t, err)
+	defer src.Close()
+	got, err := src.GetSignatures(ctx, nil)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, signatures, got)
+
+	// The signatures are stored next to the manifest revision.
+	files, err := os.ReadDir(filepath.Join(dir, "docker/registry/v2/repositories/test/signed/_manifests/revisions/sha256", manifestDigest.Encoded(), "signatures"))
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	// Signatures of unknown manifests are rejected.
+	unknown := digest.FromString("unknown")
+	assert.Error(t, dest.PutSignatures(ctx, signatures, &unknown))
+
+	// The extension is neither advertised nor served once disabled.
+	disabled, _ := clienttest.NewFilesystemClient(t, nil, client.WithoutSignaturesExtension())
+	rr := httptest.NewRecorder()
+	disabled.GetApp().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v2/", nil))
+	assert.Empty(t, rr.Result().Header.Get("X-Registry-Supports-Signatures"))
+	rr = httptest.NewRecorder()
+	disabled.GetApp().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/extensions/v2/test/signed/signatures/"+manifestDigest.String(), nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestStorageLookasideSignatures(t *testing.T) {
+	ctx := context.Background()
+	registriesDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(registriesDir, "sigstore.yaml"),
+		[]byte("default-docker:\n  sigstore: "+StorageLookasideScheme+":///sigstore\n"), 0644))
+	sys := &types.SystemContext{RegistriesDirPath: registriesDir}
+	c, dir := clienttest.NewFilesystemClient(t, []string{"REGISTRY_STORAGE_DELETE_ENABLED=true"})
+	ut := NewTransport(c, "storage-lookaside")
+	t.Cleanup(ut.Deregister)
+	ref, err := ut.ParseReference("//test/signed:latest")
+	require.NoError(t, err)
+	manifestDigest, err := manifest.Digest(clienttest.CopyFixtureImage(t, ref))
+	require.NoError(t, err)
+
+	dest, err := ref.NewImageDestination(ctx, sys)
+	require.NoError(t, err)
+	defer dest.Close()
+	require.NoError(t, dest.SupportsSignatures(ctx))
+	signatures := [][]byte{[]byte("signature one"), []byte("signature two")}
+	require.NoError(t, dest.PutSignatures(ctx, signatures, &manifestDigest))
+
+	src, err := ref.NewImageSource(ctx, sys)
+	require.NoError(t, err)
+	defer src.Close()
+	got, err := src.GetSignatures(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, signatures, got)
+
+	// The signatures are stored by the storage driver, and not through the API extension.
+	sigDir := filepath.Join(dir, "sigstore/test/signed/_signatures/sha256", manifestDigest.Encoded())
+	files, err := os.ReadDir(sigDir)
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+	_, err = os.Stat(filepath.Join(dir, "docker/registry/v2/repositories/test/signed/_manifests/revisions/sha256", manifestDigest.Encoded(), "signatures"))
+	assert.True(t, os.IsNotExist(err))
+
+	require.NoError(t, ref.DeleteImage(ctx, sys))
+	files, err = os.ReadDir(sigDir)
+	if err == nil {
+		assert.Empty(t, files)
+	} else {
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestImmutableTags(t *testing.T) {
+	ctx := context.Background()
+	sys := &types.SystemContext{}
+	cl, _ := clienttest.NewFilesystemClient(t, nil, client.WithImmutableTags("backups/*"))
+	ut := NewTransport(cl, "filesystem")
+	defer ut.Deregister()
+
+	// putManifest pushes m to name.
+	putManifest := func(name string, m []byte) error {
+		ref, err := ut.ParseReference(name)
+		require.NoError(t, err)
+		dest, err := ref.NewImageDestination(ctx, sys)
+		require.NoError(t, err)
+		defer dest.Close()
+		return dest.PutManifest(ctx, m, nil)
+	}
+	var imageManifest []byte
+	for _, name := range []string{"//backups/app:v1", "//mutable/app:v1"} {
+		ref, err := ut.ParseReference(name)
+		require.NoError(t, err)
+		imageManifest = clienttest.CopyFixtureImage(t, ref)
+	}
+	var m map[string]any
+	require.NoError(t, json.Unmarshal(imageManifest, &m))
+	m["variant"] = 1
+	variant, err := json.Marshal(m)
+	require.NoError(t, err)
+	variantDigest, err := manifest.Digest(variant)
+	require.NoError(t, err)
+
+	err = putManifest("//backups/app:v1", variant)
+	var immutable ErrTagImmutable
+	require.ErrorAs(t, err, &immutable)
+	assert.Equal(t, "backups/app:v1", immutable.Tag)
+	revisions, err := cl.ManifestRevisions(ctx, "backups/app")
+	require.NoError(t, err)
+	assert.NotContains(t, revisions, variantDigest)
+
+	// Pushing the same manifest again, to a new tag, or to a mutable repository succeeds.
+	require.NoError(t, putManifest("//backups/app:v1", imageManifest))
+	require.NoError(t, putManifest("//backups/app:v2", variant))
+	require.NoError(t, putManifest("//mutable/app:v1", variant))
+	assertImageIn(t, cl, "//backups/app:v1")
+}
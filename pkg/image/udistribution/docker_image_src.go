@@ -18,6 +18,8 @@ import (
 	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/pkg/sysregistriesv2"
 	"github.com/containers/image/v5/types"
+	"github.com/distribution/distribution/v3"
+	"github.com/migtools/udistribution/pkg/client"
 	"github.com/migtools/udistribution/pkg/internal/image/iolimits"
 	"github.com/migtools/udistribution/pkg/internal/image/private"
 	digest "github.com/opencontainers/go-digest"
@@ -29,11 +31,20 @@ type udistributionImageSource struct {
 	logicalRef  udistributionReference // The reference the user requested.
 	physicalRef udistributionReference // The actual reference we are accessing (possibly a mirror)
 	c           *udistributionClient
+	// fallbacks are the other read backends of the transport, tried in order when reading from c fails.
+	fallbacks []imageSourceFallback
 	// State
 	cachedManifest         []byte // nil if not loaded yet
 	cachedManifestMIMEType string // Only valid if cachedManifest != nil
 }
 
+// imageSourceFallback is the location of physicalRef on a read backend other than the one the manifest was loaded from.
+type imageSourceFallback struct {
+	description string
+	ref         udistributionReference
+	c           *udistributionClient
+}
+
 // newImageSource creates a new ImageSource for the specified image reference.
 // The caller must call .Close() on the returned ImageSource.
 func newImageSource(ctx context.Context, sys *types.SystemContext, ref udistributionReference) (*udistributionImageSource, error) {
@@ -61,26 +72,46 @@ func newImageSource(ctx context.Context, sys *types.SystemContext, ref udistribu
 	if err != nil {
 		return nil, err
 	}
+	// Each endpoint is tried on every read backend, primary backend first.
+	backends := ref.UdistributionTransport.readBackends()
 	type attempt struct {
-		ref reference.Named
-		err error
+		ref     reference.Named
+		backend string
+		err     error
 	}
 	attempts := []attempt{}
-	for _, pullSource := range pullSources {
-		if sys != nil && sys.DockerLogMirrorChoice {
-			logrus.Infof("Trying to access %q", pullSource.Reference)
-		} else {
-			logrus.Debugf("Trying to access %q", pullSource.Reference)
-		}
-		s, err := newImageSourceAttempt(ctx, sys, ref, pullSource)
-		if err == nil {
-			return s, nil
+	for i, backend := range backends {
+		backendRef := ref
+		backendRef.UdistributionTransport = backend
+		description := backendDescription(backend, i)
+		for _, pullSource := range pullSources {
+			if sys != nil && sys.DockerLogMirrorChoice {
+				logrus.Infof("Trying to access %q on %s", pullSource.Reference, description)
+			} else {
+				logrus.Debugf("Trying to access %q on %s", pullSource.Reference, description)
+			}
+			s, err := newImageSourceAttempt(ctx, sys, backendRef, pullSource)
+			if err == nil {
+				s.logicalRef = ref
+				if len(backends) > 1 {
+					if err := s.setupFallbacks(sys, backends, i); err != nil {
+						return nil, err
+					}
+					if sys != nil && sys.DockerLogMirrorChoice {
+						logrus.Infof("Reading %q from %s", pullSource.Reference, description)
+					} else {
+						logrus.Debugf("Reading %q from %s", pullSource.Reference, description)
+					}
+				}
+				return s, nil
+			}
+			logrus.Debugf("Accessing %q on %s failed: %v", pullSource.Reference, description, err)
+			attempts = append(attempts, attempt{
+				ref:     pullSource.Reference,
+				backend: description,
+				err:     err,
+			})
 		}
-		logrus.Debugf("Accessing %q failed: %v", pullSource.Reference, err)
-		attempts = append(attempts, attempt{
-			ref: pullSource.Reference,
-			err: err,
-		})
 	}
 	switch len(attempts) {
 	case 0:
@@ -89,12 +120,24 @@ func newImageSource(ctx context.Context, sys *types.SystemContext, ref udistribu
 		return nil, attempts[0].err // If no mirrors are used, perfectly preserve the error type and add no noise.
 	default:
 		// Don’t just build a string, try to preserve the typed error.
-		primary := &attempts[len(attempts)-1]
+		// The primary error is the one for the non-mirror original location on the primary backend.
+		primaryIndex := len(pullSources) - 1
+		primary := &attempts[primaryIndex]
 		extras := []string{}
-		for i := 0; i < len(attempts)-1; i++ {
+		for i := 0; i < len(attempts); i++ {
+			if i == primaryIndex {
+				continue
+			}
 			// This is difficult to fit into a single-line string, when the error can contain arbitrary strings including any metacharacters we decide to use.
 			// The paired [] at least have some chance of being unambiguous.
-			extras = append(extras, fmt.Sprintf("[%s: %v]", attempts[i].ref.String(), attempts[i].err))
+			if len(backends) > 1 {
+				extras = append(extras, fmt.Sprintf("[%s on %s: %v]", attempts[i].ref.String(), attempts[i].backend, attempts[i].err))
+			} else {
+				extras = append(extras, fmt.Sprintf("[%s: %v]", attempts[i].ref.String(), attempts[i].err))
+			}
+		}
+		if len(backends) > 1 {
+			return nil, errors.Wrapf(primary.err, "(Mirrors and fallback backends also failed: %s): %s", strings.Join(extras, "\n"), primary.ref.String())
 		}
 		return nil, errors.Wrapf(primary.err, "(Mirrors also failed: %s): %s", strings.Join(extras, "\n"), primary.ref.String())
 	}
@@ -109,16 +152,7 @@ func newImageSourceAttempt(ctx context.Context, sys *types.SystemContext, logica
 		return nil, err
 	}
 
-	endpointSys := sys
-	// sys.DockerAuthConfig does not explicitly specify a registry; we must not blindly send the credentials intended for the primary endpoint to mirrors.
-	if endpointSys != nil && endpointSys.DockerAuthConfig != nil && reference.Domain(physicalRef.ref) != reference.Domain(logicalRef.ref) {
-		copy := *endpointSys
-		copy.DockerAuthConfig = nil
-		copy.DockerBearerRegistryToken = ""
-		endpointSys = &copy
-	}
-
-	client, err := newDockerClientFromRef(endpointSys, physicalRef, false, "pull")
+	client, err := newDockerClientFromRef(endpointSystemContext(sys, logicalRef, physicalRef), physicalRef, false, "pull")
 	if err != nil {
 		return nil, err
 	}
@@ -136,6 +170,62 @@ func newImageSourceAttempt(ctx context.Context, sys *types.SystemContext, logica
 	return s, nil
 }
 
+// endpointSystemContext returns the SystemContext to use when accessing physicalRef on behalf of logicalRef.
+func endpointSystemContext(sys *types.SystemContext, logicalRef, physicalRef udistributionReference) *types.SystemContext {
+	endpointSys := sys
+	// sys.DockerAuthConfig does not explicitly specify a registry; we must not blindly send the credentials intended for the primary endpoint to mirrors.
+	if endpointSys != nil && endpointSys.DockerAuthConfig != nil && reference.Domain(physicalRef.ref) != reference.Domain(logicalRef.ref) {
+		copy := *endpointSys
+		copy.DockerAuthConfig = nil
+		copy.DockerBearerRegistryToken = ""
+		endpointSys = &copy
+	}
+	return endpointSys
+}
+
+// setupFallbacks sets s.fallbacks to the location of s.physicalRef on all backends other than backends[served], in order.
+func (s *udistributionImageSource) setupFallbacks(sys *types.SystemContext, backends []*UdistributionTransport, served int) error {
+	for i, backend := range backends {
+		if i == served {
+			continue
+		}
+		ref := s.physicalRef
+		ref.UdistributionTransport = backend
+		c, err := newDockerClientFromRef(endpointSystemContext(sys, s.logicalRef, ref), ref, false, "pull")
+		if err != nil {
+			return err
+		}
+		c.tlsClientConfig.InsecureSkipVerify = s.c.tlsClientConfig.InsecureSkipVerify
+		s.fallbacks = append(s.fallbacks, imageSourceFallback{
+			description: backendDescription(backend, i),
+			ref:         ref,
+			c:           c,
+		})
+	}
+	return nil
+}
+
+// logFallbackChoice logs that what has been read from fallback instead of the backend serving the manifest.
+func (s *udistributionImageSource) logFallbackChoice(what string, fallback imageSourceFallback) {
+	if s.c.sys != nil && s.c.sys.DockerLogMirrorChoice {
+		logrus.Infof("Read %s from %s", what, fallback.description)
+	} else {
+		logrus.Debugf("Read %s from %s", what, fallback.description)
+	}
+}
+
+// fallbacksFailedError returns primaryErr annotated with the errors encountered on fallback backends, if any.
+func fallbacksFailedError(primaryErr error, fallbacks []imageSourceFallback, fallbackErrs []error) error {
+	if len(fallbackErrs) == 0 {
+		return primaryErr
+	}
+	extras := []string{}
+	for i, err := range fallbackErrs {
+		extras = append(extras, fmt.Sprintf("[%s: %v]", fallbacks[i].description, err))
+	}
+	return errors.Wrapf(primaryErr, "(Fallback backends also failed: %s)", strings.Join(extras, "\n"))
+}
+
 // Reference returns the reference used to set up this source, _as specified by the user_
 // (not as the image itself, or its underlying storage, claims).  This can be used e.g. to determine which public keys are trusted for this image.
 func (s *udistributionImageSource) Reference() types.ImageReference {
@@ -183,7 +273,20 @@ func simplifyContentType(contentType string) string {
 // this never happens if the primary manifest is not a manifest list (e.g. if the source never returns manifest lists).
 func (s *udistributionImageSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
 	if instanceDigest != nil {
-		return s.fetchManifest(ctx, instanceDigest.String())
+		manblob, mt, err := s.fetchManifest(ctx, instanceDigest.String())
+		if err == nil || len(s.fallbacks) == 0 {
+			return manblob, mt, err
+		}
+		fallbackErrs := []error{}
+		for _, fallback := range s.fallbacks {
+			manblob, mt, ferr := fetchManifestFrom(ctx, fallback.c, fallback.ref, instanceDigest.String())
+			if ferr == nil {
+				s.logFallbackChoice(fmt.Sprintf("manifest %s", instanceDigest.String()), fallback)
+				return manblob, mt, nil
+			}
+			fallbackErrs = append(fallbackErrs, ferr)
+		}
+		return nil, "", fallbacksFailedError(err, s.fallbacks, fallbackErrs)
 	}
 	err := s.ensureManifestIsLoaded(ctx)
 	if err != nil {
@@ -193,18 +296,23 @@ func (s *udistributionImageSource) GetManifest(ctx context.Context, instanceDige
 }
 
 func (s *udistributionImageSource) fetchManifest(ctx context.Context, tagOrDigest string) ([]byte, string, error) {
-	path := fmt.Sprintf(manifestPath, reference.Path(s.physicalRef.ref), tagOrDigest)
+	return fetchManifestFrom(ctx, s.c, s.physicalRef, tagOrDigest)
+}
+
+// fetchManifestFrom fetches the manifest tagOrDigest of ref using c.
+func fetchManifestFrom(ctx context.Context, c *udistributionClient, ref udistributionReference, tagOrDigest string) ([]byte, string, error) {
+	path := fmt.Sprintf(manifestPath, reference.Path(ref.ref), tagOrDigest)
 	headers := map[string][]string{
 		"Accept": manifest.DefaultRequestedManifestMIMETypes,
 	}
-	res, err := s.c.makeRequest(ctx, http.MethodGet, path, headers, nil, v2Auth, nil)
+	res, err := c.makeRequest(ctx, http.MethodGet, path, headers, nil, v2Auth, nil)
 	if err != nil {
 		return nil, "", err
 	}
 	logrus.Debugf("Content-Type from manifest GET is %q", res.Header.Get("Content-Type"))
 	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
-		return nil, "", errors.Wrapf(registryHTTPResponseToError(res), "reading manifest %s in %s", tagOrDigest, s.physicalRef.ref.Name())
+		return nil, "", errors.Wrapf(registryHTTPResponseToError(res), "reading manifest %s in %s", tagOrDigest, ref.ref.Name())
 	}
 
 	manblob, err := iolimits.ReadAtMost(res.Body, iolimits.MaxManifestBodySize)
@@ -397,23 +505,88 @@ func parseMediaType(contentType string) (string, map[string]string, error) {
 // The specified chunks must be not overlapping and sorted by their offset.
 // The readers must be fully consumed, in the order they are returned, before blocking
 // to read the next chunk.
+// Chunks are read directly from the storage driver, in parallel up to the transport's WithGetBlobAtConcurrency,
+// after the registry has authorized reading the blob; blobs the registry serves from elsewhere, e.g. as a
+// pull-through cache, are read with a range request.
 func (s *udistributionImageSource) GetBlobAt(ctx context.Context, info types.BlobInfo, chunks []private.ImageSourceChunk) (chan io.ReadCloser, chan error, error) {
+	if len(info.URLs) != 0 {
+		return nil, nil, fmt.Errorf("external URLs not supported with GetBlobAt")
+	}
+	streams, errs, err := getBlobAtFrom(ctx, s.c, s.physicalRef, info, chunks)
+	if err == nil || len(s.fallbacks) == 0 {
+		return streams, errs, err
+	}
+	fallbackErrs := []error{}
+	for _, fallback := range s.fallbacks {
+		streams, errs, ferr := getBlobAtFrom(ctx, fallback.c, fallback.ref, info, chunks)
+		if ferr == nil {
+			s.logFallbackChoice(fmt.Sprintf("chunks of blob %s", info.Digest.String()), fallback)
+			return streams, errs, nil
+		}
+		fallbackErrs = append(fallbackErrs, ferr)
+	}
+	return nil, nil, fallbacksFailedError(err, s.fallbacks, fallbackErrs)
+}
+
+// getBlobAtFrom implements GetBlobAt for the blob described by info in ref using c.
+func getBlobAtFrom(ctx context.Context, c *udistributionClient, ref udistributionReference, info types.BlobInfo, chunks []private.ImageSourceChunk) (chan io.ReadCloser, chan error, error) {
+	blob, err := openStoredBlob(ctx, c, ref, info.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	if blob == nil {
+		return getBlobAtThroughRegistry(ctx, c, ref, info, chunks)
+	}
+	for _, chunk := range chunks {
+		if chunk.Length > uint64(blob.Size) || chunk.Offset > uint64(blob.Size)-chunk.Length {
+			return nil, nil, private.BadPartialRequestError{Status: fmt.Sprintf("%d %s", http.StatusRequestedRangeNotSatisfiable, http.StatusText(http.StatusRequestedRangeNotSatisfiable))}
+		}
+	}
+	streams := make(chan io.ReadCloser)
+	errs := make(chan error)
+	go readStoredChunks(ctx, blob, chunks, ref.UdistributionTransport.getBlobAtConcurrency, streams, errs)
+	return streams, errs, nil
+}
+
+// openStoredBlob checks that the registry serves the blob dgst of ref using c, and returns its data in the registry storage,
+// or nil if the storage does not contain it.
+func openStoredBlob(ctx context.Context, c *udistributionClient, ref udistributionReference, dgst digest.Digest) (*client.StoredBlob, error) {
+	path := fmt.Sprintf(blobsPath, reference.Path(ref.ref), dgst.String())
+	logrus.Debugf("Checking %s", path)
+	res, err := c.makeRequest(ctx, http.MethodHead, path, nil, nil, v2Auth, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		err := httpResponseToError(res, "Error fetching partial blob")
+		if err == nil {
+			err = errors.Errorf("invalid status code returned when fetching blob %d (%s)", res.StatusCode, http.StatusText(res.StatusCode))
+		}
+		return nil, err
+	}
+	blob, err := ref.UdistributionTransport.Client.OpenBlob(ctx, reference.Path(ref.ref), dgst)
+	if errors.Is(err, distribution.ErrBlobUnknown) {
+		logrus.Debugf("Blob %s is not in the registry storage: %v", dgst, err)
+		return nil, nil
+	}
+	return blob, err
+}
+
+// getBlobAtThroughRegistry implements GetBlobAt with a multi-range request to the registry, for ref using c.
+func getBlobAtThroughRegistry(ctx context.Context, c *udistributionClient, ref udistributionReference, info types.BlobInfo, chunks []private.ImageSourceChunk) (chan io.ReadCloser, chan error, error) {
 	headers := make(map[string][]string)
 
 	var rangeVals []string
-	for _, c := range chunks {
-		rangeVals = append(rangeVals, fmt.Sprintf("%d-%d", c.Offset, c.Offset+c.Length-1))
+	for _, chunk := range chunks {
+		rangeVals = append(rangeVals, fmt.Sprintf("%d-%d", chunk.Offset, chunk.Offset+chunk.Length-1))
 	}
 
 	headers["Range"] = []string{fmt.Sprintf("bytes=%s", strings.Join(rangeVals, ","))}
 
-	if len(info.URLs) != 0 {
-		return nil, nil, fmt.Errorf("external URLs not supported with GetBlobAt")
-	}
-
-	path := fmt.Sprintf(blobsPath, reference.Path(s.physicalRef.ref), info.Digest.String())
+	path := fmt.Sprintf(blobsPath, reference.Path(ref.ref), info.Digest.String())
 	logrus.Debugf("Downloading %s", path)
-	res, err := s.c.makeRequest(ctx, http.MethodGet, path, headers, nil, v2Auth, nil)
+	res, err := c.makeRequest(ctx, http.MethodGet, path, headers, nil, v2Auth, nil)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -454,6 +627,22 @@ func (s *udistributionImageSource) GetBlobAt(ctx context.Context, info types.Blo
 // The Digest field in BlobInfo is guaranteed to be provided, Size may be -1 and MediaType may be optionally provided.
 // May update BlobInfoCache, preferably after it knows for certain that a blob truly exists at a specific location.
 func (s *udistributionImageSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	reporter := newTransferReporter(ctx, s.logicalRef.UdistributionTransport, TransferDownload, s.logicalRef.ref, info.Digest, info.Size)
+	body, size, err := s.getBlob(ctx, info, cache)
+	if err != nil {
+		reporter.failed(err)
+		return nil, 0, err
+	}
+	if reporter == nil {
+		return body, size, nil
+	}
+	reporter.progress.Size = size
+	return &progressReadCloser{rc: body, reporter: reporter}, size, nil
+}
+
+// getBlob implements GetBlob, without reporting the transfer.
+func (s *udistributionImageSource) getBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	cache = s.physicalRef.UdistributionTransport.blobInfoCache(cache)
 	if len(info.URLs) != 0 {
 		r, s, err := s.getExternalBlob(ctx, info.URLs)
 		if err != nil {
@@ -463,9 +652,30 @@ func (s *udistributionImageSource) GetBlob(ctx context.Context, info types.BlobI
 		}
 	}
 
-	path := fmt.Sprintf(blobsPath, reference.Path(s.physicalRef.ref), info.Digest.String())
+	body, size, err := getBlobFrom(ctx, s.c, s.physicalRef, info)
+	if err == nil {
+		cache.RecordKnownLocation(s.physicalRef.Transport(), bicTransportScope(s.physicalRef), info.Digest, newBICLocationReference(s.physicalRef))
+		return body, size, nil
+	}
+	// The location is deliberately not recorded in cache for blobs read from fallbacks:
+	// destinations only ever write to, and reuse blobs from, the primary backend.
+	fallbackErrs := []error{}
+	for _, fallback := range s.fallbacks {
+		body, size, ferr := getBlobFrom(ctx, fallback.c, fallback.ref, info)
+		if ferr == nil {
+			s.logFallbackChoice(fmt.Sprintf("blob %s", info.Digest.String()), fallback)
+			return body, size, nil
+		}
+		fallbackErrs = append(fallbackErrs, ferr)
+	}
+	return nil, 0, fallbacksFailedError(err, s.fallbacks, fallbackErrs)
+}
+
+// getBlobFrom returns a stream for the blob described by info in ref using c, and the blob’s size (or -1 if unknown).
+func getBlobFrom(ctx context.Context, c *udistributionClient, ref udistributionReference, info types.BlobInfo) (io.ReadCloser, int64, error) {
+	path := fmt.Sprintf(blobsPath, reference.Path(ref.ref), info.Digest.String())
 	logrus.Debugf("Downloading %s", path)
-	res, err := s.c.makeRequest(ctx, http.MethodGet, path, nil, nil, v2Auth, nil)
+	res, err := c.makeRequest(ctx, http.MethodGet, path, nil, nil, v2Auth, nil)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -473,7 +683,6 @@ func (s *udistributionImageSource) GetBlob(ctx context.Context, info types.BlobI
 		res.Body.Close()
 		return nil, 0, err
 	}
-	cache.RecordKnownLocation(s.physicalRef.Transport(), bicTransportScope(s.physicalRef), info.Digest, newBICLocationReference(s.physicalRef))
 	return res.Body, getBlobSize(res), nil
 }
 
@@ -486,6 +695,8 @@ func (s *udistributionImageSource) GetSignatures(ctx context.Context, instanceDi
 		return nil, err
 	}
 	switch {
+	case s.c.usesStorageLookaside():
+		return s.getSignaturesFromLookaside(ctx, instanceDigest)
 	case s.c.supportsSignatures:
 		return s.getSignaturesFromAPIExtension(ctx, instanceDigest)
 	case s.c.signatureBase != nil:
@@ -575,6 +786,8 @@ func (s *udistributionImageSource) getOneSignature(ctx context.Context, url *url
 		}
 		return sig, false, nil
 
+	case StorageLookasideScheme:
+		return s.c.getStorageSignature(ctx, url)
 	default:
 		return nil, false, errors.Errorf("Unsupported scheme when reading signature from %s", url.Redacted())
 	}
@@ -602,7 +815,7 @@ func (s *udistributionImageSource) getSignaturesFromAPIExtension(ctx context.Con
 }
 
 // deleteImage deletes the named image from the registry, if supported.
-func deleteImage(ctx context.Context, sys *types.SystemContext, ref udistributionReference) error {
+func deleteImage(ctx context.Context, sys *types.SystemContext, ref udistributionReference, opts DeleteImageOptions) error {
 	// docker/distribution does not document what action should be used for deleting images.
 	//
 	// Current docker/distribution requires "pull" for reading the manifest and "delete" for deleting it.
@@ -644,6 +857,11 @@ func deleteImage(ctx context.Context, sys *types.SystemContext, ref udistributio
 	if err != nil {
 		return fmt.Errorf("computing manifest digest: %w", err)
 	}
+	if opts.CascadeReferrers {
+		if err := deleteReferrers(ctx, sys, c, ref, manifestDigest, opts); err != nil {
+			return err
+		}
+	}
 	deletePath := fmt.Sprintf(manifestPath, reference.Path(ref.ref), manifestDigest)
 
 	// When retrieving the digest from a registry >= 2.3 use the following header:
@@ -664,7 +882,7 @@ func deleteImage(ctx context.Context, sys *types.SystemContext, ref udistributio
 
 	for i := 0; ; i++ {
 		url := signatureStorageURL(c.signatureBase, manifestDigest, i)
-		missing, err := c.deleteOneSignature(url)
+		missing, err := c.deleteOneSignature(ctx, url)
 		if err != nil {
 			return err
 		}
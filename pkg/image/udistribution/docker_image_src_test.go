@@ -8,12 +8,16 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"testing"
 
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
 	"github.com/containers/image/v5/types"
 	"github.com/migtools/udistribution/pkg/internal/image/private"
+	"github.com/migtools/udistribution/pkg/internal/testing/clienttest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -211,3 +215,68 @@ func TestParseMediaType(t *testing.T) {
 	_, _, err = parseMediaType("multipart/byteranges; boundary=@")
 	require.Error(t, err)
 }
+
+func TestImageSourceReadFallbacks(t *testing.T) {
+	ctx := context.Background()
+	sys := &types.SystemContext{}
+	fallback, _ := clienttest.NewFilesystemClient(t, nil)
+	fallbackTransport := NewTransport(fallback, "fallback")
+	defer fallbackTransport.Deregister()
+	fallbackRef, err := fallbackTransport.ParseReference("//test/fallback:latest")
+	require.NoError(t, err)
+	clienttest.CopyFixtureImage(t, fallbackRef)
+
+	ut, primaryDir := newFilesystemTestTransport(t, WithReadFallbacks(fallback))
+	ref, err := ut.ParseReference("//test/fallback:latest")
+	require.NoError(t, err)
+
+	// The image only exists on the fallback.
+	src, err := ref.NewImageSource(ctx, sys)
+	require.NoError(t, err)
+	defer src.Close()
+	assert.Equal(t, ref, src.Reference())
+	manifestBlob, _, err := src.GetManifest(ctx, nil)
+	require.NoError(t, err)
+	parsed, err := manifest.FromBlob(manifestBlob, manifest.GuessMIMEType(manifestBlob))
+	require.NoError(t, err)
+	layer := parsed.LayerInfos()[0].BlobInfo
+	rc, _, err := src.GetBlob(ctx, layer, none.NoCache)
+	require.NoError(t, err)
+	layerData, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	rc.Close()
+
+	// The image exists on both, but a blob is missing from the primary.
+	clienttest.CopyFixtureImage(t, ref)
+	layerHex := layer.Digest.Encoded()
+	require.NoError(t, os.Remove(filepath.Join(primaryDir, "docker/registry/v2/blobs/sha256", layerHex[:2], layerHex, "data")))
+	src2, err := ref.NewImageSource(ctx, sys)
+	require.NoError(t, err)
+	defer src2.Close()
+	rc, _, err = src2.GetBlob(ctx, layer, none.NoCache)
+	require.NoError(t, err)
+	rc.Close()
+	chunks := []private.ImageSourceChunk{{Offset: 0, Length: 2}, {Offset: uint64(len(layerData)) - 2, Length: 2}}
+	streams, errs, err := src2.(private.ImageSource).GetBlobAt(ctx, layer, chunks)
+	require.NoError(t, err)
+	verifyGetBlobAtOutput(t, streams, errs, []verifyGetBlobAtData{
+		{expectedData: layerData[:2]},
+		{expectedData: layerData[len(layerData)-2:]},
+		{expectedData: nil},
+	})
+
+	// Nothing anywhere: errors from all backends are reported.
+	missingRef, err := ut.ParseReference("//test/missing:latest")
+	require.NoError(t, err)
+	_, err = missingRef.NewImageSource(ctx, sys)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "fallback filesystem backend #1")
+
+	// A blob missing everywhere reports errors from all backends.
+	_, _, err = src2.GetBlob(ctx, types.BlobInfo{Digest: "sha256:" + sha256digestHex}, none.NoCache)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Fallback backends also failed")
+	_, _, err = src2.(private.ImageSource).GetBlobAt(ctx, types.BlobInfo{Digest: "sha256:" + sha256digestHex}, chunks[:1])
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Fallback backends also failed")
+}
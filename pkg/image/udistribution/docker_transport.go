@@ -14,6 +14,7 @@ import (
 	"github.com/containers/image/v5/types"
 	"github.com/migtools/udistribution/pkg/client"
 	"github.com/migtools/udistribution/pkg/constants"
+	"github.com/migtools/udistribution/pkg/internal/image/blobinfocache"
 	"github.com/pkg/errors"
 )
 
@@ -29,16 +30,45 @@ type UdistributionTransport struct {
 	*client.Client
 	name string
 	uuid string
+
+	// readFallbacks are additional clients tried, in order, when reading from Client fails.
+	readFallbacks []*client.Client
+	// writeReplicas are additional clients every write is replicated to, according to replication.
+	writeReplicas []*client.Client
+	replication   ReplicationOptions
+	// chunkedUploads configures how PutBlob uploads blobs.
+	chunkedUploads ChunkedUploadOptions
+	// transferProgress configures reporting of blob transfers.
+	transferProgress TransferProgressOptions
+	// persistentCache, if not nil, is a cache used in addition to the cache of callers; see WithPersistentBlobInfoCache.
+	persistentCache blobinfocache.BlobInfoCache2
+	// getBlobAtConcurrency is the number of chunks GetBlobAt reads at once; 0 means defaultGetBlobAtConcurrency.
+	getBlobAtConcurrency int
+}
+
+// TransportOption configures optional behavior of a UdistributionTransport.
+type TransportOption func(*UdistributionTransport)
+
+// WithReadFallbacks configures backends which are tried, in order, when an image or blob
+// cannot be read from the transport's own client, e.g. a secondary bucket holding replicated backups.
+// Writes always go to the transport's own client only.
+func WithReadFallbacks(clients ...*client.Client) TransportOption {
+	return func(t *UdistributionTransport) {
+		t.readFallbacks = append(t.readFallbacks, clients...)
+	}
 }
 
 // Create new transport and register.
 // When you are done with this transport, use Deregister() to unregister it from available transports.
-func NewTransport(client *client.Client, name string) *UdistributionTransport {
+func NewTransport(client *client.Client, name string, opts ...TransportOption) *UdistributionTransport {
 	t := UdistributionTransport{
 		Client: client,
 		name:   name,
 		uuid:   uuid.Generate().String(),
 	}
+	for _, opt := range opts {
+		opt(&t)
+	}
 	if transports.Get(t.Name()) == nil {
 		transports.Register(t)
 	}
@@ -47,7 +77,7 @@ func NewTransport(client *client.Client, name string) *UdistributionTransport {
 
 // Create new transport with client params and register.
 // When you are done with this transport, use Deregister() to unregister it from available transports.
-func NewTransportFromNewConfig(config string, env []string) (*UdistributionTransport, error) {
+func NewTransportFromNewConfig(config string, env []string, opts ...TransportOption) (*UdistributionTransport, error) {
 	c, err := client.NewClient(config, env)
 	if err != nil {
 		return nil, err
@@ -57,12 +87,26 @@ func NewTransportFromNewConfig(config string, env []string) (*UdistributionTrans
 		name:   c.GetApp().Config.Storage.Type(),
 		uuid:   uuid.Generate().String(),
 	}
+	for _, opt := range opts {
+		opt(&t)
+	}
 	if transports.Get(t.Name()) == nil {
 		transports.Register(t)
 	}
 	return &t, nil
 }
 
+// CheckAuth validates the credentials against the access controller of the transport's in-process registry,
+// and checks that the registry's storage backend is reachable.
+// It returns ErrUnauthorizedForCredentials if the credentials are rejected, and client.ErrStorageUnreachable or
+// client.ErrBucketMissing if the storage backend can not be used.
+func (t *UdistributionTransport) CheckAuth(ctx context.Context, sys *types.SystemContext, username, password string) error {
+	if err := t.Client.CheckStorage(ctx); err != nil {
+		return err
+	}
+	return checkAuth(ctx, sys, t, username, password, dockerRegistry)
+}
+
 func (u UdistributionTransport) Deregister() {
 	transports.Delete(u.Name())
 }
@@ -71,6 +115,45 @@ func (t UdistributionTransport) Name() string {
 	return constants.TransportPrefix + t.name + "-" + t.uuid
 }
 
+// readBackends returns one transport per backend usable for reads, in the order they should be tried:
+// the transport's own client first, followed by any configured read fallbacks.
+// All returned transports share the identity (Name()) of t.
+func (t *UdistributionTransport) readBackends() []*UdistributionTransport {
+	backends := []*UdistributionTransport{t}
+	for _, c := range t.readFallbacks {
+		backends = append(backends, t.withBackend(c))
+	}
+	return backends
+}
+
+// writeBackends returns one transport per backend writes are replicated to:
+// the transport's own client first, followed by any configured write replicas.
+// All returned transports share the identity (Name()) of t.
+func (t *UdistributionTransport) writeBackends() []*UdistributionTransport {
+	backends := []*UdistributionTransport{t.withBackend(t.Client)}
+	for _, c := range t.writeReplicas {
+		backends = append(backends, t.withBackend(c))
+	}
+	return backends
+}
+
+// withBackend returns a copy of t which only accesses c.
+func (t *UdistributionTransport) withBackend(c *client.Client) *UdistributionTransport {
+	backend := *t
+	backend.Client = c
+	backend.readFallbacks = nil
+	backend.writeReplicas = nil
+	return &backend
+}
+
+// backendDescription returns a human-readable description of the i-th backend returned by readBackends.
+func backendDescription(backend *UdistributionTransport, i int) string {
+	if i == 0 {
+		return fmt.Sprintf("primary %s backend", backend.GetApp().Config.Storage.Type())
+	}
+	return fmt.Sprintf("fallback %s backend #%d", backend.GetApp().Config.Storage.Type(), i)
+}
+
 // ParseReference converts a string, which should not start with the ImageTransport.Name prefix, into an ImageReference.
 func (t UdistributionTransport) ParseReference(reference string) (types.ImageReference, error) {
 	return ParseReference(reference, &t)
@@ -206,8 +289,9 @@ func (ref udistributionReference) NewImageDestination(ctx context.Context, sys *
 }
 
 // DeleteImage deletes the named image from the registry, if supported.
+// Referrers of the image are not deleted, see DeleteImageWithOptions.
 func (ref udistributionReference) DeleteImage(ctx context.Context, sys *types.SystemContext) error {
-	return deleteImage(ctx, sys, ref)
+	return deleteImage(ctx, sys, ref, DeleteImageOptions{})
 }
 
 // tagOrDigest returns a tag or digest from the reference.
@@ -2,12 +2,18 @@ package udistribution
 
 import (
 	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/transports"
 	"github.com/containers/image/v5/types"
 	"github.com/migtools/udistribution/pkg/client"
 	"github.com/migtools/udistribution/pkg/constants"
+	"github.com/migtools/udistribution/pkg/internal/testing/clienttest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -226,3 +232,72 @@ func TestReferenceTagOrDigest(t *testing.T) {
 	_, err = dockerRef.tagOrDigest()
 	assert.Error(t, err)
 }
+
+func TestTransportCheckAuth(t *testing.T) {
+	ctx := context.Background()
+	sys := &types.SystemContext{}
+	htpasswdPath := filepath.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, os.WriteFile(htpasswdPath, []byte(testHtpasswd), 0600))
+	c, _ := clienttest.NewFilesystemClient(t, []string{
+		"REGISTRY_AUTH=htpasswd",
+		"REGISTRY_AUTH_HTPASSWD_REALM=test",
+		"REGISTRY_AUTH_HTPASSWD_PATH=" + htpasswdPath,
+	})
+	ut := NewTransport(c, "filesystem")
+	defer ut.Deregister()
+	assert.NoError(t, ut.CheckAuth(ctx, sys, "testuser", "testpassword"))
+	assert.ErrorAs(t, ut.CheckAuth(ctx, sys, "testuser", "wrong"), &ErrUnauthorizedForCredentials{})
+
+	broken := NewTransport(newBrokenTestClient(t), "filesystem")
+	defer broken.Deregister()
+	assert.ErrorAs(t, broken.CheckAuth(ctx, sys, "", ""), &client.ErrStorageUnreachable{})
+
+	s3 := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNotFound)
+		_, _ = rw.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchBucket</Code><Message>The specified bucket does not exist</Message><BucketName>missing</BucketName></Error>`))
+	}))
+	defer s3.Close()
+	missing, err := client.NewClient("", []string{
+		"REGISTRY_STORAGE=s3",
+		"REGISTRY_STORAGE_S3_BUCKET=missing",
+		"REGISTRY_STORAGE_S3_REGION=us-east-1",
+		"REGISTRY_STORAGE_S3_ACCESSKEY=test",
+		"REGISTRY_STORAGE_S3_SECRETKEY=test",
+		"REGISTRY_STORAGE_S3_REGIONENDPOINT=" + s3.URL,
+		"REGISTRY_STORAGE_S3_FORCEPATHSTYLE=true",
+		"REGISTRY_STORAGE_CACHE_BLOBDESCRIPTOR=inmemory",
+	})
+	require.NoError(t, err)
+	missingUT := NewTransport(missing, "s3")
+	defer missingUT.Deregister()
+	err = missingUT.CheckAuth(ctx, sys, "", "")
+	var bucketErr client.ErrBucketMissing
+	require.ErrorAs(t, err, &bucketErr)
+	assert.Equal(t, "missing", bucketErr.Bucket)
+
+	azure := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("x-ms-error-code", "ContainerNotFound")
+		rw.WriteHeader(http.StatusNotFound)
+		_, _ = rw.Write([]byte(`<?xml version="1.0" encoding="utf-8"?><Error><Code>ContainerNotFound</Code><Message>The specified container does not exist.</Message></Error>`))
+	}))
+	defer azure.Close()
+	missingContainer, err := client.NewClient("", []string{
+		"REGISTRY_STORAGE=azure",
+		"REGISTRY_STORAGE_AZURE_ACCOUNTNAME=test",
+		"REGISTRY_STORAGE_AZURE_ACCOUNTKEY=dGVzdA==",
+		"REGISTRY_STORAGE_AZURE_CONTAINER=missing",
+		"REGISTRY_STORAGE_AZURE_SERVICEURL=" + azure.URL,
+		"REGISTRY_STORAGE_CACHE_BLOBDESCRIPTOR=inmemory",
+	})
+	require.NoError(t, err)
+	missingContainerUT := NewTransport(missingContainer, "azure")
+	defer missingContainerUT.Deregister()
+	err = missingContainerUT.CheckAuth(ctx, sys, "", "")
+	require.ErrorAs(t, err, &bucketErr)
+	assert.Equal(t, "missing", bucketErr.Bucket)
+
+	// The package-level CheckAuth does not leave a transport registered.
+	before := len(transports.ListNames())
+	require.NoError(t, CheckAuth(ctx, sys, "", "", ""))
+	assert.Equal(t, before, len(transports.ListNames()))
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/distribution/distribution/v3/registry/api/errcode"
 	"github.com/distribution/distribution/v3/registry/client"
 	perrors "github.com/pkg/errors"
 )
@@ -26,6 +27,65 @@ func (e ErrUnauthorizedForCredentials) Error() string {
 	return fmt.Sprintf("unable to retrieve auth token: invalid username/password: %s", e.Err.Error())
 }
 
+// ErrTagImmutable is returned when pushing a manifest to a tag of an immutable repository which references another manifest.
+type ErrTagImmutable struct {
+	// Tag is the tag, including the repository, e.g. "ns/repo:tag".
+	Tag string
+	Err error
+}
+
+func (e ErrTagImmutable) Error() string {
+	return fmt.Sprintf("tag %s is immutable: %s", e.Tag, e.Err.Error())
+}
+
+func (e ErrTagImmutable) Unwrap() error {
+	return e.Err
+}
+
+// ErrQuotaExceeded is returned when an upload or a manifest is rejected because the repository is over one of its quotas.
+type ErrQuotaExceeded struct {
+	// Repository is the repository, e.g. "ns/repo".
+	Repository string
+	Err        error
+}
+
+func (e ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf("quota of %s exceeded: %s", e.Repository, e.Err.Error())
+}
+
+func (e ErrQuotaExceeded) Unwrap() error {
+	return e.Err
+}
+
+// hasErrorCode returns true iff err, from client.HandleErrorResponse or from the in-process registry, contains an error
+// with code. Errors of repository middlewares are reported by some handlers as the detail of an UNKNOWN error.
+func hasErrorCode(err error, code errcode.ErrorCode) bool {
+	var errs errcode.Errors
+	var single errcode.Error
+	switch {
+	case errors.As(err, &errs):
+	case errors.As(err, &single):
+		errs = errcode.Errors{single}
+	default:
+		return false
+	}
+	for _, e := range errs {
+		ec, ok := e.(errcode.ErrorCoder)
+		if !ok {
+			continue
+		}
+		if ec.ErrorCode() == code {
+			return true
+		}
+		if e, ok := e.(errcode.Error); ok && e.Code == errcode.ErrorCodeUnknown {
+			if detail, ok := e.Detail.(map[string]interface{}); ok && detail["code"] == code.String() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // httpResponseToError translates the https.Response into an error, possibly prefixing it with the supplied context. It returns
 // nil if the response is not considered an error.
 // NOTE: Almost all callers in this package should use registryHTTPResponseToError instead.
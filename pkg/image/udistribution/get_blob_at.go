@@ -0,0 +1,121 @@
+package udistribution
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/migtools/udistribution/pkg/client"
+	"github.com/migtools/udistribution/pkg/internal/image/private"
+)
+
+// defaultGetBlobAtConcurrency is the number of chunks GetBlobAt reads from the storage at once by default.
+const defaultGetBlobAtConcurrency = 4
+
+// WithGetBlobAtConcurrency sets the number of chunks of a blob GetBlobAt reads from the storage driver in parallel,
+// e.g. for partial pulls of zstd:chunked layers; 0 uses a default of 4.
+func WithGetBlobAtConcurrency(n int) TransportOption {
+	return func(t *UdistributionTransport) {
+		t.getBlobAtConcurrency = n
+	}
+}
+
+// readStoredChunks sends a reader for each of chunks of blob to streams, in order, reading up to concurrency chunks
+// from the storage at once; a chunk is read until its reader is consumed or closed. It sends a single error to errs on
+// failure, and closes both channels when done.
+func readStoredChunks(ctx context.Context, blob *client.StoredBlob, chunks []private.ImageSourceChunk, concurrency int, streams chan io.ReadCloser, errs chan error) {
+	defer close(streams)
+	defer close(errs)
+	if concurrency <= 0 {
+		concurrency = defaultGetBlobAtConcurrency
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type openedChunk struct {
+		reader io.ReadCloser
+		err    error
+	}
+	opened := make([]chan openedChunk, len(chunks))
+	for i := range opened {
+		opened[i] = make(chan openedChunk, 1)
+	}
+	slots := make(chan struct{}, concurrency)
+	go func() {
+		for i, c := range chunks {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				opened[i] <- openedChunk{err: ctx.Err()}
+				continue
+			}
+			go func(i int, c private.ImageSourceChunk) {
+				r, err := blob.Reader(ctx, int64(c.Offset))
+				if err != nil {
+					<-slots
+					opened[i] <- openedChunk{err: err}
+					return
+				}
+				opened[i] <- openedChunk{reader: &storedChunkReader{reader: r, remaining: c.Length, release: func() { <-slots }}}
+			}(i, c)
+		}
+	}()
+
+	for i := range opened {
+		chunk := <-opened[i]
+		if chunk.err == nil {
+			select {
+			case streams <- chunk.reader:
+				continue
+			case <-ctx.Done():
+				chunk.reader.Close()
+				chunk.err = ctx.Err()
+			}
+		}
+		select {
+		case errs <- chunk.err:
+		case <-ctx.Done():
+		}
+		cancel()
+		// Close the chunks opened ahead of the failed one.
+		for _, next := range opened[i+1:] {
+			if chunk := <-next; chunk.reader != nil {
+				chunk.reader.Close()
+			}
+		}
+		return
+	}
+}
+
+// storedChunkReader reads a chunk of remaining bytes from the reader of a blob, and releases its slot once the chunk
+// has been read in full, or failed to, or when closed.
+type storedChunkReader struct {
+	reader    io.ReadCloser
+	remaining uint64
+	release   func()
+	once      sync.Once
+}
+
+func (r *storedChunkReader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		r.once.Do(r.release)
+		return 0, io.EOF
+	}
+	if uint64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.reader.Read(p)
+	r.remaining -= uint64(n)
+	if err == io.EOF && r.remaining != 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if r.remaining == 0 || err != nil {
+		r.once.Do(r.release)
+	}
+	return n, err
+}
+
+func (r *storedChunkReader) Close() error {
+	r.once.Do(r.release)
+	return r.reader.Close()
+}
@@ -0,0 +1,91 @@
+package udistribution
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/internal/image/private"
+	"github.com/migtools/udistribution/pkg/internal/testing/clienttest"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBlobAt(t *testing.T) {
+	ctx := context.Background()
+	ut, _ := newFilesystemTestTransport(t, WithGetBlobAtConcurrency(2))
+	ref, err := ut.ParseReference("//test/chunks:latest")
+	require.NoError(t, err)
+	clienttest.CopyFixtureImage(t, ref)
+	content := strings.Repeat("0123456789", 500)
+	dest, err := ref.NewImageDestination(ctx, &types.SystemContext{})
+	require.NoError(t, err)
+	defer dest.Close()
+	info, err := dest.PutBlob(ctx, bytesReader(content), types.BlobInfo{Size: -1}, none.NoCache, false)
+	require.NoError(t, err)
+
+	src, err := newImageSource(ctx, &types.SystemContext{}, ref.(udistributionReference))
+	require.NoError(t, err)
+	defer src.Close()
+	chunks := []private.ImageSourceChunk{{Offset: 0, Length: 5}, {Offset: 12, Length: 3}, {Offset: 20, Length: 0}, {Offset: 100, Length: 1000}, {Offset: 4990, Length: 10}}
+	streams, errs, err := src.GetBlobAt(ctx, info, chunks)
+	require.NoError(t, err)
+	expected := []verifyGetBlobAtData{}
+	for _, c := range chunks {
+		expected = append(expected, verifyGetBlobAtData{expectedData: []byte(content[c.Offset : c.Offset+c.Length]), expectedError: nil})
+	}
+	expected = append(expected, verifyGetBlobAtData{expectedData: nil, expectedError: nil})
+	verifyGetBlobAtOutput(t, streams, errs, expected)
+
+	// Readers consumed in full free their slot even if they are closed later.
+	streams, errs, err = src.GetBlobAt(ctx, info, chunks)
+	require.NoError(t, err)
+	readers := []io.ReadCloser{}
+	for i, c := range chunks {
+		r, ok := <-streams
+		require.True(t, ok)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, content[c.Offset:c.Offset+c.Length], string(data), "chunk %d", i)
+		readers = append(readers, r)
+	}
+	_, ok := <-streams
+	assert.False(t, ok)
+	assert.NoError(t, <-errs)
+	for _, r := range readers {
+		require.NoError(t, r.Close())
+	}
+
+	// Chunks past the end of the blob are rejected.
+	_, _, err = src.GetBlobAt(ctx, info, []private.ImageSourceChunk{{Offset: 4990, Length: 11}})
+	assert.ErrorAs(t, err, &private.BadPartialRequestError{})
+
+	// Blobs the registry does not serve are not read from the storage.
+	_, _, err = src.GetBlobAt(ctx, types.BlobInfo{Digest: digest.FromString("unknown")}, chunks[:1])
+	assert.Error(t, err)
+}
+
+func TestStoredChunkReader(t *testing.T) {
+	released := 0
+	r := &storedChunkReader{reader: io.NopCloser(strings.NewReader("0123")), remaining: 6, release: func() { released++ }}
+	data, err := io.ReadAll(r)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, "0123", string(data))
+	assert.Equal(t, 1, released)
+	require.NoError(t, r.Close())
+	require.NoError(t, r.Close())
+	assert.Equal(t, 1, released)
+
+	released = 0
+	r = &storedChunkReader{reader: io.NopCloser(strings.NewReader("012345")), remaining: 4, release: func() { released++ }}
+	data, err = io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "0123", string(data))
+	assert.Equal(t, 1, released)
+	require.NoError(t, r.Close())
+	assert.Equal(t, 1, released)
+}
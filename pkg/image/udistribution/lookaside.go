@@ -1,6 +1,7 @@
 package udistribution
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"os"
@@ -11,6 +12,7 @@ import (
 	"github.com/containers/image/v5/docker/reference"
 	"github.com/containers/image/v5/types"
 	"github.com/containers/storage/pkg/homedir"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/ghodss/yaml"
 	"github.com/migtools/udistribution/pkg/internal/image/rootless"
 	"github.com/opencontainers/go-digest"
@@ -36,6 +38,11 @@ var defaultUserDockerDir = filepath.FromSlash(".local/share/containers/sigstore"
 // defaultDockerDir is the default sigstore directory for root
 var defaultDockerDir = "/var/lib/containers/sigstore"
 
+// StorageLookasideScheme is the scheme of sigstore locations which store signatures through the storage driver
+// of the transport's client, next to the images, e.g. "udistribution-storage:///sigstore".
+// Such a location is used instead of the X-Registry-Supports-Signatures API extension.
+const StorageLookasideScheme = "udistribution-storage"
+
 // registryConfiguration is one of the files in registriesDirPath configuring lookaside locations, or the result of merging them all.
 // NOTE: Keep this in sync with docs/registries.d.md!
 type registryConfiguration struct {
@@ -233,3 +240,81 @@ func signatureStorageURL(base signatureStorageBase, manifestDigest digest.Digest
 	url.Path = fmt.Sprintf("%s@%s=%s/signature-%d", url.Path, manifestDigest.Algorithm(), manifestDigest.Hex(), index+1)
 	return &url
 }
+
+// usesStorageLookaside returns true if c stores signatures through the storage driver of its transport.
+func (c *udistributionClient) usesStorageLookaside() bool {
+	return c.signatureBase != nil && c.signatureBase.Scheme == StorageLookasideScheme
+}
+
+// storageLookasidePath returns the storage driver path of the signature at url, which uses StorageLookasideScheme.
+// Storage driver paths can not contain the "@" and "=" of signature storage URLs, so
+// <path>/<repo>@<algorithm>=<hex>/signature-<index> is stored at <path>/<repo>/_signatures/<algorithm>/<hex>/signature-<index>.
+func storageLookasidePath(url *url.URL) (string, error) {
+	i := strings.LastIndex(url.Path, "@")
+	if url.Host != "" || i == -1 {
+		return "", errors.Errorf("Invalid %s signature storage URL %s", StorageLookasideScheme, url.Redacted())
+	}
+	p := path.Join(url.Path[:i], "_signatures", strings.Replace(url.Path[i+1:], "=", "/", 1))
+	if !storagedriver.PathRegexp.MatchString(p) {
+		return "", errors.Errorf("Invalid %s signature storage URL %s", StorageLookasideScheme, url.Redacted())
+	}
+	return p, nil
+}
+
+// storageLookasideDriver returns the storage driver and path of the signature at url, which uses StorageLookasideScheme.
+func (c *udistributionClient) storageLookasideDriver(url *url.URL) (storagedriver.StorageDriver, string, error) {
+	p, err := storageLookasidePath(url)
+	if err != nil {
+		return nil, "", err
+	}
+	driver, err := c.ut.Client.StorageDriver()
+	if err != nil {
+		return nil, "", err
+	}
+	return driver, p, nil
+}
+
+// getStorageSignature reads a signature from url, which uses StorageLookasideScheme.
+// If it successfully determines that the signature does not exist, returns with missing set to true and error set to nil.
+func (c *udistributionClient) getStorageSignature(ctx context.Context, url *url.URL) (signature []byte, missing bool, err error) {
+	driver, p, err := c.storageLookasideDriver(url)
+	if err != nil {
+		return nil, false, err
+	}
+	logrus.Debugf("Reading %s from %s storage", p, driver.Name())
+	sig, err := driver.GetContent(ctx, p)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, true, nil
+		}
+		return nil, false, err
+	}
+	return sig, false, nil
+}
+
+// putStorageSignature writes a signature to url, which uses StorageLookasideScheme.
+func (c *udistributionClient) putStorageSignature(ctx context.Context, url *url.URL, signature []byte) error {
+	driver, p, err := c.storageLookasideDriver(url)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("Writing %s to %s storage", p, driver.Name())
+	return driver.PutContent(ctx, p, signature)
+}
+
+// deleteStorageSignature deletes a signature from url, which uses StorageLookasideScheme, if it exists.
+// If it successfully determines that the signature does not exist, returns (true, nil)
+func (c *udistributionClient) deleteStorageSignature(ctx context.Context, url *url.URL) (missing bool, err error) {
+	driver, p, err := c.storageLookasideDriver(url)
+	if err != nil {
+		return false, err
+	}
+	logrus.Debugf("Deleting %s from %s storage", p, driver.Name())
+	if err := driver.Delete(ctx, p); err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return true, nil
+		}
+		return false, err
+	}
+	return false, nil
+}
@@ -296,6 +296,31 @@ func TestSignatureStorageBaseSignatureStorageURL(t *testing.T) {
 	}
 }
 
+func TestStorageLookasidePath(t *testing.T) {
+	const mdMapped = "sha256=0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	for _, c := range []struct {
+		url      string
+		expected string
+	}{
+		{StorageLookasideScheme + ":///sigstore/busybox@" + mdMapped + "/signature-1", "/sigstore/busybox/_signatures/sha256/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef/signature-1"},
+		{StorageLookasideScheme + ":///ns/repo@" + mdMapped + "/signature-12", "/ns/repo/_signatures/sha256/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef/signature-12"},
+		{StorageLookasideScheme + "://host/sigstore/busybox@" + mdMapped + "/signature-1", ""}, // Hosts are not supported
+		{StorageLookasideScheme + ":///sigstore/busybox/signature-1", ""},                      // No manifest digest
+		{StorageLookasideScheme + ":///sig store/busybox@" + mdMapped + "/signature-1", ""},    // Invalid storage driver path
+	} {
+		url, err := url.Parse(c.url)
+		require.NoError(t, err)
+		res, err := storageLookasidePath(url)
+		if c.expected == "" {
+			assert.Error(t, err, c.url)
+		} else {
+			require.NoError(t, err, c.url)
+			assert.Equal(t, c.expected, res, c.url)
+		}
+	}
+}
+
 func TestBuiltinDefaultSignatureStorageDir(t *testing.T) {
 	base := builtinDefaultSignatureStorageDir(0)
 	assert.NotNil(t, base)
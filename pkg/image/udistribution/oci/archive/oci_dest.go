@@ -0,0 +1,100 @@
+package archive
+
+import (
+	"context"
+	"os"
+
+	"github.com/containers/image/v5/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type ociArchiveImageDestination struct {
+	types.ImageDestination // The destination of the unpacked OCI layout; implements most of types.ImageDestination
+	ref                    ociArchiveReference
+	tempDir                string // The unpacked archive, tarred to ref.resolvedFile on Commit and deleted on Close; "" if owned by a Writer
+}
+
+// newImageDestination returns an ImageDestination writing to an OCI layout in a temporary directory, or in the directory
+// of the Writer of ref, if any.
+func newImageDestination(ctx context.Context, sys *types.SystemContext, ref ociArchiveReference) (types.ImageDestination, error) {
+	if ref.sourceIndex != -1 {
+		return nil, errors.Errorf("Destination reference must not contain a manifest index @%d", ref.sourceIndex)
+	}
+	var dir, tempDir string
+	if ref.archiveWriter != nil {
+		dir = ref.archiveWriter.tempDir
+	} else {
+		var err error
+		if tempDir, err = createTempDir(sys); err != nil {
+			return nil, errors.Wrap(err, "creating oci reference")
+		}
+		dir = tempDir
+	}
+	succeeded := false
+	defer func() {
+		if !succeeded && tempDir != "" {
+			if err := os.RemoveAll(tempDir); err != nil {
+				logrus.Debugf("Error deleting temporary directory: %v", err)
+			}
+		}
+	}()
+
+	layoutRef, err := ref.layoutReference(dir)
+	if err != nil {
+		return nil, err
+	}
+	unpackedDest, err := layoutRef.NewImageDestination(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	succeeded = true
+	return &ociArchiveImageDestination{
+		ImageDestination: unpackedDest,
+		ref:              ref,
+		tempDir:          tempDir,
+	}, nil
+}
+
+// Reference returns the reference used to set up this destination.
+func (d *ociArchiveImageDestination) Reference() types.ImageReference {
+	return d.ref
+}
+
+// Close removes resources associated with an initialized ImageDestination, if any
+// Close deletes the temp directory of the oci-archive image, unless owned by a Writer
+func (d *ociArchiveImageDestination) Close() error {
+	defer func() {
+		if d.tempDir != "" {
+			if err := os.RemoveAll(d.tempDir); err != nil {
+				logrus.Debugf("Error deleting temporary directory: %v", err)
+			}
+		}
+	}()
+	return d.ImageDestination.Close()
+}
+
+// HasThreadSafePutBlob indicates whether PutBlob can be executed concurrently.
+func (d *ociArchiveImageDestination) HasThreadSafePutBlob() bool {
+	return false
+}
+
+// Commit marks the process of storing the image as successful and asks for the image to be persisted
+// unparsedToplevel contains data about the top-level manifest of the source (which may be a single-arch image or a manifest list
+// if PutManifest was only called for the single-arch image with instanceDigest == nil), primarily to allow lookups by the
+// original manifest list digest, if desired.
+// after the directory is made, it is tarred up into a file and the directory is deleted; images added through a Writer
+// are only tarred up when the Writer is closed.
+func (d *ociArchiveImageDestination) Commit(ctx context.Context, unparsedToplevel types.UnparsedImage) error {
+	if err := d.ImageDestination.Commit(ctx, unparsedToplevel); err != nil {
+		return errors.Wrapf(err, "storing image %q", d.ref.image)
+	}
+	if d.tempDir == "" {
+		return nil
+	}
+	// path of directory to tar up
+	src := d.tempDir
+	// path to save tarred up file
+	dst := d.ref.resolvedFile
+	return tarDirectory(src, dst)
+}
@@ -0,0 +1,89 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/containers/image/v5/types"
+	ocilayout "github.com/migtools/udistribution/pkg/image/udistribution/oci/layout"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ImageNotFoundError is used when the OCI structure, in principle, exists and seems valid enough,
+// but nothing matches the “image” part of the provided reference.
+type ImageNotFoundError struct {
+	ref ociArchiveReference
+	// We may make members public, or add methods, in the future.
+}
+
+func (e ImageNotFoundError) Error() string {
+	return fmt.Sprintf("no descriptor found for reference %q", e.ref.image)
+}
+
+type ociArchiveImageSource struct {
+	types.ImageSource // The source of the unpacked OCI layout; implements most of types.ImageSource
+	ref               ociArchiveReference
+	tempDir           string // The unpacked archive, deleted on Close; "" if owned by a Reader
+}
+
+// newImageSource returns an ImageSource for reading from an existing directory.
+// newImageSource untars the file and saves it in a temp directory, unless ref was created by a Reader.
+func newImageSource(ctx context.Context, sys *types.SystemContext, ref ociArchiveReference) (types.ImageSource, error) {
+	var dir, tempDir string
+	if ref.archiveReader != nil {
+		dir = ref.archiveReader.tempDir
+	} else {
+		var err error
+		if tempDir, err = createUntarTempDir(sys, ref.resolvedFile); err != nil {
+			return nil, errors.Wrap(err, "creating temp directory")
+		}
+		dir = tempDir
+	}
+	succeeded := false
+	defer func() {
+		if !succeeded && tempDir != "" {
+			if err := os.RemoveAll(tempDir); err != nil {
+				logrus.Debugf("Error deleting temporary directory: %v", err)
+			}
+		}
+	}()
+
+	layoutRef, err := ref.layoutReference(dir)
+	if err != nil {
+		return nil, err
+	}
+	unpackedSrc, err := layoutRef.NewImageSource(ctx, sys)
+	if err != nil {
+		var notFound ocilayout.ImageNotFoundError
+		if errors.As(err, &notFound) {
+			err = ImageNotFoundError{ref: ref}
+		}
+		return nil, err
+	}
+	succeeded = true
+	return &ociArchiveImageSource{
+		ImageSource: unpackedSrc,
+		ref:         ref,
+		tempDir:     tempDir,
+	}, nil
+}
+
+// Reference returns the reference used to set up this source.
+func (s *ociArchiveImageSource) Reference() types.ImageReference {
+	return s.ref
+}
+
+// Close removes resources associated with an initialized ImageSource, if any.
+// Close deletes the temporary directory the archive was extracted to, unless owned by a Reader.
+func (s *ociArchiveImageSource) Close() error {
+	defer func() {
+		if s.tempDir != "" {
+			if err := os.RemoveAll(s.tempDir); err != nil {
+				logrus.Debugf("Error deleting temporary directory: %v", err)
+			}
+		}
+	}()
+	return s.ImageSource.Close()
+}
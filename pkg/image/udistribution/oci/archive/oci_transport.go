@@ -0,0 +1,251 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/containers/image/v5/directory/explicitfilepath"
+	"github.com/containers/image/v5/docker/reference"
+	ctrImage "github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/types"
+	"github.com/containers/storage/pkg/archive"
+	"github.com/migtools/udistribution/pkg/image/udistribution/oci/internal"
+	ocilayout "github.com/migtools/udistribution/pkg/image/udistribution/oci/layout"
+	"github.com/migtools/udistribution/pkg/internal/image/tmpdir"
+	"github.com/pkg/errors"
+)
+
+// Transport is an ImageTransport for OCI archive
+// it creates an oci-archive tar file by calling into the OCI transport
+// tarring the directory created by oci and deleting the directory
+// It is not registered in transports, which would conflict with the containers/image transport of the same name.
+var Transport = ociArchiveTransport{}
+
+type ociArchiveTransport struct{}
+
+// ociArchiveReference is an ImageReference for OCI Archive paths
+type ociArchiveReference struct {
+	file         string
+	resolvedFile string
+	image        string
+	// If not -1, a zero-based index of the manifest in index.json. Valid only for sources.
+	// Must not be set if image is set.
+	sourceIndex int
+	// If not nil, must have been created from file.
+	archiveReader *Reader
+	// If not nil, must have been created for file.
+	archiveWriter *Writer
+}
+
+func (t ociArchiveTransport) Name() string {
+	return "oci-archive"
+}
+
+// ParseReference converts a string, which should not start with the ImageTransport.Name prefix
+// into an ImageReference.
+func (t ociArchiveTransport) ParseReference(reference string) (types.ImageReference, error) {
+	return ParseReference(reference)
+}
+
+// ValidatePolicyConfigurationScope checks that scope is a valid name for a signature.PolicyTransportScopes keys
+func (t ociArchiveTransport) ValidatePolicyConfigurationScope(scope string) error {
+	return internal.ValidateScope(scope)
+}
+
+// ParseReference converts a string, which should not start with the ImageTransport.Name prefix, into an OCI ImageReference.
+// The image part of the reference is either an image name, or @index to select a manifest of index.json by its position.
+func ParseReference(reference string) (types.ImageReference, error) {
+	file, image := internal.SplitPathAndImage(reference)
+	sourceIndex, err := internal.ParseSourceIndex(image)
+	if err != nil {
+		return nil, err
+	}
+	if sourceIndex != -1 {
+		return newReference(file, "", sourceIndex, nil, nil)
+	}
+	return newReference(file, image, -1, nil, nil)
+}
+
+// NewReference returns an OCI reference for a file and a image.
+func NewReference(file, image string) (types.ImageReference, error) {
+	return newReference(file, image, -1, nil, nil)
+}
+
+// NewIndexReference returns an OCI reference for a file and a zero-based index of a manifest in its index.json.
+func NewIndexReference(file string, sourceIndex int) (types.ImageReference, error) {
+	return newReference(file, "", sourceIndex, nil, nil)
+}
+
+// newReference returns an OCI reference for a file, an image or a source index,
+// and optionally a Reader or a Writer of file.
+func newReference(file, image string, sourceIndex int, archiveReader *Reader, archiveWriter *Writer) (types.ImageReference, error) {
+	resolved, err := explicitfilepath.ResolvePathToFullyExplicit(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := internal.ValidateOCIPath(file); err != nil {
+		return nil, err
+	}
+
+	if err := internal.ValidateImageName(image); err != nil {
+		return nil, err
+	}
+
+	if sourceIndex != -1 {
+		if image != "" {
+			return nil, errors.Errorf("Invalid oci-archive: reference: cannot use both an image %s and a source index @%d", image, sourceIndex)
+		}
+		if sourceIndex < 0 {
+			return nil, errors.Errorf("Invalid oci-archive: reference: index @%d must not be negative", sourceIndex)
+		}
+	}
+
+	return ociArchiveReference{
+		file:          file,
+		resolvedFile:  resolved,
+		image:         image,
+		sourceIndex:   sourceIndex,
+		archiveReader: archiveReader,
+		archiveWriter: archiveWriter,
+	}, nil
+}
+
+func (ref ociArchiveReference) Transport() types.ImageTransport {
+	return Transport
+}
+
+// StringWithinTransport returns a string representation of the reference, which MUST be such that
+// reference.Transport().ParseReference(reference.StringWithinTransport()) returns an equivalent reference.
+func (ref ociArchiveReference) StringWithinTransport() string {
+	if ref.sourceIndex != -1 {
+		return fmt.Sprintf("%s:@%d", ref.file, ref.sourceIndex)
+	}
+	return fmt.Sprintf("%s:%s", ref.file, ref.image)
+}
+
+// DockerReference returns a Docker reference associated with this reference
+func (ref ociArchiveReference) DockerReference() reference.Named {
+	return nil
+}
+
+// PolicyConfigurationIdentity returns a string representation of the reference, suitable for policy lookup.
+func (ref ociArchiveReference) PolicyConfigurationIdentity() string {
+	// NOTE: ref.image is not a part of the image identity, because "$dir:$someimage" and "$dir:" may mean the
+	// same image and the two can’t be statically disambiguated.  Using at least the repository directory is
+	// less granular but hopefully still useful.
+	return ref.resolvedFile
+}
+
+// PolicyConfigurationNamespaces returns a list of other policy configuration namespaces to search
+// for if explicit configuration for PolicyConfigurationIdentity() is not set
+func (ref ociArchiveReference) PolicyConfigurationNamespaces() []string {
+	res := []string{}
+	path := ref.resolvedFile
+	for {
+		lastSlash := strings.LastIndex(path, "/")
+		// Note that we do not include "/"; it is redundant with the default "" global default,
+		// and rejected by ociTransport.ValidatePolicyConfigurationScope above.
+		if lastSlash == -1 || path == "/" {
+			break
+		}
+		res = append(res, path)
+		path = path[:lastSlash]
+	}
+	return res
+}
+
+// NewImage returns a types.ImageCloser for this reference, possibly specialized for this ImageTransport.
+// The caller must call .Close() on the returned ImageCloser.
+// NOTE: If any kind of signature verification should happen, build an UnparsedImage from the value returned by NewImageSource,
+// verify that UnparsedImage, and convert it into a real Image via image.FromUnparsedImage.
+// WARNING: This may not do the right thing for a manifest list, see image.FromSource for details.
+func (ref ociArchiveReference) NewImage(ctx context.Context, sys *types.SystemContext) (types.ImageCloser, error) {
+	src, err := newImageSource(ctx, sys, ref)
+	if err != nil {
+		return nil, err
+	}
+	return ctrImage.FromSource(ctx, sys, src)
+}
+
+// NewImageSource returns a types.ImageSource for this reference.
+// The caller must call .Close() on the returned ImageSource.
+func (ref ociArchiveReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	return newImageSource(ctx, sys, ref)
+}
+
+// NewImageDestination returns a types.ImageDestination for this reference.
+// The caller must call .Close() on the returned ImageDestination.
+func (ref ociArchiveReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	return newImageDestination(ctx, sys, ref)
+}
+
+// DeleteImage deletes the named image from the registry, if supported.
+func (ref ociArchiveReference) DeleteImage(ctx context.Context, sys *types.SystemContext) error {
+	return errors.New("Deleting images not implemented for oci: images")
+}
+
+// layoutReference returns the reference of the image of ref in the OCI layout at dir.
+func (ref ociArchiveReference) layoutReference(dir string) (types.ImageReference, error) {
+	if ref.sourceIndex != -1 {
+		return ocilayout.NewIndexReference(dir, ref.sourceIndex)
+	}
+	return ocilayout.NewReference(dir, ref.image)
+}
+
+// createTempDir creates a temporary directory for the OCI layout of an archive.
+// If SystemContext.BigFilesTemporaryDir not "", overrides the temporary directory to use for storing big files
+func createTempDir(sys *types.SystemContext) (string, error) {
+	dir, err := os.MkdirTemp(tmpdir.TemporaryDirectoryForBigFiles(sys), "oci")
+	if err != nil {
+		return "", errors.Wrap(err, "creating temp directory")
+	}
+	return dir, nil
+}
+
+// createUntarTempDir creates a temporary directory and extracts the archive at file to it.
+func createUntarTempDir(sys *types.SystemContext, file string) (string, error) {
+	dir, err := createTempDir(sys)
+	if err != nil {
+		return "", err
+	}
+	// TODO: This can take quite some time, and should ideally be cancellable using a context.Context.
+	arch, err := os.Open(file)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	defer arch.Close()
+	if err := archive.NewDefaultArchiver().Untar(arch, dir, &archive.TarOptions{NoLchown: true}); err != nil {
+		if err := os.RemoveAll(dir); err != nil {
+			return "", errors.Wrapf(err, "deleting temp directory %q", dir)
+		}
+		return "", errors.Wrapf(err, "untarring file %q", file)
+	}
+	return dir, nil
+}
+
+// tarDirectory converts the directory at src and saves it to dst
+func tarDirectory(src, dst string) error {
+	// input is a stream of bytes from the archive of the directory at path
+	input, err := archive.Tar(src, archive.Uncompressed)
+	if err != nil {
+		return errors.Wrapf(err, "retrieving stream of bytes from %q", src)
+	}
+	defer input.Close()
+
+	// creates the tar file
+	outFile, err := os.Create(dst)
+	if err != nil {
+		return errors.Wrapf(err, "creating tar file %q", dst)
+	}
+	defer outFile.Close()
+
+	// copies the contents of the directory to the tar file
+	// TODO: This can take quite some time, and should ideally be cancellable using a context.Context.
+	_, err = io.Copy(outFile, input)
+	return err
+}
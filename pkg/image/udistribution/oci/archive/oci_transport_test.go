@@ -0,0 +1,133 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	imgspec "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransportName(t *testing.T) {
+	assert.Equal(t, "oci-archive", Transport.Name())
+}
+
+func TestParseReference(t *testing.T) {
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "archive.tar")
+
+	for _, c := range []struct {
+		input, image string
+		sourceIndex  int
+		valid        bool
+	}{
+		{file, "", -1, true},
+		{file + ":notlatest", "notlatest", -1, true},
+		{file + ":@2", "", 2, true},
+		{file + ":@-2", "", -1, false},
+		{file + ":invalid'image!value@", "", -1, false},
+	} {
+		for _, fn := range []func(string) (types.ImageReference, error){ParseReference, Transport.ParseReference} {
+			ref, err := fn(c.input)
+			if !c.valid {
+				assert.Error(t, err, c.input)
+				continue
+			}
+			require.NoError(t, err, c.input)
+			archiveRef, ok := ref.(ociArchiveReference)
+			require.True(t, ok, c.input)
+			assert.Equal(t, file, archiveRef.file, c.input)
+			assert.Equal(t, c.image, archiveRef.image, c.input)
+			assert.Equal(t, c.sourceIndex, archiveRef.sourceIndex, c.input)
+		}
+	}
+}
+
+// putTestImage writes an image with a single layer of content to ref, and returns its manifest.
+func putTestImage(t *testing.T, ref types.ImageReference, content string) []byte {
+	ctx := context.Background()
+	dest, err := ref.NewImageDestination(ctx, nil)
+	require.NoError(t, err)
+	defer dest.Close()
+	putBlob := func(mediaType string, data []byte) imgspecv1.Descriptor {
+		info, err := dest.PutBlob(ctx, bytes.NewReader(data), types.BlobInfo{Size: -1}, nil, false)
+		require.NoError(t, err)
+		return imgspecv1.Descriptor{MediaType: mediaType, Digest: info.Digest, Size: info.Size}
+	}
+	manifestBlob, err := json.Marshal(imgspecv1.Manifest{
+		Versioned:   imgspec.Versioned{SchemaVersion: 2},
+		MediaType:   imgspecv1.MediaTypeImageManifest,
+		Config:      putBlob(imgspecv1.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`)),
+		Layers:      []imgspecv1.Descriptor{putBlob(imgspecv1.MediaTypeImageLayer, []byte(content))},
+		Annotations: map[string]string{"org.example.content": content},
+	})
+	require.NoError(t, err)
+	require.NoError(t, dest.PutManifest(ctx, manifestBlob, nil))
+	require.NoError(t, dest.Commit(ctx, nil))
+	return manifestBlob
+}
+
+// assertArchivedImage asserts that ref is the image of manifestBlob.
+func assertArchivedImage(t *testing.T, ref types.ImageReference, manifestBlob []byte) {
+	ctx := context.Background()
+	src, err := ref.NewImageSource(ctx, nil)
+	require.NoError(t, err)
+	defer src.Close()
+	m, mimeType, err := src.GetManifest(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, manifestBlob, m)
+	assert.Equal(t, imgspecv1.MediaTypeImageManifest, mimeType)
+}
+
+func TestWriterReader(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "archive.tar")
+
+	writer, err := NewWriter(nil, file)
+	require.NoError(t, err)
+	ref, err := writer.NewReference("v1")
+	require.NoError(t, err)
+	tagged := putTestImage(t, ref, "tagged")
+	ref, err = writer.NewReference("")
+	require.NoError(t, err)
+	untagged := putTestImage(t, ref, "untagged")
+	require.NoError(t, writer.Close())
+
+	_, err = NewWriter(nil, file)
+	assert.Error(t, err)
+
+	reader, err := NewReader(nil, file)
+	require.NoError(t, err)
+	listed, err := reader.List()
+	require.NoError(t, err)
+	require.Len(t, listed, 2)
+	assert.Equal(t, file+":v1", listed[0].Reference.StringWithinTransport())
+	assert.Equal(t, digest.FromBytes(tagged), listed[0].ManifestDescriptor.Digest)
+	assert.Equal(t, file+":@1", listed[1].Reference.StringWithinTransport())
+	assert.Equal(t, digest.FromBytes(untagged), listed[1].ManifestDescriptor.Digest)
+	assertArchivedImage(t, listed[0].Reference, tagged)
+	assertArchivedImage(t, listed[1].Reference, untagged)
+	require.NoError(t, reader.Close())
+
+	// References not bound to a Reader extract the archive themselves.
+	ref, err = ParseReference(file + ":@1")
+	require.NoError(t, err)
+	assertArchivedImage(t, ref, untagged)
+	ref, err = ParseReference(file + ":missing")
+	require.NoError(t, err)
+	_, err = ref.NewImageSource(context.Background(), nil)
+	assert.ErrorAs(t, err, &ImageNotFoundError{})
+
+	// References not bound to a Writer write an archive with a single image.
+	single := filepath.Join(t.TempDir(), "single.tar")
+	ref, err = NewReference(single, "")
+	require.NoError(t, err)
+	manifestBlob := putTestImage(t, ref, "single")
+	assertArchivedImage(t, ref, manifestBlob)
+}
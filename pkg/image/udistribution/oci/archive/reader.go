@@ -0,0 +1,69 @@
+package archive
+
+import (
+	"os"
+
+	"github.com/containers/image/v5/types"
+	ocilayout "github.com/migtools/udistribution/pkg/image/udistribution/oci/layout"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Reader manages a single OCI archive, allows listing its contents and accessing
+// individual images with less overhead than creating image references individually
+// (because the archive is extracted only once).
+type Reader struct {
+	path    string // The original, user-specified path
+	tempDir string // The extracted OCI layout
+}
+
+// NewReader returns a Reader for path.
+// The caller should call .Close() on the returned object.
+func NewReader(sys *types.SystemContext, path string) (*Reader, error) {
+	if _, err := newReference(path, "", -1, nil, nil); err != nil {
+		return nil, err
+	}
+	tempDir, err := createUntarTempDir(sys, path)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		path:    path,
+		tempDir: tempDir,
+	}, nil
+}
+
+// Close deletes temporary files associated with the Reader, if any.
+func (r *Reader) Close() error {
+	return os.RemoveAll(r.tempDir)
+}
+
+// ListResult is an image of an OCI archive, as returned by Reader.List.
+type ListResult struct {
+	// Reference selects the image: by its name if it has one, by its index in index.json otherwise.
+	Reference          types.ImageReference
+	ManifestDescriptor imgspecv1.Descriptor
+}
+
+// List returns the images of the archive, in the order of its index.json.
+// The references are valid only until the Reader is closed.
+func (r *Reader) List() ([]ListResult, error) {
+	listed, err := ocilayout.List(r.tempDir)
+	if err != nil {
+		return nil, err
+	}
+	res := []ListResult{}
+	for i, l := range listed {
+		var ref types.ImageReference
+		if refName := l.ManifestDescriptor.Annotations[imgspecv1.AnnotationRefName]; refName != "" {
+			ref, err = newReference(r.path, refName, -1, r, nil)
+		} else {
+			ref, err = newReference(r.path, "", i, r, nil)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "creating a reference for manifest @%d", i)
+		}
+		res = append(res, ListResult{Reference: ref, ManifestDescriptor: l.ManifestDescriptor})
+	}
+	return res, nil
+}
@@ -0,0 +1,53 @@
+package archive
+
+import (
+	"os"
+
+	"github.com/containers/image/v5/types"
+	"github.com/pkg/errors"
+)
+
+// Writer manages a single in-progress OCI archive and allows adding images to it.
+// Images are written to an OCI layout in a temporary directory, which is tarred up when the Writer is closed.
+type Writer struct {
+	path    string // The original, user-specified path
+	tempDir string // The OCI layout being written
+}
+
+// NewWriter returns a Writer for path.
+// The caller should call .Close() on the returned object.
+func NewWriter(sys *types.SystemContext, path string) (*Writer, error) {
+	if _, err := newReference(path, "", -1, nil, nil); err != nil {
+		return nil, err
+	}
+	// Fail early rather than after writing all images, as docker-archive does.
+	fi, err := os.Stat(path)
+	if err == nil && fi.Mode().IsRegular() && fi.Size() != 0 {
+		return nil, errors.New("oci-archive doesn't support modifying existing images")
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "statting file %q", path)
+	}
+	tempDir, err := createTempDir(sys)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		path:    path,
+		tempDir: tempDir,
+	}, nil
+}
+
+// Close writes all images added so far to the archive, and
+// releases state associated with the Writer, if any.
+// No more images can be added after this is called.
+func (w *Writer) Close() error {
+	defer os.RemoveAll(w.tempDir)
+	return tarDirectory(w.tempDir, w.path)
+}
+
+// NewReference returns an ImageReference that allows adding an image to Writer,
+// with an optional image name. Images must be added one at a time.
+func (w *Writer) NewReference(image string) (types.ImageReference, error) {
+	return newReference(w.path, image, -1, nil, w)
+}
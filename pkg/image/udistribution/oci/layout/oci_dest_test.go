@@ -0,0 +1,199 @@
+package layout
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	imgspec "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const sbomArtifactType = "application/vnd.example.sbom.v1+json"
+
+// putBlob writes data to dest, and returns its descriptor.
+func putBlob(t *testing.T, dest types.ImageDestination, mediaType string, data []byte) imgspecv1.Descriptor {
+	info, err := dest.PutBlob(context.Background(), bytes.NewReader(data), types.BlobInfo{Size: -1}, nil, false)
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromBytes(data), info.Digest)
+	return imgspecv1.Descriptor{MediaType: mediaType, Digest: info.Digest, Size: info.Size}
+}
+
+// testManifest returns an OCI manifest with content as its only layer, written to dest.
+func testManifest(t *testing.T, dest types.ImageDestination, content string, subject *imgspecv1.Descriptor) []byte {
+	m := imgspecv1.Manifest{
+		Versioned: imgspec.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Config:    putBlob(t, dest, imgspecv1.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`)),
+		Layers:    []imgspecv1.Descriptor{putBlob(t, dest, imgspecv1.MediaTypeImageLayer, []byte(content))},
+		Subject:   subject,
+	}
+	if subject != nil {
+		m.ArtifactType = sbomArtifactType
+		m.Config = putBlob(t, dest, imgspecv1.MediaTypeEmptyJSON, []byte("{}"))
+		m.Annotations = map[string]string{"org.example.sbom": content}
+	}
+	manifestBlob, err := json.Marshal(m)
+	require.NoError(t, err)
+	return manifestBlob
+}
+
+// putImage writes the image of manifestBlob, and its instances, to ref.
+func putImage(t *testing.T, ref types.ImageReference, manifestBlob []byte, instances ...[]byte) {
+	ctx := context.Background()
+	dest, err := ref.NewImageDestination(ctx, nil)
+	require.NoError(t, err)
+	defer dest.Close()
+	for _, instance := range instances {
+		dgst := digest.FromBytes(instance)
+		require.NoError(t, dest.PutManifest(ctx, instance, &dgst))
+	}
+	require.NoError(t, dest.PutManifest(ctx, manifestBlob, nil))
+	require.NoError(t, dest.Commit(ctx, nil))
+}
+
+// newTestDestination returns a destination for writing blobs to dir.
+func newTestDestination(t *testing.T, dir string) types.ImageDestination {
+	ref, err := NewReference(dir, "")
+	require.NoError(t, err)
+	dest, err := ref.NewImageDestination(context.Background(), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { dest.Close() })
+	return dest
+}
+
+func TestImageIndexesAndReferrers(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	blobs := newTestDestination(t, dir)
+
+	image := testManifest(t, blobs, "image", nil)
+	imageDigest := digest.FromBytes(image)
+	ref, err := NewReference(dir, "v1")
+	require.NoError(t, err)
+	putImage(t, ref, image)
+
+	// A referrer of the image, stored without a name.
+	sbom := testManifest(t, blobs, "sbom", &imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageManifest, Digest: imageDigest, Size: int64(len(image))})
+	untagged, err := NewReference(dir, "")
+	require.NoError(t, err)
+	putImage(t, untagged, sbom)
+
+	// A multi-image index, whose instances are not listed in index.json.
+	amd64 := testManifest(t, blobs, "amd64", nil)
+	arm64 := testManifest(t, blobs, "arm64", nil)
+	index := imgspecv1.Index{
+		Versioned: imgspec.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageIndex,
+		Manifests: []imgspecv1.Descriptor{
+			{MediaType: imgspecv1.MediaTypeImageManifest, Digest: digest.FromBytes(amd64), Size: int64(len(amd64)), Platform: &imgspecv1.Platform{Architecture: "amd64", OS: "linux"}},
+			{MediaType: imgspecv1.MediaTypeImageManifest, Digest: digest.FromBytes(arm64), Size: int64(len(arm64)), Platform: &imgspecv1.Platform{Architecture: "arm64", OS: "linux"}},
+		},
+		Annotations: map[string]string{"org.example.index": "kept"},
+	}
+	indexBlob, err := json.Marshal(index)
+	require.NoError(t, err)
+	multi, err := NewReference(dir, "multi")
+	require.NoError(t, err)
+	putImage(t, multi, indexBlob, amd64, arm64)
+
+	layoutBlob, err := os.ReadFile(filepath.Join(dir, imgspecv1.ImageLayoutFile))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"imageLayoutVersion": "1.0.0"}`, string(layoutBlob))
+
+	listed, err := List(dir)
+	require.NoError(t, err)
+	require.Len(t, listed, 3)
+	assert.Equal(t, dir+":v1", listed[0].Reference.StringWithinTransport())
+	assert.Equal(t, dir+":@1", listed[1].Reference.StringWithinTransport())
+	assert.Equal(t, sbomArtifactType, listed[1].ManifestDescriptor.ArtifactType)
+	assert.Equal(t, dir+":multi", listed[2].Reference.StringWithinTransport())
+	assert.Equal(t, imgspecv1.MediaTypeImageIndex, listed[2].ManifestDescriptor.MediaType)
+
+	// The only image of a layout can not be selected without a name or an index, if there are several.
+	_, err = untagged.NewImageSource(ctx, nil)
+	assert.ErrorIs(t, err, ErrMoreThanOneImage)
+
+	for _, c := range []struct {
+		ref      types.ImageReference
+		manifest []byte
+		mimeType string
+	}{
+		{listed[0].Reference, image, imgspecv1.MediaTypeImageManifest},
+		{listed[1].Reference, sbom, imgspecv1.MediaTypeImageManifest},
+		{multi, indexBlob, imgspecv1.MediaTypeImageIndex},
+	} {
+		src, err := c.ref.NewImageSource(ctx, nil)
+		require.NoError(t, err)
+		m, mimeType, err := src.GetManifest(ctx, nil)
+		require.NoError(t, err)
+		assert.Equal(t, c.manifest, m)
+		assert.Equal(t, c.mimeType, mimeType)
+		require.NoError(t, src.Close())
+	}
+
+	src, err := multi.NewImageSource(ctx, nil)
+	require.NoError(t, err)
+	defer src.Close()
+	list, err := manifest.ListFromBlob(indexBlob, imgspecv1.MediaTypeImageIndex)
+	require.NoError(t, err)
+	for i, instance := range list.Instances() {
+		m, mimeType, err := src.GetManifest(ctx, &instance)
+		require.NoError(t, err)
+		assert.Equal(t, [][]byte{amd64, arm64}[i], m)
+		assert.Equal(t, imgspecv1.MediaTypeImageManifest, mimeType)
+		parsed, err := manifest.OCI1FromManifest(m)
+		require.NoError(t, err)
+		reader, _, err := src.GetBlob(ctx, parsed.LayerInfos()[0].BlobInfo, nil)
+		require.NoError(t, err)
+		content, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		reader.Close()
+		assert.Equal(t, []string{"amd64", "arm64"}[i], string(content))
+	}
+
+	referrers, err := GetReferrers(ctx, nil, ref, "")
+	require.NoError(t, err)
+	assert.Equal(t, []imgspecv1.Descriptor{{
+		MediaType:    imgspecv1.MediaTypeImageManifest,
+		Digest:       digest.FromBytes(sbom),
+		Size:         int64(len(sbom)),
+		ArtifactType: sbomArtifactType,
+		Annotations:  map[string]string{"org.example.sbom": "sbom"},
+	}}, referrers)
+	referrers, err = GetReferrers(ctx, nil, ref, "application/vnd.example.other")
+	require.NoError(t, err)
+	assert.Empty(t, referrers)
+	referrers, err = GetReferrers(ctx, nil, multi, "")
+	require.NoError(t, err)
+	assert.Empty(t, referrers)
+
+	// Writing another image with an existing name moves the name.
+	image2 := testManifest(t, blobs, "image2", nil)
+	putImage(t, ref, image2)
+	listed, err = List(dir)
+	require.NoError(t, err)
+	require.Len(t, listed, 4)
+	assert.Equal(t, dir+":@0", listed[0].Reference.StringWithinTransport())
+	assert.Equal(t, dir+":v1", listed[3].Reference.StringWithinTransport())
+	assert.Equal(t, digest.FromBytes(image2), listed[3].ManifestDescriptor.Digest)
+
+	// Index references are only valid for sources.
+	indexRef, err := NewIndexReference(dir, 0)
+	require.NoError(t, err)
+	_, err = indexRef.NewImageDestination(ctx, nil)
+	assert.Error(t, err)
+	indexRef, err = NewIndexReference(dir, 4)
+	require.NoError(t, err)
+	_, err = indexRef.NewImageSource(ctx, nil)
+	assert.Error(t, err)
+}
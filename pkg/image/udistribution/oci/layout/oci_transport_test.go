@@ -0,0 +1,107 @@
+package layout
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransportName(t *testing.T) {
+	assert.Equal(t, "oci", Transport.Name())
+}
+
+func TestTransportParseReference(t *testing.T) {
+	testParseReference(t, Transport.ParseReference)
+}
+
+func TestTransportValidatePolicyConfigurationScope(t *testing.T) {
+	for _, scope := range []string{
+		"/etc",
+		"/this/does/not/exist",
+	} {
+		err := Transport.ValidatePolicyConfigurationScope(scope)
+		assert.NoError(t, err, scope)
+	}
+
+	for _, scope := range []string{
+		"relative/path",
+		"/",
+		"/double//slashes",
+		"/has/./dot",
+		"/has/dot/../dot",
+		"/trailing/slash/",
+	} {
+		err := Transport.ValidatePolicyConfigurationScope(scope)
+		assert.Error(t, err, scope)
+	}
+}
+
+func TestParseReference(t *testing.T) {
+	testParseReference(t, ParseReference)
+}
+
+// testParseReference is a test shared for Transport.ParseReference and ParseReference.
+func testParseReference(t *testing.T, fn func(string) (types.ImageReference, error)) {
+	tmpDir := t.TempDir()
+
+	for _, c := range []struct {
+		input, dir, image string
+		sourceIndex       int
+	}{
+		{tmpDir, tmpDir, "", -1},
+		{tmpDir + ":", tmpDir, "", -1},
+		{tmpDir + ":notlatest", tmpDir, "notlatest", -1},
+		{tmpDir + ":docker.io/library/busybox:notlatest", tmpDir, "docker.io/library/busybox:notlatest", -1},
+		{tmpDir + ":@0", tmpDir, "", 0},
+		{tmpDir + ":@12", tmpDir, "", 12},
+		{tmpDir + ":@-1", "", "", -1},
+		{tmpDir + ":@latest", "", "", -1},
+		{tmpDir + ":invalid'image!value@", "", "", -1},
+	} {
+		ref, err := fn(c.input)
+		if c.dir == "" {
+			assert.Error(t, err, c.input)
+			continue
+		}
+		require.NoError(t, err, c.input)
+		ociRef, ok := ref.(ociReference)
+		require.True(t, ok, c.input)
+		assert.Equal(t, c.dir, ociRef.dir, c.input)
+		assert.Equal(t, c.image, ociRef.image, c.input)
+		assert.Equal(t, c.sourceIndex, ociRef.sourceIndex, c.input)
+
+		// StringWithinTransport round-trips.
+		ref2, err := fn(ref.StringWithinTransport())
+		require.NoError(t, err, c.input)
+		assert.Equal(t, ociRef, ref2, c.input)
+	}
+}
+
+func TestNewIndexReference(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	ref, err := NewIndexReference(tmpDir, 3)
+	require.NoError(t, err)
+	assert.Equal(t, tmpDir+":@3", ref.StringWithinTransport())
+
+	_, err = NewIndexReference(tmpDir, -2)
+	assert.Error(t, err)
+
+	_, err = NewIndexReference(tmpDir+":colon", 0)
+	assert.Error(t, err)
+}
+
+func TestReferencePolicyConfigurationNamespaces(t *testing.T) {
+	tmpDir, err := filepath.EvalSymlinks(t.TempDir())
+	require.NoError(t, err)
+	ref, err := NewReference(filepath.Join(tmpDir, "dir"), "image")
+	require.NoError(t, err)
+	namespaces := ref.PolicyConfigurationNamespaces()
+	require.NotEmpty(t, namespaces)
+	assert.Equal(t, filepath.Join(tmpDir, "dir"), namespaces[0])
+	assert.Equal(t, tmpDir, namespaces[1])
+	assert.Equal(t, ref.PolicyConfigurationIdentity(), namespaces[0])
+}
@@ -0,0 +1,101 @@
+package layout
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// referrer is the part of an OCI manifest or index relevant to referrers.
+type referrer struct {
+	ArtifactType string                `json:"artifactType,omitempty"`
+	Config       *imgspecv1.Descriptor `json:"config,omitempty"`
+	Subject      *imgspecv1.Descriptor `json:"subject,omitempty"`
+	Annotations  map[string]string     `json:"annotations,omitempty"`
+}
+
+// parseReferrer parses the parts of the OCI manifest or index m relevant to referrers.
+func parseReferrer(m []byte) (referrer, error) {
+	r := referrer{}
+	if err := json.Unmarshal(m, &r); err != nil {
+		return referrer{}, err
+	}
+	return r, nil
+}
+
+// artifactType returns the artifact type of the manifest, as defined for the referrers API:
+// its artifactType, or the media type of its config.
+func (r referrer) artifactType() string {
+	if r.ArtifactType != "" {
+		return r.ArtifactType
+	}
+	if r.Config != nil {
+		return r.Config.MediaType
+	}
+	return ""
+}
+
+// GetReferrers returns descriptors of the manifests listed in the index.json of the layout of ref which have the image ref as their subject,
+// as the referrers API of a registry would. If artifactType is not empty, only referrers of that artifact type are returned.
+// Referrers are typically stored as untagged manifests, e.g. by copying them to a reference without an image name.
+func GetReferrers(ctx context.Context, sys *types.SystemContext, ref types.ImageReference, artifactType string) ([]imgspecv1.Descriptor, error) {
+	ociRef, ok := ref.(ociReference)
+	if !ok {
+		return nil, errors.New("error typecasting, need type ociRef")
+	}
+	subject, err := ociRef.getManifestDescriptor()
+	if err != nil {
+		return nil, err
+	}
+	index, err := ociRef.getIndex()
+	if err != nil {
+		return nil, err
+	}
+	sharedBlobDir := ""
+	if sys != nil {
+		sharedBlobDir = sys.OCISharedBlobDirPath
+	}
+
+	referrers := []imgspecv1.Descriptor{}
+	seen := map[digest.Digest]bool{}
+	for _, md := range index.Manifests {
+		if md.MediaType != imgspecv1.MediaTypeImageManifest && md.MediaType != imgspecv1.MediaTypeImageIndex {
+			continue
+		}
+		if md.Digest == subject.Digest || seen[md.Digest] {
+			continue
+		}
+		seen[md.Digest] = true
+		manifestPath, err := ociRef.blobPath(md.Digest, sharedBlobDir)
+		if err != nil {
+			return nil, err
+		}
+		m, err := os.ReadFile(manifestPath)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := parseReferrer(m)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing manifest %s", md.Digest)
+		}
+		if parsed.Subject == nil || parsed.Subject.Digest != subject.Digest {
+			continue
+		}
+		if artifactType != "" && parsed.artifactType() != artifactType {
+			continue
+		}
+		referrers = append(referrers, imgspecv1.Descriptor{
+			MediaType:    md.MediaType,
+			Digest:       md.Digest,
+			Size:         md.Size,
+			ArtifactType: parsed.artifactType(),
+			Annotations:  parsed.Annotations,
+		})
+	}
+	return referrers, nil
+}
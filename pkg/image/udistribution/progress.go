@@ -0,0 +1,221 @@
+package udistribution
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// TransferDirection is the direction of a blob transfer.
+type TransferDirection int
+
+const (
+	// TransferUpload is a blob written by an image destination.
+	TransferUpload TransferDirection = iota
+	// TransferDownload is a blob read by an image source.
+	TransferDownload
+)
+
+func (d TransferDirection) String() string {
+	if d == TransferDownload {
+		return "download"
+	}
+	return "upload"
+}
+
+// TransferEvent is the kind of a TransferProgress report.
+type TransferEvent int
+
+const (
+	// TransferStarted is reported before the first byte of a blob is transferred.
+	TransferStarted TransferEvent = iota
+	// TransferProgressed is reported at most once per TransferProgressOptions.Interval while a blob is transferred.
+	TransferProgressed
+	// TransferCompleted is reported once all of a blob has been transferred.
+	TransferCompleted
+	// TransferFailed is reported if a transfer fails, or a download is closed before its end.
+	TransferFailed
+)
+
+// TransferProgress reports the progress of a single blob transfer.
+type TransferProgress struct {
+	Event      TransferEvent
+	Direction  TransferDirection
+	Repository string // e.g. "ns/repo"
+	// Digest of the blob; "" for uploads of blobs with an unknown digest, until TransferCompleted.
+	Digest digest.Digest
+	// Size of the blob, or -1 if unknown.
+	Size        int64
+	Transferred int64
+	// BytesPerSecond is the average throughput since the transfer started.
+	BytesPerSecond float64
+	// Err is set for TransferFailed.
+	Err error
+}
+
+// TransferProgressOptions configures reporting of blob transfers.
+type TransferProgressOptions struct {
+	// Interval is the minimum time between TransferProgressed reports of a transfer; 0 means one second.
+	Interval time.Duration
+	// OnProgress is called synchronously from the transfer, so it should return quickly.
+	// It may be called concurrently for different transfers, e.g. by copy.Image.
+	OnProgress func(TransferProgress)
+}
+
+const defaultTransferProgressInterval = time.Second
+
+// WithTransferProgress reports blob transfers of the transport's image sources and destinations,
+// independently of copy.Options.Progress. Options set for an operation by ContextWithTransferProgress take precedence.
+func WithTransferProgress(opts TransferProgressOptions) TransportOption {
+	return func(t *UdistributionTransport) {
+		t.transferProgress = opts
+	}
+}
+
+type transferProgressKey struct{}
+
+// ContextWithTransferProgress returns a context making operations of udistribution transports using it report
+// blob transfers using opts, instead of the options of the transport.
+func ContextWithTransferProgress(ctx context.Context, opts TransferProgressOptions) context.Context {
+	return context.WithValue(ctx, transferProgressKey{}, opts)
+}
+
+// transferProgressOptions returns the options for reporting transfers of an operation using ctx and t, or nil if they are not reported.
+func transferProgressOptions(ctx context.Context, t *UdistributionTransport) *TransferProgressOptions {
+	opts, ok := ctx.Value(transferProgressKey{}).(TransferProgressOptions)
+	if !ok {
+		opts = t.transferProgress
+	}
+	if opts.OnProgress == nil {
+		return nil
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultTransferProgressInterval
+	}
+	return &opts
+}
+
+// transferReporter reports the progress of a single blob transfer.
+type transferReporter struct {
+	opts       *TransferProgressOptions
+	progress   TransferProgress
+	start      time.Time
+	lastReport time.Time
+	finished   bool
+	// resumed is the number of bytes transferred before the reporter was created, excluded from the throughput.
+	resumed int64
+}
+
+// newTransferReporter returns a reporter of a transfer of blob dgst, of size or -1 if unknown, in the repository of ref,
+// or nil if transfers of the operation using ctx and t are not reported. It reports TransferStarted.
+func newTransferReporter(ctx context.Context, t *UdistributionTransport, direction TransferDirection, ref reference.Named, dgst digest.Digest, size int64) *transferReporter {
+	opts := transferProgressOptions(ctx, t)
+	if opts == nil {
+		return nil
+	}
+	now := time.Now()
+	r := &transferReporter{
+		opts: opts,
+		progress: TransferProgress{
+			Event:      TransferStarted,
+			Direction:  direction,
+			Repository: reference.Path(ref),
+			Digest:     dgst,
+			Size:       size,
+		},
+		start:      now,
+		lastReport: now,
+	}
+	opts.OnProgress(r.progress)
+	return r
+}
+
+// resume records offset bytes as having been transferred before, e.g. by an interrupted upload.
+func (r *transferReporter) resume(offset int64) {
+	if r == nil {
+		return
+	}
+	r.progress.Transferred = offset
+	r.resumed = offset
+}
+
+// transferred records n more transferred bytes, and reports TransferProgressed if the interval has elapsed.
+func (r *transferReporter) transferred(n int) {
+	if r == nil || r.finished {
+		return
+	}
+	r.progress.Transferred += int64(n)
+	now := time.Now()
+	if now.Sub(r.lastReport) >= r.opts.Interval {
+		r.lastReport = now
+		r.report(TransferProgressed, now)
+	}
+}
+
+// completed reports TransferCompleted of a blob with dgst and size.
+func (r *transferReporter) completed(dgst digest.Digest, size int64) {
+	if r == nil || r.finished {
+		return
+	}
+	r.progress.Digest = dgst
+	r.progress.Size = size
+	r.progress.Transferred = size
+	r.finished = true
+	r.report(TransferCompleted, time.Now())
+}
+
+// failed reports TransferFailed with err.
+func (r *transferReporter) failed(err error) {
+	if r == nil || r.finished {
+		return
+	}
+	r.progress.Err = err
+	r.finished = true
+	r.report(TransferFailed, time.Now())
+}
+
+func (r *transferReporter) report(event TransferEvent, now time.Time) {
+	r.progress.Event = event
+	if elapsed := now.Sub(r.start).Seconds(); elapsed > 0 {
+		r.progress.BytesPerSecond = float64(r.progress.Transferred-r.resumed) / elapsed
+	}
+	r.opts.OnProgress(r.progress)
+}
+
+// progressReader reports data read from an upload stream to a transferReporter.
+type progressReader struct {
+	r        io.Reader
+	reporter *transferReporter
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.reporter.transferred(n)
+	return n, err
+}
+
+// progressReadCloser reports data read from a downloaded blob to a transferReporter.
+type progressReadCloser struct {
+	rc       io.ReadCloser
+	reporter *transferReporter
+}
+
+func (p *progressReadCloser) Read(b []byte) (int, error) {
+	n, err := p.rc.Read(b)
+	p.reporter.transferred(n)
+	switch {
+	case err == io.EOF:
+		p.reporter.completed(p.reporter.progress.Digest, p.reporter.progress.Transferred)
+	case err != nil:
+		p.reporter.failed(err)
+	}
+	return n, err
+}
+
+func (p *progressReadCloser) Close() error {
+	p.reporter.failed(io.ErrUnexpectedEOF)
+	return p.rc.Close()
+}
@@ -0,0 +1,111 @@
+package udistribution
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/internal/testing/clienttest"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// assertTransfer checks that events report a single successful transfer of content in direction.
+func assertTransfer(t *testing.T, events []TransferProgress, direction TransferDirection, content string) {
+	require.GreaterOrEqual(t, len(events), 3, direction.String())
+	assert.Equal(t, TransferStarted, events[0].Event, direction.String())
+	last := events[len(events)-1]
+	assert.Equal(t, TransferCompleted, last.Event, direction.String())
+	assert.Equal(t, digest.FromString(content), last.Digest, direction.String())
+	assert.Equal(t, int64(len(content)), last.Size, direction.String())
+	assert.Equal(t, int64(len(content)), last.Transferred, direction.String())
+	for i, e := range events {
+		assert.Equal(t, direction, e.Direction, direction.String())
+		assert.Equal(t, "test/progress", e.Repository, direction.String())
+		if i > 0 {
+			assert.GreaterOrEqual(t, e.Transferred, events[i-1].Transferred, direction.String())
+		}
+		if i > 0 && i < len(events)-1 {
+			assert.Equal(t, TransferProgressed, e.Event, direction.String())
+		}
+	}
+}
+
+func TestTransferProgress(t *testing.T) {
+	ctx := context.Background()
+	events := []TransferProgress{}
+	var mu sync.Mutex // copyTestImage transfers layers concurrently
+	ut, _ := newFilesystemTestTransport(t, WithChunkedUploads(ChunkedUploadOptions{ChunkSize: 1000}), WithTransferProgress(TransferProgressOptions{
+		Interval: time.Nanosecond,
+		OnProgress: func(p TransferProgress) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, p)
+		},
+	}))
+	ref, err := ut.ParseReference("//test/progress:latest")
+	require.NoError(t, err)
+	clienttest.CopyFixtureImage(t, ref)
+	content := strings.Repeat("0123456789", 450)
+
+	events = events[:0]
+	dest, err := ref.NewImageDestination(ctx, &types.SystemContext{})
+	require.NoError(t, err)
+	defer dest.Close()
+	info, err := dest.PutBlob(ctx, bytesReader(content), types.BlobInfo{Size: -1}, none.NoCache, false)
+	require.NoError(t, err)
+	assertTransfer(t, events, TransferUpload, content)
+	assert.Equal(t, digest.Digest(""), events[0].Digest)
+	assert.Equal(t, int64(-1), events[0].Size)
+
+	events = events[:0]
+	src, err := newImageSource(ctx, &types.SystemContext{}, ref.(udistributionReference))
+	require.NoError(t, err)
+	defer src.Close()
+	rc, _, err := src.GetBlob(ctx, info, none.NoCache)
+	require.NoError(t, err)
+	assert.Equal(t, content, readAllAndClose(t, rc, err))
+	assertTransfer(t, events, TransferDownload, content)
+
+	// A download closed before its end fails.
+	events = events[:0]
+	rc, _, err = src.GetBlob(ctx, info, none.NoCache)
+	require.NoError(t, err)
+	_, err = rc.Read(make([]byte, 10))
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.NotEmpty(t, events)
+	assert.Equal(t, TransferFailed, events[len(events)-1].Event)
+
+	// Options of an operation replace the options of the transport.
+	events = events[:0]
+	opEvents := []TransferProgress{}
+	opCtx := ContextWithTransferProgress(ctx, TransferProgressOptions{
+		OnProgress: func(p TransferProgress) { opEvents = append(opEvents, p) },
+	})
+	readErr := errors.New("connection reset")
+	_, err = dest.PutBlob(opCtx, &failingReader{r: bytesReader(content), err: readErr}, types.BlobInfo{Size: -1}, none.NoCache, false)
+	require.ErrorIs(t, err, readErr)
+	assert.Empty(t, events)
+	require.Len(t, opEvents, 2)
+	assert.Equal(t, TransferStarted, opEvents[0].Event)
+	assert.Equal(t, TransferFailed, opEvents[1].Event)
+	assert.ErrorIs(t, opEvents[1].Err, readErr)
+	assert.Equal(t, int64(len(content)), opEvents[1].Transferred)
+}
+
+func TestTransferProgressDisabled(t *testing.T) {
+	ut, _ := newFilesystemTestTransport(t)
+	assert.Nil(t, newTransferReporter(context.Background(), ut, TransferUpload, nil, "", -1))
+	var r io.Reader = &progressReader{r: bytesReader("data")}
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
@@ -0,0 +1,272 @@
+package udistribution
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/client"
+	"github.com/migtools/udistribution/pkg/internal/image/iolimits"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	referrersPath = "/v2/%s/referrers/%s"
+
+	// subjectHeader is set by registries which process the subject of an uploaded manifest.
+	subjectHeader        = "OCI-Subject"
+	filtersAppliedHeader = "OCI-Filters-Applied"
+)
+
+// DeleteImageOptions configures DeleteImageWithOptions.
+type DeleteImageOptions struct {
+	// CascadeReferrers also deletes manifests referring to the image through their subject (e.g. signatures, SBOMs),
+	// recursively, and the referrers tag schema index of the image.
+	CascadeReferrers bool
+}
+
+// DeleteImageWithOptions deletes the image ref, which must use a udistribution transport, as configured by opts.
+func DeleteImageWithOptions(ctx context.Context, sys *types.SystemContext, ref types.ImageReference, opts DeleteImageOptions) error {
+	dr, ok := ref.(udistributionReference)
+	if !ok {
+		return errors.Errorf("ref must be a udistributionReference")
+	}
+	return deleteImage(ctx, sys, dr, opts)
+}
+
+// GetReferrers returns descriptors of the manifests which have the image ref as their subject.
+// If artifactType is not empty, only referrers of that artifact type are returned.
+// Registries without the referrers API are supported through the referrers tag schema.
+func GetReferrers(ctx context.Context, sys *types.SystemContext, ref types.ImageReference, artifactType string) ([]imgspecv1.Descriptor, error) {
+	dr, ok := ref.(udistributionReference)
+	if !ok {
+		return nil, errors.Errorf("ref must be a udistributionReference")
+	}
+	c, err := newDockerClientFromRef(sys, dr, false, "pull")
+	if err != nil {
+		return nil, err
+	}
+	tagOrDigest, err := dr.tagOrDigest()
+	if err != nil {
+		return nil, err
+	}
+	subject, err := manifestDigestIn(ctx, c, dr, tagOrDigest)
+	if err != nil {
+		return nil, err
+	}
+	if subject == "" {
+		return nil, errors.Errorf("Unable to list referrers of %v: image does not exist", dr.ref)
+	}
+	return c.getReferrers(ctx, dr.ref, subject, artifactType)
+}
+
+// getReferrers returns descriptors of the manifests in the repository of ref which have subject as their subject,
+// using the referrers API if available, and the referrers tag schema otherwise.
+func (c *udistributionClient) getReferrers(ctx context.Context, ref reference.Named, subject digest.Digest, artifactType string) ([]imgspecv1.Descriptor, error) {
+	path := fmt.Sprintf(referrersPath, reference.Path(ref), subject)
+	if artifactType != "" {
+		path += "?" + url.Values{"artifactType": {artifactType}}.Encode()
+	}
+	res, err := c.makeRequest(ctx, http.MethodGet, path, nil, nil, v2Auth, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var index *imgspecv1.Index
+	filtered := false
+	switch res.StatusCode {
+	case http.StatusOK:
+		body, err := iolimits.ReadAtMost(res.Body, iolimits.MaxManifestBodySize)
+		if err != nil {
+			return nil, err
+		}
+		index = &imgspecv1.Index{}
+		if err := json.Unmarshal(body, index); err != nil {
+			return nil, errors.Wrapf(err, "decoding referrers of %s", subject)
+		}
+		filtered = res.Header.Get(filtersAppliedHeader) != ""
+	case http.StatusNotFound:
+		logrus.Debugf("Referrers API not supported for %s, using the referrers tag schema", ref.Name())
+		if index, _, err = c.getReferrersTagIndex(ctx, ref, subject); err != nil {
+			return nil, err
+		}
+		if index == nil {
+			return []imgspecv1.Descriptor{}, nil
+		}
+	default:
+		return nil, errors.Wrapf(registryHTTPResponseToError(res), "listing referrers of %s in %s", subject, ref.Name())
+	}
+
+	referrers := []imgspecv1.Descriptor{}
+	for _, desc := range index.Manifests {
+		if artifactType == "" || filtered || desc.ArtifactType == artifactType {
+			referrers = append(referrers, desc)
+		}
+	}
+	return referrers, nil
+}
+
+// supportsReferrers returns true if the registry serves the referrers API for the repository of ref.
+func (c *udistributionClient) supportsReferrers(ctx context.Context, ref reference.Named, subject digest.Digest) (bool, error) {
+	res, err := c.makeRequest(ctx, http.MethodGet, fmt.Sprintf(referrersPath, reference.Path(ref), subject), nil, nil, v2Auth, nil)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, errors.Wrapf(registryHTTPResponseToError(res), "probing referrers API of %s", ref.Name())
+	}
+}
+
+// getReferrersTagIndex returns the index at the referrers tag schema of subject, and its digest, or nil if it does not exist.
+func (c *udistributionClient) getReferrersTagIndex(ctx context.Context, ref reference.Named, subject digest.Digest) (*imgspecv1.Index, digest.Digest, error) {
+	headers := map[string][]string{
+		"Accept": {imgspecv1.MediaTypeImageIndex},
+	}
+	path := fmt.Sprintf(manifestPath, reference.Path(ref), client.ReferrersTagSchema(subject))
+	res, err := c.makeRequest(ctx, http.MethodGet, path, headers, nil, v2Auth, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, "", nil
+	default:
+		return nil, "", errors.Wrapf(registryHTTPResponseToError(res), "reading referrers tag of %s in %s", subject, ref.Name())
+	}
+	body, err := iolimits.ReadAtMost(res.Body, iolimits.MaxManifestBodySize)
+	if err != nil {
+		return nil, "", err
+	}
+	index := imgspecv1.Index{}
+	if err := json.Unmarshal(body, &index); err != nil {
+		return nil, "", errors.Wrapf(err, "decoding referrers tag of %s", subject)
+	}
+	indexDigest, err := manifest.Digest(body)
+	if err != nil {
+		return nil, "", err
+	}
+	return &index, indexDigest, nil
+}
+
+// addReferrer records the manifest m, with digest mDigest, as a referrer of its subject in the referrers tag schema,
+// if the manifest has a subject and the registry did not process it. The in-process registry indexes subjects itself.
+func (c *udistributionClient) addReferrer(ctx context.Context, ref reference.Named, m []byte, mDigest digest.Digest, res *http.Response) error {
+	var parsed struct {
+		MediaType    string                `json:"mediaType"`
+		ArtifactType string                `json:"artifactType,omitempty"`
+		Config       *imgspecv1.Descriptor `json:"config,omitempty"`
+		Subject      *imgspecv1.Descriptor `json:"subject,omitempty"`
+		Annotations  map[string]string     `json:"annotations,omitempty"`
+	}
+	if c.ut != nil && servedInProcess(&url.URL{Host: c.registry}) {
+		return nil
+	}
+	if err := json.Unmarshal(m, &parsed); err != nil || parsed.Subject == nil || res.Header.Get(subjectHeader) != "" {
+		return nil
+	}
+	subject := parsed.Subject.Digest
+	supported, err := c.supportsReferrers(ctx, ref, subject)
+	if err != nil || supported {
+		return err
+	}
+
+	desc := imgspecv1.Descriptor{
+		MediaType:    parsed.MediaType,
+		ArtifactType: parsed.ArtifactType,
+		Digest:       mDigest,
+		Size:         int64(len(m)),
+		Annotations:  parsed.Annotations,
+	}
+	if desc.ArtifactType == "" && parsed.Config != nil && desc.MediaType == imgspecv1.MediaTypeImageManifest {
+		desc.ArtifactType = parsed.Config.MediaType
+	}
+	index, _, err := c.getReferrersTagIndex(ctx, ref, subject)
+	if err != nil {
+		return err
+	}
+	if index == nil {
+		index = &imgspecv1.Index{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: imgspecv1.MediaTypeImageIndex}
+	}
+	for _, existing := range index.Manifests {
+		if existing.Digest == desc.Digest {
+			return nil
+		}
+	}
+	index.Manifests = append(index.Manifests, desc)
+	body, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	headers := map[string][]string{
+		"Content-Type": {imgspecv1.MediaTypeImageIndex},
+	}
+	tag := client.ReferrersTagSchema(subject)
+	put, err := c.makeRequest(ctx, http.MethodPut, fmt.Sprintf(manifestPath, reference.Path(ref), tag), headers, bytes.NewReader(body), v2Auth, nil)
+	if err != nil {
+		return err
+	}
+	defer put.Body.Close()
+	if !successStatus(put.StatusCode) {
+		return errors.Wrapf(registryHTTPResponseToError(put), "updating referrers tag %s in %s", tag, ref.Name())
+	}
+	return nil
+}
+
+// deleteReferrers deletes the referrers of subject in the repository of ref, recursively, and its referrers tag schema index.
+func deleteReferrers(ctx context.Context, sys *types.SystemContext, c *udistributionClient, ref udistributionReference, subject digest.Digest, opts DeleteImageOptions) error {
+	referrers, err := c.getReferrers(ctx, ref.ref, subject, "")
+	if err != nil {
+		return err
+	}
+	for _, desc := range referrers {
+		if desc.Digest == subject {
+			continue
+		}
+		named, err := reference.WithDigest(reference.TrimNamed(ref.ref), desc.Digest)
+		if err != nil {
+			return err
+		}
+		referrer, err := newReference(named, ref.UdistributionTransport)
+		if err != nil {
+			return err
+		}
+		if err := deleteImage(ctx, sys, referrer, opts); err != nil {
+			if exists, existsErr := manifestDigestIn(ctx, c, ref, desc.Digest.String()); existsErr == nil && exists == "" {
+				continue // already deleted, e.g. listed in the referrers tag schema index after having been deleted
+			}
+			return errors.Wrapf(err, "deleting referrer %s of %s", desc.Digest, subject)
+		}
+	}
+	_, indexDigest, err := c.getReferrersTagIndex(ctx, ref.ref, subject)
+	if err != nil || indexDigest == "" {
+		return err
+	}
+	res, err := c.makeRequest(ctx, http.MethodDelete, fmt.Sprintf(manifestPath, reference.Path(ref.ref), indexDigest), nil, nil, v2Auth, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusAccepted && res.StatusCode != http.StatusNotFound {
+		return errors.Wrapf(registryHTTPResponseToError(res), "deleting referrers tag of %s in %s", subject, ref.ref.Name())
+	}
+	return nil
+}
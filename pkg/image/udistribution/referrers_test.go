@@ -0,0 +1,174 @@
+package udistribution
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/types"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/migtools/udistribution/pkg/client"
+	"github.com/migtools/udistribution/pkg/internal/testing/clienttest"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pushTestArtifact pushes an OCI artifact of artifactType with subject to repo of ut, and returns its digest.
+func pushTestArtifact(t *testing.T, ut *UdistributionTransport, repo string, subject digest.Digest, artifactType, content string) digest.Digest {
+	ctx := context.Background()
+	sys := &types.SystemContext{}
+	emptyConfig := []byte("{}")
+	m := imgspecv1.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    imgspecv1.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Config:       imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeEmptyJSON, Digest: digest.FromBytes(emptyConfig), Size: int64(len(emptyConfig))},
+		Layers:       []imgspecv1.Descriptor{{MediaType: "text/plain", Digest: digest.FromString(content), Size: int64(len(content))}},
+		Subject:      &imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageManifest, Digest: subject},
+	}
+	manifestBlob, err := json.Marshal(m)
+	require.NoError(t, err)
+	manifestDigest, err := manifest.Digest(manifestBlob)
+	require.NoError(t, err)
+
+	ref, err := ut.ParseReference("//" + repo + "@" + manifestDigest.String())
+	require.NoError(t, err)
+	dest, err := ref.NewImageDestination(ctx, sys)
+	require.NoError(t, err)
+	defer dest.Close()
+	_, err = dest.PutBlob(ctx, bytesReader(string(emptyConfig)), types.BlobInfo{Digest: m.Config.Digest, Size: m.Config.Size}, none.NoCache, true)
+	require.NoError(t, err)
+	_, err = dest.PutBlob(ctx, bytesReader(content), types.BlobInfo{Digest: m.Layers[0].Digest, Size: m.Layers[0].Size}, none.NoCache, false)
+	require.NoError(t, err)
+	require.NoError(t, dest.PutManifest(ctx, manifestBlob, nil))
+	require.NoError(t, dest.Commit(ctx, nil))
+	return manifestDigest
+}
+
+func TestReferrers(t *testing.T) {
+	ctx := context.Background()
+	sys := &types.SystemContext{}
+	c, dir := clienttest.NewFilesystemClient(t, []string{"REGISTRY_STORAGE_DELETE_ENABLED=true"})
+	ut := NewTransport(c, "referrers")
+	t.Cleanup(ut.Deregister)
+	ref, err := ut.ParseReference("//test/app:latest")
+	require.NoError(t, err)
+	subject, err := manifest.Digest(clienttest.CopyFixtureImage(t, ref))
+	require.NoError(t, err)
+
+	sbom := pushTestArtifact(t, ut, "test/app", subject, "application/spdx+json", "sbom")
+	sig := pushTestArtifact(t, ut, "test/app", subject, "application/vnd.dev.cosign.artifact.sig.v1+json", "signature")
+	// A referrer of a referrer is not a referrer of the image.
+	sbomSig := pushTestArtifact(t, ut, "test/app", sbom, "application/vnd.dev.cosign.artifact.sig.v1+json", "sbom signature")
+
+	referrers, err := GetReferrers(ctx, sys, ref, "")
+	require.NoError(t, err)
+	digests := []digest.Digest{}
+	for _, desc := range referrers {
+		digests = append(digests, desc.Digest)
+		assert.Equal(t, imgspecv1.MediaTypeImageManifest, desc.MediaType)
+	}
+	assert.ElementsMatch(t, []digest.Digest{sbom, sig}, digests)
+
+	referrers, err = GetReferrers(ctx, sys, ref, "application/spdx+json")
+	require.NoError(t, err)
+	require.Len(t, referrers, 1)
+	assert.Equal(t, sbom, referrers[0].Digest)
+	assert.Equal(t, "application/spdx+json", referrers[0].ArtifactType)
+
+	// Referrers are indexed by subject when pushed.
+	indexed, err := os.ReadDir(filepath.Join(dir, "docker/registry/v2/repositories/test/app/_referrers/sha256", subject.Encoded(), "sha256"))
+	require.NoError(t, err)
+	assert.Len(t, indexed, 2)
+
+	// The registry serves the referrers API, so the referrers tag schema is not used.
+	tagIndex, err := ut.ParseReference("//test/app:" + client.ReferrersTagSchema(subject))
+	require.NoError(t, err)
+	_, err = tagIndex.NewImageSource(ctx, sys)
+	assert.Error(t, err)
+
+	require.NoError(t, DeleteImageWithOptions(ctx, sys, ref, DeleteImageOptions{CascadeReferrers: true}))
+	for _, dgst := range []digest.Digest{subject, sbom, sig, sbomSig} {
+		deleted, err := ut.ParseReference("//test/app@" + dgst.String())
+		require.NoError(t, err)
+		_, err = deleted.NewImageSource(ctx, sys)
+		assert.Error(t, err, dgst.String())
+	}
+}
+
+func TestReferrersGarbageCollection(t *testing.T) {
+	ctx := context.Background()
+	sys := &types.SystemContext{}
+	c, dir := clienttest.NewFilesystemClient(t, []string{"REGISTRY_STORAGE_DELETE_ENABLED=true"})
+	ut := NewTransport(c, "referrers-gc")
+	t.Cleanup(ut.Deregister)
+	ref, err := ut.ParseReference("//test/app:latest")
+	require.NoError(t, err)
+	subject, err := manifest.Digest(clienttest.CopyFixtureImage(t, ref))
+	require.NoError(t, err)
+	sbom := pushTestArtifact(t, ut, "test/app", subject, "application/spdx+json", "sbom")
+	missing := digest.FromString("missing subject")
+	pushTestArtifact(t, ut, "test/app", missing, "application/spdx+json", "orphan sbom")
+	// The index does not create revisions for subjects.
+	_, err = os.Stat(filepath.Join(dir, "docker/registry/v2/repositories/test/app/_manifests/revisions/sha256", missing.Encoded()))
+	assert.True(t, os.IsNotExist(err), "%v", err)
+
+	// The untagged referrers are is collected once, and the collection goes on to sweep its blobs.
+	driver, err := c.StorageDriver()
+	require.NoError(t, err)
+	registry, err := storage.NewRegistry(ctx, driver, storage.EnableDelete)
+	require.NoError(t, err)
+	require.NoError(t, storage.MarkAndSweep(ctx, driver, registry, storage.GCOpts{RemoveUntagged: true}))
+	_, err = os.Stat(filepath.Join(dir, "docker/registry/v2/blobs/sha256", sbom.Encoded()[:2], sbom.Encoded()))
+	assert.True(t, os.IsNotExist(err), "%v", err)
+	referrers, err := GetReferrers(ctx, sys, ref, "")
+	require.NoError(t, err)
+	assert.Empty(t, referrers)
+	assertImageIn(t, c, "//test/app:latest")
+}
+
+func TestReferrersTagSchema(t *testing.T) {
+	ctx := context.Background()
+	sys := &types.SystemContext{}
+	ut, _ := newFilesystemTestTransport(t)
+	ref, err := ut.ParseReference("//test/app:latest")
+	require.NoError(t, err)
+	subject, err := manifest.Digest(clienttest.CopyFixtureImage(t, ref))
+	require.NoError(t, err)
+	sig := pushTestArtifact(t, ut, "test/app", subject, "application/vnd.dev.cosign.artifact.sig.v1+json", "signature")
+
+	// An index at the referrers tag schema, e.g. written by a client which did not find the referrers API,
+	// is merged with the referrers found by the registry.
+	index := imgspecv1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageIndex,
+		Manifests: []imgspecv1.Descriptor{
+			{MediaType: imgspecv1.MediaTypeImageManifest, ArtifactType: "application/vnd.example.backup+json", Digest: subject, Size: 1},
+			{MediaType: imgspecv1.MediaTypeImageManifest, ArtifactType: "application/vnd.dev.cosign.artifact.sig.v1+json", Digest: sig, Size: 1},
+		},
+	}
+	indexBlob, err := json.Marshal(index)
+	require.NoError(t, err)
+	tagRef, err := ut.ParseReference("//test/app:" + client.ReferrersTagSchema(subject))
+	require.NoError(t, err)
+	dest, err := tagRef.NewImageDestination(ctx, sys)
+	require.NoError(t, err)
+	defer dest.Close()
+	require.NoError(t, dest.PutManifest(ctx, indexBlob, nil))
+	require.NoError(t, dest.Commit(ctx, nil))
+
+	referrers, err := GetReferrers(ctx, sys, ref, "")
+	require.NoError(t, err)
+	assert.Len(t, referrers, 2)
+	referrers, err = GetReferrers(ctx, sys, ref, "application/vnd.example.backup+json")
+	require.NoError(t, err)
+	require.Len(t, referrers, 1)
+	assert.Equal(t, subject, referrers[0].Digest)
+}
@@ -0,0 +1,330 @@
+package udistribution
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/client"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// replicatedImageDestination is an ImageDestination which writes the same image to several backends.
+type replicatedImageDestination struct {
+	ref      udistributionReference
+	opts     ReplicationOptions
+	replicas []*dockerImageDestination
+	names    []string
+	// State
+	mutex    sync.Mutex       // Protects failures.
+	failures []ReplicaFailure // Writes which failed on some replicas, but were accepted by enough others.
+}
+
+// newReplicatedImageDestination creates a new ImageDestination writing ref to every backend returned by ref's writeBackends.
+func newReplicatedImageDestination(sys *types.SystemContext, ref udistributionReference) (types.ImageDestination, error) {
+	d := &replicatedImageDestination{
+		ref:  ref,
+		opts: ref.UdistributionTransport.replication,
+	}
+	for i, backend := range ref.UdistributionTransport.writeBackends() {
+		backendRef := ref
+		backendRef.UdistributionTransport = backend
+		c, err := newDockerClientFromRef(sys, backendRef, true, "pull,push")
+		if err != nil {
+			return nil, err
+		}
+		d.replicas = append(d.replicas, &dockerImageDestination{ref: backendRef, c: c})
+		d.names = append(d.names, replicaDescription(backend, i))
+	}
+	return d, nil
+}
+
+// forEachReplica runs fn concurrently for every replica, and returns the error of each.
+func (d *replicatedImageDestination) forEachReplica(fn func(i int, replica *dockerImageDestination) error) []error {
+	errs := make([]error, len(d.replicas))
+	var wg sync.WaitGroup
+	for i, replica := range d.replicas {
+		wg.Add(1)
+		go func(i int, replica *dockerImageDestination) {
+			defer wg.Done()
+			errs[i] = fn(i, replica)
+		}(i, replica)
+	}
+	wg.Wait()
+	return errs
+}
+
+// evaluate decides whether the write of item, which failed on the replicas with a non-nil value in errs, succeeded overall.
+// Failures which are tolerated by ReplicateQuorum are recorded for reporting on Commit.
+func (d *replicatedImageDestination) evaluate(item string, errs []error) error {
+	succeeded := []string{}
+	failures := []ReplicaFailure{}
+	for i, err := range errs {
+		if err == nil {
+			succeeded = append(succeeded, d.names[i])
+		} else {
+			failures = append(failures, ReplicaFailure{Replica: d.names[i], Item: item, Err: err})
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	if len(succeeded) >= d.opts.requiredReplicas(len(d.replicas)) {
+		for _, f := range failures {
+			logrus.Warnf("Replicating %s failed on %s, continuing with %d of %d replicas: %v", item, f.Replica, len(succeeded), len(d.replicas), f.Err)
+		}
+		d.mutex.Lock()
+		d.failures = append(d.failures, failures...)
+		d.mutex.Unlock()
+		return nil
+	}
+	if len(succeeded) == 0 {
+		// Nothing was written; return the primary error unchanged, so that typed errors (e.g. ManifestTypeRejectedError) are preserved.
+		for _, f := range failures[1:] {
+			logrus.Debugf("Writing %s also failed on %s: %v", item, f.Replica, f.Err)
+		}
+		return failures[0].Err
+	}
+	return ErrPartialReplication{Item: item, Succeeded: succeeded, Failures: failures}
+}
+
+// Reference returns the reference used to set up this destination.  Note that this should directly correspond to user's intent,
+// e.g. it should use the public hostname instead of the result of resolving CNAMEs or following redirects.
+func (d *replicatedImageDestination) Reference() types.ImageReference {
+	return d.ref
+}
+
+// Close removes resources associated with an initialized ImageDestination, if any.
+func (d *replicatedImageDestination) Close() error {
+	var firstErr error
+	for _, replica := range d.replicas {
+		if err := replica.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (d *replicatedImageDestination) SupportedManifestMIMETypes() []string {
+	return d.replicas[0].SupportedManifestMIMETypes()
+}
+
+// SupportsSignatures returns an error (to be displayed to the user) if the destination certainly can't store signatures.
+// Note: It is still possible for PutSignatures to fail if SupportsSignatures returns nil.
+func (d *replicatedImageDestination) SupportsSignatures(ctx context.Context) error {
+	errs := d.forEachReplica(func(_ int, replica *dockerImageDestination) error {
+		return replica.SupportsSignatures(ctx)
+	})
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *replicatedImageDestination) DesiredLayerCompression() types.LayerCompression {
+	return d.replicas[0].DesiredLayerCompression()
+}
+
+// AcceptsForeignLayerURLs returns false iff foreign layers in manifest should be actually
+// uploaded to the image destination, true otherwise.
+func (d *replicatedImageDestination) AcceptsForeignLayerURLs() bool {
+	return d.replicas[0].AcceptsForeignLayerURLs()
+}
+
+// MustMatchRuntimeOS returns true iff the destination can store only images targeted for the current runtime architecture and OS. False otherwise.
+func (d *replicatedImageDestination) MustMatchRuntimeOS() bool {
+	return d.replicas[0].MustMatchRuntimeOS()
+}
+
+// IgnoresEmbeddedDockerReference returns true iff the destination does not care about Image.EmbeddedDockerReferenceConflicts(),
+// and would prefer to receive an unmodified manifest instead of one modified for the destination.
+// Does not make a difference if Reference().DockerReference() is nil.
+func (d *replicatedImageDestination) IgnoresEmbeddedDockerReference() bool {
+	return d.replicas[0].IgnoresEmbeddedDockerReference()
+}
+
+// HasThreadSafePutBlob indicates whether PutBlob can be executed concurrently.
+func (d *replicatedImageDestination) HasThreadSafePutBlob() bool {
+	return true
+}
+
+// PutBlob writes contents of stream to every replica, reading stream only once, and returns data representing the result.
+// See dockerImageDestination.PutBlob for the semantics of the arguments.
+func (d *replicatedImageDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	writers := make([]*io.PipeWriter, len(d.replicas))
+	readers := make([]*io.PipeReader, len(d.replicas))
+	for i := range d.replicas {
+		readers[i], writers[i] = io.Pipe()
+	}
+	infos := make([]types.BlobInfo, len(d.replicas))
+	ctx = withoutBatchCopy(ctx)
+	done := make(chan []error)
+	go func() {
+		done <- d.forEachReplica(func(i int, replica *dockerImageDestination) error {
+			info, err := replica.PutBlob(ctx, readers[i], inputInfo, cache, isConfig)
+			// Unblock the fan-out if the replica returned without consuming all of its input, e.g. because it already had the blob.
+			readers[i].CloseWithError(errReplicaDone)
+			infos[i] = info
+			return err
+		})
+	}()
+	_, err := io.Copy(&fanOutWriter{writers: writers}, stream)
+	for _, w := range writers {
+		if err != nil && err != errReplicaDone {
+			w.CloseWithError(err) // Make sure every replica fails, as PutBlob must, if reading stream failed.
+		} else {
+			w.Close()
+		}
+	}
+	errs := <-done
+
+	item := "blob"
+	if inputInfo.Digest != "" {
+		item = "blob " + inputInfo.Digest.String()
+	}
+	if err := d.evaluate(item, errs); err != nil {
+		return types.BlobInfo{}, err
+	}
+	for i, err := range errs {
+		if err == nil {
+			return infos[i], nil
+		}
+	}
+	return types.BlobInfo{}, errors.New("Internal error: replicatedImageDestination.PutBlob succeeded without a successful replica")
+}
+
+// errReplicaDone is used to stop feeding data to a replica which has returned from PutBlob.
+var errReplicaDone = errors.New("replica is not reading any more data")
+
+// fanOutWriter is an io.Writer writing all its input to each of writers which is still accepting data.
+type fanOutWriter struct {
+	writers []*io.PipeWriter
+}
+
+func (w *fanOutWriter) Write(p []byte) (int, error) {
+	live := w.writers[:0]
+	for _, pw := range w.writers {
+		if _, err := pw.Write(p); err == nil {
+			live = append(live, pw)
+		}
+	}
+	w.writers = live
+	if len(live) == 0 {
+		return 0, errReplicaDone
+	}
+	return len(p), nil
+}
+
+// TryReusingBlob checks whether the transport already contains, or can efficiently reuse, a blob, and if so, applies it to the current destination
+// (e.g. if the blob is a filesystem layer, this signifies that the changes it describes need to be applied again when composing a filesystem tree).
+// info.Digest must not be empty.
+// A blob is only reused if every replica can reuse exactly the same blob; otherwise PutBlob must be used, which skips replicas already containing it.
+func (d *replicatedImageDestination) TryReusingBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache, canSubstitute bool) (bool, types.BlobInfo, error) {
+	reused := make([]bool, len(d.replicas))
+	infos := make([]types.BlobInfo, len(d.replicas))
+	ctx = withoutBatchCopy(ctx)
+	errs := d.forEachReplica(func(i int, replica *dockerImageDestination) error {
+		var err error
+		// Substitution is not allowed, every replica might choose a different substitute.
+		reused[i], infos[i], err = replica.TryReusingBlob(ctx, info, cache, false)
+		return err
+	})
+	for i := range d.replicas {
+		if errs[i] != nil {
+			return false, types.BlobInfo{}, errs[i]
+		}
+		if !reused[i] {
+			return false, types.BlobInfo{}, nil
+		}
+	}
+	return true, infos[0], nil
+}
+
+// reuseBlobFrom makes blob srcDigest in srcRepo available in every replica, see dockerImageDestination.reuseBlobFrom.
+// Replicas which do not find the blob in srcRepo fail, as ReplicationOptions allow.
+func (d *replicatedImageDestination) reuseBlobFrom(ctx context.Context, srcRepo reference.Named, srcDigest digest.Digest) (bool, int64, error) {
+	sizes := make([]int64, len(d.replicas))
+	errs := d.forEachReplica(func(i int, replica *dockerImageDestination) error {
+		exists, size, err := replica.reuseBlobFrom(ctx, srcRepo, srcDigest)
+		if err == nil && !exists {
+			err = errors.Errorf("blob %s is not stored in %s", srcDigest, srcRepo.Name())
+		}
+		sizes[i] = size
+		return err
+	})
+	if err := d.evaluate("blob "+srcDigest.String(), errs); err != nil {
+		return false, -1, err
+	}
+	for i, err := range errs {
+		if err == nil {
+			return true, sizes[i], nil
+		}
+	}
+	return false, -1, nil
+}
+
+// copyBlobFrom copies blob srcDigest in srcRepo, of the registry of src, into every replica, see dockerImageDestination.copyBlobFrom.
+// Unlike other writes it fails if any replica fails, so that the caller can write the blob to all replicas in another way.
+func (d *replicatedImageDestination) copyBlobFrom(ctx context.Context, src *client.Client, srcRepo reference.Named, srcDigest digest.Digest) (int64, error) {
+	sizes := make([]int64, len(d.replicas))
+	errs := d.forEachReplica(func(i int, replica *dockerImageDestination) error {
+		var err error
+		sizes[i], err = replica.copyBlobFrom(ctx, src, srcRepo, srcDigest)
+		return err
+	})
+	for i, err := range errs {
+		if err != nil {
+			return -1, errors.Wrapf(err, "copying blob %s to %s", srcDigest, d.names[i])
+		}
+	}
+	return sizes[0], nil
+}
+
+// PutManifest writes manifest to every replica.
+// See dockerImageDestination.PutManifest for the semantics of the arguments.
+func (d *replicatedImageDestination) PutManifest(ctx context.Context, m []byte, instanceDigest *digest.Digest) error {
+	errs := d.forEachReplica(func(_ int, replica *dockerImageDestination) error {
+		return replica.PutManifest(ctx, m, instanceDigest)
+	})
+	item := "manifest for " + d.ref.ref.String()
+	if instanceDigest != nil {
+		item = "manifest " + instanceDigest.String()
+	}
+	return d.evaluate(item, errs)
+}
+
+// PutSignatures uploads a set of signatures to every replica.
+// See dockerImageDestination.PutSignatures for the semantics of the arguments.
+func (d *replicatedImageDestination) PutSignatures(ctx context.Context, signatures [][]byte, instanceDigest *digest.Digest) error {
+	errs := d.forEachReplica(func(_ int, replica *dockerImageDestination) error {
+		return replica.PutSignatures(ctx, signatures, instanceDigest)
+	})
+	return d.evaluate("signatures for "+d.ref.ref.String(), errs)
+}
+
+// Commit marks the process of storing the image as successful and asks for the image to be persisted.
+// If any write was not accepted by all replicas, it is reported through ReplicationOptions.OnPartialWrite.
+func (d *replicatedImageDestination) Commit(ctx context.Context, unparsedToplevel types.UnparsedImage) error {
+	errs := d.forEachReplica(func(_ int, replica *dockerImageDestination) error {
+		return replica.Commit(ctx, unparsedToplevel)
+	})
+	if err := d.evaluate("commit of "+d.ref.ref.String(), errs); err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	failures := d.failures
+	d.mutex.Unlock()
+	if len(failures) != 0 {
+		logrus.Warnf("%s was not written to all replicas, %d writes failed; use RepairReplicas to fill in missing content", d.ref.ref.String(), len(failures))
+		if d.opts.OnPartialWrite != nil {
+			d.opts.OnPartialWrite(ReplicationReport{Reference: d.ref.ref.String(), Failures: failures})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package udistribution
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/client"
+	"github.com/migtools/udistribution/pkg/internal/testing/clienttest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newBrokenTestClient returns a client whose storage can't be written to.
+func newBrokenTestClient(t *testing.T) *client.Client {
+	notADir := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(notADir, nil, 0600))
+	c, _ := clienttest.NewFilesystemClient(t, []string{"REGISTRY_STORAGE_FILESYSTEM_ROOTDIRECTORY=" + filepath.Join(notADir, "root")})
+	return c
+}
+
+// assertImageIn checks that refString can be read, in full, using c.
+func assertImageIn(t *testing.T, c *client.Client, refString string) {
+	ut := NewTransport(c, "check")
+	defer ut.Deregister()
+	ref, err := ut.ParseReference(refString)
+	require.NoError(t, err)
+	img, err := ref.NewImage(context.Background(), &types.SystemContext{})
+	require.NoError(t, err)
+	defer img.Close()
+	for _, layer := range img.LayerInfos() {
+		rc, _, err := img.(*Image).src.GetBlob(context.Background(), layer, none.NoCache)
+		require.NoError(t, err)
+		rc.Close()
+	}
+	_, err = img.ConfigBlob(context.Background())
+	require.NoError(t, err)
+}
+
+func TestReplicatedImageDestinationSynchronous(t *testing.T) {
+	replica, _ := clienttest.NewFilesystemClient(t, nil)
+	ut, _ := newFilesystemTestTransport(t, WithWriteReplicas(ReplicationOptions{}, replica))
+	ref, err := ut.ParseReference("//test/replicated:v1")
+	require.NoError(t, err)
+	clienttest.CopyFixtureImage(t, ref)
+	clienttest.CopyFixtureImage(t, ref) // Everything exists already
+	assertImageIn(t, ut.Client, "//test/replicated:v1")
+	assertImageIn(t, replica, "//test/replicated:v1")
+
+	ut2, _ := newFilesystemTestTransport(t, WithWriteReplicas(ReplicationOptions{}, newBrokenTestClient(t)))
+	broken, err := ut2.ParseReference("//test/replicated:v1")
+	require.NoError(t, err)
+	dest, err := broken.NewImageDestination(context.Background(), &types.SystemContext{})
+	require.NoError(t, err)
+	defer dest.Close()
+	_, err = dest.PutBlob(context.Background(), bytesReader("data"), types.BlobInfo{Size: -1}, none.NoCache, false)
+	var partial ErrPartialReplication
+	require.True(t, errors.As(err, &partial), "%#v", err)
+	assert.Equal(t, []string{"replica #0 (filesystem)"}, partial.Succeeded)
+	require.Len(t, partial.Failures, 1)
+	assert.Equal(t, "replica #1 (filesystem)", partial.Failures[0].Replica)
+}
+
+func TestReplicatedImageDestinationQuorum(t *testing.T) {
+	replica, _ := clienttest.NewFilesystemClient(t, nil)
+	reports := []ReplicationReport{}
+	ut, _ := newFilesystemTestTransport(t, WithWriteReplicas(ReplicationOptions{
+		Mode: ReplicateQuorum,
+		OnPartialWrite: func(r ReplicationReport) {
+			reports = append(reports, r)
+		},
+	}, replica, newBrokenTestClient(t)))
+	ref, err := ut.ParseReference("//test/quorum:v1")
+	require.NoError(t, err)
+	clienttest.CopyFixtureImage(t, ref)
+	assertImageIn(t, ut.Client, "//test/quorum:v1")
+	assertImageIn(t, replica, "//test/quorum:v1")
+	require.Len(t, reports, 1)
+	assert.Equal(t, "docker.io/test/quorum:v1", reports[0].Reference)
+	assert.NotEmpty(t, reports[0].Failures)
+	for _, f := range reports[0].Failures {
+		assert.Equal(t, "replica #2 (filesystem)", f.Replica)
+	}
+}
+
+func TestRepairReplicas(t *testing.T) {
+	primary, _ := clienttest.NewFilesystemClient(t, nil)
+	unreplicated := NewTransport(primary, "unreplicated")
+	defer unreplicated.Deregister()
+	unreplicatedRef, err := unreplicated.ParseReference("//test/repair:v1")
+	require.NoError(t, err)
+	clienttest.CopyFixtureImage(t, unreplicatedRef)
+
+	replica, _ := clienttest.NewFilesystemClient(t, nil)
+	ut := NewTransport(primary, "replicated", WithWriteReplicas(ReplicationOptions{}, replica))
+	defer ut.Deregister()
+	ref, err := ut.ParseReference("//test/repair:v1")
+	require.NoError(t, err)
+	repairs, err := RepairReplicas(context.Background(), &types.SystemContext{}, ref)
+	require.NoError(t, err)
+	require.Len(t, repairs, 1)
+	assert.Equal(t, "replica #1 (filesystem)", repairs[0].Replica)
+	assert.Len(t, repairs[0].Blobs, 2) // Config and the single layer
+	assert.Len(t, repairs[0].Manifests, 1)
+	assertImageIn(t, replica, "//test/repair:v1")
+
+	// Nothing left to repair.
+	repairs, err = RepairReplicas(context.Background(), &types.SystemContext{}, ref)
+	require.NoError(t, err)
+	assert.Empty(t, repairs)
+}
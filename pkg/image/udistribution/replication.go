@@ -0,0 +1,289 @@
+package udistribution
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/pkg/sysregistriesv2"
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/client"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ReplicationMode selects how many replicas must accept a write for the write to succeed.
+type ReplicationMode int
+
+const (
+	// ReplicateSynchronously requires every replica to accept every write.
+	ReplicateSynchronously ReplicationMode = iota
+	// ReplicateQuorum requires at least ReplicationOptions.Quorum replicas to accept every write.
+	// Replicas which failed are reported through ReplicationOptions.OnPartialWrite, and can be repaired with RepairReplicas.
+	ReplicateQuorum
+)
+
+// ReplicationOptions configures writes to a transport with write replicas.
+type ReplicationOptions struct {
+	Mode ReplicationMode
+	// Quorum is the number of replicas, including the transport's own client, which must accept a write in ReplicateQuorum mode.
+	// 0 means a majority of replicas.
+	Quorum int
+	// OnPartialWrite, if not nil, is called on Commit of an image which was not written to all replicas.
+	OnPartialWrite func(ReplicationReport)
+}
+
+// WithWriteReplicas configures clients which every write to the transport is replicated to, in addition to the transport's own client.
+func WithWriteReplicas(opts ReplicationOptions, clients ...*client.Client) TransportOption {
+	return func(t *UdistributionTransport) {
+		t.writeReplicas = append(t.writeReplicas, clients...)
+		t.replication = opts
+	}
+}
+
+// requiredReplicas returns how many of n replicas must accept a write.
+func (o ReplicationOptions) requiredReplicas(n int) int {
+	if o.Mode != ReplicateQuorum {
+		return n
+	}
+	if o.Quorum <= 0 {
+		return n/2 + 1
+	}
+	if o.Quorum > n {
+		return n
+	}
+	return o.Quorum
+}
+
+// replicaDescription returns a human-readable description of the i-th backend returned by writeBackends.
+func replicaDescription(backend *UdistributionTransport, i int) string {
+	return fmt.Sprintf("replica #%d (%s)", i, backend.GetApp().Config.Storage.Type())
+}
+
+// ReplicaFailure is a write which failed on a single replica.
+type ReplicaFailure struct {
+	Replica string // Description of the replica
+	Item    string // What was being written, e.g. "blob sha256:…"
+	Err     error
+}
+
+func (f ReplicaFailure) String() string {
+	return fmt.Sprintf("[%s on %s: %v]", f.Item, f.Replica, f.Err)
+}
+
+// ErrPartialReplication is returned when a write succeeded on some replicas, but not on as many as required.
+// The replicas listed in Succeeded now contain content the others do not; use RepairReplicas to fill it in.
+type ErrPartialReplication struct {
+	Item      string
+	Succeeded []string
+	Failures  []ReplicaFailure
+}
+
+func (e ErrPartialReplication) Error() string {
+	failures := []string{}
+	for _, f := range e.Failures {
+		failures = append(failures, f.String())
+	}
+	return fmt.Sprintf("writing %s was only partially replicated: succeeded on %s, failed: %s", e.Item, strings.Join(e.Succeeded, ", "), strings.Join(failures, "\n"))
+}
+
+// ReplicationReport describes writes of an image which did not reach all replicas, although enough replicas accepted them.
+type ReplicationReport struct {
+	Reference string
+	Failures  []ReplicaFailure
+}
+
+// ReplicaRepair describes content written to a replica by RepairReplicas.
+type ReplicaRepair struct {
+	Replica   string
+	Blobs     []digest.Digest
+	Manifests []digest.Digest
+}
+
+// RepairReplicas copies the image ref, which must use a transport with write replicas, from the first replica
+// which contains it to every replica missing any of its manifests or blobs.
+// It returns what was written to each repaired replica.
+func RepairReplicas(ctx context.Context, sys *types.SystemContext, ref types.ImageReference) ([]ReplicaRepair, error) {
+	dr, ok := ref.(udistributionReference)
+	if !ok {
+		return nil, errors.Errorf("ref must be a udistributionReference")
+	}
+	backends := dr.UdistributionTransport.writeBackends()
+	if len(backends) < 2 {
+		return nil, errors.Errorf("transport %s has no write replicas", dr.UdistributionTransport.Name())
+	}
+
+	var (
+		src         *udistributionImageSource
+		srcReplica  int
+		attemptErrs []string
+	)
+	for i, backend := range backends {
+		backendRef := dr
+		backendRef.UdistributionTransport = backend
+		s, err := newImageSourceAttempt(ctx, sys, backendRef, sysregistriesv2.PullSource{Reference: dr.ref})
+		if err == nil {
+			src, srcReplica = s, i
+			break
+		}
+		attemptErrs = append(attemptErrs, fmt.Sprintf("[%s: %v]", replicaDescription(backend, i), err))
+	}
+	if src == nil {
+		return nil, errors.Errorf("no replica contains %s: %s", dr.ref.String(), strings.Join(attemptErrs, "\n"))
+	}
+	defer src.Close()
+	logrus.Debugf("Repairing replicas of %s from %s", dr.ref.String(), replicaDescription(backends[srcReplica], srcReplica))
+
+	repairs := []ReplicaRepair{}
+	for i, backend := range backends {
+		if i == srcReplica {
+			continue
+		}
+		backendRef := dr
+		backendRef.UdistributionTransport = backend
+		repair, err := repairReplica(ctx, sys, src, backendRef)
+		if err != nil {
+			return repairs, errors.Wrapf(err, "repairing %s", replicaDescription(backend, i))
+		}
+		if len(repair.Blobs) != 0 || len(repair.Manifests) != 0 {
+			repair.Replica = replicaDescription(backend, i)
+			repairs = append(repairs, repair)
+		}
+	}
+	return repairs, nil
+}
+
+// repairReplica copies everything reachable from the top-level manifest of src, which is missing in dest, to dest.
+func repairReplica(ctx context.Context, sys *types.SystemContext, src *udistributionImageSource, destRef udistributionReference) (ReplicaRepair, error) {
+	repair := ReplicaRepair{}
+	c, err := newDockerClientFromRef(sys, destRef, true, "pull,push")
+	if err != nil {
+		return repair, err
+	}
+	dest := &dockerImageDestination{ref: destRef, c: c}
+
+	topManifest, topMIMEType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return repair, err
+	}
+	instances := []digest.Digest{}
+	if manifest.MIMETypeIsMultiImage(topMIMEType) {
+		list, err := manifest.ListFromBlob(topManifest, topMIMEType)
+		if err != nil {
+			return repair, err
+		}
+		instances = list.Instances()
+	}
+
+	repairOne := func(instanceDigest *digest.Digest) error {
+		m, mt, err := src.GetManifest(ctx, instanceDigest)
+		if err != nil {
+			return err
+		}
+		if manifest.MIMETypeIsMultiImage(mt) {
+			return errors.Errorf("nested manifest lists are not supported")
+		}
+		parsed, err := manifest.FromBlob(m, mt)
+		if err != nil {
+			return err
+		}
+		blobs := []types.BlobInfo{}
+		if config := parsed.ConfigInfo(); config.Digest != "" {
+			blobs = append(blobs, config)
+		}
+		for _, layer := range parsed.LayerInfos() {
+			if len(layer.URLs) == 0 {
+				blobs = append(blobs, layer.BlobInfo)
+			}
+		}
+		for _, blob := range blobs {
+			exists, _, err := dest.blobExists(ctx, destRef.ref, blob.Digest, nil)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			stream, size, err := src.GetBlob(ctx, blob, none.NoCache)
+			if err != nil {
+				return err
+			}
+			_, err = dest.PutBlob(ctx, stream, types.BlobInfo{Digest: blob.Digest, Size: size, MediaType: blob.MediaType}, none.NoCache, false)
+			stream.Close()
+			if err != nil {
+				return err
+			}
+			repair.Blobs = append(repair.Blobs, blob.Digest)
+		}
+		if instanceDigest == nil {
+			return nil // The top-level manifest is handled by the caller.
+		}
+		existing, err := manifestDigestIn(ctx, dest.c, destRef, instanceDigest.String())
+		if err != nil {
+			return err
+		}
+		if existing != *instanceDigest {
+			if err := dest.PutManifest(ctx, m, instanceDigest); err != nil {
+				return err
+			}
+			repair.Manifests = append(repair.Manifests, *instanceDigest)
+		}
+		return nil
+	}
+	if len(instances) == 0 {
+		if err := repairOne(nil); err != nil {
+			return repair, err
+		}
+	}
+	for i := range instances {
+		if err := repairOne(&instances[i]); err != nil {
+			return repair, err
+		}
+	}
+
+	topDigest, err := manifest.Digest(topManifest)
+	if err != nil {
+		return repair, err
+	}
+	refTail, err := destRef.tagOrDigest()
+	if err != nil {
+		return repair, err
+	}
+	existing, err := manifestDigestIn(ctx, dest.c, destRef, refTail)
+	if err != nil {
+		return repair, err
+	}
+	if existing != topDigest {
+		if err := dest.PutManifest(ctx, topManifest, nil); err != nil {
+			return repair, err
+		}
+		repair.Manifests = append(repair.Manifests, topDigest)
+	}
+	return repair, nil
+}
+
+// manifestDigestIn returns the digest of manifest tagOrDigest in ref, or "" if it does not exist.
+func manifestDigestIn(ctx context.Context, c *udistributionClient, ref udistributionReference, tagOrDigest string) (digest.Digest, error) {
+	path := fmt.Sprintf(manifestPath, reference.Path(ref.ref), tagOrDigest)
+	headers := map[string][]string{
+		"Accept": manifest.DefaultRequestedManifestMIMETypes,
+	}
+	res, err := c.makeRequest(ctx, http.MethodHead, path, headers, nil, v2Auth, nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return digest.Parse(res.Header.Get("Docker-Content-Digest"))
+	case http.StatusNotFound:
+		return "", nil
+	default:
+		return "", errors.Wrapf(registryHTTPResponseToError(res), "reading digest %s in %s", tagOrDigest, ref.ref.Name())
+	}
+}
@@ -0,0 +1,476 @@
+package udistribution
+
+import (
+	"context"
+	"strings"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/image/udistribution/archive"
+	ociarchive "github.com/migtools/udistribution/pkg/image/udistribution/oci/archive"
+	"github.com/migtools/udistribution/pkg/image/udistribution/oci/layout"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// ArchiveFormat is the format of the archives written by ExportRepository and read by ImportRepository.
+type ArchiveFormat int
+
+const (
+	// DockerArchive is a docker-archive tarball, as written by docker save.
+	DockerArchive ArchiveFormat = iota
+	// OCILayout is an OCI image layout directory. Unlike docker-archives, it keeps OCI annotations, image indexes and artifacts.
+	OCILayout
+	// OCIArchive is a tarball of an OCI image layout.
+	OCIArchive
+)
+
+// RepositoryArchiveOptions configures ExportRepository and ImportRepository.
+type RepositoryArchiveOptions struct {
+	// CopyImagesOptions are used to copy the images; ExportRepository copies one image at a time.
+	// copy.Options.RemoveSignatures is set from Signatures; a CopyImagesOptions.Copy override must remove signatures itself
+	// unless Signatures is set.
+	CopyImagesOptions
+	Format ArchiveFormat
+	// Untagged also transfers the manifests which are not tagged, except instances of the manifest lists transferred.
+	Untagged bool
+	// Signatures also transfers the signatures of the images, stored by the signatures API extension or a lookaside
+	// storage, and the tags of signatures and attestations, as stored by sigstore, and of referrers indexes.
+	// Only OCI formats can store signatures, in a "signatures" directory of the layout, and signed images keep their
+	// original manifests in them. Importing signatures requires the destination to store them, with the signatures
+	// API extension or StorageLookasideScheme.
+	Signatures bool
+	// Progress, if set, is called once each image has been transferred, or failed to; calls are not concurrent.
+	Progress func(RepositoryImageProgress)
+}
+
+// RepositoryImage is an image transferred by ExportRepository or ImportRepository.
+type RepositoryImage struct {
+	// Tag of the image; "" for an untagged manifest.
+	Tag string
+	// Digest of the manifest; not set for images imported with a tag.
+	Digest digest.Digest
+}
+
+// RepositoryImageProgress reports that an image was transferred by ExportRepository or ImportRepository.
+type RepositoryImageProgress struct {
+	RepositoryImage
+	// Done is the number of images transferred so far, including this one, out of Total.
+	Done  int
+	Total int
+	// Err is the error of the transfer of the image, if any.
+	Err error
+}
+
+// ExportRepository writes every tag of the repository of repo, a udistributionReference whose tag is ignored,
+// to an archive at destination, in opts.Format. Layers shared by several images are written once.
+// The signatures of the images are only exported if opts.Signatures.
+// It returns the result of the copy of each image.
+func ExportRepository(ctx context.Context, sys *types.SystemContext, repo types.ImageReference, destination string, opts RepositoryArchiveOptions) (results []CopyResult, retErr error) {
+	dr, ok := repo.(udistributionReference)
+	if !ok {
+		return nil, errors.Errorf("repo must be a udistributionReference")
+	}
+	if opts.Signatures && opts.Format == DockerArchive {
+		return nil, errors.New("docker-archives can not store signatures")
+	}
+	images, err := repositoryImages(ctx, sys, dr, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Images are read by digest, in case tags are moved while they are exported.
+	srcRef := func(image RepositoryImage) (types.ImageReference, error) {
+		return newRepositoryImageReference(dr, RepositoryImage{Digest: image.Digest})
+	}
+	name := reference.TrimNamed(dr.ref)
+	groups := [][]RepositoryImage{}
+	pairs := []CopyPair{}
+	switch opts.Format {
+	case DockerArchive:
+		writer, err := archive.NewWriter(sys, destination)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := writer.Close(); err != nil && retErr == nil {
+				retErr = errors.Wrapf(err, "writing %s", destination)
+			}
+		}()
+		// An image can only be written once to a docker-archive, with all its tags.
+		byDigest := map[digest.Digest]int{}
+		for _, image := range images {
+			if i, ok := byDigest[image.Digest]; ok {
+				groups[i] = append(groups[i], image)
+				continue
+			}
+			byDigest[image.Digest] = len(groups)
+			groups = append(groups, []RepositoryImage{image})
+		}
+		for _, group := range groups {
+			src, err := srcRef(group[0])
+			if err != nil {
+				return nil, err
+			}
+			tags := []reference.NamedTagged{}
+			for _, image := range group {
+				if image.Tag == "" {
+					continue
+				}
+				tagged, err := reference.WithTag(name, image.Tag)
+				if err != nil {
+					return nil, err
+				}
+				tags = append(tags, tagged)
+			}
+			var dest types.ImageReference
+			if len(tags) == 0 {
+				dest, err = writer.NewReference(nil)
+			} else {
+				dest, err = writer.NewReference(tags[0])
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(tags) > 1 {
+				dest = additionalTagsReference{ImageReference: dest, tags: tags[1:]}
+			}
+			pairs = append(pairs, CopyPair{Src: src, Dest: dest})
+		}
+	case OCILayout, OCIArchive:
+		destRef := func(image string) (types.ImageReference, error) {
+			return layout.NewReference(destination, image)
+		}
+		if opts.Format == OCIArchive {
+			writer, err := ociarchive.NewWriter(sys, destination)
+			if err != nil {
+				return nil, err
+			}
+			defer func() {
+				if err := writer.Close(); err != nil && retErr == nil {
+					retErr = errors.Wrapf(err, "writing %s", destination)
+				}
+			}()
+			destRef = writer.NewReference
+		}
+		for _, image := range images {
+			src, err := srcRef(image)
+			if err != nil {
+				return nil, err
+			}
+			dest, err := destRef(image.Tag)
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, []RepositoryImage{image})
+			pairs = append(pairs, CopyPair{Src: src, Dest: dest})
+		}
+	default:
+		return nil, errors.Errorf("unknown archive format %d", opts.Format)
+	}
+	// No format supports concurrent writers.
+	opts.MaxParallelImages = 1
+	return copyRepositoryImages(ctx, pairs, groups, opts)
+}
+
+// ImportRepository copies every tagged image of the archive at source, in opts.Format, to the repository of repo,
+// a udistributionReference whose tag is ignored. Images are tagged with their tag in the archive, whatever
+// repository the archive names them in. Blobs shared by several images are uploaded once.
+// Untagged images are stored by the digest of their manifest in the archive, if opts.Untagged.
+// The signatures of the images are only imported if opts.Signatures.
+// It returns the result of the copy of each image.
+func ImportRepository(ctx context.Context, sys *types.SystemContext, source string, repo types.ImageReference, opts RepositoryArchiveOptions) ([]CopyResult, error) {
+	dr, ok := repo.(udistributionReference)
+	if !ok {
+		return nil, errors.Errorf("repo must be a udistributionReference")
+	}
+	groups := [][]RepositoryImage{}
+	pairs := []CopyPair{}
+	add := func(image RepositoryImage, src types.ImageReference) error {
+		if image.Tag != "" && !opts.Signatures && isSignatureTag(image.Tag) {
+			return nil
+		}
+		dest, err := newRepositoryImageReference(dr, image)
+		if err != nil {
+			return err
+		}
+		groups = append(groups, []RepositoryImage{image})
+		pairs = append(pairs, CopyPair{Src: src, Dest: dest})
+		return nil
+	}
+
+	switch opts.Format {
+	case DockerArchive:
+		reader, err := archive.NewReader(sys, source)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		archiveImages, err := reader.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, refs := range archiveImages {
+			for _, ref := range refs {
+				if tagged, ok := ref.DockerReference().(reference.NamedTagged); ok {
+					if err := add(RepositoryImage{Tag: tagged.Tag()}, ref); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				if !opts.Untagged {
+					continue
+				}
+				dgst, err := manifestDigest(ctx, sys, ref)
+				if err != nil {
+					return nil, err
+				}
+				if err := add(RepositoryImage{Digest: dgst}, ref); err != nil {
+					return nil, err
+				}
+			}
+		}
+	case OCILayout, OCIArchive:
+		var listed []layout.ListResult
+		if opts.Format == OCIArchive {
+			reader, err := ociarchive.NewReader(sys, source)
+			if err != nil {
+				return nil, err
+			}
+			defer reader.Close()
+			archived, err := reader.List()
+			if err != nil {
+				return nil, err
+			}
+			for _, l := range archived {
+				listed = append(listed, layout.ListResult{Reference: l.Reference, ManifestDescriptor: l.ManifestDescriptor})
+			}
+		} else {
+			var err error
+			if listed, err = layout.List(source); err != nil {
+				return nil, err
+			}
+		}
+		for _, l := range listed {
+			image := RepositoryImage{Digest: l.ManifestDescriptor.Digest}
+			if refName := l.ManifestDescriptor.Annotations[imgspecv1.AnnotationRefName]; refName != "" {
+				tag, err := layoutTag(refName)
+				if err != nil {
+					return nil, errors.Wrapf(err, "in %s", source)
+				}
+				image = RepositoryImage{Tag: tag}
+			} else if !opts.Untagged {
+				continue
+			}
+			if err := add(image, l.Reference); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, errors.Errorf("unknown archive format %d", opts.Format)
+	}
+	return copyRepositoryImages(ctx, pairs, groups, opts)
+}
+
+// copyRepositoryImages copies pairs with CopyImages, reporting each of groups, the images transferred by each pair, to opts.Progress.
+func copyRepositoryImages(ctx context.Context, pairs []CopyPair, groups [][]RepositoryImage, opts RepositoryArchiveOptions) ([]CopyResult, error) {
+	copyOpts := opts.CopyImagesOptions
+	imageOptions := copy.Options{}
+	if copyOpts.Options != nil {
+		imageOptions = *copyOpts.Options
+	}
+	imageOptions.RemoveSignatures = !opts.Signatures
+	copyOpts.Options = &imageOptions
+	if opts.Progress != nil {
+		total := 0
+		for _, group := range groups {
+			total += len(group)
+		}
+		done := 0
+		callerDone := copyOpts.Done
+		copyOpts.Done = func(i int, result CopyResult) {
+			if callerDone != nil {
+				callerDone(i, result)
+			}
+			for _, image := range groups[i] {
+				done++
+				opts.Progress(RepositoryImageProgress{RepositoryImage: image, Done: done, Total: total, Err: result.Err})
+			}
+		}
+	}
+	return CopyImages(ctx, pairs, copyOpts)
+}
+
+// repositoryImages returns the images of the repository of ref transferred with opts, with the digests of their manifests.
+// Untagged manifests are those not tagged, and not an instance of a manifest list of the repository.
+func repositoryImages(ctx context.Context, sys *types.SystemContext, ref udistributionReference, opts RepositoryArchiveOptions) ([]RepositoryImage, error) {
+	tags, err := GetRepositoryTags(ctx, sys, ref)
+	if err != nil {
+		return nil, err
+	}
+	var revisions []digest.Digest
+	if opts.Untagged {
+		if revisions, err = ref.UdistributionTransport.Client.ManifestRevisions(ctx, reference.Path(ref.ref)); err != nil {
+			return nil, err
+		}
+	}
+	if len(tags) == 0 && len(revisions) == 0 {
+		return nil, nil
+	}
+	first := RepositoryImage{}
+	if len(tags) != 0 {
+		first.Tag = tags[0]
+	} else {
+		first.Digest = revisions[0]
+	}
+	firstRef, err := newRepositoryImageReference(ref, first)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newImageSource(ctx, sys, firstRef)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	reachable := map[digest.Digest]bool{}
+	var markInstances func(manifestBlob []byte, mimeType string) error
+	markInstances = func(manifestBlob []byte, mimeType string) error {
+		if !opts.Untagged || !manifest.MIMETypeIsMultiImage(mimeType) {
+			return nil
+		}
+		list, err := manifest.ListFromBlob(manifestBlob, mimeType)
+		if err != nil {
+			return err
+		}
+		for _, instance := range list.Instances() {
+			if reachable[instance] {
+				continue
+			}
+			reachable[instance] = true
+			instanceBlob, instanceMIMEType, err := src.GetManifest(ctx, &instance)
+			if err != nil {
+				return err
+			}
+			if err := markInstances(instanceBlob, instanceMIMEType); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	images := []RepositoryImage{}
+	for _, tag := range tags {
+		manifestBlob, mimeType, err := src.fetchManifest(ctx, tag)
+		if err != nil {
+			return nil, err
+		}
+		dgst, err := manifest.Digest(manifestBlob)
+		if err != nil {
+			return nil, err
+		}
+		reachable[dgst] = true
+		if err := markInstances(manifestBlob, mimeType); err != nil {
+			return nil, err
+		}
+		if opts.Signatures || !isSignatureTag(tag) {
+			images = append(images, RepositoryImage{Tag: tag, Digest: dgst})
+		}
+	}
+	for _, revision := range revisions {
+		revision := revision
+		manifestBlob, mimeType, err := src.GetManifest(ctx, &revision)
+		if err != nil {
+			return nil, err
+		}
+		if err := markInstances(manifestBlob, mimeType); err != nil {
+			return nil, err
+		}
+	}
+	for _, revision := range revisions {
+		if !reachable[revision] {
+			images = append(images, RepositoryImage{Digest: revision})
+		}
+	}
+	return images, nil
+}
+
+// newRepositoryImageReference returns a reference to image in the repository of ref.
+func newRepositoryImageReference(ref udistributionReference, image RepositoryImage) (udistributionReference, error) {
+	name := reference.TrimNamed(ref.ref)
+	var named reference.Named
+	var err error
+	if image.Tag != "" {
+		named, err = reference.WithTag(name, image.Tag)
+	} else {
+		named, err = reference.WithDigest(name, image.Digest)
+	}
+	if err != nil {
+		return udistributionReference{}, err
+	}
+	return newReference(named, ref.UdistributionTransport)
+}
+
+// additionalTagsReference is a docker-archive reference which also adds tags to the image written.
+type additionalTagsReference struct {
+	types.ImageReference
+	tags []reference.NamedTagged
+}
+
+func (ref additionalTagsReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	dest, err := ref.ImageReference.NewImageDestination(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	tagged, ok := dest.(interface {
+		AddRepoTags(tags []reference.NamedTagged)
+	})
+	if !ok {
+		dest.Close()
+		return nil, errors.Errorf("Internal error: %s can not add tags", transports.ImageName(ref.ImageReference))
+	}
+	tagged.AddRepoTags(ref.tags)
+	return dest, nil
+}
+
+// manifestDigest returns the digest of the manifest of ref.
+func manifestDigest(ctx context.Context, sys *types.SystemContext, ref types.ImageReference) (digest.Digest, error) {
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	manifestBlob, _, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	return manifest.Digest(manifestBlob)
+}
+
+// isSignatureTag returns true if tag names the signatures or attestations of a manifest as sigstore does, e.g. "sha256-<hex>.sig",
+// or the index of its referrers, see client.ReferrersTagSchema.
+func isSignatureTag(tag string) bool {
+	name, _, _ := strings.Cut(tag, ".")
+	algorithm, encoded, ok := strings.Cut(name, "-")
+	return ok && digest.NewDigestFromEncoded(digest.Algorithm(algorithm), encoded).Validate() == nil
+}
+
+// layoutTag returns the tag of an image named refName in an OCI layout, either a tag or a reference with a tag.
+func layoutTag(refName string) (string, error) {
+	if reference.TagRegexp.FindString(refName) == refName {
+		return refName, nil
+	}
+	named, err := reference.ParseNormalizedNamed(refName)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid image name %q", refName)
+	}
+	tagged, ok := named.(reference.NamedTagged)
+	if !ok {
+		return "", errors.Errorf("image name %q has no tag", refName)
+	}
+	return tagged.Tag(), nil
+}
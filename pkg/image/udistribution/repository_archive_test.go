@@ -0,0 +1,233 @@
+package udistribution
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/copy"
+	_ "github.com/containers/image/v5/docker/archive"
+	"github.com/containers/image/v5/manifest"
+	_ "github.com/containers/image/v5/oci/archive"
+	_ "github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/image/udistribution/archive"
+	ociarchive "github.com/migtools/udistribution/pkg/image/udistribution/oci/archive"
+	"github.com/migtools/udistribution/pkg/image/udistribution/oci/layout"
+	"github.com/migtools/udistribution/pkg/internal/testing/clienttest"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImportRepository(t *testing.T) {
+	ctx := context.Background()
+	sys := &types.SystemContext{}
+	ut, _ := newFilesystemTestTransport(t)
+	var imageManifest []byte
+	for _, tag := range []string{"v1", "v2"} {
+		ref, err := ut.ParseReference("//test/app:" + tag)
+		require.NoError(t, err)
+		imageManifest = clienttest.CopyFixtureImage(t, ref)
+	}
+	imageDigest, err := manifest.Digest(imageManifest)
+	require.NoError(t, err)
+	sigTag := imageDigest.Algorithm().String() + "-" + imageDigest.Encoded() + ".sig"
+	ref, err := ut.ParseReference("//test/app:" + sigTag)
+	require.NoError(t, err)
+	clienttest.CopyFixtureImage(t, ref)
+
+	// An untagged manifest of the same image.
+	var untagged map[string]any
+	require.NoError(t, json.Unmarshal(imageManifest, &untagged))
+	untagged["untagged"] = true
+	untaggedManifest, err := json.Marshal(untagged)
+	require.NoError(t, err)
+	untaggedDigest, err := manifest.Digest(untaggedManifest)
+	require.NoError(t, err)
+	untaggedRef, err := ut.ParseReference("//test/app@" + untaggedDigest.String())
+	require.NoError(t, err)
+	dest, err := untaggedRef.NewImageDestination(ctx, sys)
+	require.NoError(t, err)
+	require.NoError(t, dest.PutManifest(ctx, untaggedManifest, nil))
+	require.NoError(t, dest.Close())
+
+	repo, err := ut.ParseReference("//test/app:latest")
+	require.NoError(t, err)
+	revisions, err := ut.Client.ManifestRevisions(ctx, "test/app")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []any{imageDigest, untaggedDigest}, []any{revisions[0], revisions[1]})
+
+	// Only tags are exported by default, and the image is written once, with both tags.
+	archivePath := filepath.Join(t.TempDir(), "app.tar")
+	progress := []RepositoryImageProgress{}
+	results, err := ExportRepository(ctx, sys, repo, archivePath, RepositoryArchiveOptions{
+		CopyImagesOptions: CopyImagesOptions{Copy: copyTestImages},
+		Progress:          func(p RepositoryImageProgress) { progress = append(progress, p) },
+	})
+	require.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, []RepositoryImageProgress{
+		{RepositoryImage: RepositoryImage{Tag: "v1", Digest: imageDigest}, Done: 1, Total: 2},
+		{RepositoryImage: RepositoryImage{Tag: "v2", Digest: imageDigest}, Done: 2, Total: 2},
+	}, progress)
+	reader, err := archive.NewReader(sys, archivePath)
+	require.NoError(t, err)
+	archived, err := reader.List()
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.Len(t, archived, 1)
+	assert.Len(t, archived[0], 2)
+
+	imported, err := ut.ParseReference("//imported/app:latest")
+	require.NoError(t, err)
+	results, err = ImportRepository(ctx, sys, archivePath, imported, RepositoryArchiveOptions{CopyImagesOptions: CopyImagesOptions{Copy: copyTestImages}})
+	require.NoError(t, err)
+	assert.Len(t, results, 2)
+	assertImageIn(t, ut.Client, "//imported/app:v1")
+	assertImageIn(t, ut.Client, "//imported/app:v2")
+
+	// Untagged manifests and signatures are exported on request.
+	layoutPath := filepath.Join(t.TempDir(), "layout")
+	results, err = ExportRepository(ctx, sys, repo, layoutPath, RepositoryArchiveOptions{
+		CopyImagesOptions: CopyImagesOptions{Copy: copyTestImages},
+		Format:            OCILayout,
+		Untagged:          true,
+		Signatures:        true,
+	})
+	require.NoError(t, err)
+	assert.Len(t, results, 4)
+	indexBlob, err := os.ReadFile(filepath.Join(layoutPath, "index.json"))
+	require.NoError(t, err)
+	var index imgspecv1.Index
+	require.NoError(t, json.Unmarshal(indexBlob, &index))
+	names := []string{}
+	for _, desc := range index.Manifests {
+		names = append(names, desc.Annotations[imgspecv1.AnnotationRefName])
+	}
+	assert.ElementsMatch(t, []string{"v1", "v2", sigTag, ""}, names)
+
+	imported, err = ut.ParseReference("//fromlayout/app:latest")
+	require.NoError(t, err)
+	results, err = ImportRepository(ctx, sys, layoutPath, imported, RepositoryArchiveOptions{CopyImagesOptions: CopyImagesOptions{Copy: copyTestImages}, Format: OCILayout})
+	require.NoError(t, err)
+	assert.Len(t, results, 2)
+	assertImageIn(t, ut.Client, "//fromlayout/app:v1")
+	assertImageIn(t, ut.Client, "//fromlayout/app:v2")
+	tags, err := GetRepositoryTags(ctx, sys, imported)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v1", "v2"}, tags)
+
+	// OCI archives keep untagged manifests, which are imported by digest.
+	ociArchivePath := filepath.Join(t.TempDir(), "app-oci.tar")
+	results, err = ExportRepository(ctx, sys, repo, ociArchivePath, RepositoryArchiveOptions{
+		CopyImagesOptions: CopyImagesOptions{Copy: copyTestImages},
+		Format:            OCIArchive,
+		Untagged:          true,
+	})
+	require.NoError(t, err)
+	assert.Len(t, results, 3)
+	imported, err = ut.ParseReference("//fromociarchive/app:latest")
+	require.NoError(t, err)
+	progress = []RepositoryImageProgress{}
+	results, err = ImportRepository(ctx, sys, ociArchivePath, imported, RepositoryArchiveOptions{
+		CopyImagesOptions: CopyImagesOptions{Copy: copyTestImages},
+		Format:            OCIArchive,
+		Untagged:          true,
+		Progress:          func(p RepositoryImageProgress) { progress = append(progress, p) },
+	})
+	require.NoError(t, err)
+	assert.Len(t, results, 3)
+	// The untagged manifest was converted to OCI when exported, dropping its extra field, and is imported with the digest
+	// it has in the archive, the one of the tagged images.
+	tags = []string{}
+	var importedDigest digest.Digest
+	for _, p := range progress {
+		if p.Tag == "" {
+			importedDigest = p.Digest
+		} else {
+			tags = append(tags, p.Tag)
+		}
+	}
+	assert.ElementsMatch(t, []string{"v1", "v2"}, tags)
+	require.NotEmpty(t, importedDigest)
+	assert.NotEqual(t, untaggedDigest, importedDigest)
+	assertImageIn(t, ut.Client, "//fromociarchive/app:v1")
+	assertImageIn(t, ut.Client, "//fromociarchive/app:v2")
+	assertImageIn(t, ut.Client, "//fromociarchive/app@"+importedDigest.String())
+	revisions, err = ut.Client.ManifestRevisions(ctx, "fromociarchive/app")
+	require.NoError(t, err)
+	assert.Equal(t, []digest.Digest{importedDigest}, revisions)
+}
+
+func TestExportImportRepositorySignatures(t *testing.T) {
+	ctx := context.Background()
+	sys := &types.SystemContext{RegistriesDirPath: "/this/does/not/exist"}
+	ut, _ := newFilesystemTestTransport(t)
+	repo, err := ut.ParseReference("//test/signed:latest")
+	require.NoError(t, err)
+	manifestDigest, err := manifest.Digest(clienttest.CopyFixtureImage(t, repo))
+	require.NoError(t, err)
+	dest, err := repo.NewImageDestination(ctx, sys)
+	require.NoError(t, err)
+	signatures := [][]byte{[]byte("signature one"), []byte("signature two")}
+	require.NoError(t, dest.PutSignatures(ctx, signatures, &manifestDigest))
+	require.NoError(t, dest.Close())
+	copyOpts := CopyImagesOptions{
+		Policy:  &signature.Policy{Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()}},
+		Options: &copy.Options{SourceCtx: sys, DestinationCtx: sys},
+	}
+
+	// Signatures are exported to OCI formats, and imported, on request.
+	archivePath := filepath.Join(t.TempDir(), "signed-oci.tar")
+	_, err = ExportRepository(ctx, sys, repo, archivePath, RepositoryArchiveOptions{CopyImagesOptions: copyOpts, Format: OCIArchive, Signatures: true})
+	require.NoError(t, err)
+	imported, err := ut.ParseReference("//imported/signed:latest")
+	require.NoError(t, err)
+	_, err = ImportRepository(ctx, sys, archivePath, imported, RepositoryArchiveOptions{CopyImagesOptions: copyOpts, Format: OCIArchive, Signatures: true})
+	require.NoError(t, err)
+	src, err := imported.NewImageSource(ctx, sys)
+	require.NoError(t, err)
+	got, err := src.GetSignatures(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, src.Close())
+	assert.ElementsMatch(t, signatures, got)
+
+	// Otherwise, they are removed.
+	layoutPath := filepath.Join(t.TempDir(), "layout")
+	_, err = ExportRepository(ctx, sys, repo, layoutPath, RepositoryArchiveOptions{CopyImagesOptions: copyOpts, Format: OCILayout})
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(layoutPath, "signatures"))
+	assert.True(t, os.IsNotExist(err))
+	// docker-archives can not store them.
+	_, err = ExportRepository(ctx, sys, repo, filepath.Join(t.TempDir(), "signed.tar"), RepositoryArchiveOptions{CopyImagesOptions: copyOpts, Signatures: true})
+	assert.Error(t, err)
+}
+
+func TestIsSignatureTag(t *testing.T) {
+	for tag, expected := range map[string]bool{
+		"latest": false,
+		"sha256-0123456789012345678901234567890123456789012345678901234567890123":      true,
+		"sha256-0123456789012345678901234567890123456789012345678901234567890123.sig":  true,
+		"sha256-0123456789012345678901234567890123456789012345678901234567890123.att":  true,
+		"sha256-01234567890123456789012345678901234567890123456789012345678901.sig":    false,
+		"v1-0123456789012345678901234567890123456789012345678901234567890123.sig":      false,
+		"sha256-0123456789012345678901234567890123456789012345678901234567890123-next": false,
+	} {
+		assert.Equal(t, expected, isSignatureTag(tag), tag)
+	}
+}
+
+func TestArchiveTransportsNotRegistered(t *testing.T) {
+	// The containers/image transports of the same names, imported by this test, are registered without panicking.
+	for _, ours := range []types.ImageTransport{archive.Transport, layout.Transport, ociarchive.Transport} {
+		registered := transports.Get(ours.Name())
+		require.NotNil(t, registered, ours.Name())
+		assert.NotEqual(t, ours, registered, ours.Name())
+	}
+}
@@ -0,0 +1,41 @@
+package udistribution
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/internal/testing/clienttest"
+	"golang.org/x/sync/semaphore"
+)
+
+// newFilesystemTestTransport returns a registered transport storing data in a new temporary directory, which is also returned.
+func newFilesystemTestTransport(t *testing.T, opts ...TransportOption) (*UdistributionTransport, string) {
+	c, dir := clienttest.NewFilesystemClient(t, nil)
+	ut := NewTransport(c, "filesystem", opts...)
+	t.Cleanup(ut.Deregister)
+	return ut, dir
+}
+
+// copyTestImages is an ImageCopier accepting images without signatures.
+func copyTestImages(ctx context.Context, pair CopyPair, blobCopies *semaphore.Weighted) ([]byte, error) {
+	policyContext, err := signature.NewPolicyContext(&signature.Policy{Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()}})
+	if err != nil {
+		return nil, err
+	}
+	defer policyContext.Destroy()
+	return copy.Image(ctx, policyContext, pair.Dest, pair.Src, &copy.Options{
+		SourceCtx:                     &types.SystemContext{},
+		DestinationCtx:                &types.SystemContext{},
+		ConcurrentBlobCopiesSemaphore: blobCopies,
+	})
+}
+
+// bytesReader returns a reader of s.
+func bytesReader(s string) io.Reader {
+	return bytes.NewReader([]byte(s))
+}
@@ -0,0 +1,325 @@
+package udistribution
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/internal/image/putblobdigest"
+	"github.com/migtools/udistribution/pkg/internal/image/uploadreader"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ChunkedUploadOptions configures how blobs are uploaded by a transport.
+type ChunkedUploadOptions struct {
+	// ChunkSize is the maximum size of a single PATCH request. 0 uploads every blob in a single request.
+	// Chunked uploads which are interrupted, or fail to reach the registry, are kept in the registry to be resumed;
+	// other failed uploads, e.g. failing to read the blob or rejected by the registry, are cancelled.
+	ChunkSize int64
+	// OnChunk, if not nil, is called with the state of the upload after every chunk committed by the registry,
+	// so that it can be saved, and the upload resumed by ResumeBlobUpload if the process is interrupted.
+	OnChunk func(UploadSession)
+}
+
+// WithChunkedUploads configures how blobs are uploaded by the transport.
+func WithChunkedUploads(opts ChunkedUploadOptions) TransportOption {
+	return func(t *UdistributionTransport) {
+		t.chunkedUploads = opts
+	}
+}
+
+// UploadSession is the state of an unfinished blob upload, which can be saved (e.g. as JSON), and resumed by ResumeBlobUpload.
+// Uploads are kept in the registry storage, so a session can be resumed by any client using the same storage.
+// The upload state in Location is signed with the http.secret of the registry configuration, and only accepted by
+// clients sharing it; ResumeBlobUpload reads the committed offset and a freshly signed Location from the registry first.
+type UploadSession struct {
+	// Repository is the repository the blob is uploaded to, e.g. "ns/repo".
+	Repository string `json:"repository"`
+	// UUID identifies the upload in the registry.
+	UUID string `json:"uuid"`
+	// Location is the URL to continue the upload at, including the HMAC-signed upload state.
+	Location string `json:"location"`
+	// Offset is the number of bytes committed by the registry.
+	Offset int64 `json:"offset"`
+}
+
+// ErrUploadInterrupted is returned by PutBlob when a chunked upload (see ChunkedUploadOptions) is interrupted, or a
+// chunk fails to reach the registry, after it has started.
+// Session can be passed to ResumeBlobUpload to continue the upload from the last committed offset.
+type ErrUploadInterrupted struct {
+	Session UploadSession
+	Err     error
+}
+
+func (e ErrUploadInterrupted) Error() string {
+	return fmt.Sprintf("upload %s to %s interrupted at offset %d: %v", e.Session.UUID, e.Session.Repository, e.Session.Offset, e.Err)
+}
+
+func (e ErrUploadInterrupted) Unwrap() error {
+	return e.Err
+}
+
+// newUploadSession returns the session of an upload started at location, as returned by the registry.
+func newUploadSession(repo reference.Named, location *url.URL, res *http.Response) UploadSession {
+	uuid := res.Header.Get("Docker-Upload-UUID")
+	if uuid == "" {
+		uuid = location.Path[strings.LastIndex(location.Path, "/")+1:]
+	}
+	return UploadSession{
+		Repository: reference.Path(repo),
+		UUID:       uuid,
+		Location:   location.String(),
+	}
+}
+
+// errChunkNotSent is returned by uploadChunk when the chunk could not be sent to the registry.
+type errChunkNotSent struct {
+	err error
+}
+
+func (e errChunkNotSent) Error() string {
+	return e.err.Error()
+}
+
+func (e errChunkNotSent) Unwrap() error {
+	return e.err
+}
+
+// uploadFailed returns the error to report for the upload of session failing with err.
+// Chunked uploads which were interrupted, or failed to send a chunk, are kept to be resumed, and reported as
+// ErrUploadInterrupted; other uploads are cancelled.
+func (d *dockerImageDestination) uploadFailed(ctx context.Context, session UploadSession, err error) error {
+	if d.ref.UdistributionTransport.chunkedUploads.ChunkSize > 0 {
+		var notSent errChunkNotSent
+		if errors.As(err, &notSent) {
+			return ErrUploadInterrupted{Session: session, Err: notSent.err}
+		}
+		if ctx.Err() != nil {
+			return ErrUploadInterrupted{Session: session, Err: err}
+		}
+	}
+	if cancelErr := d.cancelBlobUpload(ctx, session); cancelErr != nil {
+		// The upload data is left to PurgeUploads; return the more important error.
+		logrus.Debugf("Error cancelling failed upload %s: %v", session.UUID, cancelErr)
+	}
+	return err
+}
+
+// cancelBlobUpload cancels the upload of session, deleting its data from the registry storage.
+func (d *dockerImageDestination) cancelBlobUpload(ctx context.Context, session UploadSession) error {
+	// Cancel even if the upload failed because ctx was cancelled.
+	ctx = context.WithoutCancel(ctx)
+	// The upload state in session.Location is rejected if the registry committed data after it was issued.
+	_, uploadLocation, err := d.uploadStatus(ctx, session)
+	if err != nil {
+		return err
+	}
+	// docker/distribution requires the "delete" action to cancel an upload, on top of the "pull,push" scope of
+	// the destination; in-process, only the authorizer of the client decides whether it is granted.
+	extraScope := &authScope{remoteName: reference.Path(d.ref.ref), actions: "delete"}
+	logrus.Debugf("Cancelling upload %s", session.UUID)
+	res, err := d.c.makeRequestToResolvedURL(ctx, http.MethodDelete, uploadLocation, nil, nil, -1, v2Auth, extraScope)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return errors.Wrapf(registryHTTPResponseToError(res), "cancelling upload %s", session.UUID)
+	}
+	// docker/distribution rewrites the upload hash state when closing the cancelled upload,
+	// which would be left in the storage forever, without the start time PurgeUploads relies on.
+	return d.ref.UdistributionTransport.Client.RemoveUpload(ctx, session.Repository, session.UUID)
+}
+
+// uploadBlobData uploads stream, of size inputSize or -1 if unknown, to session, which is updated as the registry commits data.
+// It returns the location to complete the upload at.
+func (d *dockerImageDestination) uploadBlobData(ctx context.Context, session *UploadSession, stream io.Reader, inputSize int64) (*url.URL, error) {
+	uploadLocation, err := url.Parse(session.Location)
+	if err != nil {
+		return nil, err
+	}
+	opts := d.ref.UdistributionTransport.chunkedUploads
+	if opts.ChunkSize <= 0 {
+		return d.uploadBlobDataOnce(ctx, uploadLocation, stream, inputSize)
+	}
+
+	buf := make([]byte, opts.ChunkSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n, err := io.ReadFull(stream, buf)
+		if err == io.EOF {
+			return uploadLocation, nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		uploadLocation, err = d.uploadChunk(ctx, uploadLocation, buf[:n], session.Offset)
+		if err != nil {
+			return nil, err
+		}
+		session.Location = uploadLocation.String()
+		session.Offset += int64(n)
+		logrus.Debugf("Committed %d bytes of upload %s", session.Offset, session.UUID)
+		if opts.OnChunk != nil {
+			opts.OnChunk(*session)
+		}
+		if n < len(buf) {
+			return uploadLocation, nil
+		}
+	}
+}
+
+// uploadBlobDataOnce uploads stream, of size inputSize or -1 if unknown, in a single PATCH request to uploadLocation,
+// and returns the location to complete the upload at.
+func (d *dockerImageDestination) uploadBlobDataOnce(ctx context.Context, uploadLocation *url.URL, stream io.Reader, inputSize int64) (*url.URL, error) {
+	uploadReader := uploadreader.NewUploadReader(stream)
+	// This error text should never be user-visible, we terminate only after makeRequestToResolvedURL
+	// returns, so there isn’t a way for the error text to be provided to any of our callers.
+	defer uploadReader.Terminate(errors.New("Reading data from an already terminated upload"))
+	res, err := d.c.makeRequestToResolvedURL(ctx, http.MethodPatch, uploadLocation, map[string][]string{"Content-Type": {"application/octet-stream"}}, uploadReader, inputSize, v2Auth, nil)
+	if err != nil {
+		logrus.Debugf("Error uploading layer chunked %v", err)
+		return nil, err
+	}
+	defer res.Body.Close()
+	if !successStatus(res.StatusCode) {
+		return nil, errors.Wrapf(registryHTTPResponseToError(res), "uploading layer chunked")
+	}
+	uploadLocation, err = res.Location()
+	if err != nil {
+		return nil, errors.Wrap(err, "determining upload URL")
+	}
+	return uploadLocation, nil
+}
+
+// uploadChunk uploads chunk, starting at offset, to uploadLocation, and returns the location to continue the upload at.
+func (d *dockerImageDestination) uploadChunk(ctx context.Context, uploadLocation *url.URL, chunk []byte, offset int64) (*url.URL, error) {
+	headers := map[string][]string{
+		"Content-Type":   {"application/octet-stream"},
+		"Content-Range":  {fmt.Sprintf("%d-%d", offset, offset+int64(len(chunk))-1)},
+		"Content-Length": {strconv.Itoa(len(chunk))},
+	}
+	res, err := d.c.makeRequestToResolvedURL(ctx, http.MethodPatch, uploadLocation, headers, bytes.NewReader(chunk), int64(len(chunk)), v2Auth, nil)
+	if err != nil {
+		return nil, errChunkNotSent{err: err}
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		return nil, errors.Wrapf(registryHTTPResponseToError(res), "uploading chunk at offset %d", offset)
+	}
+	uploadLocation, err = res.Location()
+	if err != nil {
+		return nil, errors.Wrap(err, "determining upload URL")
+	}
+	return uploadLocation, nil
+}
+
+// uploadStatus returns the number of bytes committed to the upload of session, and the location to continue it at.
+func (d *dockerImageDestination) uploadStatus(ctx context.Context, session UploadSession) (int64, *url.URL, error) {
+	statusLocation, err := url.Parse(session.Location)
+	if err != nil {
+		return -1, nil, errors.Wrapf(err, "invalid upload location %q", session.Location)
+	}
+	statusLocation.RawQuery = "" // The upload status does not require the upload state.
+	res, err := d.c.makeRequestToResolvedURL(ctx, http.MethodGet, statusLocation, nil, nil, -1, v2Auth, nil)
+	if err != nil {
+		return -1, nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return -1, nil, errors.Wrapf(registryHTTPResponseToError(res), "reading status of upload %s", session.UUID)
+	}
+	uploadLocation, err := res.Location()
+	if err != nil {
+		return -1, nil, errors.Wrap(err, "determining upload URL")
+	}
+	// The Range header is "0-<last byte>", and "0-0" for both empty uploads and uploads of a single byte.
+	_, end, ok := strings.Cut(res.Header.Get("Range"), "-")
+	if !ok {
+		return -1, nil, errors.Errorf("invalid upload range %q", res.Header.Get("Range"))
+	}
+	last, err := strconv.ParseInt(end, 10, 64)
+	if err != nil {
+		return -1, nil, errors.Wrapf(err, "invalid upload range %q", res.Header.Get("Range"))
+	}
+	switch {
+	case last > 0:
+		return last + 1, uploadLocation, nil
+	case session.Offset > 0:
+		return 1, uploadLocation, nil
+	default:
+		return 0, uploadLocation, nil
+	}
+}
+
+// ResumeBlobUpload continues the upload of session, returned in an ErrUploadInterrupted by PutBlob or passed to
+// ChunkedUploadOptions.OnChunk, to ref, which must use a udistribution transport without write replicas.
+// stream must provide the blob from its start; the data committed by the registry is skipped, seeking if stream
+// is an io.Seeker and a digest.Canonical inputInfo.Digest is known.
+func ResumeBlobUpload(ctx context.Context, sys *types.SystemContext, ref types.ImageReference, session UploadSession, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache) (types.BlobInfo, error) {
+	dr, ok := ref.(udistributionReference)
+	if !ok {
+		return types.BlobInfo{}, errors.Errorf("ref must be a udistributionReference")
+	}
+	if len(dr.UdistributionTransport.writeReplicas) != 0 {
+		return types.BlobInfo{}, errors.Errorf("resuming uploads is not supported with write replicas")
+	}
+	if session.Repository != reference.Path(dr.ref) {
+		return types.BlobInfo{}, errors.Errorf("upload %s is to %s, not %s", session.UUID, session.Repository, reference.Path(dr.ref))
+	}
+	dest, err := newImageDestination(sys, dr)
+	if err != nil {
+		return types.BlobInfo{}, err
+	}
+	defer dest.Close()
+	return dest.(*dockerImageDestination).resumeBlobUpload(ctx, session, stream, inputInfo, cache)
+}
+
+// resumeBlobUpload implements ResumeBlobUpload.
+func (d *dockerImageDestination) resumeBlobUpload(ctx context.Context, session UploadSession, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache) (types.BlobInfo, error) {
+	cache = d.ref.UdistributionTransport.blobInfoCache(cache)
+	offset, uploadLocation, err := d.uploadStatus(ctx, session)
+	if err != nil {
+		return types.BlobInfo{}, err
+	}
+	logrus.Debugf("Resuming upload %s at offset %d", session.UUID, offset)
+	session.Offset = offset
+	session.Location = uploadLocation.String()
+
+	sizeCounter := &sizeCounter{}
+	seeker, canSeek := stream.(io.Seeker)
+	if canSeek && inputInfo.Digest != "" && inputInfo.Digest.Algorithm() == digest.Canonical {
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			return types.BlobInfo{}, err
+		}
+		sizeCounter.size = offset
+	}
+	digester, stream := putblobdigest.DigestIfCanonicalUnknown(stream, inputInfo)
+	stream = io.TeeReader(stream, sizeCounter)
+	if sizeCounter.size < offset {
+		// Read the committed data, so that it is digested and counted.
+		if _, err := io.CopyN(io.Discard, stream, offset); err != nil {
+			return types.BlobInfo{}, errors.Wrapf(err, "skipping %d bytes committed to upload %s", offset, session.UUID)
+		}
+	}
+	reporter := newTransferReporter(ctx, d.ref.UdistributionTransport, TransferUpload, d.ref.ref, inputInfo.Digest, inputInfo.Size)
+	reporter.resume(offset)
+	stream = &progressReader{r: stream, reporter: reporter}
+	if uploadLocation, err = d.uploadBlobData(ctx, &session, stream, -1); err != nil {
+		err = d.uploadFailed(ctx, session, err)
+		reporter.failed(err)
+		return types.BlobInfo{}, err
+	}
+	return d.completeReportedBlobUpload(ctx, reporter, session, uploadLocation, digester.Digest(), sizeCounter.size, cache)
+}
@@ -0,0 +1,215 @@
+package udistribution
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/client"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingReader returns the data of r, and then err instead of io.EOF.
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, f.err
+	}
+	return n, err
+}
+
+// interruptingReader returns the data of r, and then cancels the context of the upload instead of returning io.EOF.
+type interruptingReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (i *interruptingReader) Read(p []byte) (int, error) {
+	n, err := i.r.Read(p)
+	if err == io.EOF {
+		i.cancel()
+		return n, context.Canceled
+	}
+	return n, err
+}
+
+// newSharedStorageTestTransport returns a registered transport using storage in dir, and http.secret secret.
+func newSharedStorageTestTransport(t *testing.T, name, dir, secret string, opts ...TransportOption) *UdistributionTransport {
+	c, err := client.NewClient("", []string{
+		"REGISTRY_STORAGE=filesystem",
+		"REGISTRY_STORAGE_FILESYSTEM_ROOTDIRECTORY=" + dir,
+		"REGISTRY_STORAGE_CACHE_BLOBDESCRIPTOR=inmemory",
+		"REGISTRY_HTTP_SECRET=" + secret,
+	})
+	require.NoError(t, err)
+	ut := NewTransport(c, name, opts...)
+	t.Cleanup(ut.Deregister)
+	return ut
+}
+
+// readTestBlob returns the content of blob dgst in the filesystem storage in dir.
+func readTestBlob(t *testing.T, dir string, dgst digest.Digest) string {
+	content, err := os.ReadFile(filepath.Join(dir, "docker/registry/v2/blobs", dgst.Algorithm().String(), dgst.Encoded()[:2], dgst.Encoded(), "data"))
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestChunkedPutBlob(t *testing.T) {
+	ctx := context.Background()
+	offsets := []int64{}
+	dir := t.TempDir()
+	ut := newSharedStorageTestTransport(t, "chunked", dir, "secret", WithChunkedUploads(ChunkedUploadOptions{
+		ChunkSize: 1000,
+		OnChunk: func(s UploadSession) {
+			assert.Equal(t, "test/chunked", s.Repository)
+			assert.NotEmpty(t, s.UUID)
+			offsets = append(offsets, s.Offset)
+		},
+	}))
+	ref, err := ut.ParseReference("//test/chunked:latest")
+	require.NoError(t, err)
+	dest, err := ref.NewImageDestination(ctx, &types.SystemContext{})
+	require.NoError(t, err)
+	defer dest.Close()
+
+	content := strings.Repeat("0123456789", 450)
+	info, err := dest.PutBlob(ctx, bytesReader(content), types.BlobInfo{Size: -1}, none.NoCache, false)
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromString(content), info.Digest)
+	assert.Equal(t, int64(len(content)), info.Size)
+	assert.Equal(t, []int64{1000, 2000, 3000, 4000, 4500}, offsets)
+	assert.Equal(t, content, readTestBlob(t, dir, info.Digest))
+}
+
+func TestResumeBlobUpload(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	content := strings.Repeat("0123456789", 450)
+
+	for _, c := range []struct {
+		name   string
+		stream func() io.Reader
+		info   types.BlobInfo
+	}{
+		{"read through", func() io.Reader { return bytesReader(content) }, types.BlobInfo{Size: -1}},
+		{"seek", func() io.Reader { return bytes.NewReader([]byte(content)) }, types.BlobInfo{Digest: digest.FromString(content), Size: int64(len(content))}},
+	} {
+		ut := newSharedStorageTestTransport(t, "interrupted", dir, "shared secret", WithChunkedUploads(ChunkedUploadOptions{ChunkSize: 1000}))
+		ref, err := ut.ParseReference("//test/resumed:" + strings.ReplaceAll(c.name, " ", "-"))
+		require.NoError(t, err)
+		dest, err := ref.NewImageDestination(ctx, &types.SystemContext{})
+		require.NoError(t, err)
+		uploadCtx, cancel := context.WithCancel(ctx)
+		_, err = dest.PutBlob(uploadCtx, &interruptingReader{r: bytesReader(content[:2500]), cancel: cancel}, types.BlobInfo{Size: -1}, none.NoCache, false)
+		dest.Close()
+		var interrupted ErrUploadInterrupted
+		require.ErrorAs(t, err, &interrupted, c.name)
+		assert.ErrorIs(t, err, context.Canceled, c.name)
+		assert.Equal(t, int64(2000), interrupted.Session.Offset, c.name)
+		saved, err := json.Marshal(interrupted.Session)
+		require.NoError(t, err)
+		ut.Deregister()
+
+		// Resume in another client sharing the storage and http.secret.
+		var session UploadSession
+		require.NoError(t, json.Unmarshal(saved, &session))
+		resumer := newSharedStorageTestTransport(t, "resumer", dir, "shared secret", WithChunkedUploads(ChunkedUploadOptions{ChunkSize: 1000}))
+		resumedRef, err := resumer.ParseReference("//test/resumed:" + strings.ReplaceAll(c.name, " ", "-"))
+		require.NoError(t, err)
+		info, err := ResumeBlobUpload(ctx, &types.SystemContext{}, resumedRef, session, c.stream(), c.info, none.NoCache)
+		require.NoError(t, err, c.name)
+		assert.Equal(t, digest.FromString(content), info.Digest, c.name)
+		assert.Equal(t, int64(len(content)), info.Size, c.name)
+		assert.Equal(t, content, readTestBlob(t, dir, info.Digest), c.name)
+		resumer.Deregister()
+
+		// The upload no longer exists.
+		otherRef, err := resumer.ParseReference("//test/other:latest")
+		require.NoError(t, err)
+		_, err = ResumeBlobUpload(ctx, &types.SystemContext{}, otherRef, session, c.stream(), c.info, none.NoCache)
+		assert.Error(t, err, c.name)
+	}
+}
+
+func TestCancelFailedUpload(t *testing.T) {
+	ctx := context.Background()
+	content := strings.Repeat("0123456789", 450)
+	for _, c := range []struct {
+		name   string
+		chunks ChunkedUploadOptions
+		stream io.Reader
+		info   types.BlobInfo
+	}{
+		{"read error", ChunkedUploadOptions{}, &failingReader{r: bytesReader(content), err: errors.New("connection reset")}, types.BlobInfo{Size: -1}},
+		// Chunked uploads are only kept when interrupted.
+		{"chunked read error", ChunkedUploadOptions{ChunkSize: 1000}, &failingReader{r: bytesReader(content[:2500]), err: errors.New("connection reset")}, types.BlobInfo{Size: -1}},
+		{"chunked digest mismatch", ChunkedUploadOptions{ChunkSize: 1000}, bytesReader(content), types.BlobInfo{Digest: digest.FromString("other"), Size: -1}},
+	} {
+		dir := t.TempDir()
+		ut := newSharedStorageTestTransport(t, "cancelled", dir, "secret", WithChunkedUploads(c.chunks))
+		ref, err := ut.ParseReference("//test/cancelled:latest")
+		require.NoError(t, err)
+		dest, err := ref.NewImageDestination(ctx, &types.SystemContext{})
+		require.NoError(t, err)
+		_, err = dest.PutBlob(ctx, c.stream, c.info, none.NoCache, false)
+		dest.Close()
+		require.Error(t, err, c.name)
+		var interrupted ErrUploadInterrupted
+		assert.False(t, errors.As(err, &interrupted), c.name)
+		uploads, err := os.ReadDir(filepath.Join(dir, "docker/registry/v2/repositories/test/cancelled/_uploads"))
+		require.NoError(t, err, c.name)
+		assert.Empty(t, uploads, c.name)
+		ut.Deregister()
+	}
+}
+
+func TestPurgeUploads(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	ut := newSharedStorageTestTransport(t, "purged", dir, "secret", WithChunkedUploads(ChunkedUploadOptions{ChunkSize: 1000}))
+	ref, err := ut.ParseReference("//test/purged:latest")
+	require.NoError(t, err)
+	dest, err := ref.NewImageDestination(ctx, &types.SystemContext{})
+	require.NoError(t, err)
+	defer dest.Close()
+	content := strings.Repeat("0123456789", 450)
+	uploadCtx, cancel := context.WithCancel(ctx)
+	_, err = dest.PutBlob(uploadCtx, &interruptingReader{r: bytesReader(content[:2500]), cancel: cancel}, types.BlobInfo{Size: -1}, none.NoCache, false)
+	var interrupted ErrUploadInterrupted
+	require.ErrorAs(t, err, &interrupted)
+
+	purged, err := ut.Client.PurgeUploads(ctx, time.Hour, false)
+	require.NoError(t, err)
+	assert.Empty(t, purged)
+
+	for _, dryRun := range []bool{true, false} {
+		// A negative age includes uploads started in the current second.
+		purged, err = ut.Client.PurgeUploads(ctx, -time.Minute, dryRun)
+		require.NoError(t, err)
+		require.Len(t, purged, 1)
+		assert.Equal(t, "test/purged", purged[0].Repository)
+		assert.Equal(t, interrupted.Session.UUID, purged[0].UUID)
+		assert.Equal(t, int64(2000), purged[0].Size)
+	}
+	_, err = ResumeBlobUpload(ctx, &types.SystemContext{}, ref, interrupted.Session, bytesReader(content), types.BlobInfo{Size: -1}, none.NoCache)
+	assert.Error(t, err)
+	purged, err = ut.Client.PurgeUploads(ctx, -time.Minute, false)
+	require.NoError(t, err)
+	assert.Empty(t, purged)
+}
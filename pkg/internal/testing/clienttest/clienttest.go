@@ -0,0 +1,65 @@
+// Package clienttest is a TESTING-ONLY utility.
+//
+// It creates clients storing data in temporary directories, and copies a fixture image to them, for the tests of
+// the client and of the udistribution transport.
+//
+// NEVER use this in non-testing subpackages!
+package clienttest
+
+import (
+	"context"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
+	"github.com/migtools/udistribution/pkg/client"
+	"github.com/migtools/udistribution/pkg/image/udistribution/archive"
+	"github.com/stretchr/testify/require"
+)
+
+// ArchiveFixture is the path of a docker-archive with a single, almost empty, layer.
+var ArchiveFixture = func() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "../../../image/udistribution/archive/fixtures/almostempty.tar")
+}()
+
+// NewFilesystemClient returns a client with opts storing data in a new temporary directory, which is also returned.
+// extraEnv is added to the environment configuring the client, after the filesystem storage.
+func NewFilesystemClient(t testing.TB, extraEnv []string, opts ...client.ClientOption) (*client.Client, string) {
+	dir := t.TempDir()
+	env := append([]string{
+		"REGISTRY_STORAGE=filesystem",
+		"REGISTRY_STORAGE_FILESYSTEM_ROOTDIRECTORY=" + dir,
+		"REGISTRY_STORAGE_CACHE_BLOBDESCRIPTOR=inmemory",
+	}, extraEnv...)
+	c, err := client.NewClient("", env, opts...)
+	require.NoError(t, err)
+	return c, dir
+}
+
+// CopyFixtureImage copies ArchiveFixture to dest, and returns the manifest written.
+func CopyFixtureImage(t testing.TB, dest types.ImageReference) []byte {
+	manifest, err := CopyFixtureImageWithContext(dest, &types.SystemContext{})
+	require.NoError(t, err)
+	return manifest
+}
+
+// CopyFixtureImageWithContext copies ArchiveFixture to dest, using destCtx for the destination.
+func CopyFixtureImageWithContext(dest types.ImageReference, destCtx *types.SystemContext) ([]byte, error) {
+	src, err := archive.ParseReference(ArchiveFixture)
+	if err != nil {
+		return nil, err
+	}
+	policyContext, err := signature.NewPolicyContext(&signature.Policy{Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()}})
+	if err != nil {
+		return nil, err
+	}
+	defer policyContext.Destroy()
+	return copy.Image(context.Background(), policyContext, dest, src, &copy.Options{
+		SourceCtx:      &types.SystemContext{},
+		DestinationCtx: destCtx,
+	})
+}